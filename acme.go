@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// letsEncrypt is the default ACME directory. Use
+// https://acme-staging-v02.api.letsencrypt.org/directory to try things out
+// without running into its rate limits.
+const letsEncrypt = acme.LetsEncryptURL
+
+// acmeRenewBefore is how long before it expires a certificate is renewed
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// newACMEManager returns a manager obtaining TLS certificates for domains
+// from the ACME CA at directory, such as Let's Encrypt, when first asked for
+// them, and renewing them before they expire. Its HTTPHandler answers HTTP-01
+// challenges, and redirects anything else to HTTPS. Certificates and the
+// account key are kept in cacheDir so that restarts don't need new ones.
+func newACMEManager(directory, email string, domains []string, cacheDir string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cacheDir),
+		HostPolicy:  autocert.HostWhitelist(domains...),
+		RenewBefore: acmeRenewBefore,
+		Client:      &acme.Client{DirectoryURL: directory},
+		Email:       email,
+	}
+}
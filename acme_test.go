@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is a minimal ACME CA, checking request signatures and fetching
+// HTTP-01 challenge responses from challenges.
+type fakeACME struct {
+	t          *testing.T
+	srv        *httptest.Server
+	challenges string
+	caKey      *ecdsa.PrivateKey
+	ca         *x509.Certificate
+
+	mu          sync.Mutex
+	nonce       int
+	badNonce    bool
+	pub         *ecdsa.PublicKey
+	authzStatus string
+	orderStatus string
+	chain       []byte
+}
+
+func startFakeACME(t *testing.T, challenges string) *fakeACME {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	f := &fakeACME{t: t, challenges: challenges, caKey: key, ca: ca, badNonce: true, authzStatus: "pending", orderStatus: "pending"}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeACME) handle(resp http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nonce++
+	resp.Header().Set("Replay-Nonce", "nonce-"+strconv.Itoa(f.nonce))
+	base := f.srv.URL
+	switch {
+	case req.URL.Path == "/directory":
+		writeJSON(resp, 200, map[string]string{"newNonce": base + "/nonce", "newAccount": base + "/account", "newOrder": base + "/order"})
+		return
+	case req.URL.Path == "/nonce":
+		return
+	}
+	payload, ok := f.verify(resp, req)
+	if !ok {
+		return
+	}
+	order := func() map[string]any {
+		if f.orderStatus == "pending" && f.authzStatus == "valid" {
+			f.orderStatus = "ready"
+		}
+		return map[string]any{"status": f.orderStatus, "authorizations": []string{base + "/authz/1"}, "finalize": base + "/finalize", "certificate": base + "/cert"}
+	}
+	switch req.URL.Path {
+	case "/account":
+		resp.Header().Set("Location", base+"/account/1")
+		writeJSON(resp, http.StatusCreated, map[string]string{"status": "valid"})
+	case "/order":
+		resp.Header().Set("Location", base+"/order/1")
+		writeJSON(resp, http.StatusCreated, order())
+	case "/order/1":
+		if f.orderStatus == "processing" {
+			f.orderStatus = "valid"
+		}
+		writeJSON(resp, 200, order())
+	case "/authz/1":
+		writeJSON(resp, 200, map[string]any{
+			"status":     f.authzStatus,
+			"identifier": map[string]string{"type": "dns", "value": "example.test"},
+			"challenges": []map[string]string{{"type": "http-01", "url": base + "/chall/1", "token": "tok", "status": "pending"}},
+		})
+	case "/chall/1":
+		challenge, _ := http.NewRequest("GET", f.challenges+"/.well-known/acme-challenge/tok", nil)
+		challenge.Host = "example.test"
+		r, err := http.DefaultClient.Do(challenge)
+		if err != nil {
+			f.t.Error(err)
+			return
+		}
+		keyAuth, _ := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if strings.HasPrefix(string(keyAuth), "tok.") {
+			f.authzStatus = "valid"
+		} else {
+			f.authzStatus = "invalid"
+		}
+		writeJSON(resp, 200, map[string]string{"status": "processing"})
+	case "/finalize":
+		var fin struct{ CSR string }
+		_ = json.Unmarshal(payload, &fin)
+		der, _ := base64.RawURLEncoding.DecodeString(fin.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			f.t.Error(err)
+			return
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}, f.ca, csr.PublicKey, f.caKey)
+		if err != nil {
+			f.t.Error(err)
+			return
+		}
+		f.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})...)
+		f.orderStatus = "processing"
+		resp.Header().Set("Location", base+"/order/1")
+		writeJSON(resp, 200, order())
+	case "/cert":
+		resp.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = resp.Write(f.chain)
+	default:
+		http.NotFound(resp, req)
+	}
+}
+
+// verify checks a request's JWS, returning its payload.
+func (f *fakeACME) verify(resp http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	fail := func(typ, detail string) ([]byte, bool) {
+		resp.Header().Set("Content-Type", "application/problem+json")
+		resp.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(resp).Encode(map[string]string{"type": typ, "detail": detail})
+		return nil, false
+	}
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		return fail("urn:ietf:params:acme:error:malformed", err.Error())
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var h struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *struct{ X, Y string }
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "ES256" || h.URL != f.srv.URL+req.URL.Path {
+		return fail("urn:ietf:params:acme:error:malformed", "bad protected header "+string(header))
+	}
+	if f.badNonce {
+		f.badNonce = false
+		return fail("urn:ietf:params:acme:error:badNonce", "stale nonce")
+	}
+	if h.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(h.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(h.JWK.Y)
+		f.pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else if h.Kid != f.srv.URL+"/account/1" || f.pub == nil {
+		return fail("urn:ietf:params:acme:error:accountDoesNotExist", "unknown account "+h.Kid)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(f.pub, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return fail("urn:ietf:params:acme:error:malformed", "bad signature")
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, true
+}
+
+func TestACMEObtainsCertificate(t *testing.T) {
+	// GIVEN an ACME CA, which can reach our challenge responses
+	dir := t.TempDir()
+	m := newACMEManager("", "ops@example.test", []string{"example.test"}, dir)
+	challenges := httptest.NewServer(m.HTTPHandler(nil))
+	defer challenges.Close()
+	ca := startFakeACME(t, challenges.URL)
+	m.Client.DirectoryURL = ca.srv.URL + "/directory"
+	hello := &tls.ClientHelloInfo{ServerName: "example.test"}
+
+	// WHEN a certificate is first needed
+	cert, err := m.GetCertificate(hello)
+
+	// THEN it's obtained from the CA
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("example.test"); err != nil {
+		t.Error(err)
+	}
+
+	// WHEN restarted, with the CA gone
+	ca.srv.Close()
+	m2 := newACMEManager(ca.srv.URL+"/directory", "", []string{"example.test"}, dir)
+
+	// THEN the cached certificate is used
+	cached, err := m2.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached.Leaf.Equal(cert.Leaf) {
+		t.Error("expected the cached certificate to be used")
+	}
+
+	// WHEN asked for another domain
+	_, err = m2.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"})
+
+	// THEN it's refused
+	if err == nil {
+		t.Error("expected no certificate for other domains")
+	}
+}
+
+func TestACMEChallengeHandlerRedirects(t *testing.T) {
+	m := newACMEManager("", "", []string{"example.test"}, t.TempDir())
+	srv := httptest.NewServer(m.HTTPHandler(nil))
+	defer srv.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	// WHEN an ordinary request arrives
+	resp, err := client.Get(srv.URL + "/some/path?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	// THEN it is sent to HTTPS
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://127.0.0.1:443/some/path?q=1" {
+		t.Errorf("unexpected response %v %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	for _, tc := range []struct {
+		host   string
+		status int
+	}{
+		{"example.test", http.StatusNotFound},
+		{"other.test", http.StatusForbidden},
+	} {
+		// WHEN an unknown challenge is requested
+		req, _ := http.NewRequest("GET", srv.URL+"/.well-known/acme-challenge/nope", nil)
+		req.Host = tc.host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN there's no answer
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected %v, got %v", tc.host, tc.status, resp.StatusCode)
+		}
+	}
+}
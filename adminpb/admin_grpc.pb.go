@@ -0,0 +1,302 @@
+// The regproxy admin API over gRPC, the same registry and stats as the HTTP
+// admin API. regproxy serves it on listeners which speak HTTP/2, i.e. those
+// with TLS. The Go server and client in adminpb are generated from this file
+// with go generate, which runs
+//
+//   protoc --go_out=. --go_opt=module=regproxy2 --go-grpc_out=. --go-grpc_opt=module=regproxy2 admin.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.28.3
+// source: admin.proto
+
+package adminpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Admin_ListUpstreams_FullMethodName  = "/regproxy.admin.v1.Admin/ListUpstreams"
+	Admin_GetUpstream_FullMethodName    = "/regproxy.admin.v1.Admin/GetUpstream"
+	Admin_PutUpstream_FullMethodName    = "/regproxy.admin.v1.Admin/PutUpstream"
+	Admin_DeleteUpstream_FullMethodName = "/regproxy.admin.v1.Admin/DeleteUpstream"
+	Admin_GetStats_FullMethodName       = "/regproxy.admin.v1.Admin/GetStats"
+)
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	// ListUpstreams returns every registered upstream, by name.
+	ListUpstreams(ctx context.Context, in *ListUpstreamsRequest, opts ...grpc.CallOption) (*ListUpstreamsResponse, error)
+	// GetUpstream returns one upstream, or NOT_FOUND.
+	GetUpstream(ctx context.Context, in *GetUpstreamRequest, opts ...grpc.CallOption) (*Upstream, error)
+	// PutUpstream creates or replaces an upstream, returning it as stored,
+	// with its ETag in the etag response metadata. As with
+	// PUT /upstreams/{name}, replacing an upstream registered with a different
+	// callback returns ALREADY_EXISTS unless if-match metadata is sent, and
+	// if-match or if-none-match metadata which doesn't hold returns
+	// FAILED_PRECONDITION.
+	PutUpstream(ctx context.Context, in *Upstream, opts ...grpc.CallOption) (*Upstream, error)
+	// DeleteUpstream removes an upstream, or returns NOT_FOUND. if-match
+	// metadata which doesn't hold returns FAILED_PRECONDITION.
+	DeleteUpstream(ctx context.Context, in *DeleteUpstreamRequest, opts ...grpc.CallOption) (*DeleteUpstreamResponse, error)
+	// GetStats returns the proxy's current load and its metrics.
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) ListUpstreams(ctx context.Context, in *ListUpstreamsRequest, opts ...grpc.CallOption) (*ListUpstreamsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListUpstreamsResponse)
+	err := c.cc.Invoke(ctx, Admin_ListUpstreams_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetUpstream(ctx context.Context, in *GetUpstreamRequest, opts ...grpc.CallOption) (*Upstream, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Upstream)
+	err := c.cc.Invoke(ctx, Admin_GetUpstream_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) PutUpstream(ctx context.Context, in *Upstream, opts ...grpc.CallOption) (*Upstream, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Upstream)
+	err := c.cc.Invoke(ctx, Admin_PutUpstream_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) DeleteUpstream(ctx context.Context, in *DeleteUpstreamRequest, opts ...grpc.CallOption) (*DeleteUpstreamResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteUpstreamResponse)
+	err := c.cc.Invoke(ctx, Admin_DeleteUpstream_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Stats)
+	err := c.cc.Invoke(ctx, Admin_GetStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility.
+type AdminServer interface {
+	// ListUpstreams returns every registered upstream, by name.
+	ListUpstreams(context.Context, *ListUpstreamsRequest) (*ListUpstreamsResponse, error)
+	// GetUpstream returns one upstream, or NOT_FOUND.
+	GetUpstream(context.Context, *GetUpstreamRequest) (*Upstream, error)
+	// PutUpstream creates or replaces an upstream, returning it as stored,
+	// with its ETag in the etag response metadata. As with
+	// PUT /upstreams/{name}, replacing an upstream registered with a different
+	// callback returns ALREADY_EXISTS unless if-match metadata is sent, and
+	// if-match or if-none-match metadata which doesn't hold returns
+	// FAILED_PRECONDITION.
+	PutUpstream(context.Context, *Upstream) (*Upstream, error)
+	// DeleteUpstream removes an upstream, or returns NOT_FOUND. if-match
+	// metadata which doesn't hold returns FAILED_PRECONDITION.
+	DeleteUpstream(context.Context, *DeleteUpstreamRequest) (*DeleteUpstreamResponse, error)
+	// GetStats returns the proxy's current load and its metrics.
+	GetStats(context.Context, *GetStatsRequest) (*Stats, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAdminServer struct{}
+
+func (UnimplementedAdminServer) ListUpstreams(context.Context, *ListUpstreamsRequest) (*ListUpstreamsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUpstreams not implemented")
+}
+func (UnimplementedAdminServer) GetUpstream(context.Context, *GetUpstreamRequest) (*Upstream, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUpstream not implemented")
+}
+func (UnimplementedAdminServer) PutUpstream(context.Context, *Upstream) (*Upstream, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutUpstream not implemented")
+}
+func (UnimplementedAdminServer) DeleteUpstream(context.Context, *DeleteUpstreamRequest) (*DeleteUpstreamResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUpstream not implemented")
+}
+func (UnimplementedAdminServer) GetStats(context.Context, *GetStatsRequest) (*Stats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+func (UnimplementedAdminServer) testEmbeddedByValue()               {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	// If the following call pancis, it indicates UnimplementedAdminServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_ListUpstreams_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUpstreamsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListUpstreams(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_ListUpstreams_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListUpstreams(ctx, req.(*ListUpstreamsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetUpstream_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUpstreamRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetUpstream(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_GetUpstream_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetUpstream(ctx, req.(*GetUpstreamRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_PutUpstream_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Upstream)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).PutUpstream(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_PutUpstream_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).PutUpstream(ctx, req.(*Upstream))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_DeleteUpstream_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUpstreamRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).DeleteUpstream(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_DeleteUpstream_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).DeleteUpstream(ctx, req.(*DeleteUpstreamRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "regproxy.admin.v1.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListUpstreams",
+			Handler:    _Admin_ListUpstreams_Handler,
+		},
+		{
+			MethodName: "GetUpstream",
+			Handler:    _Admin_GetUpstream_Handler,
+		},
+		{
+			MethodName: "PutUpstream",
+			Handler:    _Admin_PutUpstream_Handler,
+		},
+		{
+			MethodName: "DeleteUpstream",
+			Handler:    _Admin_DeleteUpstream_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _Admin_GetStats_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "admin.proto",
+}
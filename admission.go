@@ -0,0 +1,67 @@
+package main
+
+import (
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons for shedding a request, as reported by regproxy_requests_shed_total
+const (
+	shedInFlight = "in_flight"
+	shedMemory   = "memory"
+)
+
+// heapSampleInterval bounds how stale the heap size used for admission may
+// be, reading it on every request would be wasted work under load
+const heapSampleInterval = 100 * time.Millisecond
+
+// admission sheds new requests once too many are in flight or the heap has
+// grown too large, so that an overloaded proxy fails some requests quickly
+// rather than slowing every request down until they all time out.
+type admission struct {
+	maxInFlight  int64
+	maxHeapBytes int64
+	inFlight     atomic.Int64
+
+	mu         sync.Mutex
+	sampledAt  time.Time
+	heapBytes  int64
+	heapSample []metrics.Sample
+}
+
+// admit returns the reason to shed a new request, or "" to admit it. An
+// admitted request must call done when finished.
+func (a *admission) admit() string {
+	if n := a.inFlight.Add(1); a.maxInFlight > 0 && n > a.maxInFlight {
+		a.inFlight.Add(-1)
+		return shedInFlight
+	}
+	if a.maxHeapBytes > 0 && a.heap() > a.maxHeapBytes {
+		a.inFlight.Add(-1)
+		return shedMemory
+	}
+	return ""
+}
+
+func (a *admission) done() {
+	a.inFlight.Add(-1)
+}
+
+// heap returns the bytes of live and not yet collected heap objects, which
+// unlike runtime.ReadMemStats is cheap to read and doesn't stop the world.
+func (a *admission) heap() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(a.sampledAt) < heapSampleInterval {
+		return a.heapBytes
+	}
+	if a.heapSample == nil {
+		a.heapSample = []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	}
+	metrics.Read(a.heapSample)
+	a.heapBytes = int64(a.heapSample[0].Value.Uint64())
+	a.sampledAt = time.Now()
+	return a.heapBytes
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAdmissionInFlightLimit(t *testing.T) {
+	a := &admission{maxInFlight: 1}
+	if reason := a.admit(); reason != "" {
+		t.Fatalf("expected the first request admitted, got %s", reason)
+	}
+	if reason := a.admit(); reason != shedInFlight {
+		t.Errorf("expected the second request shed, got %q", reason)
+	}
+	a.done()
+	if reason := a.admit(); reason != "" {
+		t.Errorf("expected a request admitted once the first finished, got %s", reason)
+	}
+}
+
+func TestAdmissionShedsUnderMemoryPressure(t *testing.T) {
+	// GIVEN a heap limit we're certainly over
+	cfg := testConfig()
+	cfg.MaxHeapBytes = 1
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		defer withStatusUpstreams(url, t, 200)()
+
+		// WHEN
+		r, err := http.Get(url)
+
+		// THEN
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != http.StatusServiceUnavailable || r.Header.Get("Retry-After") == "" {
+			t.Errorf("expected 503 with Retry-After, got %v", r.StatusCode)
+		}
+		if n := rp.metrics.shedRequests.value(shedMemory); n != 1 {
+			t.Errorf("expected 1 shed request, got %v", n)
+		}
+		if n := rp.admission.inFlight.Load(); n != 0 {
+			t.Errorf("expected nothing left in flight, got %d", n)
+		}
+	})
+}
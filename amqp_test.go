@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// AMQP 0-9-1 frame types, and the methods the fake broker uses, as class
+// and method IDs
+const (
+	amqpFrameMethod = 1
+	amqpFrameHeader = 2
+	amqpFrameBody   = 3
+	amqpFrameEnd    = 0xCE
+)
+
+var (
+	amqpConnectionStart   = [2]uint16{10, 10}
+	amqpConnectionStartOk = [2]uint16{10, 11}
+	amqpConnectionTune    = [2]uint16{10, 30}
+	amqpConnectionOpen    = [2]uint16{10, 40}
+	amqpConnectionOpenOk  = [2]uint16{10, 41}
+	amqpConnectionClose   = [2]uint16{10, 50}
+	amqpConnectionCloseOk = [2]uint16{10, 51}
+	amqpChannelOpen       = [2]uint16{20, 10}
+	amqpChannelOpenOk     = [2]uint16{20, 11}
+	amqpChannelClose      = [2]uint16{20, 40}
+	amqpChannelCloseOk    = [2]uint16{20, 41}
+	amqpConfirmSelect     = [2]uint16{85, 10}
+	amqpConfirmSelectOk   = [2]uint16{85, 11}
+	amqpBasicPublish      = [2]uint16{60, 40}
+	amqpBasicReturn       = [2]uint16{60, 50}
+	amqpBasicAck          = [2]uint16{60, 80}
+)
+
+var amqpProtocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// fakeAMQP is a broker with a single queue, named by the routing key it
+// accepts on the default exchange. Messages with any other routing key are
+// returned as unroutable.
+type fakeAMQP struct {
+	queue string
+	// unconfirmed leaves every publish waiting for its confirmation
+	unconfirmed bool
+
+	mu       sync.Mutex
+	vhosts   []string
+	messages []fakeAMQPMessage
+}
+
+type fakeAMQPMessage struct {
+	routingKey string
+	properties []byte
+	body       string
+}
+
+func startFakeAMQP(t *testing.T, queue string) (*fakeAMQP, string) {
+	return startFakeAMQPWith(t, &fakeAMQP{queue: queue}, nil)
+}
+
+// startFakeAMQPWith starts a fake broker, over TLS if serverTLS is set.
+func startFakeAMQPWith(t *testing.T, f *fakeAMQP, serverTLS *tls.Config) (*fakeAMQP, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverTLS != nil {
+		l = tls.NewListener(l, serverTLS)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f, l.Addr().String()
+}
+
+func (f *fakeAMQP) serve(c net.Conn) {
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(c)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != string(amqpProtocolHeader) {
+		return
+	}
+	send := func(channel uint16, id [2]uint16, args []byte) {
+		_, _ = c.Write(amqpFrame(amqpFrameMethod, channel, amqpMethodPayload(id, args)))
+	}
+	var w amqpWriter
+	_ = w.WriteByte(0)
+	_ = w.WriteByte(9)
+	w.uint32(0) // no server properties
+	w.longstr("PLAIN")
+	w.longstr("en_US")
+	send(0, amqpConnectionStart, w.Bytes())
+
+	var tag uint64
+	var publishing fakeAMQPMessage
+	var size uint64
+	for {
+		var fh [7]byte
+		if _, err := io.ReadFull(r, fh[:]); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(fh[3:])+1)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		payload = payload[:len(payload)-1]
+		channel := binary.BigEndian.Uint16(fh[1:3])
+		switch fh[0] {
+		case amqpFrameHeader:
+			size = binary.BigEndian.Uint64(payload[4:12])
+			publishing.properties = payload[14:]
+		case amqpFrameBody:
+			publishing.body += string(payload)
+		case amqpFrameMethod:
+			id, args := amqpMethodID(payload)
+			switch id {
+			case amqpConnectionStartOk:
+				w.Reset()
+				w.uint16(1)
+				w.uint32(4096)
+				w.uint16(0)
+				send(0, amqpConnectionTune, w.Bytes())
+			case amqpConnectionOpen:
+				f.mu.Lock()
+				f.vhosts = append(f.vhosts, amqpShortstr(args))
+				f.mu.Unlock()
+				send(0, amqpConnectionOpenOk, []byte{0})
+			case amqpConnectionClose:
+				send(0, amqpConnectionCloseOk, nil)
+				return
+			case amqpChannelOpen:
+				send(channel, amqpChannelOpenOk, []byte{0, 0, 0, 0})
+			case amqpChannelClose:
+				send(channel, amqpChannelCloseOk, nil)
+			case amqpConfirmSelect:
+				send(channel, amqpConfirmSelectOk, nil)
+			case amqpBasicPublish:
+				exchange := amqpShortstr(args[2:])
+				publishing = fakeAMQPMessage{routingKey: amqpShortstr(args[3+len(exchange):])}
+			}
+		}
+		if publishing.properties != nil && uint64(len(publishing.body)) == size {
+			tag++
+			if publishing.routingKey != f.queue {
+				// the return carries the message, here without properties
+				w.Reset()
+				w.uint16(312)
+				w.shortstr("NO_ROUTE")
+				w.shortstr("")
+				w.shortstr(publishing.routingKey)
+				send(channel, amqpBasicReturn, w.Bytes())
+				w.Reset()
+				w.uint16(amqpBasicPublish[0])
+				w.uint16(0)
+				w.uint64(uint64(len(publishing.body)))
+				w.uint16(0)
+				_, _ = c.Write(amqpFrame(amqpFrameHeader, channel, w.Bytes()))
+				if publishing.body != "" {
+					_, _ = c.Write(amqpFrame(amqpFrameBody, channel, []byte(publishing.body)))
+				}
+			} else {
+				f.mu.Lock()
+				f.messages = append(f.messages, publishing)
+				f.mu.Unlock()
+			}
+			if !f.unconfirmed {
+				send(channel, amqpBasicAck, append(binary.BigEndian.AppendUint64(nil, tag), 0))
+			}
+			publishing = fakeAMQPMessage{}
+		}
+	}
+}
+
+func amqpFrame(typ byte, channel uint16, payload []byte) []byte {
+	b := []byte{typ}
+	b = binary.BigEndian.AppendUint16(b, channel)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	b = append(b, payload...)
+	return append(b, amqpFrameEnd)
+}
+
+func amqpMethodPayload(id [2]uint16, args []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id[0])
+	b = binary.BigEndian.AppendUint16(b, id[1])
+	return append(b, args...)
+}
+
+func amqpMethodID(payload []byte) ([2]uint16, []byte) {
+	if len(payload) < 4 {
+		return [2]uint16{}, nil
+	}
+	return [2]uint16{binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])}, payload[4:]
+}
+
+// amqpShortstr reads the short string b starts with.
+func amqpShortstr(b []byte) string {
+	if len(b) == 0 || len(b) < 1+int(b[0]) {
+		return ""
+	}
+	return string(b[1 : 1+b[0]])
+}
+
+// amqpWriter encodes AMQP's big-endian fields.
+type amqpWriter struct {
+	bytes.Buffer
+}
+
+func (w *amqpWriter) uint16(v uint16) {
+	_, _ = w.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (w *amqpWriter) uint32(v uint32) {
+	_, _ = w.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (w *amqpWriter) uint64(v uint64) {
+	_, _ = w.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (w *amqpWriter) shortstr(s string) {
+	_ = w.WriteByte(byte(len(s)))
+	_, _ = w.WriteString(s)
+}
+
+func (w *amqpWriter) longstr(s string) {
+	w.uint32(uint32(len(s)))
+	_, _ = w.WriteString(s)
+}
+
+func TestPublishToAMQP(t *testing.T) {
+	amqp, addr := startFakeAMQP(t, "webhooks")
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN
+		register(url, upstream{Name: "queue", Callback: "amqp://user:pass@" + addr + "/events?routingKey=webhooks"}, t)
+
+		// WHEN a body bigger than a frame is sent
+		payload := strings.Repeat("x", 10000)
+		req, _ := http.NewRequest("POST", url+"/hook", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("expected 202, got %v", resp.StatusCode)
+		}
+		amqp.mu.Lock()
+		defer amqp.mu.Unlock()
+		if len(amqp.messages) != 1 || amqp.messages[0].body != payload {
+			t.Fatalf("expected the body to be published, got %d messages", len(amqp.messages))
+		}
+		props := string(amqp.messages[0].properties)
+		if !strings.Contains(props, "text/plain") || !strings.Contains(props, resp.Header.Get(requestIDHeader)) || !strings.Contains(props, ":path") {
+			t.Errorf("unexpected message properties %q", props)
+		}
+		if strings.Contains(props, "Authorization") {
+			t.Errorf("expected the caller's credentials to be left out of %q", props)
+		}
+		if amqp.vhosts[0] != "events" {
+			t.Errorf("expected vhost events, got %v", amqp.vhosts)
+		}
+	})
+}
+
+func TestPublishToAMQPOverTLS(t *testing.T) {
+	// GIVEN a broker over TLS
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeSelfSigned(t, certFile, keyFile, "amqp.test")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+	amqp, addr := startFakeAMQPWith(t, &fakeAMQP{queue: "webhooks"}, &tls.Config{Certificates: []tls.Certificate{cert}})
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	rp.sinks["amqps"].(*amqpPublishers).tlsConfig = &tls.Config{RootCAs: roots, ServerName: "amqp.test"}
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		register(url, upstream{Name: "queue", Callback: "amqps://user:pass@" + addr + "/events?routingKey=webhooks"}, t)
+
+		// WHEN
+		resp, err := http.Post(url+"/hook", "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("expected 202, got %v", resp.StatusCode)
+		}
+		amqp.mu.Lock()
+		defer amqp.mu.Unlock()
+		if len(amqp.messages) != 1 || amqp.messages[0].body != "payload" {
+			t.Errorf("expected the body to be published, got %d messages", len(amqp.messages))
+		}
+	})
+}
+
+func TestUnroutableAMQPMessage(t *testing.T) {
+	_, addr := startFakeAMQP(t, "webhooks")
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN a routing key with no queue
+		register(url, upstream{Name: "queue", Callback: "amqp://" + addr + "?routingKey=nowhere"}, t)
+
+		// WHEN
+		status := getStatus(url, t)
+
+		// THEN
+		if status != http.StatusInternalServerError {
+			t.Errorf("expected 500, got %v", status)
+		}
+	})
+}
+
+func TestAMQPPublishCancelled(t *testing.T) {
+	// GIVEN a broker which never confirms
+	_, addr := startFakeAMQPWith(t, &fakeAMQP{queue: "webhooks", unconfirmed: true}, nil)
+	ap := &amqpPublisher{uri: "amqp://" + addr, timeout: 10 * time.Second}
+
+	// WHEN the caller gives up waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := ap.publish(ctx, amqpMessage{routingKey: "webhooks", body: []byte("payload")})
+
+	// THEN so does the publish, rather than waiting out the timeout
+	if err == nil {
+		t.Fatal("expected the publish to fail")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expected the publish to stop when cancelled, took %v", took)
+	}
+	// AND the connection is dropped, as whether the message arrived is unknown
+	if ap.conn != nil {
+		t.Error("expected the connection to be re-established for the next publish")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// apiPrefix is the path prefix of the current version of the management
+// API. The same endpoints remain at their unprefixed paths for older
+// clients.
+const apiPrefix = "/v1"
+
+// apiMediaType is the media type of the current version of the management
+// API's JSON bodies. Clients may ask for it to pin the schema they were
+// written against; plain application/json gets the current version.
+const apiMediaType = "application/vnd.regproxy.v1+json"
+
+// apiMediaPrefix starts every version of apiMediaType
+const apiMediaPrefix = "application/vnd.regproxy."
+
+// handleAdmin registers a management endpoint at pattern, both under
+// apiPrefix and unprefixed, negotiating the version of its bodies.
+func handleAdmin(sm *http.ServeMux, pattern string, h http.HandlerFunc) {
+	sm.Handle(pattern, negotiateVersion(h))
+	sm.Handle(apiPrefix+pattern, negotiateVersion(h))
+}
+
+// negotiateVersion rejects requests whose body is a version of the API that
+// isn't supported with 415, and those which only accept one with 406. When
+// a client asks for apiMediaType, JSON responses are labelled with it.
+func negotiateVersion(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); strings.HasPrefix(ct, apiMediaPrefix) && ct != apiMediaType {
+			writeProblem(resp, newProblem(http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported API version %s, expected %s", ct, apiMediaType)))
+			return
+		}
+		versioned, acceptable := false, true
+		if accept := req.Header.Get("Accept"); strings.Contains(accept, apiMediaPrefix) {
+			acceptable = false
+			for _, r := range strings.Split(accept, ",") {
+				mt, params, _ := mime.ParseMediaType(strings.TrimSpace(r))
+				if params["q"] == "0" {
+					continue
+				}
+				switch mt {
+				case apiMediaType:
+					versioned, acceptable = true, true
+				case "application/json", "application/*", "*/*":
+					acceptable = true
+				}
+			}
+		}
+		if !acceptable {
+			writeProblem(resp, newProblem(http.StatusNotAcceptable, "Unsupported API version, this server provides "+apiMediaType))
+			return
+		}
+		if versioned {
+			resp = &versionedWriter{ResponseWriter: resp}
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
+
+// versionedWriter labels JSON responses with apiMediaType.
+type versionedWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *versionedWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.Header().Get("Content-Type") == "application/json" {
+			w.Header().Set("Content-Type", apiMediaType)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *versionedWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVersionedAPI(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN an upstream registered through the versioned API
+		req, _ := http.NewRequest(http.MethodPut, url+"/v1/upstreams/foo", strings.NewReader(`{"callback":"http://foo"}`))
+		req.Header.Set("Content-Type", apiMediaType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected 201, got %v", resp.StatusCode)
+		}
+
+		// THEN it can be read at the legacy path
+		if status := getStatus(url+"/upstreams/foo", t); status != 200 {
+			t.Errorf("expected 200, got %v", status)
+		}
+
+		// AND in the versioned media type, when asked for
+		req, _ = http.NewRequest(http.MethodGet, url+"/v1/upstreams/foo", nil)
+		req.Header.Set("Accept", apiMediaType)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != apiMediaType {
+			t.Errorf("expected 200 %s, got %v %s", apiMediaType, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+	})
+}
+
+func TestUnsupportedAPIVersion(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// WHEN a newer version's body is sent
+		req, _ := http.NewRequest(http.MethodPut, url+"/v1/upstreams/foo", strings.NewReader(`{"callback":"http://foo"}`))
+		req.Header.Set("Content-Type", "application/vnd.regproxy.v2+json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it's refused
+		if resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("expected 415, got %v", resp.StatusCode)
+		}
+
+		// WHEN only a newer version is accepted
+		req, _ = http.NewRequest(http.MethodGet, url+"/v1/upstreams", nil)
+		req.Header.Set("Accept", "application/vnd.regproxy.v2+json")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it's refused
+		if resp.StatusCode != http.StatusNotAcceptable {
+			t.Errorf("expected 406, got %v", resp.StatusCode)
+		}
+	})
+}
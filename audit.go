@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditRecord is what the audit trail keeps about each proxied request: the
+// delivery report sent to result callbacks, and who sent the request.
+type auditRecord struct {
+	deliveryReport
+	Caller auditCaller `json:"caller"`
+}
+
+// auditCaller identifies who sent a request, as far as the proxy knows.
+type auditCaller struct {
+	// Subject is the sub claim of the request's bearer token, which has
+	// been verified if -jwt-jwks-url is set
+	Subject string `json:"subject,omitempty"`
+	// ClientCert is the subject of the verified client certificate
+	ClientCert   string `json:"clientCert,omitempty"`
+	Tenant       string `json:"tenant,omitempty"`
+	Address      string `json:"address"`
+	ForwardedFor string `json:"forwardedFor,omitempty"`
+}
+
+// auditSink stores audit records, each a line of JSON.
+type auditSink interface {
+	write(record []byte) error
+}
+
+// auditLog records every proxied request, once all its upstream calls have
+// finished, to a directory or an HTTP endpoint. Failing to record one is
+// logged and counted, but doesn't fail the request, which has already been
+// delivered.
+type auditLog struct {
+	sink         auditSink
+	tenantHeader string
+	failures     *counterVec
+}
+
+// newAuditLog returns nil if there's no audit sink configured.
+func newAuditLog(cfg Config, failures *counterVec) (*auditLog, error) {
+	var sink auditSink
+	switch {
+	case cfg.AuditSink == "":
+		return nil, nil
+	case strings.HasPrefix(cfg.AuditSink, "http://") || strings.HasPrefix(cfg.AuditSink, "https://"):
+		sink = &auditHTTPSink{url: cfg.AuditSink, client: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		fs, err := newAuditFileSink(cfg.AuditSink, cfg.AuditRetention)
+		if err != nil {
+			return nil, err
+		}
+		sink = fs
+	}
+	return &auditLog{sink: sink, tenantHeader: cfg.RateLimitTenantHeader, failures: failures}, nil
+}
+
+func (a *auditLog) record(req *http.Request, status int, d *delivery) {
+	rec := auditRecord{deliveryReport: newDeliveryReport(req, status, d), Caller: a.caller(req)}
+	b, err := json.Marshal(rec)
+	if err == nil {
+		err = a.sink.write(append(b, '\n'))
+	}
+	if err != nil {
+		a.failures.inc()
+		log.Printf("Failed to write the audit record of request %s: %v", d.requestID, err)
+	}
+}
+
+func (a *auditLog) caller(req *http.Request) auditCaller {
+	c := auditCaller{
+		Subject:      bearerSubject(req),
+		Tenant:       req.Header.Get(a.tenantHeader),
+		Address:      req.RemoteAddr,
+		ForwardedFor: req.Header.Get("X-Forwarded-For"),
+	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		c.ClientCert = req.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	return c
+}
+
+// bearerSubject returns the sub claim of the request's bearer token, if it
+// is a JWT.
+func bearerSubject(req *http.Request) string {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	var claims jwtClaims
+	if decodeJWTPart(parts[1], &claims) != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// auditFileSink appends records to a file per day in a directory, named
+// audit-YYYY-MM-DD.jsonl after the UTC date. Files older than the retention
+// period, if there is one, are deleted as each new file is started.
+type auditFileSink struct {
+	dir       string
+	retention time.Duration
+	now       func() time.Time
+
+	mu   sync.Mutex
+	day  string
+	file *os.File
+}
+
+func newAuditFileSink(dir string, retention time.Duration) (*auditFileSink, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &auditFileSink{dir: dir, retention: retention, now: time.Now}, nil
+}
+
+func (s *auditFileSink) write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().UTC()
+	if day := now.Format(time.DateOnly); day != s.day {
+		if s.file != nil {
+			_ = s.file.Close()
+			s.file = nil
+		}
+		f, err := os.OpenFile(filepath.Join(s.dir, "audit-"+day+".jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return err
+		}
+		s.file, s.day = f, day
+		s.expire(now)
+	}
+	_, err := s.file.Write(record)
+	return err
+}
+
+// expire deletes files from before the retention period.
+func (s *auditFileSink) expire(now time.Time) {
+	if s.retention <= 0 {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(s.dir, "audit-*.jsonl"))
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		day, err := time.Parse(time.DateOnly, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), "audit-"), ".jsonl"))
+		// A file holds records until the end of its day
+		if err != nil || !day.AddDate(0, 0, 1).Before(now.Add(-s.retention)) {
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			log.Printf("Failed to remove expired audit file %s: %v", name, err)
+		} else {
+			log.Printf("Removed audit file %s, past the %v retention period", name, s.retention)
+		}
+	}
+}
+
+// auditHTTPSink POSTs each record to an endpoint, which is responsible for
+// keeping them.
+type auditHTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *auditHTTPSink) write(record []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("audit endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditTrail(t *testing.T) {
+	// GIVEN an audit directory
+	dir := t.TempDir()
+	cfg := testConfig()
+	cfg.AuditSink = dir
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	var err error
+	if rp.audit, err = newAuditLog(cfg, rp.metrics.auditFailures); err != nil {
+		t.Fatal(err)
+	}
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {}))
+		defer srv.Close()
+		register(url, upstream{Name: "records", Callback: srv.URL}, t)
+
+		// WHEN a client sends a request
+		req, _ := http.NewRequest("POST", url+"/records", nil)
+		claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"gp-surgery-42"}`))
+		req.Header.Set("Authorization", "Bearer e30."+claims+".sig")
+		req.Header.Set("X-Tenant-Id", "north")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN who sent it, and where it went, is recorded
+		name := filepath.Join(dir, "audit-"+time.Now().UTC().Format(time.DateOnly)+".jsonl")
+		var rec auditRecord
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if f, err := os.Open(name); err == nil {
+				scan := bufio.NewScanner(f)
+				if scan.Scan() {
+					err = json.Unmarshal(scan.Bytes(), &rec)
+				}
+				_ = f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if rec.RequestID != "" || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if rec.RequestID != resp.Header.Get(requestIDHeader) || rec.Status != 200 || rec.Path != "/records" {
+			t.Errorf("expected the request to be recorded, got %+v", rec)
+		}
+		if rec.Caller.Subject != "gp-surgery-42" || rec.Caller.Tenant != "north" || rec.Caller.Address == "" {
+			t.Errorf("expected the caller to be recorded, got %+v", rec.Caller)
+		}
+		if len(rec.Upstreams) != 1 || rec.Upstreams[0].Name != "records" || rec.Upstreams[0].Status != 200 {
+			t.Errorf("expected the upstream to be recorded, got %+v", rec.Upstreams)
+		}
+	})
+}
+
+func TestAuditRetention(t *testing.T) {
+	// GIVEN audit files from 10 days ago and yesterday
+	dir := t.TempDir()
+	now := time.Date(2026, 3, 11, 9, 0, 0, 0, time.UTC)
+	for _, day := range []string{"2026-03-01", "2026-03-10"} {
+		if err := os.WriteFile(filepath.Join(dir, "audit-"+day+".jsonl"), []byte("{}\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := newAuditFileSink(dir, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+
+	// WHEN a record is written
+	if err := s.write([]byte("{}\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN only the file past the retention period is removed
+	for day, kept := range map[string]bool{"2026-03-01": false, "2026-03-10": true, "2026-03-11": true} {
+		if _, err := os.Stat(filepath.Join(dir, "audit-"+day+".jsonl")); (err == nil) != kept {
+			t.Errorf("%s: expected kept %v, got %v", day, kept, err)
+		}
+	}
+}
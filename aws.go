@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// awsConfig is the SDK config for S3, DynamoDB and KMS clients: the region
+// from AWS_REGION or AWS_DEFAULT_REGION, and static credentials from the
+// standard environment variables. Container and web identity credentials,
+// the instance metadata service and profiles aren't supported, nor is
+// refreshing temporary credentials before their session token expires.
+func awsConfig() aws.Config {
+	return aws.Config{
+		Region:      awsRegionFromEnv(),
+		Credentials: aws.NewCredentialsCache(aws.CredentialsProviderFunc(awsCredentialsFromEnv)),
+		HTTPClient:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func awsCredentialsFromEnv(context.Context) (aws.Credentials, error) {
+	c := aws.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Source:          "environment",
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return c, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return c, nil
+}
+
+func awsRegionFromEnv() string {
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		return r
+	}
+	if r := os.Getenv("AWS_DEFAULT_REGION"); r != "" {
+		return r
+	}
+	return "us-east-1"
+}
+
+// awsEndpointOverride is the endpoint to use instead of AWS's own for a
+// service, from the AWS_ENDPOINT_URL overrides used to point at local
+// stand-ins such as MinIO or DynamoDB Local, or nil if there's none.
+func awsEndpointOverride(envSuffix string) *string {
+	if e := os.Getenv("AWS_ENDPOINT_URL_" + envSuffix); e != "" {
+		return aws.String(strings.TrimSuffix(e, "/"))
+	}
+	if e := os.Getenv("AWS_ENDPOINT_URL"); e != "" {
+		return aws.String(strings.TrimSuffix(e, "/"))
+	}
+	return nil
+}
+
+// awsStatus is the HTTP status of the response an SDK call failed with, or
+// 0 if it failed without one.
+func awsStatus(err error) int {
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		return re.HTTPStatusCode()
+	}
+	return 0
+}
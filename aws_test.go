@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestAWSEndpointOverride(t *testing.T) {
+	for name, tc := range map[string]struct {
+		env      map[string]string
+		expected string
+	}{
+		"none":     {expected: ""},
+		"shared":   {env: map[string]string{"AWS_ENDPOINT_URL": "http://localhost:4566/"}, expected: "http://localhost:4566"},
+		"service":  {env: map[string]string{"AWS_ENDPOINT_URL_KMS": "http://localhost:8080"}, expected: "http://localhost:8080"},
+		"precedes": {env: map[string]string{"AWS_ENDPOINT_URL": "http://localhost:4566", "AWS_ENDPOINT_URL_KMS": "http://localhost:8080"}, expected: "http://localhost:8080"},
+		"other":    {env: map[string]string{"AWS_ENDPOINT_URL_S3": "http://localhost:9000"}, expected: ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// GIVEN
+			t.Setenv("AWS_ENDPOINT_URL", "")
+			t.Setenv("AWS_ENDPOINT_URL_KMS", "")
+			t.Setenv("AWS_ENDPOINT_URL_S3", "")
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			// WHEN
+			got := awsEndpointOverride("KMS")
+
+			// THEN
+			if (got == nil) != (tc.expected == "") || (got != nil && *got != tc.expected) {
+				t.Errorf("expected %q, got %v", tc.expected, got)
+			}
+		})
+	}
+}
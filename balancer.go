@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type lookupFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+// defaultFallbackDelay is how long to wait for an address of the preferred
+// family before racing one of the other, as recommended by RFC 6555
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// minDialShare is the least time given to dialing each address when they're
+// tried in turn, however many are left to try
+const minDialShare = 100 * time.Millisecond
+
+// addrBalancer spreads new upstream connections across every address a
+// callback host resolves to, rather than always dialing the first one.
+// Addresses which fail to dial are skipped for a cooldown period so that a
+// dead replica doesn't keep getting its share of the traffic. Should a dial
+// fail, the host's other addresses are tried in turn within the dial
+// timeout, each getting an equal share of what's left of it, so a replica
+// whose node has died costs a connection some latency rather than failing
+// the call.
+//
+// Hosts with both IPv4 and IPv6 addresses are dialed Happy Eyeballs style:
+// an address of the preferred family first, racing one of the other family
+// if it hasn't connected within fallbackDelay (0 for the default, negative
+// to disable). Whichever family last connected to a host is preferred for
+// it, initially that of the first address resolved.
+type addrBalancer struct {
+	lookup        lookupFunc
+	dial          dialFunc
+	cooldown      time.Duration
+	fallbackDelay time.Duration
+	timeout       time.Duration
+
+	mu        sync.Mutex
+	next      map[string]int
+	unhealthy map[string]time.Time
+	preferV4  map[string]bool
+}
+
+func newAddrBalancer(lookup lookupFunc, dial dialFunc, cooldown, fallbackDelay, timeout time.Duration) *addrBalancer {
+	if fallbackDelay == 0 {
+		fallbackDelay = defaultFallbackDelay
+	}
+	return &addrBalancer{
+		lookup:        lookup,
+		dial:          dial,
+		cooldown:      cooldown,
+		fallbackDelay: fallbackDelay,
+		timeout:       timeout,
+		next:          make(map[string]int),
+		unhealthy:     make(map[string]time.Time),
+		preferV4:      make(map[string]bool),
+	}
+}
+
+func (b *addrBalancer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing to balance for IP literals
+	if net.ParseIP(host) != nil {
+		return b.dial(ctx, network, addr)
+	}
+	ips, err := b.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+	}
+	if b.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+	primary, fallback := b.families(host, ips)
+	if len(fallback) == 0 || b.fallbackDelay < 0 {
+		conn, _, err := b.dialAny(ctx, network, host, port, ips)
+		return conn, err
+	}
+	return b.race(ctx, network, host, port, primary, fallback)
+}
+
+// dialAny dials ips in turn, from the next in round-robin order for key,
+// until one connects. Each failed address is marked unhealthy, unless the
+// dial was given up on.
+func (b *addrBalancer) dialAny(ctx context.Context, network, key, port string, ips []net.IP) (net.Conn, net.IP, error) {
+	var firstErr error
+	order := b.order(key, port, ips)
+	for i, ip := range order {
+		if ctx.Err() != nil {
+			break
+		}
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && i < len(order)-1 {
+			remaining := time.Until(deadline)
+			dialCtx, cancel = context.WithTimeout(ctx, min(remaining, max(remaining/time.Duration(len(order)-i), minDialShare)))
+		}
+		target := net.JoinHostPort(ip.String(), port)
+		conn, err := b.dial(dialCtx, network, target)
+		cancel()
+		if err == nil {
+			return conn, ip, nil
+		}
+		if ctx.Err() == nil {
+			b.markUnhealthy(target)
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return nil, nil, firstErr
+}
+
+// families splits ips into those of the family preferred for host and the
+// rest.
+func (b *addrBalancer) families(host string, ips []net.IP) (primary, fallback []net.IP) {
+	b.mu.Lock()
+	preferV4, ok := b.preferV4[host]
+	b.mu.Unlock()
+	if !ok {
+		preferV4 = ips[0].To4() != nil
+	}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == preferV4 {
+			primary = append(primary, ip)
+		} else {
+			fallback = append(fallback, ip)
+		}
+	}
+	if len(primary) == 0 {
+		return fallback, nil
+	}
+	return primary, fallback
+}
+
+// race dials the addresses in primary, then those in fallback as well if
+// they all fail or the first takes longer than fallbackDelay, returning the
+// first connection made.
+func (b *addrBalancer) race(ctx context.Context, network, host, port string, primary, fallback []net.IP) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type dialed struct {
+		conn net.Conn
+		ip   net.IP
+		err  error
+	}
+	results := make(chan dialed, 2)
+	start := func(ips []net.IP) {
+		go func() {
+			// Rotate through each family separately. Losing the race
+			// cancels ctx, so isn't held against the address
+			conn, ip, err := b.dialAny(ctx, network, host+"/"+familyOf(ips[0]), port, ips)
+			results <- dialed{conn, ip, err}
+		}()
+	}
+
+	start(primary)
+	pending := 1
+	timer := time.NewTimer(b.fallbackDelay)
+	defer timer.Stop()
+	fallbackTimer := timer.C
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-fallbackTimer:
+			fallbackTimer = nil
+			start(fallback)
+			pending++
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				b.mu.Lock()
+				b.preferV4[host] = r.ip.To4() != nil
+				b.mu.Unlock()
+				// Close the loser, should it connect too
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if fallbackTimer != nil {
+				fallbackTimer = nil
+				start(fallback)
+				pending++
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+func familyOf(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// order returns the addresses for host to try, starting from the next in
+// round-robin order, with any cooling down after a failure moved to the
+// end. If every address is unhealthy we carry on rotating through them
+// anyway; failing fast here would turn a transient blip into a guaranteed
+// outage.
+func (b *addrBalancer) order(host, port string, ips []net.IP) []net.IP {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	start := b.next[host]
+	b.next[host] = start + 1
+	now := time.Now()
+	healthy := make([]net.IP, 0, len(ips))
+	var cooling []net.IP
+	for i := 0; i < len(ips); i++ {
+		ip := ips[(start+i)%len(ips)]
+		key := net.JoinHostPort(ip.String(), port)
+		until, bad := b.unhealthy[key]
+		if bad && now.After(until) {
+			delete(b.unhealthy, key)
+			bad = false
+		}
+		if bad {
+			cooling = append(cooling, ip)
+		} else {
+			healthy = append(healthy, ip)
+		}
+	}
+	return append(healthy, cooling...)
+}
+
+func (b *addrBalancer) markUnhealthy(target string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.unhealthy[target] = time.Now().Add(b.cooldown)
+}
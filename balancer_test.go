@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fakeLookup(ips ...string) lookupFunc {
+	return func(_ context.Context, _ string) ([]net.IP, error) {
+		var res []net.IP
+		for _, ip := range ips {
+			res = append(res, net.ParseIP(ip))
+		}
+		return res, nil
+	}
+}
+
+func TestAddrBalancerRotates(t *testing.T) {
+	// GIVEN a host with three addresses
+	var dialled []string
+	dial := func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialled = append(dialled, addr)
+		c1, c2 := net.Pipe()
+		_ = c2.Close()
+		return c1, nil
+	}
+	b := newAddrBalancer(fakeLookup("10.0.0.1", "10.0.0.2", "10.0.0.3"), dial, time.Minute, 0, 0)
+
+	// WHEN dialing four times
+	for i := 0; i < 4; i++ {
+		if _, err := b.DialContext(context.Background(), "tcp", "example.com:80"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// THEN each address is used in turn
+	expected := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80"}
+	for i := range expected {
+		if dialled[i] != expected[i] {
+			t.Errorf("dial %d: expected %s, got %s", i, expected[i], dialled[i])
+		}
+	}
+}
+
+func TestAddrBalancerSkipsUnhealthy(t *testing.T) {
+	// GIVEN a host where one address refuses connections
+	var dialled []string
+	dial := func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialled = append(dialled, addr)
+		if addr == "10.0.0.1:80" {
+			return nil, errors.New("connection refused")
+		}
+		c1, c2 := net.Pipe()
+		_ = c2.Close()
+		return c1, nil
+	}
+	b := newAddrBalancer(fakeLookup("10.0.0.1", "10.0.0.2"), dial, time.Minute, 0, 0)
+
+	// WHEN the first dial fails
+	if _, err := b.DialContext(context.Background(), "tcp", "example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+	// THEN the other address is tried straight away
+	if len(dialled) != 2 || dialled[0] != "10.0.0.1:80" || dialled[1] != "10.0.0.2:80" {
+		t.Fatalf("unexpected dials %v", dialled)
+	}
+	// AND later dials avoid the failed address while it is cooling down
+	for i := 0; i < 3; i++ {
+		if _, err := b.DialContext(context.Background(), "tcp", "example.com:80"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, addr := range dialled[2:] {
+		if addr != "10.0.0.2:80" {
+			t.Errorf("expected only the healthy address to be dialled, got %s", addr)
+		}
+	}
+}
+
+func TestAddrBalancerIPLiteral(t *testing.T) {
+	dial := func(_ context.Context, _, addr string) (net.Conn, error) {
+		if addr != "127.0.0.1:80" {
+			t.Errorf("expected IP literal to be dialled directly, got %s", addr)
+		}
+		c1, c2 := net.Pipe()
+		_ = c2.Close()
+		return c1, nil
+	}
+	lookup := func(_ context.Context, host string) ([]net.IP, error) {
+		t.Errorf("unexpected lookup of %s", host)
+		return nil, nil
+	}
+	b := newAddrBalancer(lookup, dial, time.Minute, 0, 0)
+	if _, err := b.DialContext(context.Background(), "tcp", "127.0.0.1:80"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddrBalancerHappyEyeballs(t *testing.T) {
+	// GIVEN a host whose IPv6 address doesn't answer, but whose IPv4 one does
+	var mu sync.Mutex
+	var dialled []string
+	dial := func(ctx context.Context, _, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialled = append(dialled, addr)
+		mu.Unlock()
+		if addr == "[2001:db8::1]:80" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		c1, c2 := net.Pipe()
+		_ = c2.Close()
+		return c1, nil
+	}
+	b := newAddrBalancer(fakeLookup("2001:db8::1", "10.0.0.1"), dial, time.Minute, 10*time.Millisecond, 0)
+
+	// WHEN dialing it
+	if _, err := b.DialContext(context.Background(), "tcp", "example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN IPv6 is tried first, but IPv4 connects once it's raced
+	mu.Lock()
+	if len(dialled) != 2 || dialled[0] != "[2001:db8::1]:80" || dialled[1] != "10.0.0.1:80" {
+		t.Errorf("unexpected dials %v", dialled)
+	}
+	dialled = nil
+	mu.Unlock()
+
+	// WHEN dialing it again
+	if _, err := b.DialContext(context.Background(), "tcp", "example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN IPv4, which worked, is preferred and IPv6 never needs trying
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialled) != 1 || dialled[0] != "10.0.0.1:80" {
+		t.Errorf("unexpected dials %v", dialled)
+	}
+}
+
+func TestAddrBalancerRetriesWithinTimeout(t *testing.T) {
+	// GIVEN a host with three addresses, the first two of which never answer
+	var mu sync.Mutex
+	var dialled []string
+	dial := func(ctx context.Context, _, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialled = append(dialled, addr)
+		mu.Unlock()
+		if addr != "10.0.0.3:80" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		c1, c2 := net.Pipe()
+		_ = c2.Close()
+		return c1, nil
+	}
+	b := newAddrBalancer(fakeLookup("10.0.0.1", "10.0.0.2", "10.0.0.3"), dial, time.Minute, 0, time.Second)
+
+	// WHEN dialing it
+	start := time.Now()
+	if _, err := b.DialContext(context.Background(), "tcp", "example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN each address is tried in turn, within the dial timeout
+	if took := time.Since(start); took >= time.Second {
+		t.Errorf("expected to connect within the dial timeout, took %v", took)
+	}
+	if len(dialled) != 3 || dialled[2] != "10.0.0.3:80" {
+		t.Errorf("unexpected dials %v", dialled)
+	}
+	// AND the addresses which timed out are cooling down
+	if order := b.order("example.com", "80", []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}); !order[0].Equal(net.ParseIP("10.0.0.3")) {
+		t.Errorf("expected the healthy address first, got %v", order)
+	}
+}
+
+func TestAddrBalancerAllFail(t *testing.T) {
+	// GIVEN a host none of whose addresses connect
+	dial := func(_ context.Context, _, addr string) (net.Conn, error) {
+		return nil, errors.New("connection refused: " + addr)
+	}
+	b := newAddrBalancer(fakeLookup("10.0.0.1", "10.0.0.2"), dial, time.Minute, 0, time.Second)
+
+	// WHEN dialing it
+	_, err := b.DialContext(context.Background(), "tcp", "example.com:80")
+
+	// THEN the first address's error is returned
+	if err == nil || err.Error() != "connection refused: 10.0.0.1:80" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// requestBody holds a proxied request's body so that every upstream can be
+// given its own reader over it. Small bodies are kept in a pooled buffer,
+// anything over the spool threshold is written to a temporary file instead.
+//
+// The transport may keep reading a request body after the response has
+// arrived, so the body counts its open readers and only releases the buffer
+// or file once the owner and every reader have closed it.
+type requestBody struct {
+	buf  *bytes.Buffer
+	file *os.File
+	size int64
+	refs atomic.Int32
+}
+
+// readRequestBody reads r, spooling it to a temporary file in dir once it
+// exceeds threshold bytes. A threshold of zero or less never spools.
+func readRequestBody(r io.Reader, threshold int64, dir string) (*requestBody, error) {
+	buf := getBuffer()
+	limited := r
+	if threshold > 0 {
+		limited = io.LimitReader(r, threshold+1)
+	}
+	if _, err := buf.ReadFrom(limited); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	if threshold <= 0 || int64(buf.Len()) <= threshold {
+		return newRequestBody(buf, nil, int64(buf.Len())), nil
+	}
+
+	f, err := os.CreateTemp(dir, "regproxy-body-")
+	if err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	// Unlink straight away where the OS allows, the open handle keeps the
+	// data readable and nothing is left behind if we crash
+	_ = os.Remove(f.Name())
+	size, err := io.Copy(f, io.MultiReader(buf, r))
+	putBuffer(buf)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return newRequestBody(nil, f, size), nil
+}
+
+// checkSpoolDir makes sure request bodies over threshold can be spooled to
+// dir, rather than each of those requests failing.
+func checkSpoolDir(threshold int64, dir string) error {
+	if threshold <= 0 {
+		return nil
+	}
+	f, err := os.CreateTemp(dir, "regproxy-body-")
+	if err != nil {
+		return fmt.Errorf("spool-dir %s can't hold request bodies over spool-threshold: %w", dir, err)
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+func newRequestBody(buf *bytes.Buffer, file *os.File, size int64) *requestBody {
+	b := &requestBody{buf: buf, file: file, size: size}
+	b.refs.Store(1)
+	return b
+}
+
+func (b *requestBody) spooled() bool {
+	return b.file != nil
+}
+
+// reader returns a new, independent reader over the whole body, which must
+// be closed.
+func (b *requestBody) reader() io.ReadCloser {
+	b.refs.Add(1)
+	var r io.Reader
+	if b.file != nil {
+		r = io.NewSectionReader(b.file, 0, b.size)
+	} else {
+		r = bytes.NewReader(b.buf.Bytes())
+	}
+	return &bodyReader{Reader: r, body: b}
+}
+
+// Close gives up the owner's reference to the body.
+func (b *requestBody) Close() error {
+	return b.release()
+}
+
+func (b *requestBody) release() error {
+	if b.refs.Add(-1) != 0 {
+		return nil
+	}
+	if b.buf != nil {
+		putBuffer(b.buf)
+		return nil
+	}
+	err := b.file.Close()
+	if rmErr := os.Remove(b.file.Name()); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+type bodyReader struct {
+	io.Reader
+	body *requestBody
+	once sync.Once
+}
+
+func (r *bodyReader) Close() error {
+	var err error
+	r.once.Do(func() {
+		err = r.body.release()
+	})
+	return err
+}
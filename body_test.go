@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadRequestBodyInMemory(t *testing.T) {
+	body, err := readRequestBody(strings.NewReader("small"), 10, os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if body.spooled() {
+		t.Errorf("expected a small body to stay in memory")
+	}
+	b, _ := io.ReadAll(body.reader())
+	if string(b) != "small" {
+		t.Errorf("unexpected body %q", b)
+	}
+}
+
+func TestCheckSpoolDir(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	for _, tc := range []struct {
+		name      string
+		threshold int64
+		dir       string
+		ok        bool
+	}{
+		{"writable", 10, t.TempDir(), true},
+		{"unavailable", 10, missing, false},
+		{"spooling off", 0, missing, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkSpoolDir(tc.threshold, tc.dir); (err == nil) != tc.ok {
+				t.Errorf("expected ok: %v, got %v", tc.ok, err)
+			}
+		})
+	}
+}
+
+func TestReadRequestBodySpooled(t *testing.T) {
+	// GIVEN a body over the threshold
+	content := strings.Repeat("0123456789", 100)
+	body, err := readRequestBody(strings.NewReader(content), 10, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	// THEN it is spooled
+	if !body.spooled() || body.size != int64(len(content)) {
+		t.Fatalf("expected body to be spooled, got spooled=%v size=%d", body.spooled(), body.size)
+	}
+	// AND concurrent readers each see the whole body
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := io.ReadAll(body.reader())
+			if err != nil {
+				t.Error(err)
+			}
+			if string(b) != content {
+				t.Errorf("reader saw %d bytes, expected %d", len(b), len(content))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestProxySpooledBody(t *testing.T) {
+	cfg := testConfig()
+	cfg.SpoolThreshold = 16
+	cfg.SpoolDir = t.TempDir()
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN two upstreams echoing the size of what they received
+		content := strings.Repeat("x", 4096)
+		var mu sync.Mutex
+		var received []int
+		handler := http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			b, _ := io.ReadAll(req.Body)
+			mu.Lock()
+			received = append(received, len(b))
+			mu.Unlock()
+		})
+		testServer1 := httptest.NewServer(handler)
+		testServer2 := httptest.NewServer(handler)
+		defer testServer1.Close()
+		defer testServer2.Close()
+		register(url, upstream{Name: "foo", Callback: testServer1.URL}, t)
+		register(url, upstream{Name: "bar", Callback: testServer2.URL}, t)
+
+		// WHEN posting a body over the spool threshold
+		r, err := http.Post(url, "text/plain", bytes.NewReader([]byte(content)))
+
+		// THEN both upstreams get all of it
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+		if len(received) != 2 || received[0] != len(content) || received[1] != len(content) {
+			t.Errorf("unexpected bodies received %v", received)
+		}
+		if n := rp.metrics.spooledRequests.value(); n != 1 {
+			t.Errorf("expected 1 spooled request, got %v", n)
+		}
+	})
+}
+
+func TestRequestBodyOutlivesOwner(t *testing.T) {
+	// GIVEN a spooled body with an open reader
+	body, err := readRequestBody(strings.NewReader(strings.Repeat("x", 100)), 10, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := body.reader()
+
+	// WHEN the owner lets go first
+	if err := body.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN the reader still works
+	b, err := io.ReadAll(r)
+	if err != nil || len(b) != 100 {
+		t.Fatalf("expected to read 100 bytes, got %d: %v", len(b), err)
+	}
+	// AND the file is released once the reader is closed too
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := body.file.Stat(); err == nil {
+		t.Errorf("expected the spool file to be closed")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// redacted replaces whatever a redaction rule matches in a logged body
+const redacted = "[REDACTED]"
+
+// bodyLogger logs the bodies of a sample of proxied requests, and of their
+// upstreams' responses, for debugging payload issues. Only the first
+// maxBytes of each body are logged. JSON fields matching a redaction path,
+// in the dot-separated form of -compare-ignore-fields, have their values
+// replaced, as does anything a redaction pattern matches, so PII isn't
+// written to the logs. A JSON body too big to parse in full isn't logged at
+// all, as its fields couldn't be redacted.
+type bodyLogger struct {
+	sample   float64
+	maxBytes int64
+	fields   []string
+	patterns []*regexp.Regexp
+}
+
+// newBodyLogger returns nil if no bodies are to be logged.
+func newBodyLogger(cfg Config) *bodyLogger {
+	if cfg.BodyLogSample <= 0 {
+		return nil
+	}
+	return &bodyLogger{
+		sample:   cfg.BodyLogSample,
+		maxBytes: cfg.BodyLogMaxBytes,
+		fields:   cfg.BodyLogRedactFields,
+		patterns: cfg.BodyLogRedactPatterns,
+	}
+}
+
+// sampled decides whether a request's bodies are logged.
+func (l *bodyLogger) sampled() bool {
+	return l != nil && rand.Float64() < l.sample
+}
+
+// logRequest logs a proxied request's body.
+func (l *bodyLogger) logRequest(req *http.Request, body *requestBody, d *delivery) {
+	r := body.reader()
+	defer r.Close()
+	head, err := io.ReadAll(io.LimitReader(r, l.maxBytes+1))
+	if err != nil {
+		log.Printf("Failed to read body of request %s to log it: %v", d.requestID, err)
+		return
+	}
+	log.Printf("Request %s %s %s body (%d bytes): %s", d.requestID, req.Method, req.URL.Path, body.size, l.redact(req.Header.Get("Content-Type"), head, body.size))
+}
+
+// logResponse arranges for the body of an upstream's response to be logged
+// as it's read, once it's closed.
+func (l *bodyLogger) logResponse(req *http.Request, ups upstream, resp *http.Response) *http.Response {
+	d := deliveryFrom(req.Context())
+	if d == nil || !d.logBodies {
+		return resp
+	}
+	resp.Body = &loggedBody{ReadCloser: resp.Body, max: l.maxBytes, done: func(head []byte, size int64) {
+		log.Printf("Request %s response body from upstream %s, status %d (%d bytes read): %s", d.requestID, ups.Name, resp.StatusCode, size, l.redact(resp.Header.Get("Content-Type"), head, size))
+	}}
+	return resp
+}
+
+// redact returns the loggable form of the first bytes of a body of size
+// bytes.
+func (l *bodyLogger) redact(contentType string, head []byte, size int64) string {
+	s, truncated, ok := l.redactText(contentType, head, size)
+	if !ok {
+		return "[not logged, JSON which can't be parsed in full to redact it]"
+	}
+	s = strconv.Quote(s)
+	if truncated {
+		s += "..."
+	}
+	return s
+}
+
+// redactText returns the first bytes of a body of size bytes, redacted and
+// cut to maxBytes, and whether they were cut. It isn't ok for JSON which
+// can't be parsed in full to redact it.
+func (l *bodyLogger) redactText(contentType string, head []byte, size int64) (s string, truncated, ok bool) {
+	truncated = int64(len(head)) > l.maxBytes || size > int64(len(head))
+	if mt, _, _ := mime.ParseMediaType(contentType); len(l.fields) > 0 && (mt == "application/json" || strings.HasSuffix(mt, "+json")) {
+		var v any
+		if truncated || json.Unmarshal(head, &v) != nil {
+			return "", truncated, false
+		}
+		redactJSON("", v, l.fields)
+		head, _ = json.Marshal(v)
+	}
+	if int64(len(head)) > l.maxBytes {
+		head, truncated = head[:l.maxBytes], true
+	}
+	s = string(head)
+	for _, re := range l.patterns {
+		s = re.ReplaceAllLiteralString(s, redacted)
+	}
+	return s, truncated, true
+}
+
+// redactJSON replaces the values at paths matching fields in v.
+func redactJSON(path string, v any, fields []string) {
+	switch vt := v.(type) {
+	case map[string]any:
+		for k, child := range vt {
+			if p := joinPath(path, k); isIgnored(p, fields) {
+				vt[k] = redacted
+			} else {
+				redactJSON(p, child, fields)
+			}
+		}
+	case []any:
+		for i, child := range vt {
+			if p := joinPath(path, strconv.Itoa(i)); isIgnored(p, fields) {
+				vt[i] = redacted
+			} else {
+				redactJSON(p, child, fields)
+			}
+		}
+	}
+}
+
+// loggedBody keeps the first bytes read from a response body, handing them
+// to done when it's closed.
+type loggedBody struct {
+	io.ReadCloser
+	max  int64
+	done func(head []byte, size int64)
+
+	head bytes.Buffer
+	size int64
+	once sync.Once
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	// Keep one byte more than is logged, so truncation is noticed
+	if room := b.max + 1 - int64(b.head.Len()); room > 0 {
+		b.head.Write(p[:min(int64(n), room)])
+	}
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	b.once.Do(func() {
+		b.done(b.head.Bytes(), b.size)
+	})
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer collects log output written from any goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog collects the log until the test ends.
+func captureLog(t *testing.T) *syncBuffer {
+	var b syncBuffer
+	log.SetOutput(&b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &b
+}
+
+func TestBodyLogRedaction(t *testing.T) {
+	l := &bodyLogger{maxBytes: 96, fields: []string{"patient.name", "items.*.nhs"}, patterns: []*regexp.Regexp{regexp.MustCompile(`[0-9]{3}-[0-9]{4}`)}}
+	for _, c := range []struct {
+		name, contentType, body, expected string
+	}{
+		{"json fields", "application/json", `{"patient":{"name":"Ann","age":40},"items":[{"nhs":"123"}]}`, `"{\"items\":[{\"nhs\":\"[REDACTED]\"}],\"patient\":{\"age\":40,\"name\":\"[REDACTED]\"}}"`},
+		{"patterns", "text/plain", "call 555-1234", `"call [REDACTED]"`},
+		{"truncated json", "application/problem+json", `{"patient":{"name":"` + strings.Repeat("x", 120) + `"}}`, "[not logged, JSON which can't be parsed in full to redact it]"},
+		{"truncated text", "text/plain", strings.Repeat("x", 120), `"` + strings.Repeat("x", 96) + `"...`},
+	} {
+		// WHEN
+		got := l.redact(c.contentType, []byte(c.body)[:min(len(c.body), 97)], int64(len(c.body)))
+
+		// THEN
+		if got != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestBodyLogging(t *testing.T) {
+	// GIVEN every request's bodies are logged, redacting a field
+	logged := captureLog(t)
+	cfg := testConfig()
+	cfg.BodyLogSample = 1
+	cfg.BodyLogMaxBytes = 1024
+	cfg.BodyLogRedactFields = []string{"name"}
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.Header().Set("Content-Type", "application/json")
+			_, _ = rr.Write([]byte(`{"name":"Bob","id":7}`))
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "patients", Callback: srv.URL}, t)
+
+		// WHEN
+		resp, err := http.Post(url+"/patients", "application/json", strings.NewReader(`{"name":"Ann"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN both bodies are logged, redacted
+		deadline := time.Now().Add(2 * time.Second)
+		for !strings.Contains(logged.String(), "response body from upstream patients") && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		out := logged.String()
+		for _, want := range []string{
+			`POST /patients body (14 bytes): "{\"name\":\"[REDACTED]\"}"`,
+			`response body from upstream patients, status 200 (21 bytes read): "{\"id\":7,\"name\":\"[REDACTED]\"}"`,
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("expected the log to contain %s, got %s", want, out)
+			}
+		}
+		if strings.Contains(out, "Ann") || strings.Contains(out, "Bob") {
+			t.Errorf("expected names to be redacted, got %s", out)
+		}
+	})
+}
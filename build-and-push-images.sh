@@ -4,5 +4,8 @@
 
 ## Increment this number when you push a new image
 VERSION=6
-docker build . -t "europe-docker.pkg.dev/infra-240614/eu.gcr.io/regproxy2:$VERSION"
+docker build . -t "europe-docker.pkg.dev/infra-240614/eu.gcr.io/regproxy2:$VERSION" \
+  --build-arg VERSION="$VERSION" \
+  --build-arg COMMIT="$(git rev-parse HEAD)" \
+  --build-arg BUILD_DATE="$(date -u +%Y-%m-%dT%H:%M:%SZ)"
 docker push "europe-docker.pkg.dev/infra-240614/eu.gcr.io/regproxy2:$VERSION"
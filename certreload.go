@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a certificate from PEM files, picking up changes to
+// them without a restart, e.g. when cert-manager rotates a mounted secret.
+// Files are polled rather than watched, as secret volumes are updated by
+// swapping symlinks which watchers don't reliably see. If the new files
+// can't be loaded, e.g. part way through being written, the previous
+// certificate is kept and loading is tried again on the next poll.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	version string
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// getCertificate is the tls.Config hook serving the current certificate.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// Run checks for changed files every interval until ctx is done.
+func (r *certReloader) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if changed, err := r.reload(); err != nil {
+				log.Printf("Failed to reload certificate %s, still serving the previous one: %v", r.certFile, err)
+			} else if changed {
+				log.Printf("Reloaded certificate %s", r.certFile)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload loads the files if they have changed since they were last loaded.
+func (r *certReloader) reload() (bool, error) {
+	version, err := fileVersion(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	unchanged := version == r.version
+	r.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.version = &cert, version
+	return true, nil
+}
+
+// fileVersion identifies the current contents of files by their sizes and
+// modification times.
+func fileVersion(files ...string) (string, error) {
+	var version string
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%d@%d;", fi.Size(), fi.ModTime().UnixNano())
+	}
+	return version, nil
+}
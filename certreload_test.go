@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a self-signed certificate for name and its key.
+func writeSelfSigned(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name}}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func servedName(t *testing.T, r *certReloader) string {
+	cert, err := r.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	// GIVEN a certificate being served
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeSelfSigned(t, certFile, keyFile, "old.test")
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN the files are only partly rewritten
+	if err := os.WriteFile(certFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN the old certificate is still served
+	if _, err := r.reload(); err == nil {
+		t.Error("expected a broken certificate not to load")
+	}
+	if name := servedName(t, r); name != "old.test" {
+		t.Errorf("expected old.test, got %s", name)
+	}
+
+	// WHEN they are rotated
+	writeSelfSigned(t, certFile, keyFile, "new.test")
+
+	// THEN the new certificate is served
+	if changed, err := r.reload(); !changed || err != nil {
+		t.Fatalf("expected the new certificate to load, got %v %v", changed, err)
+	}
+	if name := servedName(t, r); name != "new.test" {
+		t.Errorf("expected new.test, got %s", name)
+	}
+	if changed, _ := r.reload(); changed {
+		t.Error("expected unchanged files not to be reloaded")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// clientCommands are the subcommands which talk to a running instance's
+// admin API, rather than starting a proxy.
+var clientCommands = map[string]func(c *adminClient, args []string) error{
+	"register":   (*adminClient).register,
+	"deregister": (*adminClient).deregister,
+	"list":       (*adminClient).list,
+	"stats":      (*adminClient).stats,
+}
+
+// errUsage is returned by a subcommand whose arguments are wrong, once it has
+// printed its usage.
+var errUsage = errors.New("usage")
+
+// adminClient calls the admin API of the instance at addr.
+type adminClient struct {
+	addr   string
+	client *http.Client
+	out    io.Writer
+	flags  *flag.FlagSet
+}
+
+// runClientCommand runs a subcommand, returning the process's exit status.
+func runClientCommand(name string, args []string, out, errOut io.Writer) int {
+	flags := flag.NewFlagSet("regproxy "+name, flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	c := &adminClient{client: &http.Client{Timeout: 30 * time.Second}, out: out, flags: flags}
+	flags.StringVar(&c.addr, "addr", cmp.Or(os.Getenv("REGPROXY_ADDR"), "http://localhost:9876"), "base URL of the instance's admin API, by default $REGPROXY_ADDR")
+	err := clientCommands[name](c, args)
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	default:
+		fmt.Fprintf(errOut, "regproxy %s: %v\n", name, err)
+		return 1
+	}
+}
+
+// parse parses the subcommand's flags, checking it was given at least
+// minArgs arguments, and at most maxArgs unless that is negative.
+func (c *adminClient) parse(args []string, usage string, minArgs, maxArgs int) error {
+	c.flags.Usage = func() {
+		fmt.Fprintf(c.flags.Output(), "Usage: %s [flags] %s\n", c.flags.Name(), usage)
+		c.flags.PrintDefaults()
+	}
+	if err := c.flags.Parse(args); err != nil {
+		return err
+	}
+	if n := c.flags.NArg(); n < minArgs || (maxArgs >= 0 && n > maxArgs) {
+		c.flags.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// do makes an admin API call, decoding a JSON response into v if it isn't
+// nil, and turning problem responses into errors.
+func (c *adminClient) do(method, path string, body any, v any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.addr, "/")+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var pr problem
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(b, &pr) == nil && pr.Detail != "" {
+			return fmt.Errorf("%s: %s", resp.Status, pr.Detail)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// register adds an upstream, given by name and callback or as a JSON file.
+func (c *adminClient) register(args []string) error {
+	var u upstream
+	file := c.flags.String("file", "", "read the whole registration from a JSON file, - for stdin, instead of from the arguments")
+	overwrite := c.flags.Bool("overwrite", false, "replace an upstream of the same name registered with a different callback")
+	c.flags.IntVar(&u.Priority, "priority", 0, "the upstream's priority, lowest first")
+	c.flags.IntVar(&u.Weight, "weight", 0, "the upstream's weight among upstreams of the same priority")
+	c.flags.StringVar(&u.Group, "group", "", "the listener group the upstream is in")
+	c.flags.Func("label", "a key=value label, may be repeated", func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("expected key=value, got [%s]", s)
+		}
+		if u.Labels == nil {
+			u.Labels = make(map[string]string)
+		}
+		u.Labels[k] = v
+		return nil
+	})
+	if err := c.parse(args, "<name> <callback> | -file <registration.json>", 0, 2); err != nil {
+		return err
+	}
+	switch {
+	case *file != "" && c.flags.NArg() == 0:
+		if err := readRegistration(*file, &u); err != nil {
+			return err
+		}
+	case *file == "" && c.flags.NArg() == 2:
+		u.Name, u.Callback = c.flags.Arg(0), c.flags.Arg(1)
+	default:
+		c.flags.Usage()
+		return errUsage
+	}
+	path := "/register"
+	if *overwrite {
+		path += "?overwrite=true"
+	}
+	if err := c.do(http.MethodPut, path, u, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Registered %s at %s\n", u.Name, u.Callback)
+	return nil
+}
+
+func readRegistration(name string, u *upstream) error {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	if err := json.NewDecoder(f).Decode(u); err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	return nil
+}
+
+// deregister removes upstreams by name.
+func (c *adminClient) deregister(args []string) error {
+	if err := c.parse(args, "<name>...", 1, -1); err != nil {
+		return err
+	}
+	for _, name := range c.flags.Args() {
+		if err := c.do(http.MethodDelete, "/upstreams/"+url.PathEscape(name), nil, nil); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Fprintf(c.out, "Deregistered %s\n", name)
+	}
+	return nil
+}
+
+// list prints the registered upstreams as a table, or as JSON.
+func (c *adminClient) list(args []string) error {
+	asJSON := c.flags.Bool("json", false, "print the registrations as JSON")
+	if err := c.parse(args, "", 0, 0); err != nil {
+		return err
+	}
+	var list []upstream
+	if err := c.do(http.MethodGet, "/upstreams", nil, &list); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(c.out, list)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCALLBACK\tGROUP\tPRIORITY\tWEIGHT\tPAUSED")
+	for _, u := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%t\n", u.Name, u.Callback, u.Group, u.Priority, u.Weight, u.Paused)
+	}
+	return w.Flush()
+}
+
+// stats prints the instance's current load, and its upstreams' SLOs.
+func (c *adminClient) stats(args []string) error {
+	asJSON := c.flags.Bool("json", false, "print the stats as JSON")
+	if err := c.parse(args, "", 0, 0); err != nil {
+		return err
+	}
+	var s adminStats
+	if err := c.do(http.MethodGet, "/admin/stats", nil, &s); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(c.out, s)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Upstreams:\t%d\n", s.Upstreams)
+	fmt.Fprintf(w, "Requests in flight:\t%d\n", s.RequestsInFlight)
+	fmt.Fprintf(w, "Upstream calls in flight:\t%d\n", s.UpstreamCallsInFlight)
+	fmt.Fprintf(w, "Queued requests:\t%d\n", s.QueuedRequests)
+	fmt.Fprintf(w, "Leader:\t%t\n", s.Leader)
+	if len(s.SLOs) > 0 {
+		fmt.Fprintln(w)
+		header := []string{"UPSTREAM", "TARGET"}
+		for _, win := range sloWindows {
+			header = append(header, win.name)
+		}
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, slo := range s.SLOs {
+			row := []string{slo.Upstream, strconv.FormatFloat(slo.Target, 'f', -1, 64)}
+			for _, win := range sloWindows {
+				row = append(row, strconv.FormatFloat(slo.BurnRates[win.name], 'f', 2, 64))
+			}
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+	}
+	for _, t := range []struct {
+		heading string
+		counts  map[string]byteCounts
+	}{{"UPSTREAM", s.UpstreamBytes}, {"TENANT", s.TenantBytes}} {
+		if len(t.counts) == 0 {
+			continue
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, t.heading+"\tBYTES SENT\tBYTES RECEIVED")
+		names := make([]string, 0, len(t.counts))
+		for name := range t.counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", name, t.counts[name].Sent, t.counts[name].Received)
+		}
+	}
+	if len(s.Connections) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "UPSTREAM\tOPEN\tIDLE\tREUSED\tNEW\tDIAL ERRORS\tTLS HANDSHAKE")
+		names := make([]string, 0, len(s.Connections))
+		for name := range s.Connections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			c := s.Connections[name]
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%.1fms\n", name, c.Open, c.Idle, c.Reused, c.New, c.DialErrors, c.TLSHandshakeMs)
+		}
+	}
+	return w.Flush()
+}
+
+func printJSON(out io.Writer, v any) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
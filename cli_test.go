@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestClientCommands(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		run := func(args ...string) (int, string) {
+			var out, errOut bytes.Buffer
+			status := runClientCommand(args[0], append([]string{"-addr", url}, args[1:]...), &out, &errOut)
+			return status, out.String() + errOut.String()
+		}
+
+		// WHEN upstreams are registered
+		if status, out := run("register", "-priority", "1", "-label", "team=billing", "billing", "http://billing"); status != 0 {
+			t.Fatalf("expected register to succeed, got %d: %s", status, out)
+		}
+		run("register", "orders", "http://orders")
+
+		// THEN they are listed
+		status, out := run("list")
+		if status != 0 || !strings.Contains(out, "billing  http://billing") || !strings.Contains(out, "orders") {
+			t.Errorf("expected both upstreams to be listed, got %d: %s", status, out)
+		}
+		if _, out := run("list", "-json"); !strings.Contains(out, `"team": "billing"`) {
+			t.Errorf("expected the label to be registered, got %s", out)
+		}
+
+		// WHEN one is re-registered with another callback, THEN the conflict is reported
+		if status, out := run("register", "orders", "http://elsewhere"); status != 1 || !strings.Contains(out, "409") {
+			t.Errorf("expected a conflict, got %d: %s", status, out)
+		}
+
+		// WHEN one is deregistered, THEN it is no longer listed
+		if status, out := run("deregister", "orders"); status != 0 {
+			t.Fatalf("expected deregister to succeed, got %d: %s", status, out)
+		}
+		if _, out := run("list"); strings.Contains(out, "orders") {
+			t.Errorf("expected orders to be gone, got %s", out)
+		}
+
+		// AND the stats count what's left
+		if status, out := run("stats"); status != 0 || !strings.Contains(out, "Upstreams:                 1") {
+			t.Errorf("expected stats, got %d: %s", status, out)
+		}
+
+		// AND a command without its arguments is a usage error
+		if status, _ := run("register", "orders"); status != 2 {
+			t.Errorf("expected a usage error, got %d", status)
+		}
+	})
+}
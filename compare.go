@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Comparison results, as reported by the regproxy_compare_total metric
+const (
+	compareMatch          = "match"
+	compareStatusMismatch = "status_mismatch"
+	compareBodyMismatch   = "body_mismatch"
+	compareError          = "error"
+)
+
+// compare calls every upstream in parallel, returns the primary's response
+// to the client and diffs each shadow upstream's response against it. This
+// is for verifying a replacement service against the one it replaces, so
+// shadow failures never affect the client.
+func (p *RegProxy) compare(resp http.ResponseWriter, req *http.Request, body *requestBody, upstreams map[string]upstream) {
+	ordered := byPriority(upstreams)
+	results := make(chan result, len(ordered))
+	cancels := make(callCancels, len(ordered))
+	defer cancels.cancelAll()
+	for _, ups := range ordered {
+		cancels[ups.Name] = p.forwardAsync(req, body, ups, results)
+	}
+	byName := make(map[string]result, len(ordered))
+	dc := req.Context().Done()
+	for range ordered {
+		select {
+		case r := <-results:
+			byName[r.ups.Name] = r
+		// If our own client cancelled, we should stop waiting
+		case <-dc:
+			go discardResults(results, len(ordered)-len(byName))
+			for _, r := range byName {
+				r.close()
+			}
+			p.upstreamErrResp(resp, req, req.Context().Err())
+			return
+		}
+	}
+
+	primary := byName[ordered[0].Name]
+	primaryBuf := getBuffer()
+	defer putBuffer(primaryBuf)
+	primaryErr := readResult(primary, primaryBuf)
+	shadowBuf := getBuffer()
+	defer putBuffer(shadowBuf)
+	for _, ups := range ordered[1:] {
+		shadow := byName[ups.Name]
+		shadowBuf.Reset()
+		shadowErr := readResult(shadow, shadowBuf)
+		p.diffResult(req, primary, primaryBuf.Bytes(), primaryErr, shadow, shadowBuf.Bytes(), shadowErr)
+	}
+
+	if primaryErr != nil {
+		p.upstreamErrResp(resp, req, primaryErr)
+		return
+	}
+	primary.resp.Body = io.NopCloser(primaryBuf)
+	writeResponse(resp, primary.resp)
+}
+
+// readResult reads an upstream's response body into buf, closing it.
+func readResult(r result, buf *bytes.Buffer) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.resp.Body.Close()
+	_, err := buf.ReadFrom(r.resp.Body)
+	return err
+}
+
+func (p *RegProxy) diffResult(req *http.Request, primary result, primaryBody []byte, primaryErr error, shadow result, shadowBody []byte, shadowErr error) {
+	var outcome string
+	var details []string
+	switch {
+	case primaryErr != nil || shadowErr != nil:
+		outcome = compareError
+		details = append(details, fmt.Sprintf("primary error [%v], shadow error [%v]", primaryErr, shadowErr))
+	case primary.resp.StatusCode != shadow.resp.StatusCode:
+		outcome = compareStatusMismatch
+		details = append(details, fmt.Sprintf("status %d vs %d", primary.resp.StatusCode, shadow.resp.StatusCode))
+	default:
+		diffs := diffBodies(primaryBody, shadowBody, p.cfg.CompareIgnoreFields)
+		if len(diffs) == 0 {
+			outcome = compareMatch
+		} else {
+			outcome = compareBodyMismatch
+			details = append(details, "fields "+strings.Join(diffs, ", "))
+		}
+	}
+	p.metrics.compareResults.inc(shadow.ups.Name, outcome)
+	if outcome != compareMatch && rand.Float64() < p.cfg.CompareLogSample {
+		log.Printf("Response diff for %s between primary %s and shadow %s: %s", req.URL.Path, primary.ups.Name, shadow.ups.Name, strings.Join(details, "; "))
+	}
+}
+
+// diffBodies compares two response bodies, returning the paths which differ.
+// JSON bodies are compared structurally so that formatting and key order
+// don't matter, skipping any dot-separated field paths in ignore, where a *
+// segment matches any key or array index. Anything else is compared byte for
+// byte, reported as the path "body".
+func diffBodies(a, b []byte, ignore []string) []string {
+	var av, bv any
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		if bytes.Equal(a, b) {
+			return nil
+		}
+		return []string{"body"}
+	}
+	var diffs []string
+	diffJSON("", av, bv, ignore, &diffs)
+	return diffs
+}
+
+func diffJSON(path string, a, b any, ignore []string, diffs *[]string) {
+	if isIgnored(path, ignore) {
+		return
+	}
+	switch at := a.(type) {
+	case map[string]any:
+		bt, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for k := range at {
+			keys[k] = true
+		}
+		for k := range bt {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			diffJSON(joinPath(path, k), at[k], bt[k], ignore, diffs)
+		}
+		return
+	case []any:
+		bt, ok := b.([]any)
+		if !ok || len(at) != len(bt) {
+			break
+		}
+		for i := range at {
+			diffJSON(joinPath(path, strconv.Itoa(i)), at[i], bt[i], ignore, diffs)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		if path == "" {
+			path = "body"
+		}
+		*diffs = append(*diffs, path)
+	}
+}
+
+func isIgnored(path string, ignore []string) bool {
+	if path == "" {
+		return false
+	}
+	segments := strings.Split(path, ".")
+	for _, pattern := range ignore {
+		ps := strings.Split(pattern, ".")
+		if len(ps) != len(segments) {
+			continue
+		}
+		matched := true
+		for i := range ps {
+			if ps[i] != "*" && ps[i] != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiffBodies(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		ignore   []string
+		expected string
+	}{
+		{`{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1}`, nil, "[]"},
+		{`{"a":1,"b":{"c":2}}`, `{"a":1,"b":{"c":3}}`, nil, "[b.c]"},
+		{`{"a":1,"ts":"now"}`, `{"a":1,"ts":"later"}`, []string{"ts"}, "[]"},
+		{`{"items":[{"id":1,"v":1},{"id":2,"v":1}]}`, `{"items":[{"id":3,"v":1},{"id":4,"v":2}]}`, []string{"items.*.id"}, "[items.1.v]"},
+		{`{"a":1}`, `{"a":1,"extra":true}`, nil, "[extra]"},
+		{`plain text`, `plain text`, nil, "[]"},
+		{`plain text`, `other text`, nil, "[body]"},
+	}
+	for _, c := range cases {
+		diffs := fmt.Sprint(diffBodies([]byte(c.a), []byte(c.b), c.ignore))
+		if diffs != c.expected {
+			t.Errorf("diff of %s and %s: expected %s, got %s", c.a, c.b, c.expected, diffs)
+		}
+	}
+}
+
+func TestCompareMode(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeCompare
+	cfg.CompareIgnoreFields = []string{"generated"}
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(proxyUrl string, t *testing.T) {
+		// GIVEN a primary, a matching shadow and a mismatching shadow
+		primary := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.Write([]byte(`{"id":1,"generated":"a"}`))
+		}))
+		same := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.Write([]byte(`{"generated":"b","id":1}`))
+		}))
+		different := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.WriteHeader(500)
+		}))
+		defer primary.Close()
+		defer same.Close()
+		defer different.Close()
+		register(proxyUrl, upstream{Name: "primary", Callback: primary.URL, Priority: 1}, t)
+		register(proxyUrl, upstream{Name: "same", Callback: same.URL, Priority: 2}, t)
+		register(proxyUrl, upstream{Name: "different", Callback: different.URL, Priority: 2}, t)
+
+		// WHEN
+		r, err := http.Get(proxyUrl)
+
+		// THEN the primary's response is returned despite the failing shadow
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+		// AND the comparisons are counted
+		if n := rp.metrics.compareResults.value("same", compareMatch); n != 1 {
+			t.Errorf("expected 1 match, got %v", n)
+		}
+		if n := rp.metrics.compareResults.value("different", compareStatusMismatch); n != 1 {
+			t.Errorf("expected 1 status mismatch, got %v", n)
+		}
+		m, err := http.Get(proxyUrl + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(m.Body)
+		if !strings.Contains(string(body), `regproxy_compare_total{upstream="same",result="match"} 1`) {
+			t.Errorf("metric missing from /metrics output:\n%s", body)
+		}
+	})
+}
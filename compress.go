@@ -0,0 +1,153 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultCompressTypes are the media types compressed unless configured
+// otherwise, the text formats the upstreams answer with
+var defaultCompressTypes = []string{"application/json", "application/*+json", "application/xml", "application/*+xml", "text/*"}
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, by
+// name or by *, gzip;q=0 ruling it out.
+func acceptsGzip(acceptEncoding string) bool {
+	gzipOK, starOK, named := false, false, false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		ok := true
+		if q, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); found {
+			f, err := strconv.ParseFloat(q, 64)
+			ok = err == nil && f > 0
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip":
+			gzipOK, named = ok, true
+		case "*":
+			starOK = ok
+		}
+	}
+	if named {
+		return gzipOK
+	}
+	return starOK
+}
+
+// gzipWriter compresses the response to the client, if the upstream
+// didn't, its media type is one of types and it's at least minSize bytes.
+// The status is held back until it knows the size, from the Content-Length
+// or by buffering up to minSize bytes, and Close must be called once the
+// response is written to send anything still held back.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	types   []string
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	gz          *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader, w.status = true, status
+	if !w.compressible() {
+		w.decide(false)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if n, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil {
+		w.decide(n >= w.minSize)
+	}
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) >= w.minSize {
+			if err := w.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// compressible reports whether the response may be compressed, whatever
+// its size.
+func (w *gzipWriter) compressible() bool {
+	switch {
+	case w.status < http.StatusOK, w.status == http.StatusNoContent, w.status == http.StatusPartialContent, w.status == http.StatusNotModified:
+		return false
+	case w.Header().Get("Content-Encoding") != "":
+		// The upstream already encoded it
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range w.types {
+		if matchesContentType(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide sends the status, compressing what follows or not, then anything
+// buffered.
+func (w *gzipWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	_, err := w.Write(buf)
+	return err
+}
+
+// Close sends anything held back, finishing the compressed stream.
+func (w *gzipWriter) Close() error {
+	if !w.wroteHeader {
+		return nil
+	}
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+	return err
+}
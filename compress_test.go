@@ -0,0 +1,109 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                        false,
+		"gzip":                    true,
+		"deflate, gzip;q=0.5":     true,
+		"br;q=1.0, GZIP; q=0.8":   true,
+		"gzip;q=0":                false,
+		"*":                       true,
+		"*, gzip;q=0":             false,
+		"deflate, br, identity":   false,
+		"identity;q=1, *;q=0.001": true,
+	} {
+		if got := acceptsGzip(header); got != expected {
+			t.Errorf("%q: expected %t, got %t", header, expected, got)
+		}
+	}
+}
+
+func TestCompressResponses(t *testing.T) {
+	// GIVEN responses are compressed from 1KB
+	cfg := testConfig()
+	cfg.CompressResponses = true
+	cfg.CompressMinBytes = 1024
+	cfg.CompressTypes = defaultCompressTypes
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		large := `{"results": "` + strings.Repeat("x", 2048) + `"}`
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/large":
+				rr.Header().Set("Content-Type", "application/fhir+json")
+				_, _ = rr.Write([]byte(large))
+			case "/streamed":
+				rr.Header().Set("Content-Type", "application/json")
+				for range 4 {
+					_, _ = rr.Write([]byte(large[:512]))
+					rr.(http.Flusher).Flush()
+				}
+			case "/small":
+				rr.Header().Set("Content-Type", "application/json")
+				_, _ = rr.Write([]byte(`{}`))
+			case "/image":
+				rr.Header().Set("Content-Type", "image/png")
+				_, _ = rr.Write([]byte(large))
+			case "/encoded":
+				rr.Header().Set("Content-Type", "application/json")
+				rr.Header().Set("Content-Encoding", "br")
+				_, _ = rr.Write([]byte(large))
+			}
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "records", Callback: srv.URL}, t)
+		// Without the transport's own decompression, to see what's sent
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+		for path, compressed := range map[string]bool{"/large": true, "/streamed": true, "/small": false, "/image": false, "/encoded": false} {
+			// WHEN a client which accepts gzip asks for it
+			req, _ := http.NewRequest("POST", url+path, strings.NewReader("{}"))
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body io.Reader = resp.Body
+			if compressed {
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatalf("%s: %v", path, err)
+				}
+				body = gz
+			}
+			b, err := io.ReadAll(body)
+			_ = resp.Body.Close()
+
+			// THEN only large enough, unencoded text responses are compressed
+			if got := resp.Header.Get("Content-Encoding") == "gzip"; got != compressed || err != nil {
+				t.Errorf("%s: expected compressed %t, got %q, %v", path, compressed, resp.Header.Get("Content-Encoding"), err)
+			}
+			expected := large
+			if path == "/streamed" {
+				expected = strings.Repeat(large[:512], 4)
+			}
+			if compressed && string(b) != expected {
+				t.Errorf("%s: expected the whole response, got %d bytes", path, len(b))
+			}
+		}
+
+		// AND clients which don't accept gzip get the response as it was
+		resp, err := client.Post(url+"/large", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.Header.Get("Content-Encoding") != "" || string(b) != large {
+			t.Errorf("expected an uncompressed response, got %q", resp.Header.Get("Content-Encoding"))
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile sets the flags in fs from a YAML file of flag names and
+// their values, skipping those set on the command line so that they can
+// override the file. Flags which may be repeated take a list:
+//
+//	mode: failover
+//	storage-location: s3://registry/prod.json
+//	listener:
+//	  - addr=:8443,cert=tls.crt,key=tls.key
+//	  - addr=:9443,acme
+//
+// Values are scalars or lists of them, as flags have nothing nested.
+func loadConfigFile(path string, fs *flag.FlagSet) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var doc yaml.Node
+	if err := yaml.NewDecoder(f).Decode(&doc); errors.Is(err, io.EOF) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	values, err := configValues(&doc)
+	if err != nil {
+		return fmt.Errorf("%s:%w", path, err)
+	}
+	for _, v := range values {
+		if v.name == "config" || fs.Lookup(v.name) == nil {
+			return fmt.Errorf("%s:%d: unknown flag %s", path, v.line, v.name)
+		}
+		if set[v.name] {
+			continue
+		}
+		for _, item := range v.items {
+			if err := fs.Set(v.name, item); err != nil {
+				return fmt.Errorf("%s:%d: invalid value %q for %s: %w", path, v.line, item, v.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValue is a flag's values in a config file.
+type configValue struct {
+	name  string
+	line  int
+	items []string
+}
+
+// configValues reads the flags from a config file's document, in the order
+// they're given. Errors start with the line they're on.
+func configValues(doc *yaml.Node) ([]configValue, error) {
+	root := doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) == 1 {
+		root = root.Content[0]
+	}
+	if root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+		return nil, nil
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%d: expected flag names and their values", root.Line)
+	}
+	var values []configValue
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		v := configValue{name: key.Value, line: key.Line}
+		switch value.Kind {
+		case yaml.ScalarNode:
+			if value.Tag != "!!null" {
+				v.items = []string{value.Value}
+			}
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("%d: %s takes a list of values, not nested ones", item.Line, v.name)
+				}
+				v.items = append(v.items, item.Value)
+			}
+		default:
+			return nil, fmt.Errorf("%d: %s takes a value or a list of them, not nested ones", value.Line, v.name)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
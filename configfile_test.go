@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	// GIVEN flags, one of them given on the command line
+	fs := flag.NewFlagSet("regproxy", flag.ContinueOnError)
+	mode := fs.String("mode", "fanout", "")
+	port := fs.Int("port", 9876, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	page := fs.String("maintenance-page", "", "")
+	var listeners, peers []string
+	fs.Func("listener", "", func(s string) error {
+		listeners = append(listeners, s)
+		return nil
+	})
+	fs.Func("gossip-peers", "", func(s string) error {
+		peers = append(peers, s)
+		return nil
+	})
+	if err := fs.Parse([]string{"-port", "8080"}); err != nil {
+		t.Fatal(err)
+	}
+	// AND a config file setting them
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := `# regproxy
+mode: failover   # deliver to one at a time
+port: 9000
+dry-run: true
+maintenance-page: "/srv/back soon#1.html"
+listener:
+  - addr=:8443,cert=tls.crt,key=tls.key
+  - 'addr=:9443,acme'
+gossip-peers: [http://a:9876, http://b:9876]
+`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN
+	if err := loadConfigFile(path, fs); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN the file's values are set, unless given on the command line
+	if *mode != "failover" || *port != 8080 || !*dryRun || *page != "/srv/back soon#1.html" {
+		t.Errorf("unexpected values mode %s port %d dry-run %v page %s", *mode, *port, *dryRun, *page)
+	}
+	if !reflect.DeepEqual(listeners, []string{"addr=:8443,cert=tls.crt,key=tls.key", "addr=:9443,acme"}) {
+		t.Errorf("unexpected listeners %q", listeners)
+	}
+	if !reflect.DeepEqual(peers, []string{"http://a:9876", "http://b:9876"}) {
+		t.Errorf("unexpected peers %q", peers)
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"unknown flag":  "mode: fanout\nmodes: failover\n",
+		"invalid value": "port: lots\n",
+		"nested":        "storage:\n  location: s3://registry\n",
+		"stray item":    "- fanout\n",
+		"nested list":   "mode:\n  - [fanout, failover]\n",
+		"malformed":     "mode: [fanout\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			// GIVEN
+			fs := flag.NewFlagSet("regproxy", flag.ContinueOnError)
+			fs.String("mode", "fanout", "")
+			fs.Int("port", 9876, "")
+			fs.String("storage", "", "")
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			// WHEN
+			err := loadConfigFile(path, fs)
+
+			// THEN it's refused, saying where
+			if err == nil || !strings.Contains(err.Error(), path+":") {
+				t.Errorf("expected an error locating the problem, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// connUpstreamKey carries the name of the upstream a call is for to the
+// transport's dialer.
+type connUpstreamKey struct{}
+
+// connCounts are the transport's connections to an upstream, for tuning
+// -client-max-idle-conns: many new connections against few reused ones
+// means the idle pool is too small.
+type connCounts struct {
+	Open           int     `json:"open"`
+	Idle           int     `json:"idle"`
+	Reused         int64   `json:"reused"`
+	New            int64   `json:"new"`
+	DialErrors     int64   `json:"dialErrors"`
+	TLSHandshakes  int64   `json:"tlsHandshakes"`
+	TLSHandshakeMs float64 `json:"tlsHandshakeMs"`
+}
+
+// connStats tracks the connections the transport holds to each upstream.
+// Connections belong to the upstream whose call dialed them, though one
+// registered at the same host may go on to reuse them.
+type connStats struct {
+	acquired      *counterVec
+	dialErrors    *counterVec
+	handshakes    *counterVec
+	handshakeTime *counterVec
+
+	mu   sync.Mutex
+	open map[string]int
+	idle map[string]int
+}
+
+func newConnStats(m *proxyMetrics) *connStats {
+	return &connStats{
+		acquired:      m.connsAcquired,
+		dialErrors:    m.dialErrors,
+		handshakes:    m.tlsHandshakes,
+		handshakeTime: m.tlsHandshakeTime,
+		open:          make(map[string]int),
+		idle:          make(map[string]int),
+	}
+}
+
+// trackedConn is a connection dialed for an upstream, which leaves the
+// counts when it's closed.
+type trackedConn struct {
+	net.Conn
+	stats    *connStats
+	upstream string
+	// idle and closed are guarded by stats.mu
+	idle   bool
+	closed bool
+}
+
+func (c *trackedConn) Close() error {
+	c.stats.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.stats.open[c.upstream]--
+		if c.idle {
+			c.stats.idle[c.upstream]--
+		}
+	}
+	c.stats.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// setIdle moves conn into or out of the idle counts.
+func (s *connStats) setIdle(conn *trackedConn, idle bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn.closed || conn.idle == idle {
+		return
+	}
+	conn.idle = idle
+	if idle {
+		s.idle[conn.upstream]++
+	} else {
+		s.idle[conn.upstream]--
+	}
+}
+
+// dial wraps the transport's dialer to count the connections dialed for
+// each upstream, and the dials which failed.
+func (s *connStats) dial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		name, _ := ctx.Value(connUpstreamKey{}).(string)
+		conn, err := dial(ctx, network, addr)
+		if name == "" {
+			return conn, err
+		}
+		if err != nil {
+			// Not if the call was given up on
+			if ctx.Err() == nil {
+				s.dialErrors.inc(name)
+			}
+			return nil, err
+		}
+		s.mu.Lock()
+		s.open[name]++
+		s.mu.Unlock()
+		return &trackedConn{Conn: conn, stats: s, upstream: name}, nil
+	}
+}
+
+// trace returns ctx for a call to upstream, tracing the connection it's
+// made over.
+func (s *connStats) trace(ctx context.Context, upstream string) context.Context {
+	var conn *trackedConn
+	var handshakeStart time.Time
+	ctx = context.WithValue(ctx, connUpstreamKey{}, upstream)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.acquired.inc(upstream, strconv.FormatBool(info.Reused))
+			c := info.Conn
+			if tc, ok := c.(*tls.Conn); ok {
+				c = tc.NetConn()
+			}
+			if conn, _ = c.(*trackedConn); conn != nil && info.WasIdle {
+				s.setIdle(conn, false)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if err == nil && conn != nil {
+				s.setIdle(conn, true)
+			}
+		},
+		TLSHandshakeStart: func() {
+			handshakeStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil && !handshakeStart.IsZero() {
+				s.handshakes.inc(upstream)
+				s.handshakeTime.add(time.Since(handshakeStart).Seconds(), upstream)
+			}
+		},
+	})
+}
+
+// openGauge reports the open connections to each upstream.
+func (s *connStats) openGauge() map[string]float64 {
+	return s.gauge(s.open)
+}
+
+// idleGauge reports the idle connections to each upstream.
+func (s *connStats) idleGauge() map[string]float64 {
+	return s.gauge(s.idle)
+}
+
+func (s *connStats) gauge(counts map[string]int) map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string]float64, len(counts))
+	for name, n := range counts {
+		values[labelKey([]string{name})] = float64(n)
+	}
+	return values
+}
+
+// counts reports the connections to each upstream which has had any.
+func (s *connStats) counts() map[string]connCounts {
+	stats := make(map[string]connCounts)
+	s.mu.Lock()
+	for name, n := range s.open {
+		c := stats[name]
+		c.Open, c.Idle = n, s.idle[name]
+		stats[name] = c
+	}
+	s.mu.Unlock()
+	s.acquired.visit(func(_, _, _ string, _, values []string, value float64) {
+		c := stats[values[0]]
+		if values[1] == "true" {
+			c.Reused += int64(value)
+		} else {
+			c.New += int64(value)
+		}
+		stats[values[0]] = c
+	})
+	s.dialErrors.visit(func(_, _, _ string, _, values []string, value float64) {
+		c := stats[values[0]]
+		c.DialErrors = int64(value)
+		stats[values[0]] = c
+	})
+	s.handshakes.visit(func(_, _, _ string, _, values []string, value float64) {
+		c := stats[values[0]]
+		c.TLSHandshakes = int64(value)
+		stats[values[0]] = c
+	})
+	s.handshakeTime.visit(func(_, _, _ string, _, values []string, value float64) {
+		c := stats[values[0]]
+		if c.TLSHandshakes > 0 {
+			c.TLSHandshakeMs = value * 1000 / float64(c.TLSHandshakes)
+		}
+		stats[values[0]] = c
+	})
+	return stats
+}
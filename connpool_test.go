@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnStats(t *testing.T) {
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN an upstream over TLS
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			_, _ = rr.Write([]byte(`{"ok":true}`))
+		}))
+		defer srv.Close()
+		rp.client.Transport.(*http.Transport).TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+		register(url, upstream{Name: "billing", Callback: srv.URL}, t)
+
+		// WHEN two requests are sent, one after the other
+		for range 2 {
+			resp, err := http.Post(url+"/invoices", "application/json", strings.NewReader(`{}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			// Once the connection is back in the pool
+			for deadline := time.Now().Add(time.Second); rp.conns.counts()["billing"].Idle == 0 && time.Now().Before(deadline); {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+
+		// THEN the first connection was reused for the second request, and
+		// is still open and idle
+		c := rp.conns.counts()["billing"]
+		if c.Open != 1 || c.Idle != 1 || c.New != 1 || c.Reused != 1 {
+			t.Errorf("expected one connection, reused, got %+v", c)
+		}
+		// AND its TLS handshake was timed
+		if c.TLSHandshakes != 1 || c.TLSHandshakeMs <= 0 {
+			t.Errorf("expected a timed TLS handshake, got %+v", c)
+		}
+	})
+}
+
+func TestConnStatsDialErrors(t *testing.T) {
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN an upstream which can't be dialed
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+		register(url, upstream{Name: "gone", Callback: closed.URL}, t)
+
+		// WHEN a request is sent
+		resp, err := http.Post(url+"/invoices", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN the failed dial is counted
+		if n := rp.metrics.dialErrors.value("gone"); n != 1 {
+			t.Errorf("expected 1 dial error, got %v", n)
+		}
+		if c := rp.conns.counts()["gone"]; c.Open != 0 || c.DialErrors != 1 {
+			t.Errorf("expected no connections and a dial error, got %+v", c)
+		}
+	})
+}
+
+func TestConnStatsClosed(t *testing.T) {
+	// GIVEN a connection counted as idle
+	s := newConnStats(newProxyMetrics())
+	server, client := net.Pipe()
+	defer server.Close()
+	conn, err := s.dial(func(_ context.Context, _, _ string) (net.Conn, error) {
+		return client, nil
+	})(context.WithValue(context.Background(), connUpstreamKey{}, "billing"), "tcp", "billing:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setIdle(conn.(*trackedConn), true)
+
+	// WHEN it's closed, more than once
+	_ = conn.Close()
+	_ = conn.Close()
+
+	// THEN it's no longer counted
+	if c := s.counts()["billing"]; c.Open != 0 || c.Idle != 0 {
+		t.Errorf("expected no connections, got %+v", c)
+	}
+}
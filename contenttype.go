@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// validateContentTypes checks an upstream's content types are media types,
+// type/subtype, where either may be *.
+func validateContentTypes(types []string) error {
+	for _, t := range types {
+		mt, _, err := mime.ParseMediaType(t)
+		if typ, sub, ok := strings.Cut(mt, "/"); err != nil || !ok || typ == "" || sub == "" || typ == "*" && sub != "*" {
+			return fmt.Errorf("invalid content type [%s], expected e.g. application/fhir+json or application/*", t)
+		}
+	}
+	return nil
+}
+
+// matchesContentType reports whether a media type matches one accepted,
+// which may be a wildcard such as application/*, */*, or application/*+json
+// for any with a structured syntax suffix.
+func matchesContentType(accepts string, mediaType string) bool {
+	accepts, _, _ = mime.ParseMediaType(accepts)
+	if accepts == "*/*" || accepts == mediaType {
+		return true
+	}
+	typ, sub, _ := strings.Cut(accepts, "/")
+	mtyp, msub, _ := strings.Cut(mediaType, "/")
+	if suffix, ok := strings.CutPrefix(sub, "*+"); ok {
+		return typ == mtyp && strings.HasSuffix(msub, "+"+suffix)
+	}
+	return sub == "*" && typ == mtyp
+}
+
+// forContentType leaves out the upstreams registered with content types
+// which don't include the request's, e.g. sending FHIR and HL7v2 messages
+// on to different systems. Requests without a Content-Type only go to
+// upstreams accepting any. It returns how many upstreams were left out.
+func forContentType(req *http.Request, upstreams map[string]upstream) int {
+	n := 0
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	for name, ups := range upstreams {
+		if len(ups.ContentTypes) == 0 {
+			continue
+		}
+		matched := false
+		for _, t := range ups.ContentTypes {
+			matched = matched || mediaType != "" && matchesContentType(t, mediaType)
+		}
+		if !matched {
+			delete(upstreams, name)
+			n++
+		}
+	}
+	return n
+}
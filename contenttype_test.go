@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMatchesContentType(t *testing.T) {
+	for _, c := range []struct {
+		accepts, mediaType string
+		expected           bool
+	}{
+		{"application/fhir+json", "application/fhir+json", true},
+		{"application/FHIR+json; fhirVersion=4.0", "application/fhir+json", true},
+		{"application/*", "application/hl7-v2", true},
+		{"*/*", "text/plain", true},
+		{"application/fhir+json", "application/json", false},
+		{"application/*", "text/plain", false},
+		{"application/*+json", "application/fhir+json", true},
+		{"application/*+json", "application/json", false},
+	} {
+		if got := matchesContentType(c.accepts, c.mediaType); got != c.expected {
+			t.Errorf("%s accepting %s: expected %t, got %t", c.accepts, c.mediaType, c.expected, got)
+		}
+	}
+}
+
+func TestValidateContentTypes(t *testing.T) {
+	if err := validateContentTypes([]string{"application/fhir+json", "application/*", "*/*"}); err != nil {
+		t.Error(err)
+	}
+	for _, ct := range []string{"fhir", "*/json", "application/", ""} {
+		if validateContentTypes([]string{ct}) == nil {
+			t.Errorf("expected %q to be rejected", ct)
+		}
+	}
+}
+
+func TestContentTypeRouting(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN one upstream for FHIR, one for HL7v2 and one for everything
+		called := make(chan string, 3)
+		for _, u := range []upstream{
+			{Name: "fhir", ContentTypes: []string{"application/fhir+json"}},
+			{Name: "hl7", ContentTypes: []string{"x-application/hl7-v2+er7"}},
+			{Name: "archive"},
+		} {
+			name := u.Name
+			srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+				called <- name
+			}))
+			defer srv.Close()
+			u.Callback = srv.URL
+			register(url, u, t)
+		}
+		post := func(contentType string) int {
+			resp, err := http.Post(url+"/messages", contentType, strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		// WHEN a FHIR resource is sent
+		if status := post("application/fhir+json; charset=utf-8"); status != http.StatusOK {
+			t.Errorf("expected 200, got %v", status)
+		}
+
+		// THEN it only goes to the FHIR upstream and the catch-all
+		got := map[string]bool{<-called: true, <-called: true}
+		if !got["fhir"] || !got["archive"] || len(called) > 0 {
+			t.Errorf("expected fhir and archive to be called, got %v", got)
+		}
+	})
+}
+
+func TestContentTypeRoutingUnsupported(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN only an upstream for FHIR
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {}))
+		defer srv.Close()
+		register(url, upstream{Name: "fhir", Callback: srv.URL, ContentTypes: []string{"application/fhir+json"}}, t)
+
+		// WHEN something else is sent
+		resp, err := http.Post(url+"/messages", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it's refused
+		if resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("expected 415, got %v", resp.StatusCode)
+		}
+	})
+}
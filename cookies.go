@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Policies for the cookies of requests sent to an upstream
+const (
+	cookiesPass      = "pass"
+	cookiesStrip     = "strip"
+	cookiesAllowlist = "allowlist"
+)
+
+func validateCookiePolicy(u upstream) error {
+	switch u.CookiePolicy {
+	case "", cookiesPass, cookiesStrip, cookiesAllowlist:
+	default:
+		return fmt.Errorf("unknown cookiePolicy [%s], expected %s, %s or %s", u.CookiePolicy, cookiesPass, cookiesStrip, cookiesAllowlist)
+	}
+	if len(u.AllowCookies) > 0 && u.CookiePolicy != cookiesAllowlist {
+		return fmt.Errorf("allowCookies is only used with cookiePolicy %s", cookiesAllowlist)
+	}
+	return nil
+}
+
+// withCookiePolicy returns req as ups should see it, without the cookies
+// its policy doesn't let through, so that client sessions don't leak to
+// upstreams such as shadows which have no need of them.
+func withCookiePolicy(req *http.Request, ups upstream) *http.Request {
+	if ups.CookiePolicy == "" || ups.CookiePolicy == cookiesPass || req.Header.Get("Cookie") == "" {
+		return req
+	}
+	var allowed []string
+	if ups.CookiePolicy == cookiesAllowlist {
+		for _, c := range req.Cookies() {
+			if slices.Contains(ups.AllowCookies, c.Name) {
+				allowed = append(allowed, c.String())
+			}
+		}
+	}
+	req = req.Clone(req.Context())
+	req.Header.Del("Cookie")
+	if len(allowed) > 0 {
+		req.Header.Set("Cookie", strings.Join(allowed, "; "))
+	}
+	return req
+}
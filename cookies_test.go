@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCookiePolicies(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN
+		var mu sync.Mutex
+		got := make(map[string]string)
+		for _, ups := range []upstream{
+			{Name: "pass"},
+			{Name: "strip", CookiePolicy: cookiesStrip},
+			{Name: "allowlist", CookiePolicy: cookiesAllowlist, AllowCookies: []string{"locale"}},
+		} {
+			name := ups.Name
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				got[name] = r.Header.Get("Cookie")
+			}))
+			defer srv.Close()
+			ups.Callback = srv.URL
+			register(url, ups, t)
+		}
+
+		// WHEN
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Cookie", "session=abc; locale=en")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN
+		want := map[string]string{"pass": "session=abc; locale=en", "strip": "", "allowlist": "locale=en"}
+		for name, cookie := range want {
+			if got[name] != cookie {
+				t.Errorf("%s: expected cookies %q, got %q", name, cookie, got[name])
+			}
+		}
+	})
+}
+
+func TestCookiePolicyValidation(t *testing.T) {
+	if err := validateUpstream(upstream{Name: "a", Callback: "http://h", CookiePolicy: "eat"}); err == nil {
+		t.Error("expected an unknown cookie policy to be rejected")
+	}
+	if err := validateUpstream(upstream{Name: "a", Callback: "http://h", AllowCookies: []string{"x"}}); err == nil {
+		t.Error("expected allowCookies without the allowlist policy to be rejected")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// timeoutHeader is how long a client will wait for its response, a duration
+// such as 2s or a number of milliseconds
+const timeoutHeader = "X-Regproxy-Timeout"
+
+// shedDeadline is the reason a request is shed when its upstreams are
+// unlikely to answer before the client gives up
+const shedDeadline = "deadline"
+
+// deadlineMinSamples is how many recent calls an upstream needs before its
+// latency is trusted to shed requests
+const deadlineMinSamples = 10
+
+// deadlines estimates how long a request's upstream calls will take from
+// the median latency of recent calls to each upstream, so a request whose
+// client will have given up by then is failed fast rather than adding load
+// to upstreams which are already slow. A nil deadlines sheds nothing.
+type deadlines struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	upstreams map[string]*upstreamLatency
+}
+
+func newDeadlines(cfg Config) *deadlines {
+	if cfg.DeadlineWindow <= 0 {
+		return nil
+	}
+	return &deadlines{window: cfg.DeadlineWindow, upstreams: make(map[string]*upstreamLatency)}
+}
+
+func (d *deadlines) observe(name string, took time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u := d.upstreams[name]
+	if u == nil {
+		u = &upstreamLatency{}
+		d.upstreams[name] = u
+	}
+	u.samples[u.next] = latencySample{at: time.Now(), took: took}
+	u.next = (u.next + 1) % latencySamples
+}
+
+// latency returns the median latency of ups over the window, if there have
+// been enough calls to it to go on.
+func (d *deadlines) latency(ups string, now time.Time) (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u := d.upstreams[ups]
+	if u == nil {
+		return 0, false
+	}
+	took, n := u.quantile(now.Add(-d.window), 50)
+	return took, n >= deadlineMinSamples
+}
+
+// estimate returns how long mode will take to answer from upstreams: the
+// slowest upstream when it waits for them all, every upstream in turn when
+// it calls them one at a time, or the quickest when a single answer may do.
+// Upstreams without enough recent calls are left out, and it returns false
+// if there are none to go on.
+func (d *deadlines) estimate(mode, respond string, upstreams map[string]upstream, now time.Time) (time.Duration, bool) {
+	var total, slowest, quickest time.Duration
+	known := 0
+	for _, ups := range upstreams {
+		took, ok := d.latency(ups.Name, now)
+		if !ok {
+			continue
+		}
+		if known == 0 || took < quickest {
+			quickest = took
+		}
+		slowest = max(slowest, took)
+		total += took
+		known++
+	}
+	if known == 0 {
+		return 0, false
+	}
+	switch {
+	case mode == modeSequential:
+		return total, true
+	case mode == modeCompare, mode == modeFanOut && respond == fanOutWaitAll:
+		return slowest, true
+	default:
+		return quickest, true
+	}
+}
+
+// parseTimeout parses a timeoutHeader value, a duration or a number of
+// milliseconds.
+func parseTimeout(v string) (time.Duration, bool) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, ms > 0
+	}
+	d, err := time.ParseDuration(v)
+	return d, err == nil && d > 0
+}
+
+// doomed reports whether req's upstreams are unlikely to answer before its
+// client's timeout, counted from when the request arrived, runs out. Queued
+// requests are answered straight away, so are never doomed.
+func (p *RegProxy) doomed(req *http.Request, mode string, upstreams map[string]upstream, arrived time.Time) bool {
+	if p.deadlines == nil || mode == modeQueue {
+		return false
+	}
+	timeout, ok := parseTimeout(req.Header.Get(timeoutHeader))
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	estimate, ok := p.deadlines.estimate(mode, p.cfg.FanOutRespond, upstreams, now)
+	return ok && estimate > timeout-now.Sub(arrived)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadlineEstimate(t *testing.T) {
+	// GIVEN two upstreams with recent calls, one quicker than the other, and
+	// one without
+	d := newDeadlines(Config{DeadlineWindow: time.Minute})
+	for range deadlineMinSamples {
+		d.observe("quick", 10*time.Millisecond)
+		d.observe("slow", 30*time.Millisecond)
+	}
+	d.observe("new", time.Hour)
+	upstreams := map[string]upstream{"quick": {Name: "quick"}, "slow": {Name: "slow"}, "new": {Name: "new"}}
+
+	// WHEN the time to answer is estimated, THEN it depends on the mode
+	for _, c := range []struct {
+		mode, respond string
+		expected      time.Duration
+	}{
+		{modeFanOut, fanOutWaitAll, 30 * time.Millisecond},
+		{modeFanOut, fanOutEarly, 10 * time.Millisecond},
+		{modeCompare, fanOutWaitAll, 30 * time.Millisecond},
+		{modeSequential, fanOutWaitAll, 40 * time.Millisecond},
+		{modeFailover, fanOutWaitAll, 10 * time.Millisecond},
+	} {
+		if got, ok := d.estimate(c.mode, c.respond, upstreams, time.Now()); !ok || got != c.expected {
+			t.Errorf("%s/%s: expected %v, got %v %t", c.mode, c.respond, c.expected, got, ok)
+		}
+	}
+	// AND there's no estimate without enough calls
+	if _, ok := d.estimate(modeFanOut, fanOutWaitAll, map[string]upstream{"new": upstreams["new"]}, time.Now()); ok {
+		t.Error("expected no estimate for an upstream without enough calls")
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for v, expected := range map[string]time.Duration{"1500": 1500 * time.Millisecond, "2s": 2 * time.Second, "": 0, "0": 0, "-1s": 0, "soon": 0} {
+		if got, ok := parseTimeout(v); got != expected && ok || ok != (expected > 0) {
+			t.Errorf("%q: expected %v, got %v %t", v, expected, got, ok)
+		}
+	}
+}
+
+func TestDeadlineShedding(t *testing.T) {
+	cfg := testConfig()
+	cfg.DeadlineWindow = time.Minute
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN an upstream which has been taking 50ms to answer
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "slow", Callback: srv.URL}, t)
+		post := func(timeout string) int {
+			req, _ := http.NewRequest("POST", url+"/orders", strings.NewReader("{}"))
+			if timeout != "" {
+				req.Header.Set(timeoutHeader, timeout)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			return resp.StatusCode
+		}
+		for range deadlineMinSamples {
+			post("")
+		}
+
+		// WHEN a client will only wait 10ms, THEN it's failed fast
+		if status := post("10ms"); status != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %v", status)
+		}
+		if n := rp.metrics.shedRequests.value(shedDeadline); n != 1 {
+			t.Errorf("expected 1 request shed, got %v", n)
+		}
+		// AND a client which will wait long enough is answered
+		if status := post("1s"); status != http.StatusOK {
+			t.Errorf("expected 200, got %v", status)
+		}
+	})
+}
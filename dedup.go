@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// duplicateHeader marks the response standing in for a call to an upstream
+// which was skipped, having had the same request within its window
+const duplicateHeader = "X-Regproxy-Duplicate"
+
+// maxDedupEntries bounds the requests remembered for each upstream, the
+// oldest being forgotten first
+const maxDedupEntries = 100000
+
+// dedupClaim is a request being, or having been, delivered to an upstream,
+// remembered until expires. done is closed once the delivery's outcome is
+// known, and the claim is only kept if it succeeded.
+type dedupClaim struct {
+	expires time.Time
+	done    chan struct{}
+}
+
+// dedupEntry is a claim in the order they were made.
+type dedupEntry struct {
+	key   string
+	claim *dedupClaim
+}
+
+// upstreamDedup remembers the requests recently delivered to an upstream,
+// oldest first.
+type upstreamDedup struct {
+	seen  map[string]*dedupClaim
+	order []dedupEntry
+}
+
+// dedup skips delivering a request to an upstream registered with a
+// dedupWindowMs if the same request, by method, path, query and body, from
+// the same caller, was delivered to it within the window, protecting
+// consumers from retry storms by senders which don't send idempotency keys.
+// A repeat arriving while the first is still being delivered waits to see
+// whether it succeeds. Requests are remembered by this instance only.
+type dedup struct {
+	suppressed   *counterVec
+	tenantHeader string
+
+	mu        sync.Mutex
+	upstreams map[string]*upstreamDedup
+}
+
+func newDedup(suppressed *counterVec, tenantHeader string) *dedup {
+	return &dedup{suppressed: suppressed, tenantHeader: tenantHeader, upstreams: make(map[string]*upstreamDedup)}
+}
+
+// requestKey hashes what makes a request the same as another: what it asks
+// for, and who's asking, so that one caller's request is never taken for
+// another's.
+func (d *dedup) requestKey(req *http.Request, body *requestBody) string {
+	h := sha256.New()
+	var clientCert string
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		clientCert = req.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	for _, s := range []string{req.Header.Get(d.tenantHeader), req.Header.Get("Authorization"), clientCert, req.Method, req.URL.RequestURI()} {
+		// Length prefixed, so that no two callers' fields run into the same
+		_, _ = fmt.Fprintf(h, "%d:%s\n", len(s), s)
+	}
+	r := body.reader()
+	_, _ = io.Copy(h, r)
+	_ = r.Close()
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// claim claims key for delivery to ups, remembering it for the upstream's
+// window. If it's already being delivered it returns that claim to wait for
+// instead, as the delivery may yet fail, and if it has been it returns
+// neither, the request being a duplicate. A delivery which fails is
+// forgotten when it's finished, so the sender's retry gets through.
+func (d *dedup) claim(ups upstream, key string, now time.Time) (mine, pending *dedupClaim) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u := d.upstreams[ups.Name]
+	if u == nil {
+		u = &upstreamDedup{seen: make(map[string]*dedupClaim)}
+		d.upstreams[ups.Name] = u
+	}
+	for len(u.order) > 0 && (!u.order[0].claim.expires.After(now) || len(u.order) > maxDedupEntries) {
+		// Unless it's since been claimed again
+		if e := u.order[0]; u.seen[e.key] == e.claim {
+			delete(u.seen, e.key)
+		}
+		u.order = u.order[1:]
+	}
+	if c, ok := u.seen[key]; ok && c.expires.After(now) {
+		select {
+		case <-c.done:
+			d.suppressed.inc(ups.Name)
+			return nil, nil
+		default:
+			return nil, c
+		}
+	}
+	c := &dedupClaim{expires: now.Add(time.Duration(ups.DedupWindowMs) * time.Millisecond), done: make(chan struct{})}
+	u.seen[key] = c
+	u.order = append(u.order, dedupEntry{key: key, claim: c})
+	return c, nil
+}
+
+// finish records the outcome of delivering c, forgetting it if it failed.
+func (d *dedup) finish(ups upstream, key string, c *dedupClaim, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if u := d.upstreams[ups.Name]; !ok && u != nil && u.seen[key] == c {
+		delete(u.seen, key)
+	}
+	close(c.done)
+}
+
+// checkDuplicate claims req for ups, returning the response to stand in for
+// the call if it's a duplicate, and otherwise a func to call with the
+// outcome of the delivery. While the same request is being delivered it
+// waits for the outcome, failing if req is given up on first.
+func (p *RegProxy) checkDuplicate(req *http.Request, body *requestBody, ups upstream) (*http.Response, func(*http.Response, error), error) {
+	if ups.DedupWindowMs <= 0 {
+		return nil, func(*http.Response, error) {}, nil
+	}
+	key := p.dedup.requestKey(req, body)
+	for {
+		mine, pending := p.dedup.claim(ups, key, time.Now())
+		switch {
+		case mine != nil:
+			return nil, func(resp *http.Response, err error) {
+				p.dedup.finish(ups, key, mine, resp != nil && p.ok(result{ups: ups, resp: resp, err: err}))
+			}, nil
+		case pending == nil:
+			resp := accepted(req)
+			resp.Header.Set(duplicateHeader, "1")
+			return resp, nil, nil
+		}
+		// Claim again once the delivery under way is done: the request is
+		// a duplicate if it succeeded, and ours to deliver if it failed
+		select {
+		case <-pending.done:
+		case <-req.Context().Done():
+			return nil, nil, req.Context().Err()
+		}
+	}
+}
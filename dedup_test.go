@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedupClaim(t *testing.T) {
+	// GIVEN an upstream with a one minute window
+	d := newDedup(newRegistry().counter("test_duplicates_total", "", "upstream"), "")
+	ups := upstream{Name: "ehr", DedupWindowMs: time.Minute.Milliseconds()}
+	now := time.Now()
+	delivered := func(key string, at time.Time) bool {
+		mine, _ := d.claim(ups, key, at)
+		if mine != nil {
+			d.finish(ups, key, mine, true)
+		}
+		return mine != nil
+	}
+
+	// WHEN the same request comes again within the window, THEN it's a duplicate
+	if !delivered("a", now) {
+		t.Fatal("expected the first request to be delivered")
+	}
+	if mine, pending := d.claim(ups, "a", now.Add(30*time.Second)); mine != nil || pending != nil {
+		t.Error("expected a repeat within the window to be suppressed")
+	}
+	// AND other requests, and other upstreams, aren't affected
+	if !delivered("b", now) {
+		t.Error("expected other requests to be delivered")
+	}
+	if mine, _ := d.claim(upstream{Name: "billing", DedupWindowMs: 1000}, "a", now); mine == nil {
+		t.Error("expected other upstreams to be delivered")
+	}
+	// AND once the window has passed it goes again
+	if !delivered("a", now.Add(2*time.Minute)) {
+		t.Error("expected a repeat after the window to be delivered")
+	}
+
+	// WHEN a request is being delivered, THEN a repeat has to wait for it
+	mine, _ := d.claim(ups, "c", now)
+	_, pending := d.claim(ups, "c", now)
+	if pending != mine {
+		t.Fatal("expected a repeat to wait for the delivery under way")
+	}
+	// AND if the delivery fails, the repeat goes
+	d.finish(ups, "c", mine, false)
+	<-pending.done
+	if !delivered("c", now.Add(time.Second)) {
+		t.Error("expected a failed request to be delivered again")
+	}
+}
+
+func TestDedupKeyCaller(t *testing.T) {
+	// GIVEN the same request from different callers
+	d := newDedup(nil, "X-Tenant")
+	body, err := readRequestBody(strings.NewReader(`{"id": 1}`), 1<<20, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	key := func(tenant, auth string) string {
+		req := httptest.NewRequest(http.MethodPost, "/results", nil)
+		req.Header.Set("X-Tenant", tenant)
+		req.Header.Set("Authorization", auth)
+		return d.requestKey(req, body)
+	}
+
+	// THEN their keys differ, unless they are the same caller
+	if key("a", "Bearer x") != key("a", "Bearer x") {
+		t.Error("expected the same caller to have the same key")
+	}
+	if key("a", "Bearer x") == key("b", "Bearer x") || key("a", "Bearer x") == key("a", "Bearer y") {
+		t.Error("expected different tenants and credentials to have different keys")
+	}
+}
+
+func TestDuplicateSuppression(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN an upstream which doesn't want the same request twice within a minute
+		var calls atomic.Int32
+		fail := atomic.Bool{}
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+			if fail.Load() {
+				rr.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "ehr", Callback: srv.URL, DedupWindowMs: time.Minute.Milliseconds()}, t)
+		post := func(body string) *http.Response {
+			resp, err := http.Post(url+"/results", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			return resp
+		}
+
+		// WHEN a sender retries the same request
+		post(`{"id": 1}`)
+		resp := post(`{"id": 1}`)
+
+		// THEN the upstream only gets it once, and the retry is told so
+		if calls.Load() != 1 {
+			t.Errorf("expected 1 call, got %d", calls.Load())
+		}
+		if resp.StatusCode != http.StatusAccepted || resp.Header.Get(duplicateHeader) != "1" {
+			t.Errorf("expected a 202 marked as a duplicate, got %v %v", resp.StatusCode, resp.Header)
+		}
+		// AND a different request, or a retry of one which failed, is delivered
+		post(`{"id": 2}`)
+		fail.Store(true)
+		post(`{"id": 3}`)
+		fail.Store(false)
+		post(`{"id": 3}`)
+		if calls.Load() != 4 {
+			t.Errorf("expected 4 calls, got %d", calls.Load())
+		}
+	})
+}
+
+func TestDuplicateWaitsForDelivery(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN an upstream which is slow to fail the first request
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			if calls.Add(1) == 1 {
+				time.Sleep(100 * time.Millisecond)
+				rr.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "ehr", Callback: srv.URL, DedupWindowMs: time.Minute.Milliseconds()}, t)
+
+		// WHEN the sender retries while the first is still being delivered
+		first := make(chan int)
+		go func() {
+			resp, err := http.Post(url+"/results", "application/json", strings.NewReader(`{"id": 1}`))
+			if err != nil {
+				first <- 0
+				return
+			}
+			_ = resp.Body.Close()
+			first <- resp.StatusCode
+		}()
+		time.Sleep(20 * time.Millisecond)
+		resp, err := http.Post(url+"/results", "application/json", strings.NewReader(`{"id": 1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN the retry isn't answered as a duplicate of a delivery which
+		// then failed, but delivered itself
+		if s := <-first; s != http.StatusServiceUnavailable {
+			t.Errorf("expected the first to fail, got %d", s)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get(duplicateHeader) != "" || calls.Load() != 2 {
+			t.Errorf("expected the retry delivered, got %d %v after %d calls", resp.StatusCode, resp.Header, calls.Load())
+		}
+	})
+}
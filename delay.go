@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// delayHeader asks for a request to be delivered later, after a duration
+// such as 90s or at an RFC 3339 time. Delayed requests are queued.
+const delayHeader = "X-Regproxy-Delay"
+
+// parseDelay returns when a request accepted at accepted asked to be
+// delivered, the zero time for straight away.
+func parseDelay(v string, accepted time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		if d < 0 {
+			return time.Time{}, errors.New("the delay can't be negative")
+		}
+		return accepted.Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("expected a duration such as 90s, or an RFC 3339 time")
+}
+
+// checkDelay checks the delay req asks for, if any, against the longest
+// allowed, reporting whether it's delayed.
+func (p *RegProxy) checkDelay(req *http.Request) (bool, error) {
+	now := time.Now()
+	due, err := parseDelay(req.Header.Get(delayHeader), now)
+	if err != nil || due.IsZero() {
+		return false, err
+	}
+	if p.cfg.MaxDelay > 0 && due.Sub(now) > p.cfg.MaxDelay {
+		return false, errors.New("the delay is longer than " + p.cfg.MaxDelay.String())
+	}
+	return true, nil
+}
+
+// dueAt returns when a request queued for ups is delivered: no earlier than
+// its caller asked, nor than the upstream's delay after it was accepted.
+func dueAt(req *http.Request, ups upstream, accepted time.Time) time.Time {
+	// The header was checked when the request was accepted
+	due, _ := parseDelay(req.Header.Get(delayHeader), accepted)
+	if byUpstream := accepted.Add(time.Duration(ups.DelayMs) * time.Millisecond); ups.DelayMs > 0 && byUpstream.After(due) {
+		due = byUpstream
+	}
+	return due
+}
+
+// validateDelay checks an upstream's delayMs can be honoured in mode, since
+// only queued requests are held back.
+func validateDelay(u upstream, mode string) error {
+	if u.DelayMs > 0 && mode != modeQueue {
+		return fmt.Errorf("delayMs needs -mode %s, requests aren't held back in %s mode", modeQueue, mode)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDelay(t *testing.T) {
+	accepted := time.Date(2026, 11, 2, 9, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		header   string
+		expected time.Time
+		invalid  bool
+	}{
+		{"", time.Time{}, false},
+		{"90s", accepted.Add(90 * time.Second), false},
+		{"2026-11-02T10:00:00Z", accepted.Add(time.Hour), false},
+		{"-5s", time.Time{}, true},
+		{"tomorrow", time.Time{}, true},
+	} {
+		due, err := parseDelay(c.header, accepted)
+		if (err != nil) != c.invalid || !due.Equal(c.expected) {
+			t.Errorf("%q: expected %v (invalid %t), got %v, %v", c.header, c.expected, c.invalid, due, err)
+		}
+	}
+}
+
+func TestDelayedDelivery(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN an upstream, in fan-out mode
+		called := make(chan time.Time, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			called <- time.Now()
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "legacy", Callback: srv.URL}, t)
+
+		// WHEN a request asks to be delayed
+		start := time.Now()
+		req, _ := http.NewRequest("POST", url+"/orders", strings.NewReader("{}"))
+		req.Header.Set(delayHeader, "300ms")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it's accepted straight away, and delivered once it's due
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("expected 202, got %v", resp.StatusCode)
+		}
+		select {
+		case at := <-called:
+			if at.Sub(start) < 300*time.Millisecond {
+				t.Errorf("expected delivery after 300ms, got %v", at.Sub(start))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the request to be delivered")
+		}
+
+		// AND a delay which can't be read is refused
+		req, _ = http.NewRequest("POST", url+"/orders", strings.NewReader("{}"))
+		req.Header.Set(delayHeader, "soon")
+		if resp, err = http.DefaultClient.Do(req); err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400, got %v", resp.StatusCode)
+		}
+	})
+}
+
+func TestUpstreamDelay(t *testing.T) {
+	// GIVEN queue mode, and an upstream which wants requests held back
+	cfg := testConfig()
+	cfg.Mode = modeQueue
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		called := make(chan string, 2)
+		for _, u := range []upstream{{Name: "fragile", DelayMs: 300}, {Name: "robust"}} {
+			name := u.Name
+			srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+				called <- name
+			}))
+			defer srv.Close()
+			u.Callback = srv.URL
+			register(url, u, t)
+		}
+
+		// WHEN a request is accepted
+		resp, err := http.Post(url+"/orders", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN only the fragile upstream's delivery is held back
+		var order []string
+		for range 2 {
+			select {
+			case name := <-called:
+				order = append(order, name)
+			case <-time.After(2 * time.Second):
+				t.Fatal("expected both upstreams to be called")
+			}
+		}
+		if strings.Join(order, ",") != "robust,fragile" {
+			t.Errorf("expected robust then fragile, got %v", order)
+		}
+	})
+}
+
+func TestDelayNeedsQueueing(t *testing.T) {
+	// GIVEN a mode which delivers to only one upstream
+	cfg := testConfig()
+	cfg.Mode = modeBalance
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		register(url, upstream{Name: "a", Callback: "http://a"}, t)
+
+		// WHEN a request asks to be delayed, THEN it's refused
+		req, _ := http.NewRequest("POST", url+"/orders", strings.NewReader("{}"))
+		req.Header.Set(delayHeader, "300ms")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400, got %v", resp.StatusCode)
+		}
+
+		// WHEN an upstream registers with a delay, THEN it's refused
+		if r := doJSON(t, "PUT", url+"/upstreams/b", `{"callback":"http://b","delayMs":300}`, nil); r.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400, got %v", r.StatusCode)
+		}
+	})
+}
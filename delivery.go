@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// callbackHeader lets the caller ask for a summary of the delivery to be
+// POSTed to a URL of their choosing once every upstream has finished.
+const callbackHeader = "X-Regproxy-Callback"
+
+// outcome is the result of delivering a request to a single upstream.
+type outcome struct {
+	Name string `json:"name"`
+	// Callback is only for the proxy's own reports, as it can carry
+	// internal hosts and credentials; see public
+	Callback   string `json:"callback,omitempty"`
+	Status     int    `json:"status,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	// publicError is Error as shown to clients
+	publicError string
+}
+
+// delivery records what happened to each upstream while handling a single
+// proxied request.
+type delivery struct {
+	started   time.Time
+	requestID string
+	// trace is the caller's trace context, passed on to upstreams
+	trace traceContext
+	// logBodies says whether the request was sampled for body logging
+	logBodies bool
+	// har says whether the request's upstream calls are captured for
+	// /admin/har
+	har bool
+	// dryRun says upstream calls are only logged and counted, not made
+	dryRun bool
+	// pending tracks upstream calls made in the background, which may still
+	// be running after the client has had its response
+	pending sync.WaitGroup
+
+	mu       sync.Mutex
+	outcomes []outcome
+}
+
+func withDelivery(ctx context.Context, d *delivery) context.Context {
+	return context.WithValue(ctx, deliveryKey, d)
+}
+
+func deliveryFrom(ctx context.Context) *delivery {
+	d, _ := ctx.Value(deliveryKey).(*delivery)
+	return d
+}
+
+func (d *delivery) record(ups upstream, resp *http.Response, err error, took time.Duration) {
+	if d == nil {
+		return
+	}
+	o := outcome{
+		Name:       ups.Name,
+		Callback:   ups.Callback,
+		DurationMs: took.Milliseconds(),
+	}
+	if err != nil {
+		o.Error, o.publicError = err.Error(), publicError(err)
+	} else {
+		o.Status = resp.StatusCode
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.outcomes = append(d.outcomes, o)
+}
+
+// public returns the outcome as shown to clients, without the upstream's
+// callback or where it is.
+func (o outcome) public() outcome {
+	o.Callback, o.Error = "", o.publicError
+	return o
+}
+
+// snapshot returns the outcomes recorded so far.
+func (d *delivery) snapshot() []outcome {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]outcome(nil), d.outcomes...)
+}
+
+// forwardAsync calls forward in the background, sending the result to results.
+// The delivery keeps track of the call until forward returns. Each call gets
+// its own context, so that it can be abandoned with the returned cancel func
+// once its answer is no longer needed; the cancel func must always be called.
+// results must be buffered with room for every call, so that none is left
+// blocked sending its result if the caller stops waiting.
+func (p *RegProxy) forwardAsync(req *http.Request, body *requestBody, ups upstream, results chan<- result) context.CancelFunc {
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+	d := deliveryFrom(ctx)
+	if d != nil {
+		d.pending.Add(1)
+	}
+	p.asyncCalls.Add(1)
+	go func() {
+		defer p.asyncCalls.Add(-1)
+		r, err := p.forward(req, body, ups)
+		if d != nil {
+			d.pending.Done()
+		}
+		results <- result{ups: ups, resp: r, err: err}
+	}()
+	return cancel
+}
+
+// callCancels holds the cancel funcs for a request's upstream calls, by
+// upstream name.
+type callCancels map[string]context.CancelFunc
+
+// cancelExcept abandons every call but the named one.
+func (c callCancels) cancelExcept(name string) {
+	for n, cancel := range c {
+		if n != name {
+			cancel()
+		}
+	}
+}
+
+func (c callCancels) cancelAll() {
+	c.cancelExcept("")
+}
+
+func validateResultCallback(callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an absolute http(s) URL", callbackHeader)
+	}
+	return nil
+}
+
+// blockedResultNetworks are special purpose ranges which aren't covered by
+// the net.IP predicates below, but aren't public either
+var blockedResultNetworks = mustParseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "64:ff9b::/96")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// publicIP reports whether ip is an address on the internet, rather than on
+// this host, a private network or link-local, such as a cloud metadata
+// service.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range blockedResultNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newResultClient returns the client result callbacks are sent with. As the
+// caller chooses where they go, it only connects to public addresses, or
+// those in allowed, checking the address dialled so that a name resolving
+// to an internal one is refused too. It doesn't follow redirects, and
+// shares nothing with the upstreams' transport, such as its proxy or client
+// certificate.
+func newResultClient(allowed []*net.IPNet, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("result callback to unresolved address %s", address)
+			}
+			if publicIP(ip) || slices.ContainsFunc(allowed, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+				return nil
+			}
+			return fmt.Errorf("result callback to %s refused, as it isn't a public address or in -result-callback-allow-networks", ip)
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: timeout,
+	}
+}
+
+// deliveryReport is the summary POSTed to the caller's result callback.
+type deliveryReport struct {
+	RequestID  string    `json:"requestId"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Started    time.Time `json:"started"`
+	DurationMs int64     `json:"durationMs"`
+	Upstreams  []outcome `json:"upstreams"`
+}
+
+func newDeliveryReport(req *http.Request, status int, d *delivery) deliveryReport {
+	return deliveryReport{
+		RequestID:  d.requestID,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Status:     status,
+		Started:    d.started,
+		DurationMs: time.Since(d.started).Milliseconds(),
+		Upstreams:  d.snapshot(),
+	}
+}
+
+// public returns the report as shown to clients, without the upstreams'
+// callbacks.
+func (r deliveryReport) public() deliveryReport {
+	upstreams := make([]outcome, len(r.Upstreams))
+	for i, o := range r.Upstreams {
+		upstreams[i] = o.public()
+	}
+	r.Upstreams = upstreams
+	return r
+}
+
+// sendResultCallback waits for every upstream call to finish, then POSTs a
+// summary of the delivery to callback. As the caller chooses callback, the
+// summary is only what a client may see, and is sent with a client which
+// only reaches public addresses.
+func (p *RegProxy) sendResultCallback(callback string, req *http.Request, status int, d *delivery) {
+	defer logPanic(p.metrics.panics, "result callback for "+req.URL.Path)
+	d.pending.Wait()
+	b, err := json.Marshal(newDeliveryReport(req, status, d).public())
+	if err != nil {
+		log.Printf("Failed to encode result callback for %s: %v", req.URL.Path, err)
+		return
+	}
+	r, err := p.results.Post(callback, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Printf("Failed to send result callback to %s: %v", callback, err)
+		return
+	}
+	_ = r.Body.Close()
+	if !isSuccess(r) {
+		log.Printf("Result callback to %s returned %d", callback, r.StatusCode)
+	}
+}
+
+// statusRecorder remembers the status code written to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResultCallback(t *testing.T) {
+	// the listener is on loopback, which result callbacks only reach when allowed
+	cfg := testConfig()
+	cfg.ResultCallbackAllowNetworks = mustParseCIDRs("127.0.0.0/8", "::1/128")
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN two upstreams, one failing, and a caller listening for results
+		ok := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			if req.Header.Get(callbackHeader) != "" {
+				t.Errorf("result callback header should not be forwarded")
+			}
+			rr.Write([]byte("ok"))
+		}))
+		failing := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.WriteHeader(500)
+		}))
+		defer ok.Close()
+		defer failing.Close()
+		register(url, upstream{Name: "ok", Callback: ok.URL}, t)
+		register(url, upstream{Name: "failing", Callback: failing.URL}, t)
+		reports := make(chan deliveryReport, 1)
+		listener := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			var report deliveryReport
+			if err := json.NewDecoder(req.Body).Decode(&report); err != nil {
+				t.Error(err)
+			}
+			reports <- report
+		}))
+		defer listener.Close()
+
+		// WHEN
+		req, _ := http.NewRequest("POST", url+"/hook", nil)
+		req.Header.Set(callbackHeader, listener.URL)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Body.Close()
+
+		// THEN a summary of every upstream arrives
+		select {
+		case report := <-reports:
+			if report.Path != "/hook" || report.Method != "POST" || report.Status != 500 {
+				t.Errorf("unexpected report %+v", report)
+			}
+			statuses := map[string]int{}
+			for _, o := range report.Upstreams {
+				statuses[o.Name] = o.Status
+				if o.Callback != "" {
+					t.Errorf("expected no callback URLs, got %+v", o)
+				}
+			}
+			if statuses["ok"] != 200 || statuses["failing"] != 500 {
+				t.Errorf("unexpected upstream outcomes %+v", report.Upstreams)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no result callback received")
+		}
+	})
+}
+
+func TestResultCallbackInvalid(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		register(url, upstream{Name: "foo", Callback: "http://localhost:1"}, t)
+		req, _ := http.NewRequest("POST", url+"/hook", nil)
+		req.Header.Set(callbackHeader, "not-a-url")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 400 {
+			t.Errorf("expected 400, got %v", r.StatusCode)
+		}
+	})
+}
+
+func TestResultClientRefusesInternalAddresses(t *testing.T) {
+	// GIVEN a listener on loopback
+	var requests int
+	listener := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+		requests++
+	}))
+	defer listener.Close()
+
+	for _, tc := range []struct {
+		name    string
+		allowed []*net.IPNet
+		url     string
+	}{
+		{"loopback", nil, listener.URL},
+		{"loopback by name", nil, "http://localhost:" + listener.URL[len("http://127.0.0.1:"):]},
+		{"metadata service", nil, "http://169.254.169.254/latest/meta-data/"},
+		{"private", nil, "http://10.0.0.1:1/"},
+		{"unspecified", nil, "http://0.0.0.0:1/"},
+		{"other network allowed", mustParseCIDRs("10.0.0.0/8"), listener.URL},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// WHEN a result is sent there
+			r, err := newResultClient(tc.allowed, time.Second).Post(tc.url, "application/json", nil)
+
+			// THEN it's refused before connecting
+			if err == nil {
+				_ = r.Body.Close()
+				t.Fatalf("expected %s to be refused", tc.url)
+			}
+		})
+	}
+	if requests != 0 {
+		t.Errorf("expected no requests to reach the listener, got %d", requests)
+	}
+}
+
+func TestResultClientDoesNotFollowRedirects(t *testing.T) {
+	// GIVEN an allowed listener redirecting elsewhere
+	var redirected bool
+	target := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+	listener := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer listener.Close()
+
+	// WHEN a result is sent to it
+	r, err := newResultClient(mustParseCIDRs("127.0.0.0/8"), time.Second).Post(listener.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Body.Close()
+
+	// THEN the redirect is returned rather than followed
+	if r.StatusCode != http.StatusTemporaryRedirect || redirected {
+		t.Errorf("expected the redirect not to be followed, got %d", r.StatusCode)
+	}
+}
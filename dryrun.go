@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// dryRunHeader asks for a single request to be dry run, as -dry-run does
+// for every request.
+const dryRunHeader = "X-Regproxy-Dry-Run"
+
+// dryRun logs and counts the call which would be made to ups, answering in
+// the upstream's place with a 202 marked with the dry run header. The URL
+// logged is where an HTTP upstream would be called, before any secrets in
+// its query are resolved.
+func (p *RegProxy) dryRun(req *http.Request, body *requestBody, ups upstream, callback *url.URL) *http.Response {
+	target := p.callTarget(req, ups, callback)
+	p.metrics.dryRunCalls.inc(ups.Name)
+	log.Printf("Dry run: would send %s %s (%d bytes) to upstream %s at %s", req.Method, req.URL.Path, body.size, ups.Name, target.Redacted())
+	resp := accepted(req)
+	resp.Header.Set(dryRunHeader, "1")
+	return resp
+}
+
+// callTarget returns where an HTTP upstream is called for req, or otherwise
+// its callback.
+func (p *RegProxy) callTarget(req *http.Request, ups upstream, callback *url.URL) *url.URL {
+	if callback.Scheme != "http" && callback.Scheme != "https" {
+		return callback
+	}
+	u := *req.URL
+	targetURL(&u, callback, ups, p.cfg.PathMode)
+	return &u
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDryRunHeader(t *testing.T) {
+	// GIVEN an upstream which sets a query parameter
+	logged := captureLog(t)
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "orders", Callback: srv.URL, Query: &queryRules{Set: map[string]string{"source": "proxy"}}}, t)
+
+		// WHEN a request is dry run
+		req, _ := http.NewRequest("POST", url+"/orders", strings.NewReader("{}"))
+		req.Header.Set(dryRunHeader, "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN where it would go is logged and counted, but nothing is sent
+		if resp.StatusCode != http.StatusAccepted || resp.Header.Get(dryRunHeader) != "1" {
+			t.Errorf("expected a dry run 202, got %v %v", resp.StatusCode, resp.Header)
+		}
+		if calls.Load() != 0 {
+			t.Errorf("expected no upstream calls, got %d", calls.Load())
+		}
+		want := "Dry run: would send POST /orders (2 bytes) to upstream orders at " + srv.URL + "/orders?source=proxy"
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("expected the log to contain %s, got %s", want, logged.String())
+		}
+		if n := rp.metrics.dryRunCalls.value("orders"); n != 1 {
+			t.Errorf("expected the dry run call to be counted, got %v", n)
+		}
+
+		// WHEN the next request isn't, THEN it is sent
+		resp, err = http.Post(url+"/orders", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if calls.Load() != 1 {
+			t.Errorf("expected the upstream to be called, got %d", calls.Load())
+		}
+	})
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxTransactItems is DynamoDB's limit on the items in one transaction, and
+// so on how many upstreams ReplaceAll can change atomically
+const maxTransactItems = 100
+
+// RegStorageDynamo keeps one item per upstream in a DynamoDB table with a
+// string partition key "name". Every item carries a revision, and writes are
+// conditional on the revision this instance last read, so instances sharing
+// a table can't silently overwrite each other's changes.
+//
+// With a TTL, each write sets an "expires" epoch seconds attribute, so
+// registrations lapse unless they are renewed by registering again. Enable
+// TTL on that attribute in the table to have DynamoDB delete them; they are
+// ignored from the moment they expire either way.
+type RegStorageDynamo struct {
+	client *dynamodb.Client
+	table  string
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	revisions map[string]int64
+}
+
+type dynamoItem = map[string]types.AttributeValue
+
+// newDynamoStorage opens dynamodb://table locations.
+func newDynamoStorage(location string, ttl time.Duration) (*RegStorageDynamo, bool, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "dynamodb" {
+		return nil, false, nil
+	}
+	if u.Host == "" {
+		return nil, true, fmt.Errorf("dynamodb storage location [%s] needs a table name", location)
+	}
+	client := dynamodb.NewFromConfig(awsConfig(), func(o *dynamodb.Options) {
+		o.BaseEndpoint = awsEndpointOverride("DYNAMODB")
+	})
+	s := &RegStorageDynamo{
+		client:    client,
+		table:     u.Host,
+		ttl:       ttl,
+		revisions: make(map[string]int64),
+	}
+	// Reading everything up front learns the current revisions, and checks
+	// the table is there
+	upstreams, err := s.All()
+	if err != nil {
+		return nil, true, err
+	}
+	for _, ups := range upstreams {
+		log.Printf("Adding upstream from dynamodb table %s %v", s.table, ups)
+	}
+	return s, true, nil
+}
+
+func (s *RegStorageDynamo) Put(u upstream) error {
+	item, err := s.item(u)
+	if err != nil {
+		return err
+	}
+	cond := s.condition(u.Name)
+	_, err = s.client.PutItem(context.Background(), &dynamodb.PutItemInput{
+		TableName:                 &s.table,
+		Item:                      item,
+		ConditionExpression:       &cond.expression,
+		ExpressionAttributeNames:  cond.names,
+		ExpressionAttributeValues: cond.values,
+	})
+	if err != nil {
+		return dynamoError(err)
+	}
+	s.setRevision(u.Name, item)
+	return nil
+}
+
+func (s *RegStorageDynamo) Delete(name string) error {
+	cond := s.condition(name)
+	_, err := s.client.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+		TableName:                 &s.table,
+		Key:                       dynamoKey(name),
+		ConditionExpression:       &cond.expression,
+		ExpressionAttributeNames:  cond.names,
+		ExpressionAttributeValues: cond.values,
+	})
+	if err != nil {
+		return dynamoError(err)
+	}
+	s.mu.Lock()
+	delete(s.revisions, name)
+	s.mu.Unlock()
+	return nil
+}
+
+// ReplaceAll writes and deletes in a single transaction, which bounds it to
+// maxTransactItems changes.
+func (s *RegStorageDynamo) ReplaceAll(upstreams map[string]upstream) error {
+	current, err := s.All()
+	if err != nil {
+		return err
+	}
+	var actions []types.TransactWriteItem
+	items := make(map[string]dynamoItem, len(upstreams))
+	for name, u := range upstreams {
+		item, err := s.item(u)
+		if err != nil {
+			return err
+		}
+		items[name] = item
+		cond := s.condition(name)
+		actions = append(actions, types.TransactWriteItem{Put: &types.Put{
+			TableName:                 &s.table,
+			Item:                      item,
+			ConditionExpression:       &cond.expression,
+			ExpressionAttributeNames:  cond.names,
+			ExpressionAttributeValues: cond.values,
+		}})
+	}
+	for name := range current {
+		if _, ok := upstreams[name]; ok {
+			continue
+		}
+		cond := s.condition(name)
+		actions = append(actions, types.TransactWriteItem{Delete: &types.Delete{
+			TableName:                 &s.table,
+			Key:                       dynamoKey(name),
+			ConditionExpression:       &cond.expression,
+			ExpressionAttributeNames:  cond.names,
+			ExpressionAttributeValues: cond.values,
+		}})
+	}
+	if len(actions) == 0 {
+		return nil
+	}
+	if len(actions) > maxTransactItems {
+		return fmt.Errorf("can't change %d upstreams at once in dynamodb, the limit is %d", len(actions), maxTransactItems)
+	}
+	if _, err := s.client.TransactWriteItems(context.Background(), &dynamodb.TransactWriteItemsInput{TransactItems: actions}); err != nil {
+		return dynamoError(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.revisions)
+	for name, item := range items {
+		s.revisions[name] = dynamoNumber(item, "revision")
+	}
+	return nil
+}
+
+func (s *RegStorageDynamo) All() (map[string]upstream, error) {
+	res := make(map[string]upstream)
+	revisions := make(map[string]int64)
+	now := time.Now().Unix()
+	err := s.scan(func(item dynamoItem) error {
+		var u upstream
+		if err := json.Unmarshal([]byte(dynamoString(item, "upstream")), &u); err != nil {
+			return fmt.Errorf("corrupt storage, invalid item [%s]: %w", dynamoString(item, "name"), err)
+		}
+		revisions[u.Name] = dynamoNumber(item, "revision")
+		if !expired(item, now) {
+			res[u.Name] = u
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.revisions = revisions
+	s.mu.Unlock()
+	return res, nil
+}
+
+// scan calls f with every upstream item in the table.
+func (s *RegStorageDynamo) scan(f func(dynamoItem) error) error {
+	pages := dynamodb.NewScanPaginator(s.client, &dynamodb.ScanInput{TableName: &s.table, ConsistentRead: aws.Bool(true)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.Background())
+		if err != nil {
+			return dynamoError(err)
+		}
+		for _, item := range page.Items {
+			// Leases share the table
+			if _, ok := item["holder"]; ok {
+				continue
+			}
+			if err := f(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func expired(item dynamoItem, now int64) bool {
+	if _, ok := item["expires"]; !ok {
+		return false
+	}
+	return dynamoNumber(item, "expires") <= now
+}
+
+// sweepExpired deletes expired registrations, for tables without DynamoDB's
+// own TTL enabled. Only the leader runs it.
+func (s *RegStorageDynamo) sweepExpired(ctx context.Context) error {
+	now := time.Now().Unix()
+	var stale []dynamoItem
+	err := s.scan(func(item dynamoItem) error {
+		if expired(item, now) {
+			stale = append(stale, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range stale {
+		_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 &s.table,
+			Key:                       dynamoItem{"name": item["name"]},
+			ConditionExpression:       aws.String("#rev = :rev"),
+			ExpressionAttributeNames:  map[string]string{"#rev": "revision"},
+			ExpressionAttributeValues: dynamoItem{":rev": item["revision"]},
+		})
+		err = dynamoError(err)
+		if errors.Is(err, errStorageConflict) {
+			// Renewed since we looked
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Removed expired upstream %s", dynamoString(item, "name"))
+	}
+	return nil
+}
+
+// acquireLease keeps leases as items alongside the upstreams, named
+// "lease:<name>", taken with a conditional write.
+func (s *RegStorageDynamo) acquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &s.table,
+		Item: dynamoItem{
+			"name":   &types.AttributeValueMemberS{Value: "lease:" + name},
+			"holder": &types.AttributeValueMemberS{Value: holder},
+			"until":  &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(ttl).UnixMilli(), 10)},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(#name) OR #holder = :holder OR #until < :now"),
+		ExpressionAttributeNames: map[string]string{"#name": "name", "#holder": "holder", "#until": "until"},
+		ExpressionAttributeValues: dynamoItem{
+			":holder": &types.AttributeValueMemberS{Value: holder},
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixMilli(), 10)},
+		},
+	})
+	err = dynamoError(err)
+	if errors.Is(err, errStorageConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// item builds the stored form of u, one revision on from the last we read.
+func (s *RegStorageDynamo) item(u upstream) (dynamoItem, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	rev := s.revisions[u.Name] + 1
+	s.mu.Unlock()
+	item := dynamoItem{
+		"name":     &types.AttributeValueMemberS{Value: u.Name},
+		"upstream": &types.AttributeValueMemberS{Value: string(b)},
+		"revision": &types.AttributeValueMemberN{Value: strconv.FormatInt(rev, 10)},
+	}
+	if s.ttl > 0 {
+		item["expires"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10)}
+	}
+	return item, nil
+}
+
+// dynamoCondition is a condition expression, with its names and values
+type dynamoCondition struct {
+	expression string
+	names      map[string]string
+	values     dynamoItem
+}
+
+// condition makes a write conditional on the item being at the revision we
+// last read, or not existing if we haven't seen it.
+func (s *RegStorageDynamo) condition(name string) dynamoCondition {
+	s.mu.Lock()
+	rev, seen := s.revisions[name]
+	s.mu.Unlock()
+	if !seen {
+		return dynamoCondition{expression: "attribute_not_exists(#name)", names: map[string]string{"#name": "name"}}
+	}
+	return dynamoCondition{
+		expression: "#rev = :rev",
+		names:      map[string]string{"#rev": "revision"},
+		values:     dynamoItem{":rev": &types.AttributeValueMemberN{Value: strconv.FormatInt(rev, 10)}},
+	}
+}
+
+func (s *RegStorageDynamo) setRevision(name string, item dynamoItem) {
+	rev := dynamoNumber(item, "revision")
+	s.mu.Lock()
+	s.revisions[name] = rev
+	s.mu.Unlock()
+}
+
+func dynamoKey(name string) dynamoItem {
+	return dynamoItem{"name": &types.AttributeValueMemberS{Value: name}}
+}
+
+// dynamoString is the string attribute k of item, or "" if it has none.
+func dynamoString(item dynamoItem, k string) string {
+	v, _ := item[k].(*types.AttributeValueMemberS)
+	if v == nil {
+		return ""
+	}
+	return v.Value
+}
+
+// dynamoNumber is the integer attribute k of item, or 0 if it has none.
+func dynamoNumber(item dynamoItem, k string) int64 {
+	v, _ := item[k].(*types.AttributeValueMemberN)
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.Value, 10, 64)
+	return n
+}
+
+// dynamoError reports failed conditions as errStorageConflict.
+func dynamoError(err error) error {
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return errStorageConflict
+	}
+	var cancelled *types.TransactionCanceledException
+	if errors.As(err, &cancelled) {
+		for _, reason := range cancelled.CancellationReasons {
+			if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				return errStorageConflict
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDynamo serves the few DynamoDB actions the storage uses, over a table
+// keyed by name, evaluating the two condition expressions it sends.
+type fakeDynamo struct {
+	mu    sync.Mutex
+	items map[string]fakeDynamoItem
+}
+
+// fakeDynamoItem is an item in DynamoDB's JSON, attribute name to type to value.
+type fakeDynamoItem map[string]map[string]string
+
+func (f *fakeDynamo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var in struct {
+		Item                      fakeDynamoItem
+		Key                       fakeDynamoItem
+		ConditionExpression       string
+		ExpressionAttributeValues fakeDynamoItem
+	}
+	_ = json.NewDecoder(r.Body).Decode(&in)
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	switch action {
+	case "Scan":
+		items := make([]fakeDynamoItem, 0, len(f.items))
+		for _, item := range f.items {
+			items = append(items, item)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"Items": items})
+		return
+	case "PutItem", "DeleteItem":
+		name := in.Key["name"]["S"]
+		if action == "PutItem" {
+			name = in.Item["name"]["S"]
+		}
+		existing, exists := f.items[name]
+		ok := (in.ConditionExpression == "attribute_not_exists(#name)" && !exists) ||
+			(in.ConditionExpression == "#rev = :rev" && exists && existing["revision"]["N"] == in.ExpressionAttributeValues[":rev"]["N"])
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`))
+			return
+		}
+		if action == "PutItem" {
+			f.items[name] = in.Item
+		} else {
+			delete(f.items, name)
+		}
+	}
+	_, _ = w.Write([]byte("{}"))
+}
+
+func withDynamo(t *testing.T, ttl time.Duration) (*fakeDynamo, func() *RegStorageDynamo) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	fake := &fakeDynamo{items: make(map[string]fakeDynamoItem)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ENDPOINT_URL_DYNAMODB", srv.URL)
+	return fake, func() *RegStorageDynamo {
+		s, _, err := newDynamoStorage("dynamodb://regproxy", ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+}
+
+func TestDynamoConditionalWrites(t *testing.T) {
+	// GIVEN two instances sharing a table
+	_, open := withDynamo(t, 0)
+	a, b := open(), open()
+	if err := a.Put(upstream{Name: "foo", Callback: "http://a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN b writes without having seen a's registration
+	err := b.Put(upstream{Name: "foo", Callback: "http://b"})
+
+	// THEN it's refused until b has read the current revision
+	if err != errStorageConflict {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+	if _, err := b.All(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(upstream{Name: "foo", Callback: "http://b"}); err != nil {
+		t.Errorf("expected the write to succeed, got %v", err)
+	}
+	if err := a.Delete("foo"); err != errStorageConflict {
+		t.Errorf("expected a stale delete to conflict, got %v", err)
+	}
+}
+
+func TestDynamoExpiredRegistrationsAreIgnored(t *testing.T) {
+	// GIVEN a registration whose TTL has passed
+	fake, open := withDynamo(t, time.Hour)
+	s := open()
+	if err := s.Put(upstream{Name: "foo", Callback: "http://foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.items["foo"]["expires"]["N"] == "" {
+		t.Fatal("expected an expires attribute")
+	}
+	fake.items["foo"]["expires"]["N"] = "1"
+
+	// WHEN
+	all, err := s.All()
+
+	// THEN
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 0 {
+		t.Errorf("expected no upstreams, got %v", all)
+	}
+	// and it can be registered again
+	if err := s.Put(upstream{Name: "foo", Callback: "http://foo"}); err != nil {
+		t.Errorf("expected renewal to succeed, got %v", err)
+	}
+}
+
+func TestDynamoSweepExpired(t *testing.T) {
+	// GIVEN one expired and one live registration
+	fake, open := withDynamo(t, time.Hour)
+	s := open()
+	_ = s.Put(upstream{Name: "old", Callback: "http://old"})
+	_ = s.Put(upstream{Name: "new", Callback: "http://new"})
+	fake.items["old"]["expires"]["N"] = "1"
+
+	// WHEN
+	if err := s.sweepExpired(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN
+	if _, ok := fake.items["old"]; ok {
+		t.Error("expected the expired registration to be deleted")
+	}
+	if _, ok := fake.items["new"]; !ok {
+		t.Error("expected the live registration to be kept")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// egressDirect is the per-upstream proxy setting which bypasses any proxy
+// configured in the environment.
+const egressDirect = "direct"
+
+func validateEgressProxy(proxy string) error {
+	if proxy == "" || proxy == egressDirect {
+		return nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported proxy scheme [%s], expected http, https, socks5 or %s", u.Scheme, egressDirect)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxy [%s] has no host", proxy)
+	}
+	return nil
+}
+
+// withEgressProxy records the upstream's own outbound proxy on the request
+// context, for egressProxy to pick up when the transport connects.
+func withEgressProxy(ctx context.Context, proxy string) context.Context {
+	if proxy == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, egressProxyKey, proxy)
+}
+
+// egressProxy is the transport's proxy func. Upstreams registered with their
+// own proxy use it, everything else falls back to the environment.
+// The transport keys pooled connections by proxy, so upstreams using
+// different gateways never share a connection.
+func egressProxy(req *http.Request) (*url.URL, error) {
+	proxy, ok := req.Context().Value(egressProxyKey).(string)
+	if !ok {
+		return http.ProxyFromEnvironment(req)
+	}
+	if proxy == egressDirect {
+		return nil, nil
+	}
+	return url.Parse(proxy)
+}
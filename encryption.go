@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// Environment variables holding the key file storage is encrypted with:
+// either the key itself, or a data key encrypted by AWS KMS, as returned in
+// CiphertextBlob by GenerateDataKey, which KMS decrypts on startup.
+const (
+	storageKeyEnv    = "REGPROXY_STORAGE_KEY"
+	storageKMSKeyEnv = "REGPROXY_STORAGE_KEY_KMS"
+)
+
+// encryptedFileHeader starts an encrypted storage file, followed by the
+// base64 nonce and ciphertext of the plaintext format on one line.
+const encryptedFileHeader = "# regproxy registry encrypted aes-256-gcm"
+
+// errNoStorageKey is returned reading encrypted storage without a key.
+var errNoStorageKey = fmt.Errorf("storage is encrypted, set %s or %s to read it", storageKeyEnv, storageKMSKeyEnv)
+
+// storageCipher reads the storage key from the environment, returning nil if
+// there is none so storage isn't encrypted.
+func storageCipher(getenv func(string) string) (cipher.AEAD, error) {
+	var key []byte
+	switch raw, kms := getenv(storageKeyEnv), getenv(storageKMSKeyEnv); {
+	case raw != "" && kms != "":
+		return nil, fmt.Errorf("only one of %s and %s may be set", storageKeyEnv, storageKMSKeyEnv)
+	case raw != "":
+		var err error
+		if key, err = base64.StdEncoding.DecodeString(raw); err != nil {
+			return nil, fmt.Errorf("%s must be base64: %w", storageKeyEnv, err)
+		}
+	case kms != "":
+		blob, err := base64.StdEncoding.DecodeString(kms)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be base64: %w", storageKMSKeyEnv, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if key, err = kmsDecrypt(ctx, blob); err != nil {
+			return nil, fmt.Errorf("decrypting the storage key with KMS: %w", err)
+		}
+	default:
+		return nil, nil
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the storage key must be 32 bytes for AES-256, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealStorage encrypts plaintext as an encrypted storage file.
+func sealStorage(aead cipher.AEAD, plaintext []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, _ = rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(encryptedFileHeader))
+	return []byte(encryptedFileHeader + "\n" + base64.StdEncoding.EncodeToString(sealed) + "\n")
+}
+
+// openStorage decrypts an encrypted storage file, which fails if it has been
+// truncated or tampered with as well as with the wrong key.
+func openStorage(aead cipher.AEAD, file []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, errNoStorageKey
+	}
+	_, body, _ := bytes.Cut(file, []byte("\n"))
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("corrupt storage, the file is truncated")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(encryptedFileHeader))
+	if err != nil {
+		return nil, errors.New("can't decrypt storage, with the wrong key or a damaged file")
+	}
+	return plaintext, nil
+}
+
+// kmsDecrypt has AWS KMS decrypt a ciphertext blob.
+func kmsDecrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	client := kms.NewFromConfig(awsConfig(), func(o *kms.Options) {
+		o.BaseEndpoint = awsEndpointOverride("KMS")
+	})
+	out, err := client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, fmt.Errorf("kms Decrypt failed: %w", err)
+	}
+	return out.Plaintext, nil
+}
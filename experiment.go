@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// bucketHeader carries a request's experiment bucket, to upstreams and back
+// to the client.
+const bucketHeader = "X-Regproxy-Bucket"
+
+// experimentBucket is a share of requests in an A/B experiment.
+type experimentBucket struct {
+	name   string
+	weight int
+}
+
+// parseExperimentBuckets parses name=weight pairs, e.g. control=90,canary=10.
+func parseExperimentBuckets(s string) ([]experimentBucket, error) {
+	var buckets []experimentBucket
+	for _, pair := range strings.Split(s, ",") {
+		name, w, ok := strings.Cut(pair, "=")
+		weight, err := strconv.Atoi(w)
+		if !ok || name == "" || err != nil || weight < 0 {
+			return nil, fmt.Errorf("expected bucket=weight, got [%s]", pair)
+		}
+		if slices.ContainsFunc(buckets, func(b experimentBucket) bool { return b.name == name }) {
+			return nil, fmt.Errorf("bucket [%s] is listed more than once", name)
+		}
+		buckets = append(buckets, experimentBucket{name: name, weight: weight})
+	}
+	return buckets, nil
+}
+
+// experiment assigns requests to buckets by a hash of a request attribute,
+// so the same user, say, always lands in the same bucket. Raising a
+// bucket's weight only moves requests into it, from the buckets listed
+// before it. A nil experiment puts every request in no bucket.
+type experiment struct {
+	key     func(*http.Request) string
+	buckets []experimentBucket
+	total   int
+}
+
+func newExperiment(cfg Config) *experiment {
+	if len(cfg.ExperimentBuckets) == 0 {
+		return nil
+	}
+	// main has already checked the key
+	key, _ := parseHashKey(cfg.ExperimentKey)
+	e := &experiment{key: key, buckets: cfg.ExperimentBuckets}
+	for _, b := range e.buckets {
+		e.total += b.weight
+	}
+	return e
+}
+
+// bucket returns the bucket req is in. Requests without the key are put in
+// the first bucket, which is usually the control.
+func (e *experiment) bucket(req *http.Request) string {
+	if e == nil {
+		return ""
+	}
+	key := e.key(req)
+	if key == "" || e.total == 0 {
+		return e.buckets[0].name
+	}
+	x := hashUnit("experiment", key) * float64(e.total)
+	for _, b := range e.buckets {
+		if x < float64(b.weight) {
+			return b.name
+		}
+		x -= float64(b.weight)
+	}
+	return e.buckets[len(e.buckets)-1].name
+}
+
+// inBucket removes the upstreams which don't take requests in bucket. Those
+// without buckets take every request.
+func inBucket(upstreams map[string]upstream, bucket string) {
+	for name, ups := range upstreams {
+		if len(ups.Buckets) > 0 && !slices.Contains(ups.Buckets, bucket) {
+			delete(upstreams, name)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExperimentBuckets(t *testing.T) {
+	// GIVEN a 90/10 experiment on a header
+	cfg := testConfig()
+	cfg.ExperimentKey = "header:X-User-Id"
+	cfg.ExperimentBuckets = []experimentBucket{{"control", 90}, {"canary", 10}}
+	e := newExperiment(cfg)
+
+	// WHEN many users' requests are bucketed
+	counts := map[string]int{}
+	for i := range 10000 {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("X-User-Id", fmt.Sprint("user-", i))
+		b := e.bucket(req)
+		counts[b]++
+		// THEN a user always lands in the same bucket
+		if again := e.bucket(req); again != b {
+			t.Fatalf("expected user %d to stay in %s, got %s", i, b, again)
+		}
+	}
+
+	// AND the buckets get their shares
+	if counts["canary"] < 800 || counts["canary"] > 1200 || counts["control"]+counts["canary"] != 10000 {
+		t.Errorf("expected about 10%% canary, got %v", counts)
+	}
+	// AND requests without the key go to the first bucket
+	if b := e.bucket(httptest.NewRequest("POST", "/", nil)); b != "control" {
+		t.Errorf("expected control, got %s", b)
+	}
+}
+
+func TestExperimentRouting(t *testing.T) {
+	// GIVEN upstreams for each bucket, and one taking every request
+	cfg := testConfig()
+	cfg.ExperimentKey = "header:X-User-Id"
+	cfg.ExperimentBuckets = []experimentBucket{{"control", 50}, {"canary", 50}}
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		var mu sync.Mutex
+		var calls []string
+		for _, u := range []upstream{
+			{Name: "stable", Buckets: []string{"control"}},
+			{Name: "next", Buckets: []string{"canary"}},
+			{Name: "audit"},
+		} {
+			name := u.Name
+			srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls = append(calls, name+":"+req.Header.Get(bucketHeader))
+			}))
+			defer srv.Close()
+			u.Callback = srv.URL
+			register(url, u, t)
+		}
+		e := newExperiment(cfg)
+
+		for _, bucket := range []string{"control", "canary"} {
+			// WHEN a user in the bucket sends a request
+			user := ""
+			for i := 0; user == ""; i++ {
+				req := httptest.NewRequest("POST", "/", nil)
+				req.Header.Set("X-User-Id", fmt.Sprint("user-", i))
+				if e.bucket(req) == bucket {
+					user = req.Header.Get("X-User-Id")
+				}
+			}
+			calls = nil
+			req, _ := http.NewRequest("POST", url+"/orders", strings.NewReader("{}"))
+			req.Header.Set("X-User-Id", user)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+
+			// THEN only the bucket's upstreams are called, and the bucket is echoed
+			expected := map[string]string{"control": "audit:control,stable:control", "canary": "audit:canary,next:canary"}[bucket]
+			mu.Lock()
+			slices.Sort(calls)
+			got := strings.Join(calls, ",")
+			mu.Unlock()
+			if got != expected || resp.Header.Get(bucketHeader) != bucket {
+				t.Errorf("%s: expected calls %s, got %s with bucket %s", bucket, expected, got, resp.Header.Get(bucketHeader))
+			}
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errFaultDropped is returned in place of an upstream's response when a
+// fault drops it.
+var errFaultDropped = errors.New("response dropped by fault injection")
+
+// Kinds of fault, as counted by regproxy_faults_injected_total
+const (
+	faultLatency = "latency"
+	faultError   = "error"
+	faultDrop    = "drop"
+)
+
+// fault is artificial misbehaviour injected into calls to one upstream, for
+// chaos testing how callers cope. Faults expire, so a forgotten one can't
+// break an environment for long.
+type fault struct {
+	Upstream string `json:"upstream"`
+	// LatencyMs delays each call before it's made
+	LatencyMs int64 `json:"latencyMs,omitempty"`
+	// ErrorStatus, if set, is returned without calling the upstream at all
+	ErrorStatus int `json:"errorStatus,omitempty"`
+	// Drop calls the upstream but discards its response, as if the
+	// connection had failed after the upstream acted on the request
+	Drop bool `json:"drop,omitempty"`
+	// Probability of each call being affected, where 0 means always
+	Probability float64   `json:"probability,omitempty"`
+	TTL         string    `json:"ttl"`
+	Expires     time.Time `json:"expires"`
+}
+
+// faultInjector holds the active faults, by upstream name. A nil injector
+// injects nothing.
+type faultInjector struct {
+	injected *counterVec
+
+	mu     sync.Mutex
+	faults map[string]fault
+}
+
+func newFaultInjector(injected *counterVec) *faultInjector {
+	return &faultInjector{injected: injected, faults: make(map[string]fault)}
+}
+
+func (fi *faultInjector) lookup(name string) (fault, bool) {
+	if fi == nil {
+		return fault{}, false
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	f, ok := fi.faults[name]
+	if ok && time.Now().After(f.Expires) {
+		delete(fi.faults, name)
+		return fault{}, false
+	}
+	return f, ok
+}
+
+// do makes an upstream call through any fault active for it.
+func (fi *faultInjector) do(req *http.Request, name string, call func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	f, ok := fi.lookup(name)
+	if !ok || (f.Probability > 0 && rand.Float64() >= f.Probability) {
+		return call(req)
+	}
+	if f.LatencyMs > 0 {
+		fi.injected.inc(name, faultLatency)
+		select {
+		case <-time.After(time.Duration(f.LatencyMs) * time.Millisecond):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if f.ErrorStatus != 0 {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		fi.injected.inc(name, faultError)
+		log.Printf("Injecting status %d for upstream %s", f.ErrorStatus, name)
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", f.ErrorStatus, http.StatusText(f.ErrorStatus)),
+			StatusCode: f.ErrorStatus,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       io.NopCloser(strings.NewReader("Injected fault\n")),
+			Request:    req,
+		}, nil
+	}
+	resp, err := call(req)
+	if err == nil && f.Drop {
+		_ = resp.Body.Close()
+		fi.injected.inc(name, faultDrop)
+		log.Printf("Dropping response from upstream %s", name)
+		return nil, errFaultDropped
+	}
+	return resp, err
+}
+
+// faultList handles GET /admin/faults.
+func (p *RegProxy) faultList(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(resp, http.MethodGet)
+		return
+	}
+	p.faults.mu.Lock()
+	list := make([]fault, 0, len(p.faults.faults))
+	for _, f := range p.faults.faults {
+		if time.Now().Before(f.Expires) {
+			list = append(list, f)
+		}
+	}
+	p.faults.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Upstream < list[j].Upstream })
+	writeJSON(resp, http.StatusOK, list)
+}
+
+// faultResource handles PUT and DELETE of /admin/faults/{name}.
+func (p *RegProxy) faultResource(resp http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	switch req.Method {
+	case http.MethodPut:
+		var f fault
+		if err := json.NewDecoder(req.Body).Decode(&f); err != nil {
+			badRequest(resp, err.Error())
+			return
+		}
+		ttl, err := time.ParseDuration(f.TTL)
+		if err != nil || ttl <= 0 {
+			badRequest(resp, fmt.Sprintf("A fault needs a positive ttl, such as 5m, got [%s]", f.TTL))
+			return
+		}
+		if f.ErrorStatus != 0 && (f.ErrorStatus < 100 || f.ErrorStatus > 599) {
+			badRequest(resp, fmt.Sprintf("Invalid errorStatus [%d]", f.ErrorStatus))
+			return
+		}
+		f.Upstream = name
+		f.Expires = time.Now().Add(ttl)
+		p.faults.mu.Lock()
+		p.faults.faults[name] = f
+		p.faults.mu.Unlock()
+		log.Printf("Injecting fault %+v", f)
+		writeJSON(resp, http.StatusOK, f)
+	case http.MethodDelete:
+		p.faults.mu.Lock()
+		delete(p.faults.faults, name)
+		p.faults.mu.Unlock()
+		log.Printf("Removed fault for upstream %s", name)
+		resp.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(resp, http.MethodPut, http.MethodDelete)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func withFaults(t *testing.T, f func(url string, t *testing.T)) {
+	cfg := testConfig()
+	cfg.FaultInjection = true
+	withRegProxyConfig(t, cfg, f)
+}
+
+func TestInjectedErrorStatus(t *testing.T) {
+	withFaults(t, func(url string, t *testing.T) {
+		// GIVEN
+		defer withStatusUpstreams(url, t, 200)()
+		if r := doJSON(t, "PUT", url+"/admin/faults/a", `{"errorStatus":503,"ttl":"1m"}`, nil); r.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %v", r.StatusCode)
+		}
+
+		// WHEN
+		status := getStatus(url, t)
+
+		// THEN
+		if status != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %v", status)
+		}
+
+		// WHEN the fault is removed
+		doJSON(t, "DELETE", url+"/admin/faults/a", "", nil)
+		if status := getStatus(url, t); status != 200 {
+			t.Errorf("expected 200 after removing the fault, got %v", status)
+		}
+	})
+}
+
+func TestInjectedLatencyAndDrop(t *testing.T) {
+	withFaults(t, func(url string, t *testing.T) {
+		// GIVEN
+		defer withStatusUpstreams(url, t, 200)()
+		doJSON(t, "PUT", url+"/admin/faults/a", `{"latencyMs":50,"drop":true,"ttl":"1m"}`, nil)
+
+		// WHEN
+		start := time.Now()
+		status := getStatus(url, t)
+
+		// THEN the response is delayed and then lost
+		if took := time.Since(start); took < 50*time.Millisecond {
+			t.Errorf("expected at least 50ms latency, took %v", took)
+		}
+		if status != http.StatusInternalServerError {
+			t.Errorf("expected 500, got %v", status)
+		}
+	})
+}
+
+func TestFaultsExpire(t *testing.T) {
+	fi := newFaultInjector(newProxyMetrics().faultsInjected)
+	fi.faults["a"] = fault{Upstream: "a", ErrorStatus: 500, Expires: time.Now().Add(-time.Second)}
+	if _, ok := fi.lookup("a"); ok {
+		t.Error("expected the fault to have expired")
+	}
+}
+
+func TestFaultsDisabledByDefault(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		defer withStatusUpstreams(url, t, 200)()
+		// Without the API, the path is proxied like any other
+		doJSON(t, "PUT", url+"/admin/faults/a", `{"errorStatus":503,"ttl":"1m"}`, nil)
+		if status := getStatus(url, t); status != 200 {
+			t.Errorf("expected the fault API to be disabled, got %v", status)
+		}
+	})
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fileFormatVersion is the version of the file storage format written. Files
+// from before there was a header are version 1, and are migrated when the
+// storage is opened.
+const fileFormatVersion = 2
+
+// A version 2 file starts with a header line and ends with a trailer line
+// counting the upstreams between, so that a truncated file is noticed.
+const (
+	fileHeaderPrefix  = "# regproxy registry v"
+	fileTrailerPrefix = "# end "
+)
+
+// fileBackupSuffix names the copy of the previous version of the file kept
+// by each write, to recover from if the file is damaged.
+const fileBackupSuffix = ".bak"
+
+// RegStorageFile keeps one JSON registration per line in a file. Writes go
+// to a temporary file which is synced then renamed over the file, so that a
+// crash mid-write leaves the previous version intact. With a cipher, the
+// whole file is encrypted.
+type RegStorageFile struct {
+	fileName string
+	aead     cipher.AEAD
+}
+
+func NewRegStorageFile(fileName string, aead cipher.AEAD) (*RegStorageFile, error) {
+	m := &RegStorageFile{fileName: fileName, aead: aead}
+	upstreams, current, err := m.read()
+	if os.IsNotExist(err) {
+		upstreams = make(map[string]upstream)
+	} else if err != nil {
+		return nil, err
+	}
+	if !current {
+		if len(upstreams) > 0 {
+			log.Printf("Rewriting file storage %s in version %d of its format, encrypted: %v", fileName, fileFormatVersion, aead != nil)
+		}
+		if err := m.write(upstreams); err != nil {
+			return nil, err
+		}
+		if aead != nil {
+			// The backup may be in plaintext
+			if err := os.Remove(fileName + fileBackupSuffix); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	for _, ups := range upstreams {
+		log.Printf("Adding upstream from file %v", ups)
+	}
+	return m, nil
+}
+
+func (m *RegStorageFile) Put(u upstream) error {
+	mm, err := m.All()
+	if err != nil {
+		return err
+	}
+	mm[u.Name] = u
+	return m.write(mm)
+}
+func (m *RegStorageFile) Delete(name string) error {
+	mm, err := m.All()
+	if err != nil {
+		return err
+	}
+	delete(mm, name)
+	return m.write(mm)
+}
+func (m *RegStorageFile) ReplaceAll(upstreams map[string]upstream) error {
+	return m.write(upstreams)
+}
+func (m *RegStorageFile) write(content map[string]upstream) error {
+	names := make([]string, 0, len(content))
+	for name := range content {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s%d\n", fileHeaderPrefix, fileFormatVersion)
+	for _, name := range names {
+		line, err := json.Marshal(content[name])
+		if err != nil {
+			return err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(&b, "%s%d\n", fileTrailerPrefix, len(content))
+	if m.aead != nil {
+		return writeFileAtomic(m.fileName, sealStorage(m.aead, b.Bytes()))
+	}
+	return writeFileAtomic(m.fileName, b.Bytes())
+}
+func (m *RegStorageFile) All() (map[string]upstream, error) {
+	upstreams, _, err := m.read()
+	return upstreams, err
+}
+
+// read parses the file, falling back to the backup of its previous version
+// if it's missing or damaged. current says whether the file itself was read,
+// in the current format and encrypted as configured, so needn't be
+// rewritten.
+func (m *RegStorageFile) read() (upstreams map[string]upstream, current bool, err error) {
+	content, err := os.ReadFile(m.fileName)
+	if err == nil {
+		var version int
+		if upstreams, version, err = m.parse(content); err == nil {
+			encrypted := bytes.HasPrefix(content, []byte(encryptedFileHeader))
+			return upstreams, version == fileFormatVersion && encrypted == (m.aead != nil), nil
+		}
+		if errors.Is(err, errNoStorageKey) {
+			// The file isn't damaged, and a backup mustn't be used instead
+			return nil, false, err
+		}
+	}
+	backup, berr := os.ReadFile(m.fileName + fileBackupSuffix)
+	if berr != nil {
+		return nil, false, err
+	}
+	upstreams, _, berr = m.parse(backup)
+	if berr != nil {
+		return nil, false, err
+	}
+	log.Printf("File storage %s can't be read (%v), using its previous version from %s%s", m.fileName, err, m.fileName, fileBackupSuffix)
+	return upstreams, false, nil
+}
+
+// parse decrypts the file if it's encrypted, then parses it.
+func (m *RegStorageFile) parse(file []byte) (map[string]upstream, int, error) {
+	if bytes.HasPrefix(file, []byte(encryptedFileHeader)) {
+		plaintext, err := openStorage(m.aead, file)
+		if err != nil {
+			return nil, 0, err
+		}
+		file = plaintext
+	}
+	return parseFile(file)
+}
+
+// parseFile reads the upstreams from file storage of any version.
+func parseFile(file []byte) (map[string]upstream, int, error) {
+	header, body, _ := bytes.Cut(file, []byte("\n"))
+	if !bytes.HasPrefix(header, []byte(fileHeaderPrefix)) {
+		upstreams, err := parseLegacyFile(file)
+		return upstreams, 1, err
+	}
+	version, err := strconv.Atoi(string(header[len(fileHeaderPrefix):]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("corrupt storage, invalid header [%s]", header)
+	}
+	if version > fileFormatVersion {
+		return nil, 0, fmt.Errorf("storage was written in version %d of its format, by a newer regproxy which must be used", version)
+	}
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		return nil, 0, errors.New("corrupt storage, the file is truncated")
+	}
+	lines := bytes.Split(body[:len(body)-1], []byte("\n"))
+	trailer := string(lines[len(lines)-1])
+	count, err := strconv.Atoi(strings.TrimPrefix(trailer, fileTrailerPrefix))
+	if !strings.HasPrefix(trailer, fileTrailerPrefix) || err != nil {
+		return nil, 0, errors.New("corrupt storage, the file is truncated")
+	}
+	upstreams, err := parseMap(bytes.Join(lines[:len(lines)-1], []byte("\n")))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(upstreams) != count {
+		return nil, 0, fmt.Errorf("corrupt storage, expected %d upstreams but read %d", count, len(upstreams))
+	}
+	return upstreams, version, nil
+}
+
+// parseLegacyFile reads a version 1 file, which has nothing to show it was
+// truncated but a last line without a newline. If that line can't be parsed
+// it's dropped.
+func parseLegacyFile(file []byte) (map[string]upstream, error) {
+	upstreams, err := parseMap(file)
+	if err == nil || len(file) == 0 || file[len(file)-1] == '\n' {
+		return upstreams, err
+	}
+	complete := file[:bytes.LastIndexByte(file, '\n')+1]
+	log.Printf("Dropping truncated last line of file storage [%s]", file[len(complete):])
+	return parseMap(complete)
+}
+
+// parseMap reads one upstream per line, either as a JSON object or in the
+// legacy name=callback form written by older versions.
+func parseMap(file []byte) (map[string]upstream, error) {
+	scan := bufio.NewScanner(bytes.NewReader(file))
+	res := make(map[string]upstream)
+	for scan.Scan() {
+		line := scan.Text()
+		if strings.HasPrefix(line, "{") {
+			var u upstream
+			if err := json.Unmarshal([]byte(line), &u); err != nil {
+				return nil, fmt.Errorf("corrupt storage, read invalid line [%s]: %w", line, err)
+			}
+			res[u.Name] = u
+			continue
+		}
+		strs := strings.Split(line, "=")
+		if len(strs) != 2 {
+			return nil, errors.New(fmt.Sprintf("corrupt storage, read invalid line [%s]", line))
+		}
+		if _, err := url.Parse(strs[1]); err != nil {
+			return nil, err
+		}
+		res[strs[0]] = upstream{Name: strs[0], Callback: strs[1]}
+	}
+	return res, nil
+}
+
+// writeFileAtomic replaces the named file with data, so that a crash leaves
+// either its old or new contents, linking the old as a backup first.
+func writeFileAtomic(name string, data []byte) error {
+	return replaceFile(name, true, os.ModePerm&^0o111, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// replaceFile replaces the named file with what write writes, synced, so
+// that a crash leaves either its old or new contents. With backup, the old
+// contents are linked as a backup first. A new file is created with perm,
+// otherwise the file keeps its permissions.
+func replaceFile(name string, backup bool, perm os.FileMode, write func(io.Writer) error) error {
+	dir := filepath.Dir(name)
+	tmp, err := os.CreateTemp(dir, filepath.Base(name)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Nothing to remove once it's been renamed
+		_ = os.Remove(tmp.Name())
+	}()
+	mode := perm
+	if fi, err := os.Stat(name); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := write(tmp); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if backup {
+		backup := name + fileBackupSuffix
+		_ = os.Remove(backup)
+		if err := os.Link(name, backup); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to back up %s: %v", name, err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes renames and removals in dir durable.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+}
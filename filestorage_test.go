@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileStorageRecoversFromTruncation(t *testing.T) {
+	// GIVEN storage written twice, so there's a backup of the first version
+	file := filepath.Join(t.TempDir(), "registry")
+	st, err := NewRegStorageFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put(upstream{Name: "foo", Callback: "http://foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put(upstream{Name: "bar", Callback: "http://bar"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN the file is cut short
+	content, _ := os.ReadFile(file)
+	if err := os.WriteFile(file, content[:len(content)-8], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN the truncation is noticed, and the previous version used
+	if _, _, err := parseFile(content[:len(content)-8]); err == nil {
+		t.Error("expected the truncated file to be refused")
+	}
+	st, err = NewRegStorageFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams, err := st.All()
+	if err != nil || len(upstreams) != 1 || upstreams["foo"].Callback != "http://foo" {
+		t.Errorf("expected the previous version, got %v, %v", upstreams, err)
+	}
+}
+
+func TestFileStorageMigratesLegacyFormat(t *testing.T) {
+	// GIVEN a file from before the format had a version, its last line cut short
+	file := filepath.Join(t.TempDir(), "registry")
+	legacy := "foo=http://localhost:3000\n{\"name\":\"bar\",\"callback\":\"http://localhost:3001\"}\n{\"name\":\"baz\",\"call"
+	if err := os.WriteFile(file, []byte(legacy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN
+	st, err := NewRegStorageFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN the complete lines are kept, in the current format
+	content, _ := os.ReadFile(file)
+	if !strings.HasPrefix(string(content), "# regproxy registry v2\n") || !strings.HasSuffix(string(content), "# end 2\n") {
+		t.Errorf("expected the file to be rewritten, got %q", content)
+	}
+	upstreams, err := st.All()
+	if err != nil || len(upstreams) != 2 || upstreams["foo"].Callback != "http://localhost:3000" {
+		t.Errorf("unexpected upstreams %v, %v", upstreams, err)
+	}
+	if leftovers, _ := filepath.Glob(file + ".tmp-*"); len(leftovers) > 0 {
+		t.Errorf("expected no temporary files, got %v", leftovers)
+	}
+}
+
+func TestFileStorageRefusesNewerFormat(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "registry")
+	if err := os.WriteFile(file, []byte("# regproxy registry v3\n# end 0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRegStorageFile(file, nil); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("expected a newer format to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gossipPath is where peers exchange registry state
+const gossipPath = "/admin/gossip"
+
+// gossipSecretEnv holds the secret every peer signs its side of an exchange
+// with, so that nobody else can inject registrations
+const gossipSecretEnv = "REGPROXY_GOSSIP_SECRET"
+
+// gossipSignatureHeader signs the body of an exchange and when it was sent,
+// as t=<unix seconds>,sig=<hex HMAC-SHA256 of t.body>
+const gossipSignatureHeader = "X-Regproxy-Gossip-Signature"
+
+// maxGossipSkew is how far a peer's clock may be from ours, bounding how old
+// a signature may be and how far in the future an entry may be written
+const maxGossipSkew = time.Minute
+
+// maxGossipBody bounds the state a peer may send
+const maxGossipBody = 32 << 20
+
+// defaultTombstoneRetention is how long a deletion is remembered unless
+// configured otherwise
+const defaultTombstoneRetention = time.Hour
+
+// gossipEntry is one upstream's state, or its deletion, as last written.
+// Conflicting entries are resolved in favour of the latest write, ties
+// going to the higher origin instance so that every peer picks the same one.
+type gossipEntry struct {
+	Upstream upstream `json:"upstream"`
+	Deleted  bool     `json:"deleted,omitempty"`
+	Updated  int64    `json:"updated"`
+	Origin   string   `json:"origin"`
+}
+
+func (e gossipEntry) newerThan(o gossipEntry) bool {
+	if e.Updated != o.Updated {
+		return e.Updated > o.Updated
+	}
+	return e.Origin > o.Origin
+}
+
+// RegStorageGossip is in-memory storage which converges with a set of peer
+// instances by periodically exchanging state with one of them at random,
+// so a group of proxies share registrations without an external datastore.
+// Registrations made on any instance reach the others within a few gossip
+// intervals.
+type RegStorageGossip struct {
+	origin string
+	secret []byte
+	// tombstoneRetention is how long a deletion is remembered, which must be
+	// long enough for it to reach every peer before it's forgotten, or the
+	// upstream will be resurrected by a peer which still has it. So it's
+	// also the longest a peer may be partitioned away.
+	tombstoneRetention time.Duration
+
+	mu      sync.Mutex
+	entries map[string]gossipEntry
+	// clock keeps Updated increasing even if the wall clock steps back
+	clock int64
+	// handingOver refuses local writes once the state is handed over
+	handingOver bool
+}
+
+func NewRegStorageGossip(origin string, secret []byte) *RegStorageGossip {
+	return &RegStorageGossip{origin: origin, secret: secret, tombstoneRetention: defaultTombstoneRetention, entries: make(map[string]gossipEntry)}
+}
+
+func (s *RegStorageGossip) Put(u upstream) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handingOver {
+		return errHandingOver
+	}
+	s.set(gossipEntry{Upstream: u})
+	return nil
+}
+
+func (s *RegStorageGossip) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handingOver {
+		return errHandingOver
+	}
+	if e, ok := s.entries[name]; ok && !e.Deleted {
+		s.set(gossipEntry{Upstream: upstream{Name: name}, Deleted: true})
+	}
+	return nil
+}
+
+func (s *RegStorageGossip) ReplaceAll(upstreams map[string]upstream) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handingOver {
+		return errHandingOver
+	}
+	for name, e := range s.entries {
+		if _, keep := upstreams[name]; !keep && !e.Deleted {
+			s.set(gossipEntry{Upstream: upstream{Name: name}, Deleted: true})
+		}
+	}
+	for _, u := range upstreams {
+		s.set(gossipEntry{Upstream: u})
+	}
+	return nil
+}
+
+func (s *RegStorageGossip) All() (map[string]upstream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]upstream, len(s.entries))
+	for name, e := range s.entries {
+		if !e.Deleted {
+			res[name] = e.Upstream
+		}
+	}
+	return res, nil
+}
+
+// set records a local write, must be called holding mu.
+func (s *RegStorageGossip) set(e gossipEntry) {
+	now := time.Now().UnixNano()
+	if now <= s.clock {
+		now = s.clock + 1
+	}
+	s.clock = now
+	e.Updated = now
+	e.Origin = s.origin
+	s.entries[e.Upstream.Name] = e
+}
+
+// validGossipEntry checks an entry from a peer as a registration would be,
+// and that it wasn't written in the future, which would let it win over
+// every later write.
+func validGossipEntry(name string, e gossipEntry, now time.Time) error {
+	switch {
+	case name == "" || name != e.Upstream.Name:
+		return fmt.Errorf("entry [%s] is for upstream [%s]", name, e.Upstream.Name)
+	case e.Origin == "":
+		return fmt.Errorf("entry [%s] has no origin", name)
+	case e.Updated > now.Add(maxGossipSkew).UnixNano():
+		return fmt.Errorf("entry [%s] was written in the future", name)
+	case e.Deleted:
+		return nil
+	}
+	return validateUpstream(e.Upstream)
+}
+
+// merge takes in any valid entries newer than ours.
+func (s *RegStorageGossip) merge(in map[string]gossipEntry) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, e := range in {
+		if err := validGossipEntry(name, e, now); err != nil {
+			log.Printf("Ignoring gossiped registration: %v", err)
+			continue
+		}
+		if current, ok := s.entries[name]; ok && !e.newerThan(current) {
+			continue
+		}
+		if e.Updated > s.clock {
+			s.clock = e.Updated
+		}
+		s.entries[name] = e
+	}
+	expired := now.Add(-s.tombstoneRetention).UnixNano()
+	for name, e := range s.entries {
+		if e.Deleted && e.Updated < expired {
+			delete(s.entries, name)
+		}
+	}
+}
+
+func (s *RegStorageGossip) state() map[string]gossipEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.entries)
+}
+
+// handover returns the state for a new process taking over, refusing any
+// more local writes until resume. Peers' changes still arrive, as the new
+// process will gossip them too.
+func (s *RegStorageGossip) handover() map[string]gossipEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handingOver = true
+	return maps.Clone(s.entries)
+}
+
+// resume accepts local writes again after a handover failed.
+func (s *RegStorageGossip) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handingOver = false
+}
+
+// sign returns the signature header for body, sent at now.
+func (s *RegStorageGossip) sign(body []byte, now time.Time) string {
+	t := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, s.secret)
+	_, _ = io.WriteString(mac, t+".")
+	_, _ = mac.Write(body)
+	return "t=" + t + ",sig=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks that body was signed with our secret within maxGossipSkew
+// of now.
+func (s *RegStorageGossip) verify(signature string, body []byte, now time.Time) error {
+	t, sig, _ := strings.Cut(signature, ",")
+	t, okT := strings.CutPrefix(t, "t=")
+	sig, okSig := strings.CutPrefix(sig, "sig=")
+	sent, err := strconv.ParseInt(t, 10, 64)
+	if !okT || !okSig || err != nil {
+		return errors.New("missing or malformed " + gossipSignatureHeader)
+	}
+	if d := now.Sub(time.Unix(sent, 0)); d > maxGossipSkew || d < -maxGossipSkew {
+		return errors.New("gossip signature has expired")
+	}
+	want := s.sign(body, time.Unix(sent, 0))
+	if !hmac.Equal([]byte(want), []byte(signature)) {
+		return errors.New("invalid gossip signature")
+	}
+	return nil
+}
+
+// readSigned reads a signed body from a peer and decodes the state in it.
+func (s *RegStorageGossip) readSigned(r io.Reader, signature string) (map[string]gossipEntry, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxGossipBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxGossipBody {
+		return nil, fmt.Errorf("gossip state over %d bytes", maxGossipBody)
+	}
+	if err := s.verify(signature, body, time.Now()); err != nil {
+		return nil, err
+	}
+	var in map[string]gossipEntry
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// handler serves a peer's push-pull exchange: it merges the peer's state and
+// returns ours. Both are signed with the shared secret.
+func (s *RegStorageGossip) handler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		methodNotAllowed(resp, http.MethodPost)
+		return
+	}
+	in, err := s.readSigned(req.Body, req.Header.Get(gossipSignatureHeader))
+	if err != nil {
+		writeProblem(resp, newProblem(http.StatusUnauthorized, err.Error()))
+		return
+	}
+	s.merge(in)
+	body, err := json.Marshal(s.state())
+	if err != nil {
+		errResp(resp, err)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set(gossipSignatureHeader, s.sign(body, time.Now()))
+	_, _ = resp.Write(body)
+}
+
+// Run exchanges state with a random peer every interval until ctx is done.
+// Peers are the base URLs of other instances.
+func (s *RegStorageGossip) Run(ctx context.Context, client *http.Client, peers []string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			peer := peers[rand.Intn(len(peers))]
+			if err := s.exchange(ctx, client, peer); err != nil {
+				log.Printf("Failed to gossip with %s: %v", peer, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *RegStorageGossip) exchange(ctx context.Context, client *http.Client, peer string) error {
+	body, err := json.Marshal(s.state())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+gossipPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(gossipSignatureHeader, s.sign(body, time.Now()))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned %s", resp.Status)
+	}
+	in, err := s.readSigned(resp.Body, resp.Header.Get(gossipSignatureHeader))
+	if err != nil {
+		return err
+	}
+	s.merge(in)
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testGossipSecret = []byte("0123456789abcdef")
+
+func gossipPeer(t *testing.T, origin string) (*RegStorageGossip, string) {
+	s := NewRegStorageGossip(origin, testGossipSecret)
+	rp := NewRegProxy(testConfig(), s)
+	srv := httptest.NewServer(rp.handler)
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+func TestGossipConverges(t *testing.T) {
+	// GIVEN two instances each with their own registration
+	a, _ := gossipPeer(t, "a")
+	b, bURL := gossipPeer(t, "b")
+	_ = a.Put(upstream{Name: "from-a", Callback: "http://a"})
+	_ = b.Put(upstream{Name: "from-b", Callback: "http://b"})
+
+	// WHEN they gossip once
+	if err := a.exchange(context.Background(), http.DefaultClient, bURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN both have both
+	for name, s := range map[string]*RegStorageGossip{"a": a, "b": b} {
+		if all, _ := s.All(); len(all) != 2 {
+			t.Errorf("instance %s expected both upstreams, got %v", name, all)
+		}
+	}
+
+	// WHEN one deletes and they gossip again
+	_ = b.Delete("from-a")
+	if err := a.exchange(context.Background(), http.DefaultClient, bURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN the deletion wins over the older registration
+	if all, _ := a.All(); len(all) != 1 {
+		t.Errorf("expected the deletion to propagate, got %v", all)
+	}
+}
+
+func TestGossipLatestWriteWins(t *testing.T) {
+	// GIVEN the same upstream registered on two instances, b later
+	a, _ := gossipPeer(t, "a")
+	b, bURL := gossipPeer(t, "b")
+	_ = a.Put(upstream{Name: "foo", Callback: "http://old"})
+	time.Sleep(time.Millisecond)
+	_ = b.Put(upstream{Name: "foo", Callback: "http://new"})
+
+	// WHEN
+	if err := a.exchange(context.Background(), http.DefaultClient, bURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN
+	for name, s := range map[string]*RegStorageGossip{"a": a, "b": b} {
+		if all, _ := s.All(); all["foo"].Callback != "http://new" {
+			t.Errorf("instance %s expected the latest registration, got %v", name, all)
+		}
+	}
+}
+
+func TestGossipRequiresSignature(t *testing.T) {
+	// GIVEN an instance, and a peer with a different secret
+	_, bURL := gossipPeer(t, "b")
+	other := NewRegStorageGossip("other", []byte("not-the-shared-secret"))
+	_ = other.Put(upstream{Name: "injected", Callback: "http://evil"})
+
+	// WHEN state is pushed unsigned, or signed with the wrong secret
+	body, _ := json.Marshal(other.state())
+	resp, err := http.Post(bURL+gossipPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	exchangeErr := other.exchange(context.Background(), http.DefaultClient, bURL)
+
+	// THEN both are refused
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected an unsigned exchange to be refused, got %d", resp.StatusCode)
+	}
+	if exchangeErr == nil {
+		t.Errorf("expected an exchange signed with another secret to be refused")
+	}
+}
+
+func TestGossipIgnoresInvalidEntries(t *testing.T) {
+	// GIVEN an instance
+	a := NewRegStorageGossip("a", testGossipSecret)
+	now := time.Now().UnixNano()
+
+	// WHEN a peer sends entries which are misnamed, invalid, or written in
+	// the future
+	a.merge(map[string]gossipEntry{
+		"billing": {Upstream: upstream{Name: "other", Callback: "http://billing"}, Updated: now, Origin: "b"},
+		"weight":  {Upstream: upstream{Name: "weight", Callback: "http://weight", Weight: -1}, Updated: now, Origin: "b"},
+		"future":  {Upstream: upstream{Name: "future", Callback: "http://future"}, Updated: time.Now().Add(time.Hour).UnixNano(), Origin: "b"},
+		"good":    {Upstream: upstream{Name: "good", Callback: "http://good"}, Updated: now, Origin: "b"},
+	})
+
+	// THEN only the valid one is taken
+	if all, _ := a.All(); len(all) != 1 || all["good"].Callback != "http://good" {
+		t.Errorf("expected only the valid entry, got %v", all)
+	}
+	// AND the clock isn't pushed into the future
+	if a.clock > time.Now().Add(maxGossipSkew).UnixNano() {
+		t.Errorf("expected the clock to stay bounded, got %d", a.clock)
+	}
+}
+
+func TestGossipForgetsDeletionsAfterRetention(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		retention time.Duration
+		forgotten bool
+	}{
+		{"default", defaultTombstoneRetention, false},
+		{"short", time.Millisecond, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// GIVEN a deleted upstream
+			a := NewRegStorageGossip("a", testGossipSecret)
+			a.tombstoneRetention = tc.retention
+			_ = a.Put(upstream{Name: "foo", Callback: "http://foo"})
+			_ = a.Delete("foo")
+			time.Sleep(5 * time.Millisecond)
+
+			// WHEN a peer's state is merged
+			a.merge(nil)
+
+			// THEN the deletion is only forgotten once past retention
+			if _, remembered := a.state()["foo"]; remembered == tc.forgotten {
+				t.Errorf("expected the deletion forgotten: %v, got state %v", tc.forgotten, a.state())
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=module=regproxy2 --go-grpc_out=. --go-grpc_opt=module=regproxy2 admin.proto
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"regproxy2/adminpb"
+)
+
+// grpcAdminService is the gRPC service in admin.proto, served by grpcAdmin
+var grpcAdminService = adminpb.Admin_ServiceDesc.ServiceName
+
+// maxGRPCMessage bounds the size of gRPC requests
+const maxGRPCMessage = 4 << 20
+
+// newGRPCAdmin makes the gRPC server for the admin service of admin.proto.
+func newGRPCAdmin(p *RegProxy) *grpc.Server {
+	s := grpc.NewServer(grpc.MaxRecvMsgSize(maxGRPCMessage), grpc.UnaryInterceptor(grpcStatusInterceptor))
+	adminpb.RegisterAdminServer(s, &grpcAdminServer{p: p})
+	return s
+}
+
+// grpcAdmin serves the admin service through the management API's mux, so
+// it's behind the same listeners and auth. gRPC needs HTTP/2, so only TLS
+// listeners can serve it.
+func (p *RegProxy) grpcAdmin(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		writeProblem(resp, newProblem(http.StatusUnsupportedMediaType, "Expected a gRPC request"))
+		return
+	}
+	// The server only knows the method by its own path, not one under the
+	// API's version prefix
+	req = req.Clone(req.Context())
+	req.URL.Path = "/" + grpcAdminService + "/" + req.PathValue("method")
+	p.grpc.ServeHTTP(resp, req)
+}
+
+// grpcStatusInterceptor gives errors from storage and the registry the gRPC
+// status codes they correspond to.
+func grpcStatusInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	resp, err := handler(ctx, req)
+	if err == nil {
+		return resp, nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return nil, err
+	}
+	switch {
+	case errors.Is(err, errStorageConflict):
+		return nil, status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, errHandingOver):
+		return nil, status.Error(codes.Unavailable, err.Error())
+	default:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+}
+
+// grpcAdminServer implements the admin service. As over HTTP, writes honour
+// If-Match and If-None-Match, sent as metadata, and the ETag of an upstream
+// put is returned as etag metadata.
+type grpcAdminServer struct {
+	adminpb.UnimplementedAdminServer
+	p *RegProxy
+}
+
+func (s *grpcAdminServer) ListUpstreams(context.Context, *adminpb.ListUpstreamsRequest) (*adminpb.ListUpstreamsResponse, error) {
+	list, err := s.p.sortedUpstreams()
+	if err != nil {
+		return nil, err
+	}
+	out := &adminpb.ListUpstreamsResponse{}
+	for _, u := range list {
+		u.Callback = redactCallback(u.Callback)
+		out.Upstreams = append(out.Upstreams, upstreamMessage(u))
+	}
+	return out, nil
+}
+
+func (s *grpcAdminServer) GetUpstream(_ context.Context, in *adminpb.GetUpstreamRequest) (*adminpb.Upstream, error) {
+	u, err := s.lookup(in.GetName())
+	if err != nil {
+		return nil, err
+	}
+	return upstreamMessage(u), nil
+}
+
+func (s *grpcAdminServer) PutUpstream(ctx context.Context, in *adminpb.Upstream) (*adminpb.Upstream, error) {
+	u, err := upstreamFromMessage(in)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if u.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Upstream needs a name")
+	}
+	if err := s.p.validateRegistration(u); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	h := grpcConditions(ctx)
+	s.p.writeLock.Lock()
+	defer s.p.writeLock.Unlock()
+	existing, exists, err := s.p.lookupUpstream(u.Name)
+	if err != nil {
+		return nil, err
+	}
+	if msg := failedPrecondition(h, existing, exists); msg != "" {
+		return nil, status.Error(codes.FailedPrecondition, msg)
+	}
+	// As over HTTP, don't let a put silently take over a name another
+	// consumer holds
+	if exists && h.Get("If-Match") == "" && existing.Callback != u.Callback {
+		return nil, status.Errorf(codes.AlreadyExists, "Upstream [%s] is already registered with a different callback, put it with if-match to replace it", u.Name)
+	}
+	keepPaused(&u, existing, exists)
+	if !exists || !reflect.DeepEqual(existing, u) {
+		log.Printf("Adding upstream %v", u)
+		if err := s.p.storage.Put(u); err != nil {
+			return nil, err
+		}
+		s.p.registryChanged()
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs("etag", etag(u))); err != nil {
+		log.Printf("Failed to set the gRPC etag metadata: %v", err)
+	}
+	return upstreamMessage(u), nil
+}
+
+func (s *grpcAdminServer) DeleteUpstream(ctx context.Context, in *adminpb.DeleteUpstreamRequest) (*adminpb.DeleteUpstreamResponse, error) {
+	s.p.writeLock.Lock()
+	defer s.p.writeLock.Unlock()
+	u, err := s.lookup(in.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if msg := failedPrecondition(grpcConditions(ctx), u, true); msg != "" {
+		return nil, status.Error(codes.FailedPrecondition, msg)
+	}
+	log.Printf("Removing upstream %v", u)
+	if err := s.p.storage.Delete(u.Name); err != nil {
+		return nil, err
+	}
+	s.p.registryChanged()
+	return &adminpb.DeleteUpstreamResponse{}, nil
+}
+
+func (s *grpcAdminServer) GetStats(context.Context, *adminpb.GetStatsRequest) (*adminpb.Stats, error) {
+	return s.p.grpcStats()
+}
+
+func (s *grpcAdminServer) lookup(name string) (upstream, error) {
+	u, ok, err := s.p.lookupUpstream(name)
+	if err != nil {
+		return upstream{}, err
+	}
+	if !ok {
+		return upstream{}, status.Errorf(codes.NotFound, "No upstream named [%s]", name)
+	}
+	return u, nil
+}
+
+// grpcConditions is the if-match and if-none-match metadata of a call, as the
+// headers the HTTP API takes them in.
+func grpcConditions(ctx context.Context) http.Header {
+	md, _ := metadata.FromIncomingContext(ctx)
+	h := make(http.Header)
+	for _, k := range []string{"If-Match", "If-None-Match"} {
+		for _, v := range md.Get(k) {
+			h.Add(k, v)
+		}
+	}
+	return h
+}
+
+func (p *RegProxy) grpcStats() (*adminpb.Stats, error) {
+	stats, err := p.stats()
+	if err != nil {
+		return nil, err
+	}
+	var metrics strings.Builder
+	p.metrics.write(&metrics)
+	out := &adminpb.Stats{
+		Upstreams:             int32(stats.Upstreams),
+		RequestsInFlight:      stats.RequestsInFlight,
+		UpstreamCallsInFlight: stats.UpstreamCallsInFlight,
+		Leader:                stats.Leader,
+		QueuedRequests:        int64(stats.QueuedRequests),
+		Metrics:               metrics.String(),
+		UpstreamBytes:         byteCountMessages(stats.UpstreamBytes),
+		TenantBytes:           byteCountMessages(stats.TenantBytes),
+	}
+	for _, s := range stats.SLOs {
+		out.Slos = append(out.Slos, &adminpb.UpstreamSLO{Upstream: s.Upstream, Target: s.Target, BurnRates: s.BurnRates})
+	}
+	if len(stats.Connections) > 0 {
+		out.Connections = make(map[string]*adminpb.ConnCounts, len(stats.Connections))
+	}
+	for name, c := range stats.Connections {
+		out.Connections[name] = &adminpb.ConnCounts{
+			Open:           int64(c.Open),
+			Idle:           int64(c.Idle),
+			Reused:         c.Reused,
+			New:            c.New,
+			DialErrors:     c.DialErrors,
+			TlsHandshakes:  c.TLSHandshakes,
+			TlsHandshakeMs: c.TLSHandshakeMs,
+		}
+	}
+	return out, nil
+}
+
+func byteCountMessages(byName map[string]byteCounts) map[string]*adminpb.ByteCounts {
+	if len(byName) == 0 {
+		return nil
+	}
+	out := make(map[string]*adminpb.ByteCounts, len(byName))
+	for name, c := range byName {
+		out[name] = &adminpb.ByteCounts{Sent: c.Sent, Received: c.Received}
+	}
+	return out
+}
+
+// upstreamMessage is u as an Upstream message.
+func upstreamMessage(u upstream) *adminpb.Upstream {
+	full, _ := json.Marshal(u)
+	return &adminpb.Upstream{
+		Name:     u.Name,
+		Callback: u.Callback,
+		Priority: int32(u.Priority),
+		Weight:   int32(u.Weight),
+		Group:    u.Group,
+		Labels:   u.Labels,
+		Json:     string(full),
+	}
+}
+
+// upstreamFromMessage is the upstream in an Upstream message, starting from
+// its json field and overriding that with the other fields set.
+func upstreamFromMessage(m *adminpb.Upstream) (upstream, error) {
+	var u upstream
+	if m.GetJson() != "" {
+		if err := json.Unmarshal([]byte(m.GetJson()), &u); err != nil {
+			return upstream{}, fmt.Errorf("invalid json: %w", err)
+		}
+	}
+	u.Name = cmp.Or(m.GetName(), u.Name)
+	u.Callback = cmp.Or(m.GetCallback(), u.Callback)
+	u.Priority = cmp.Or(int(m.GetPriority()), u.Priority)
+	u.Weight = cmp.Or(int(m.GetWeight()), u.Weight)
+	u.Group = cmp.Or(m.GetGroup(), u.Group)
+	if m.GetLabels() != nil {
+		u.Labels = m.GetLabels()
+	}
+	return u, nil
+}
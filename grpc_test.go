@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"regproxy2/adminpb"
+)
+
+// withGRPCAdmin runs rp on a TLS listener, speaking HTTP/2, and calls f with
+// a client of its admin service.
+func withGRPCAdmin(t *testing.T, rp *RegProxy, f func(adminpb.AdminClient, *grpc.ClientConn)) {
+	srv := httptest.NewUnstartedServer(rp.handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	conn, err := grpc.NewClient(strings.TrimPrefix(srv.URL, "https://"), grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(roots, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f(adminpb.NewAdminClient(conn), conn)
+}
+
+func TestGRPCAdmin(t *testing.T) {
+	// GIVEN the admin service
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withGRPCAdmin(t, rp, func(client adminpb.AdminClient, conn *grpc.ClientConn) {
+		ctx := context.Background()
+
+		// WHEN an upstream is put, with options from json
+		want := upstream{Name: "foo", Callback: "http://foo", Priority: -1, Weight: 2, Labels: map[string]string{"team": "a"}, PathMode: pathPrefix}
+		_, err := client.PutUpstream(ctx, &adminpb.Upstream{
+			Name:     "foo",
+			Callback: "http://foo",
+			Priority: -1,
+			Weight:   2,
+			Labels:   map[string]string{"team": "a"},
+			Json:     `{"pathMode":"prefix","callback":"http://ignored"}`,
+		})
+
+		// THEN it is registered
+		if err != nil {
+			t.Fatalf("expected OK, got %v", err)
+		}
+		stored, _, _ := rp.lookupUpstream("foo")
+		if !reflect.DeepEqual(stored, want) {
+			t.Errorf("unexpected upstream %+v", stored)
+		}
+
+		// AND can be read back
+		out, err := client.GetUpstream(ctx, &adminpb.GetUpstreamRequest{Name: "foo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := upstreamFromMessage(out); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected GetUpstream %+v %v", got, err)
+		}
+		list, err := client.ListUpstreams(ctx, &adminpb.ListUpstreamsRequest{})
+		if err != nil || len(list.GetUpstreams()) != 1 {
+			t.Errorf("expected one upstream listed, got %v %v", list, err)
+		}
+
+		// AND counted in the stats
+		stats, err := client.GetStats(ctx, &adminpb.GetStatsRequest{})
+		if err != nil || stats.GetUpstreams() != 1 || !strings.Contains(stats.GetMetrics(), "regproxy_requests_in_flight") {
+			t.Errorf("unexpected stats %v %v", stats, err)
+		}
+
+		// WHEN deleted THEN it's gone
+		if _, err := client.DeleteUpstream(ctx, &adminpb.DeleteUpstreamRequest{Name: "foo"}); err != nil {
+			t.Errorf("expected OK, got %v", err)
+		}
+		if _, err := client.GetUpstream(ctx, &adminpb.GetUpstreamRequest{Name: "foo"}); status.Code(err) != codes.NotFound {
+			t.Errorf("expected NOT_FOUND, got %v", err)
+		}
+
+		// WHEN an invalid upstream is put THEN it's refused
+		if _, err := client.PutUpstream(ctx, &adminpb.Upstream{Name: "bad", Callback: "kafka://"}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected INVALID_ARGUMENT, got %v", err)
+		}
+		err = conn.Invoke(ctx, "/"+grpcAdminService+"/Nope", &adminpb.GetStatsRequest{}, &adminpb.Stats{})
+		if status.Code(err) != codes.Unimplemented {
+			t.Errorf("expected UNIMPLEMENTED, got %v", err)
+		}
+	})
+}
+
+func TestGRPCAdminPutConflicts(t *testing.T) {
+	// GIVEN a registered upstream
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: map[string]upstream{"foo": {Name: "foo", Callback: "http://blue"}}})
+	withGRPCAdmin(t, rp, func(client adminpb.AdminClient, _ *grpc.ClientConn) {
+		green := &adminpb.Upstream{Name: "foo", Callback: "http://green"}
+
+		for _, test := range []struct {
+			name     string
+			md       metadata.MD
+			code     codes.Code
+			callback string
+		}{
+			{"taking over its name", nil, codes.AlreadyExists, "http://blue"},
+			{"with a stale ETag", metadata.Pairs("if-match", `"stale"`), codes.FailedPrecondition, "http://blue"},
+			{"only if it doesn't exist", metadata.Pairs("if-none-match", "*"), codes.FailedPrecondition, "http://blue"},
+			{"with its ETag", metadata.Pairs("if-match", etag(upstream{Name: "foo", Callback: "http://blue"})), codes.OK, "http://green"},
+		} {
+			// WHEN it's put with a different callback
+			var header metadata.MD
+			ctx := metadata.NewOutgoingContext(context.Background(), test.md)
+			_, err := client.PutUpstream(ctx, green, grpc.Header(&header))
+
+			// THEN it's only replaced given its ETag
+			stored, _, _ := rp.lookupUpstream("foo")
+			if status.Code(err) != test.code || stored.Callback != test.callback {
+				t.Errorf("%s: expected %s leaving %s, got %v leaving %s", test.name, test.code, test.callback, err, stored.Callback)
+			}
+			if err == nil && (len(header.Get("etag")) != 1 || header.Get("etag")[0] != etag(stored)) {
+				t.Errorf("%s: expected the ETag of the upstream put, got %q", test.name, header.Get("etag"))
+			}
+		}
+	})
+}
+
+func TestGRPCAdminIsManagementAPI(t *testing.T) {
+	// GIVEN a TLS listener, speaking HTTP/2
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	srv := httptest.NewUnstartedServer(rp.handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// WHEN the service is called under the API's version prefix
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+apiPrefix+"/"+grpcAdminService+"/ListUpstreams", bytes.NewReader(make([]byte, 5)))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	// THEN it's served as the other management endpoints are, rather than
+	// proxied
+	if resp.StatusCode != http.StatusOK || resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("expected a gRPC answer, got %d %v", resp.StatusCode, resp.Trailer)
+	}
+}
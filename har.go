@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// harRedactedHeaders have their values replaced in captured exchanges, as
+// they carry credentials.
+var harRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// harRecorder keeps the most recent of a sample of upstream calls, to be
+// exported as a HAR (HTTP Archive) for browser devtools or replay tooling.
+// Bodies are cut and redacted by the body logging rules, and credentials
+// are left out of headers.
+type harRecorder struct {
+	sample float64
+	bodies *bodyLogger
+
+	mu      sync.Mutex
+	entries []harEntry
+	// next is where the next entry goes once entries is full
+	next int
+}
+
+// newHARRecorder returns nil if no exchanges are to be captured.
+func newHARRecorder(cfg Config) *harRecorder {
+	if cfg.HARSample <= 0 || cfg.HAREntries <= 0 {
+		return nil
+	}
+	return &harRecorder{
+		sample: cfg.HARSample,
+		bodies: &bodyLogger{
+			maxBytes: cfg.BodyLogMaxBytes,
+			fields:   cfg.BodyLogRedactFields,
+			patterns: cfg.BodyLogRedactPatterns,
+		},
+		entries: make([]harEntry, 0, cfg.HAREntries),
+	}
+}
+
+// sampled decides whether a request's upstream calls are captured.
+func (h *harRecorder) sampled() bool {
+	return h != nil && rand.Float64() < h.sample
+}
+
+func (h *harRecorder) add(e harEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, e)
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// log returns the captured exchanges, oldest first.
+func (h *harRecorder) log() harLog {
+	l := harLog{Version: "1.2", Creator: harCreator{Name: "regproxy", Version: currentBuild().Version}, Entries: []harEntry{}}
+	if h == nil {
+		return l
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l.Entries = append(l.Entries, h.entries[h.next:]...)
+	l.Entries = append(l.Entries, h.entries[:h.next]...)
+	return l
+}
+
+// startHAR begins capturing a call to ups, if req was sampled. The URL is
+// taken before any secrets in the upstream's registration are resolved.
+func (p *RegProxy) startHAR(req *http.Request, body *requestBody, ups upstream, callback *url.URL, started time.Time) *harExchange {
+	d := deliveryFrom(req.Context())
+	if p.har == nil || d == nil || !d.har {
+		return nil
+	}
+	target := p.callTarget(req, ups, callback)
+	e := harEntry{
+		StartedDateTime: started,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         target.Redacted(),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: harQuery(target.Query()),
+			HeadersSize: -1,
+			BodySize:    body.size,
+		},
+		Cache:     struct{}{},
+		Upstream:  ups.Name,
+		RequestID: d.requestID,
+	}
+	if body.size > 0 {
+		r := body.reader()
+		defer r.Close()
+		head, err := io.ReadAll(io.LimitReader(r, p.har.bodies.maxBytes+1))
+		if err != nil {
+			log.Printf("Failed to read body of request %s to capture it: %v", d.requestID, err)
+		}
+		mimeType := req.Header.Get("Content-Type")
+		text, comment := p.har.text(mimeType, head, body.size)
+		e.Request.PostData = &harPostData{MimeType: mimeType, Text: text, Params: []harNameValue{}, Comment: comment}
+	}
+	return &harExchange{h: p.har, entry: e}
+}
+
+// harExchange is a call being captured.
+type harExchange struct {
+	h     *harRecorder
+	entry harEntry
+}
+
+// finish records the upstream's response, once its body has been read and
+// closed, or the error calling it.
+func (x *harExchange) finish(resp *http.Response, err error) *http.Response {
+	if x == nil {
+		return resp
+	}
+	e := x.entry
+	waited := time.Since(e.StartedDateTime)
+	e.Timings = harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: ms(waited)}
+	if resp == nil {
+		e.Time = e.Timings.Wait
+		e.Response = harResponse{HTTPVersion: "HTTP/1.1", Cookies: []harNameValue{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		x.h.add(e)
+		return resp
+	}
+	resp.Body = &loggedBody{ReadCloser: resp.Body, max: x.h.bodies.maxBytes, done: func(head []byte, size int64) {
+		e.Timings.Receive = ms(time.Since(e.StartedDateTime) - waited)
+		e.Time = e.Timings.Wait + e.Timings.Receive
+		mimeType := resp.Header.Get("Content-Type")
+		text, comment := x.h.text(mimeType, head, size)
+		_, statusText, _ := strings.Cut(resp.Status, " ")
+		e.Response = harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  statusText,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(resp.Header),
+			Content:     harContent{Size: size, MimeType: mimeType, Text: text, Comment: comment},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    size,
+		}
+		x.h.add(e)
+	}}
+	return resp
+}
+
+// text returns the capturable form of the first bytes of a body of size
+// bytes, with a comment if it was cut or left out.
+func (h *harRecorder) text(mimeType string, head []byte, size int64) (string, string) {
+	s, truncated, ok := h.bodies.redactText(mimeType, head, size)
+	switch {
+	case !ok:
+		return "", "not captured, JSON which can't be parsed in full to redact it"
+	case truncated:
+		return s, fmt.Sprintf("truncated to %d bytes", h.bodies.maxBytes)
+	}
+	return s, ""
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			for _, r := range harRedactedHeaders {
+				if strings.EqualFold(name, r) {
+					v = redacted
+				}
+			}
+			headers = append(headers, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+func harQuery(q url.Values) []harNameValue {
+	params := []harNameValue{}
+	for name, values := range q {
+		for _, v := range values {
+			params = append(params, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(params, func(i, j int) bool { return params[i].Name < params[j].Name })
+	return params
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// harExport handles GET /admin/har, answering with the captured exchanges.
+func (p *RegProxy) harExport(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		methodNotAllowed(resp, http.MethodGet, http.MethodHead)
+		return
+	}
+	resp.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "regproxy.har"}))
+	writeJSON(resp, http.StatusOK, harFile{Log: p.har.log()})
+}
+
+// The HAR 1.2 format, http://www.softwareishard.com/blog/har-12-spec/, with
+// custom fields prefixed by an underscore.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Upstream        string      `json:"_upstream"`
+	RequestID       string      `json:"_requestId"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []harNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
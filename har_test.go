@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHARExport(t *testing.T) {
+	// GIVEN every request captured, redacting a field
+	cfg := testConfig()
+	cfg.HARSample = 1
+	cfg.HAREntries = 2
+	cfg.BodyLogMaxBytes = 1024
+	cfg.BodyLogRedactFields = []string{"patient.name"}
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.Header().Set("Content-Type", "text/plain")
+			rr.WriteHeader(http.StatusCreated)
+			_, _ = io.WriteString(rr, "created "+req.URL.Query().Get("n"))
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "records", Callback: srv.URL}, t)
+
+		// WHEN more requests are made than are kept
+		for _, n := range []string{"1", "2", "3"} {
+			req, _ := http.NewRequest("POST", url+"/records?n="+n, strings.NewReader(`{"patient":{"name":"Ann","age":40}}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer secret")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+		}
+		resp, err := http.Get(url + "/admin/har")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var har harFile
+		if err := json.NewDecoder(resp.Body).Decode(&har); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the most recent calls are exported, oldest first
+		if har.Log.Version != "1.2" || len(har.Log.Entries) != 2 {
+			t.Fatalf("expected 2 entries, got %+v", har.Log)
+		}
+		for i, e := range har.Log.Entries {
+			n := []string{"2", "3"}[i]
+			if e.Upstream != "records" || e.Request.Method != "POST" || e.Request.URL != srv.URL+"/records?n="+n {
+				t.Errorf("expected the call to records for request %s, got %s %s to %s", n, e.Request.Method, e.Request.URL, e.Upstream)
+			}
+			// AND bodies and credentials are redacted
+			if e.Request.PostData == nil || e.Request.PostData.Text != `{"patient":{"age":40,"name":"[REDACTED]"}}` {
+				t.Errorf("expected the redacted request body, got %+v", e.Request.PostData)
+			}
+			for _, h := range e.Request.Headers {
+				if h.Name == "Authorization" && h.Value != redacted {
+					t.Errorf("expected the Authorization header to be redacted, got %s", h.Value)
+				}
+			}
+			// AND the upstream's response is captured
+			if e.Response.Status != 201 || e.Response.StatusText != "Created" || e.Response.Content.Text != "created "+n {
+				t.Errorf("expected the upstream's response, got %+v", e.Response)
+			}
+		}
+	})
+}
+
+func TestHARExportEmpty(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// WHEN nothing is being captured
+		resp, err := http.Get(url + "/admin/har")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		// THEN the archive is empty, but valid
+		if resp.StatusCode != 200 || !strings.Contains(string(body), `"entries":[]`) {
+			t.Errorf("expected an empty archive, got %v %s", resp.StatusCode, body)
+		}
+	})
+}
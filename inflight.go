@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// callLimiter caps the number of upstream calls in flight across every
+// proxied request, so that a burst of traffic sheds load instead of
+// spawning an unbounded number of goroutines and connections.
+type callLimiter struct {
+	limit    int64
+	sem      *semaphore.Weighted
+	inFlight atomic.Int64
+}
+
+// newCallLimiter returns a limiter allowing limit concurrent calls, or no
+// limit at all if limit is zero or less.
+func newCallLimiter(limit int64) *callLimiter {
+	l := &callLimiter{limit: limit}
+	if limit > 0 {
+		l.sem = semaphore.NewWeighted(limit)
+	}
+	return l
+}
+
+// tryAcquire reserves n call slots without waiting, returning the number
+// reserved (to hand back to release) and whether there was room.
+// A single request wanting more slots than the whole limit gets the whole
+// limit, rather than never being able to run.
+func (l *callLimiter) tryAcquire(n int64) (int64, bool) {
+	if l.sem != nil {
+		n = min(n, l.limit)
+		if !l.sem.TryAcquire(n) {
+			return 0, false
+		}
+	}
+	l.inFlight.Add(n)
+	return n, true
+}
+
+func (l *callLimiter) release(n int64) {
+	l.inFlight.Add(-n)
+	if l.sem != nil {
+		l.sem.Release(n)
+	}
+}
+
+// callSlots is the most upstream calls a mode makes at once for a request.
+func callSlots(mode string, upstreams int) int64 {
+	switch mode {
+	case modeSequential, modeFailover, modeBalance:
+		return 1
+	case modeQueue:
+		// Queued requests are bounded by the queue length instead
+		return 0
+	default:
+		return int64(upstreams)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCallLimiter(t *testing.T) {
+	l := newCallLimiter(3)
+	n, ok := l.tryAcquire(2)
+	if !ok || n != 2 {
+		t.Fatalf("expected to acquire 2 slots, got %d %v", n, ok)
+	}
+	if _, ok := l.tryAcquire(2); ok {
+		t.Errorf("expected acquire beyond the limit to fail")
+	}
+	l.release(n)
+	// More than the whole limit is capped to it
+	n, ok = l.tryAcquire(5)
+	if !ok || n != 3 {
+		t.Errorf("expected to acquire all 3 slots, got %d %v", n, ok)
+	}
+}
+
+func TestCallLimiterUnlimited(t *testing.T) {
+	l := newCallLimiter(0)
+	for i := 0; i < 10; i++ {
+		if _, ok := l.tryAcquire(1000); !ok {
+			t.Fatal("expected an unlimited limiter to always succeed")
+		}
+	}
+	if l.inFlight.Load() != 10000 {
+		t.Errorf("expected in flight to be tracked, got %d", l.inFlight.Load())
+	}
+}
+
+func TestMaxUpstreamCalls(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxUpstreamCalls = 2
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN two slow upstreams, which use up every call slot
+		handler := http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+		})
+		testServer1 := httptest.NewServer(handler)
+		testServer2 := httptest.NewServer(handler)
+		defer testServer1.Close()
+		defer testServer2.Close()
+		register(url, upstream{Name: "foo", Callback: testServer1.URL}, t)
+		register(url, upstream{Name: "bar", Callback: testServer2.URL}, t)
+		first := make(chan int)
+		go func() {
+			r, err := http.Get(url)
+			if err != nil {
+				t.Error(err)
+				first <- 0
+				return
+			}
+			first <- r.StatusCode
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		// WHEN another request arrives
+		r, err := http.Get(url)
+
+		// THEN it is turned away
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 503 || r.Header.Get("Retry-After") == "" {
+			t.Errorf("expected 503 with Retry-After, got %v", r.StatusCode)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("expected problem+json, got %s", ct)
+		}
+		// AND the first request is unaffected
+		if status := <-first; status != 200 {
+			t.Errorf("expected 200 for the first request, got %v", status)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// maxSchemaErrors bounds how many problems with a payload are reported
+const maxSchemaErrors = 10
+
+// schemaURL is where a compiled schema is taken to live, so that its own
+// references resolve, while references to any other document don't load.
+const schemaURL = "mem:///schema.json"
+
+// jsonSchema is a JSON Schema which request bodies are validated against,
+// of draft 2020-12 unless it says otherwise with $schema. Formats are only
+// annotations, as the spec has them by default.
+type jsonSchema struct {
+	schema *jsonschema.Schema
+}
+
+// compileJSONSchema parses a schema, checking its patterns and references
+// up front so that a typo fails at startup rather than on every request.
+// References can only be within the schema: nothing is loaded from files
+// or the network.
+func compileJSONSchema(b []byte) (*jsonSchema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	c := jsonschema.NewCompiler()
+	c.UseLoader(jsonschema.SchemeURLLoader{})
+	if err := c.AddResource(schemaURL, doc); err != nil {
+		return nil, err
+	}
+	schema, err := c.Compile(schemaURL)
+	if err != nil {
+		return nil, err
+	}
+	// References which only lead back to themselves are found when
+	// validating, so try it, as any value will follow them
+	var verr *jsonschema.ValidationError
+	if errors.As(schema.Validate(nil), &verr) && hasRefCycle(verr) {
+		return nil, fmt.Errorf("$ref is circular: %w", verr)
+	}
+	return &jsonSchema{schema: schema}, nil
+}
+
+func hasRefCycle(verr *jsonschema.ValidationError) bool {
+	if _, ok := verr.ErrorKind.(*kind.RefCycle); ok {
+		return true
+	}
+	return slices.ContainsFunc(verr.Causes, hasRefCycle)
+}
+
+// decodeJSONNumbers decodes a single JSON value, keeping numbers exact.
+func decodeJSONNumbers(r io.Reader) (any, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// validate returns the ways v doesn't match the schema, each prefixed with
+// the JSON pointer to where in v it is.
+func (s *jsonSchema) validate(v any) []string {
+	err := s.schema.Validate(v)
+	if err == nil {
+		return nil
+	}
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return []string{"/: " + err.Error()}
+	}
+	var errs []string
+	schemaErrors(verr, &errs)
+	return errs
+}
+
+// schemaErrors collects the innermost causes of a validation error, which
+// say what's wrong where, rather than which keywords of the schema failed.
+func schemaErrors(verr *jsonschema.ValidationError, errs *[]string) {
+	if len(verr.Causes) == 0 {
+		if len(*errs) < maxSchemaErrors {
+			at := ""
+			for _, token := range verr.InstanceLocation {
+				at += "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+			}
+			*errs = append(*errs, cmp.Or(at, "/")+": "+verr.ErrorKind.LocalizedString(schemaPrinter))
+		}
+		return
+	}
+	for _, cause := range verr.Causes {
+		schemaErrors(cause, errs)
+	}
+}
+
+// schemaPrinter words validation errors
+var schemaPrinter = message.NewPrinter(language.English)
+
+// schemaRule applies a schema to request bodies under a path prefix, or
+// arriving on a listener in an upstream group.
+type schemaRule struct {
+	prefix string
+	group  string
+	name   string
+	schema *jsonSchema
+}
+
+// parseSchemaRule parses path:<prefix>=<file> or group:<name>=<file>,
+// loading and compiling the schema in the file.
+func parseSchemaRule(s string) (schemaRule, error) {
+	matcher, file, _ := strings.Cut(s, "=")
+	kind, arg, _ := strings.Cut(matcher, ":")
+	r := schemaRule{name: strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))}
+	switch kind {
+	case "path":
+		r.prefix = arg
+	case "group":
+		r.group = arg
+	}
+	if file == "" || r.prefix == "" && r.group == "" {
+		return r, fmt.Errorf("expected path:<prefix>=<file> or group:<name>=<file>, got [%s]", s)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return r, err
+	}
+	if r.schema, err = compileJSONSchema(b); err != nil {
+		return r, fmt.Errorf("invalid JSON schema %s: %w", file, err)
+	}
+	return r, nil
+}
+
+func (r schemaRule) matches(req *http.Request, group string) bool {
+	if r.prefix != "" {
+		return strings.HasPrefix(req.URL.Path, r.prefix)
+	}
+	return r.group == group
+}
+
+// checkSchemas validates body against the schema of every rule req matches,
+// returning why it's invalid, or "" if it's valid or no rule applies. Probes
+// aren't checked, they carry whatever body they were set up with.
+func (p *RegProxy) checkSchemas(req *http.Request, group string, body *requestBody) string {
+	if len(p.cfg.JSONSchemas) == 0 || req.Context().Value(probeKey) != nil {
+		return ""
+	}
+	var v any
+	decoded := false
+	for _, r := range p.cfg.JSONSchemas {
+		if !r.matches(req, group) {
+			continue
+		}
+		if !decoded {
+			rd := body.reader()
+			var err error
+			v, err = decodeJSONNumbers(rd)
+			_ = rd.Close()
+			if err != nil {
+				p.metrics.invalidPayloads.inc(r.name)
+				return "Body isn't valid JSON: " + err.Error()
+			}
+			decoded = true
+		}
+		if errs := r.schema.validate(v); len(errs) > 0 {
+			p.metrics.invalidPayloads.inc(r.name)
+			return "Body doesn't match schema " + r.name + ": " + strings.Join(errs, "; ")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "items"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "pattern": "^ORD-[0-9]+$"},
+		"priority": {"enum": ["routine", "urgent"]},
+		"items": {"type": "array", "minItems": 1, "items": {"$ref": "#/$defs/item"}}
+	},
+	"$defs": {
+		"item": {
+			"type": "object",
+			"required": ["code"],
+			"properties": {
+				"code": {"type": "string", "minLength": 1},
+				"quantity": {"type": "integer", "minimum": 1}
+			}
+		}
+	}
+}`
+
+func TestJSONSchemaValidate(t *testing.T) {
+	s, err := compileJSONSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		body     string
+		expected []string
+	}{
+		{`{"id": "ORD-1", "items": [{"code": "FBC", "quantity": 2}]}`, nil},
+		{`{"id": "ORD-1", "items": [{"code": "FBC", "quantity": 2.0}], "priority": "urgent"}`, nil},
+		{`{"items": []}`, []string{"/: missing property 'id'", "/items: minItems: got 0, want 1"}},
+		{`{"id": "1", "items": [{"quantity": 0.5}]}`, []string{"/id: '1' does not match pattern '^ORD-[0-9]+$'", "/items/0/quantity: got number, want integer", "/items/0: missing property 'code'"}},
+		{`{"id": "ORD-1", "items": [{"code": "FBC"}], "priority": "soon", "extra": 1}`, []string{"/: additional properties 'extra' not allowed", "/priority: value must be one of 'routine', 'urgent'"}},
+		{`[]`, []string{"/: got array, want object"}},
+	} {
+		v, err := decodeJSONNumbers(strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := s.validate(v)
+		// Properties are visited in map order
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(c.expected, "\n") {
+			t.Errorf("%s: expected %q, got %q", c.body, c.expected, got)
+		}
+	}
+}
+
+func TestJSONSchemaCombinators(t *testing.T) {
+	s, err := compileJSONSchema([]byte(`{"oneOf": [{"type": "string"}, {"type": "number"}], "not": {"const": 0}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for body, valid := range map[string]bool{`"a"`: true, `1`: true, `0`: false, `true`: false} {
+		v, _ := decodeJSONNumbers(strings.NewReader(body))
+		if errs := s.validate(v); (len(errs) == 0) != valid {
+			t.Errorf("%s: expected valid %t, got %q", body, valid, errs)
+		}
+	}
+}
+
+func TestCompileJSONSchemaRejectsMistakes(t *testing.T) {
+	for _, schema := range []string{
+		`"object"`,
+		`{"pattern": "("}`,
+		`{"$ref": "#/$defs/missing"}`,
+		`{"$ref": "other.json"}`,
+		`{"$defs": {"a": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`,
+		`{} {}`,
+	} {
+		if _, err := compileJSONSchema([]byte(schema)); err == nil {
+			t.Errorf("expected %s to be rejected", schema)
+		}
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	// GIVEN orders must match a schema
+	file := filepath.Join(t.TempDir(), "order.json")
+	if err := os.WriteFile(file, []byte(orderSchema), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := parseSchemaRule("path:/orders=" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.JSONSchemas = []schemaRule{r}
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "lab", Callback: srv.URL}, t)
+		post := func(path, body string) int {
+			resp, err := http.Post(url+path, "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		// WHEN malformed orders are sent, THEN they're rejected before reaching the upstream
+		for _, body := range []string{`{"id": "ORD-1"}`, `not json`} {
+			if status := post("/orders", body); status != http.StatusUnprocessableEntity {
+				t.Errorf("%s: expected 422, got %v", body, status)
+			}
+		}
+		if calls.Load() != 0 {
+			t.Errorf("expected no upstream calls, got %d", calls.Load())
+		}
+		if n := rp.metrics.invalidPayloads.value("order"); n != 2 {
+			t.Errorf("expected 2 invalid payloads, got %v", n)
+		}
+		// AND valid orders, and other paths, go through
+		if status := post("/orders", `{"id": "ORD-1", "items": [{"code": "FBC"}]}`); status != http.StatusOK {
+			t.Errorf("expected 200 for a valid order, got %v", status)
+		}
+		if status := post("/results", `{}`); status != http.StatusOK {
+			t.Errorf("expected 200 for another path, got %v", status)
+		}
+	})
+}
+
+func TestParseSchemaRule(t *testing.T) {
+	for _, rule := range []string{"orders.json", "query:x=orders.json", "path:=orders.json", "path:/orders", "path:/orders=missing.json"} {
+		if _, err := parseSchemaRule(rule); err == nil {
+			t.Errorf("expected %s to be rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// jwksMinRefetch limits how often an unknown key ID causes the key set to be
+// fetched again early, so forged tokens can't hammer the JWKS endpoint
+const jwksMinRefetch = time.Minute
+
+// jwksInitialRetry is how soon the key set is fetched again while it never
+// has been, so a JWKS endpoint which was down at startup doesn't reject
+// every request for a minute
+const jwksInitialRetry = 5 * time.Second
+
+// jwtValidator checks the bearer token of proxied requests: a JWT signed by
+// one of the keys published at jwksURL, unexpired, and from issuer for
+// audience if they are set. Only asymmetric RS and ES algorithms are
+// accepted, so tokens can't be signed with the public keys themselves.
+type jwtValidator struct {
+	jwksURL  string
+	issuer   string
+	audience string
+	leeway   time.Duration
+	refresh  time.Duration
+	client   *http.Client
+	fetches  singleflight.Group
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+}
+
+// jwtClaims are the registered claims checked on tokens.
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *int64      `json:"exp"`
+	NotBefore *int64      `json:"nbf"`
+}
+
+// jwtAudience is a single audience or a list of them.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtAlgs are the accepted signature algorithms, by their hash and, for
+// ECDSA, the size of the signature's r and s.
+var jwtAlgs = map[string]struct {
+	hash crypto.Hash
+	size int
+}{
+	"RS256": {crypto.SHA256, 0},
+	"RS384": {crypto.SHA384, 0},
+	"RS512": {crypto.SHA512, 0},
+	"ES256": {crypto.SHA256, 32},
+	"ES384": {crypto.SHA384, 48},
+	"ES512": {crypto.SHA512, 66},
+}
+
+func newJWTValidator(cfg Config) *jwtValidator {
+	if cfg.JWKSURL == "" {
+		return nil
+	}
+	return &jwtValidator{
+		jwksURL:  cfg.JWKSURL,
+		issuer:   cfg.JWTIssuer,
+		audience: cfg.JWTAudience,
+		leeway:   cfg.JWTLeeway,
+		refresh:  cfg.JWKSRefresh,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// authenticate checks req's bearer token, if it needs one, writing a 401
+// and returning false if it isn't valid.
+func (v *jwtValidator) authenticate(resp http.ResponseWriter, req *http.Request) bool {
+	if v == nil || req.Context().Value(probeKey) != nil {
+		return true
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	var err error
+	if !ok {
+		err = errors.New("missing bearer token")
+	} else {
+		err = v.validate(req.Context(), strings.TrimSpace(token))
+	}
+	if err != nil {
+		log.Printf("Rejecting request %s: %v", req.URL.Path, err)
+		resp.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeProblem(resp, newProblem(http.StatusUnauthorized, "Invalid token: "+err.Error()))
+		return false
+	}
+	return true
+}
+
+func (v *jwtValidator) validate(ctx context.Context, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return err
+	}
+	alg, ok := jwtAlgs[header.Alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg.size != 0 || rsa.VerifyPKCS1v15(key, alg.hash, digest, sig) != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if alg.size == 0 || len(sig) != 2*alg.size || (key.Curve.Params().BitSize+7)/8 != alg.size ||
+			!ecdsa.Verify(key, digest, new(big.Int).SetBytes(sig[:alg.size]), new(big.Int).SetBytes(sig[alg.size:])) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("invalid signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return err
+	}
+	now := time.Now()
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(*claims.ExpiresAt, 0).Add(v.leeway)) {
+		return errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && now.Before(time.Unix(*claims.NotBefore, 0).Add(-v.leeway)) {
+		return errors.New("token isn't valid yet")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if v.audience != "" && !slices.Contains(claims.Audience, v.audience) {
+		return errors.New("token isn't for this audience")
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// key returns the key with ID kid, fetching the key set if it's due to be
+// refreshed, or early if kid is new, in case keys have been rotated. A key
+// we have is used while the set is refreshed in the background, and callers
+// waiting for a new key share one fetch, made without holding v.mu.
+func (v *jwtValidator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	due := !ok || time.Since(v.fetched) > v.refresh
+	retry := jwksMinRefetch
+	if v.fetched.IsZero() {
+		retry = jwksInitialRetry
+	}
+	due = due && time.Since(v.attempted) > retry
+	if due {
+		v.attempted = time.Now()
+	}
+	v.mu.Unlock()
+
+	if !due {
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}
+	// The fetch is shared, so it mustn't end when this caller gives up
+	refresh := v.fetches.DoChan("jwks", func() (any, error) {
+		return nil, v.refreshKeys(context.WithoutCancel(ctx))
+	})
+	if ok {
+		return key, nil
+	}
+	select {
+	case <-refresh:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	v.mu.Lock()
+	key, ok = v.keys[kid]
+	v.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// refreshKeys fetches the key set, carrying on with the keys we have if it
+// can't be fetched.
+func (v *jwtValidator) refreshKeys(ctx context.Context) error {
+	keys, err := v.fetch(ctx)
+	if err != nil {
+		log.Printf("Failed to fetch JWKS from %s: %v", v.jwksURL, err)
+		return err
+	}
+	v.mu.Lock()
+	v.keys, v.fetched = keys, time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *jwtValidator) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("malformed key")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("malformed key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point isn't on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
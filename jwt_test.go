@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeJWKS publishes signing keys, and signs tokens with them.
+type fakeJWKS struct {
+	srv *httptest.Server
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	keys  []map[string]string
+	calls int
+}
+
+func startFakeJWKS(t *testing.T) *fakeJWKS {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	pub, _ := ecKey.PublicKey.ECDH()
+	xy := pub.Bytes()
+	f := &fakeJWKS{rsa: rsaKey, ec: ecKey, keys: []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": b64(xy[1:33]), "y": b64(xy[33:])},
+	}}
+	f.srv = httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.calls++
+		writeJSON(rr, 200, map[string]any{"keys": f.keys})
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeJWKS) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	b64 := func(v any) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := b64(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + b64(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, f.rsa, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, f.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwtTestConfig(jwks string) Config {
+	cfg := testConfig()
+	cfg.JWKSURL = jwks
+	cfg.JWKSRefresh = time.Hour
+	cfg.JWTIssuer = "https://issuer.test"
+	cfg.JWTAudience = "regproxy"
+	cfg.JWTLeeway = time.Minute
+	return cfg
+}
+
+func TestJWTValidation(t *testing.T) {
+	f := startFakeJWKS(t)
+	v := newJWTValidator(jwtTestConfig(f.srv.URL))
+	now := time.Now().Unix()
+	valid := map[string]any{"iss": "https://issuer.test", "aud": []string{"other", "regproxy"}, "exp": now + 60}
+	with := func(k string, val any) map[string]any {
+		c := map[string]any{}
+		for k, v := range valid {
+			c[k] = v
+		}
+		if val == nil {
+			delete(c, k)
+		} else {
+			c[k] = val
+		}
+		return c
+	}
+	rs := f.sign(t, "RS256", "rsa-1", valid)
+	for _, tc := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", rs, true},
+		{"ES256", f.sign(t, "ES256", "ec-1", valid), true},
+		{"single audience", f.sign(t, "RS256", "rsa-1", with("aud", "regproxy")), true},
+		{"within leeway", f.sign(t, "RS256", "rsa-1", with("exp", now-30)), true},
+		{"expired", f.sign(t, "RS256", "rsa-1", with("exp", now-120)), false},
+		{"no expiry", f.sign(t, "RS256", "rsa-1", with("exp", nil)), false},
+		{"not yet valid", f.sign(t, "RS256", "rsa-1", with("nbf", now+120)), false},
+		{"wrong issuer", f.sign(t, "RS256", "rsa-1", with("iss", "https://evil.test")), false},
+		{"wrong audience", f.sign(t, "RS256", "rsa-1", with("aud", "other")), false},
+		{"unknown key", f.sign(t, "RS256", "rsa-2", valid), false},
+		{"key of another type", f.sign(t, "RS256", "ec-1", valid), false},
+		{"tampered", rs[:len(rs)-4] + "AAAA", false},
+		{"alg none", f.sign(t, "none", "rsa-1", valid), false},
+		{"malformed", "not.a.jwt", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := v.validate(context.Background(), tc.token)
+			if (err == nil) != tc.ok {
+				t.Errorf("expected ok %v, got %v", tc.ok, err)
+			}
+		})
+	}
+	if f.calls != 1 {
+		t.Errorf("expected the JWKS to be fetched once, got %d", f.calls)
+	}
+
+	// WHEN a key is rotated in, and tokens signed with it
+	f.mu.Lock()
+	f.keys[0]["kid"] = "rsa-2"
+	f.mu.Unlock()
+	v.attempted = time.Time{}
+
+	// THEN the new key is fetched
+	if err := v.validate(context.Background(), f.sign(t, "RS256", "rsa-2", valid)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJWTRequired(t *testing.T) {
+	f := startFakeJWKS(t)
+	withRegProxyConfig(t, jwtTestConfig(f.srv.URL), func(url string, t *testing.T) {
+		// GIVEN
+		called := false
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			called = true
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "foo", Callback: srv.URL}, t)
+
+		// WHEN a request has no token
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it is rejected before reaching any upstream
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" || called {
+			t.Errorf("expected 401 without calling upstream, got %v, called %v", resp.StatusCode, called)
+		}
+
+		// WHEN a request has a valid token
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+f.sign(t, "ES256", "ec-1", map[string]any{
+			"iss": "https://issuer.test", "aud": "regproxy", "exp": time.Now().Unix() + 60,
+		}))
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it is proxied
+		if resp.StatusCode != 200 || !called {
+			t.Errorf("expected 200 from upstream, got %v, called %v", resp.StatusCode, called)
+		}
+	})
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	// GIVEN a JWKS endpoint which is down when the proxy starts
+	f := startFakeJWKS(t)
+	var down atomic.Bool
+	down.Store(true)
+	jwks := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+		if down.Load() {
+			rr.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		f.srv.Config.Handler.ServeHTTP(rr, req)
+	}))
+	defer jwks.Close()
+	v := newJWTValidator(jwtTestConfig(jwks.URL))
+	token := f.sign(t, "RS256", "rsa-1", map[string]any{
+		"iss": "https://issuer.test", "aud": "regproxy", "exp": time.Now().Unix() + 60,
+	})
+	if err := v.validate(context.Background(), token); err == nil {
+		t.Fatal("expected no keys while the JWKS is down")
+	}
+
+	// WHEN it's back, sooner than the early refetch limit
+	down.Store(false)
+	v.attempted = time.Now().Add(-jwksInitialRetry - time.Second)
+
+	// THEN the key set is fetched again
+	if err := v.validate(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN it's down again as the key set is due to be refreshed
+	down.Store(true)
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-2 * time.Hour)
+	v.attempted = time.Time{}
+	v.mu.Unlock()
+
+	// THEN the keys already known are still used
+	if err := v.validate(context.Background(), token); err != nil {
+		t.Error(err)
+	}
+	// AND once the refresh in the background has failed
+	v.fetches.Do("jwks", func() (any, error) { return nil, nil })
+	if err := v.validate(context.Background(), token); err != nil {
+		t.Error(err)
+	}
+}
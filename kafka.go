@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+const kafkaClientID = "regproxy"
+
+// kafkaTimeout bounds dialing a broker and each request to one
+const kafkaTimeout = 10 * time.Second
+
+// kafkaProducers holds a writer per set of bootstrap brokers, credentials
+// and topic, so upstreams publishing to the same topic share connections to
+// its partition leaders.
+type kafkaProducers struct {
+	// tlsConfig is the base of the config for brokers connected to over
+	// TLS, verifying them against the system roots if nil
+	tlsConfig *tls.Config
+
+	mu      sync.Mutex
+	writers map[string]*kafka.Writer
+}
+
+func newKafkaProducers() *kafkaProducers {
+	return &kafkaProducers{writers: make(map[string]*kafka.Writer)}
+}
+
+// kafkaTLS reports whether a kafka:// callback connects to its brokers over
+// TLS, as ?tls=true asks.
+func kafkaTLS(callback *url.URL) (bool, error) {
+	switch v := callback.Query().Get("tls"); v {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid kafka tls option %q, expected true or false", v)
+	}
+}
+
+// get returns the writer for a kafka:// callback, which publishes each
+// record as it's written with acks from every in-sync replica, over
+// plaintext or TLS and authenticating with SASL/PLAIN if it has
+// credentials.
+func (k *kafkaProducers) get(callback *url.URL) (*kafka.Writer, error) {
+	useTLS, err := kafkaTLS(callback)
+	if err != nil {
+		return nil, err
+	}
+	topic := strings.TrimPrefix(callback.Path, "/")
+	key := callback.User.String() + "@" + callback.Host + "/" + topic + "?tls=" + strconv.FormatBool(useTLS)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	w := k.writers[key]
+	if w == nil {
+		dialer := &kafka.Dialer{ClientID: kafkaClientID, Timeout: kafkaTimeout, DualStack: true}
+		if useTLS {
+			dialer.TLS = k.tlsConfig
+			if dialer.TLS == nil {
+				dialer.TLS = &tls.Config{}
+			}
+		}
+		if callback.User != nil {
+			pass, _ := callback.User.Password()
+			dialer.SASLMechanism = plain.Mechanism{Username: callback.User.Username(), Password: pass}
+		}
+		w = kafka.NewWriter(kafka.WriterConfig{
+			Brokers: strings.Split(callback.Host, ","),
+			Topic:   topic,
+			Dialer:  dialer,
+			// Records keyed by the same request ID go to the same partition
+			Balancer:     &kafka.Hash{},
+			BatchSize:    1,
+			RequiredAcks: -1,
+			// Retry once, as when the partition leaders have moved
+			MaxAttempts:  2,
+			ReadTimeout:  kafkaTimeout,
+			WriteTimeout: kafkaTimeout,
+		})
+		k.writers[key] = w
+	}
+	return w, nil
+}
+
+// Deliver publishes req to the topic of a
+// kafka://[user:pass@]broker[,broker...]/topic[?tls=true] upstream. The
+// record's key is the request
+// ID, its value the body, and the request line and headers become record
+// headers, but for credentials. A successful publish is reported as 202
+// Accepted.
+func (k *kafkaProducers) Deliver(req *http.Request, body *requestBody, ups upstream, callback *url.URL) (*http.Response, error) {
+	topic := strings.TrimPrefix(callback.Path, "/")
+	r := body.reader()
+	value, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, err
+	}
+	msg := kafka.Message{Value: value, Time: time.Now()}
+	if d := deliveryFrom(req.Context()); d != nil {
+		msg.Key = []byte(d.requestID)
+	}
+	msg.Headers = append(msg.Headers, kafka.Header{Key: ":method", Value: []byte(req.Method)}, kafka.Header{Key: ":path", Value: []byte(req.URL.RequestURI())})
+	for k, vv := range messageHeaders(req.Header) {
+		for _, v := range vv {
+			msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(v)})
+		}
+	}
+	w, err := k.get(callback)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Publishing request %s to upstream %s at kafka topic %s", req.URL.Path, ups.Name, topic)
+	if err := w.WriteMessages(req.Context(), msg); err != nil {
+		log.Printf("Error publishing request %s to upstream %s at kafka topic %s: %v", req.URL.Path, ups.Name, topic, err)
+		return nil, err
+	}
+	log.Printf("Success publishing request %s to upstream %s at kafka topic %s", req.URL.Path, ups.Name, topic)
+	return accepted(req), nil
+}
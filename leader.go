@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// leaderLease is the name of the lease held by the leader
+const leaderLease = "leader"
+
+// leaseStore is implemented by storage shared between instances which can
+// grant a lease to one instance at a time.
+type leaseStore interface {
+	// acquireLease takes or renews the named lease for holder until ttl from
+	// now, reporting whether holder has it.
+	acquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+}
+
+// leader elects one instance among those sharing storage to run background
+// tasks, so they happen once cluster-wide rather than once per replica.
+// Leadership is a lease in the storage which the leader keeps renewing; if
+// it stops, another instance takes over once the lease runs out. Storage
+// which isn't shared, or can't grant leases, makes every instance a leader.
+type leader struct {
+	store  leaseStore
+	holder string
+	ttl    time.Duration
+	held   atomic.Bool
+}
+
+func newLeader(storage RegStorage, holder string, ttl time.Duration) *leader {
+	l := &leader{holder: holder, ttl: ttl}
+	if s, ok := storage.(leaseStore); ok {
+		l.store = s
+	} else {
+		l.held.Store(true)
+	}
+	return l
+}
+
+func (l *leader) isLeader() bool {
+	return l.held.Load()
+}
+
+// Run campaigns for, and renews, the lease until ctx is done.
+func (l *leader) Run(ctx context.Context) {
+	if l.store == nil {
+		return
+	}
+	// Renew well within the lease so a slow storage call doesn't lose it
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+	for {
+		l.campaign(ctx)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *leader) campaign(ctx context.Context) {
+	held, err := l.store.acquireLease(ctx, leaderLease, l.holder, l.ttl)
+	if err != nil {
+		log.Printf("Failed to renew leadership: %v", err)
+		// We can't know it's still ours, so assume it isn't
+		held = false
+	}
+	if l.held.Swap(held) != held {
+		if held {
+			log.Printf("Instance %s is now the leader", l.holder)
+		} else {
+			log.Printf("Instance %s is no longer the leader", l.holder)
+		}
+	}
+}
+
+// every runs task each interval while this instance is the leader, until
+// ctx is done.
+func (l *leader) every(ctx context.Context, interval time.Duration, name string, task func(context.Context) error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if !l.isLeader() {
+				continue
+			}
+			if err := task(ctx); err != nil {
+				log.Printf("Background task %s failed: %v", name, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// leaseRecord is the stored form of a lease
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// objectLease grants leases through a small object of its own, written with
+// the same version preconditions as the registry object.
+type objectLease struct {
+	store objectStore
+}
+
+func (o *objectLease) acquireLease(ctx context.Context, _ string, holder string, ttl time.Duration) (bool, error) {
+	body, version, err := o.store.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if body != nil {
+		var current leaseRecord
+		if err := json.Unmarshal(body, &current); err != nil {
+			return false, err
+		}
+		if current.Holder != holder && now.Before(current.Expires) {
+			return false, nil
+		}
+	}
+	next, err := json.Marshal(leaseRecord{Holder: holder, Expires: now.Add(ttl)})
+	if err != nil {
+		return false, err
+	}
+	err = o.store.put(ctx, next, version)
+	if errors.Is(err, errPreconditionFailed) {
+		// Someone else got there first
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeaderElection(t *testing.T) {
+	// GIVEN two instances sharing a lease
+	lease := &fakeObject{}
+	a := &leader{store: &objectLease{store: lease}, holder: "a", ttl: 50 * time.Millisecond}
+	b := &leader{store: &objectLease{store: lease}, holder: "b", ttl: 50 * time.Millisecond}
+
+	// WHEN both campaign
+	a.campaign(context.Background())
+	b.campaign(context.Background())
+
+	// THEN only the first is leader, and stays so while it renews
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("expected only a to lead, a %v b %v", a.isLeader(), b.isLeader())
+	}
+	a.campaign(context.Background())
+	b.campaign(context.Background())
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("expected a to keep the lead, a %v b %v", a.isLeader(), b.isLeader())
+	}
+
+	// WHEN the leader stops renewing
+	time.Sleep(60 * time.Millisecond)
+	b.campaign(context.Background())
+	a.campaign(context.Background())
+
+	// THEN the other takes over
+	if a.isLeader() || !b.isLeader() {
+		t.Errorf("expected b to take over, a %v b %v", a.isLeader(), b.isLeader())
+	}
+}
+
+func TestUnsharedStorageAlwaysLeads(t *testing.T) {
+	l := newLeader(&RegStorageMemory{upstreams: make(map[string]upstream)}, "a", time.Second)
+	if !l.isLeader() {
+		t.Error("expected in-memory storage to always lead")
+	}
+}
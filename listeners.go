@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// listenerConfig is one of the addresses the proxy serves on, optionally
+// over TLS and optionally only proxying to the upstreams in one group, e.g.
+// for an internal port reaching internal upstreams alongside a public one.
+type listenerConfig struct {
+	Addr string
+	// Cert and Key are PEM files, serving over TLS if set
+	Cert string
+	Key  string
+	// ACME serves over TLS with a certificate obtained automatically
+	ACME bool
+	// Challenges serves only ACME HTTP-01 challenges, redirecting anything
+	// else to HTTPS
+	Challenges bool
+	// ClientCA is a PEM file of CAs to verify client certificates with,
+	// for mTLS. ClientAuth says whether clients must present one.
+	ClientCA   string
+	ClientAuth string
+	// Group restricts proxied requests to upstreams registered with the
+	// same group, otherwise they go to upstreams without a group
+	Group string
+	// Family is the IP family bound to, one of listenFamilies
+	Family string
+	// Admin serves only the admin API, which the other listeners don't
+	Admin bool
+}
+
+// IP families listeners can bind to. Dual-stack listeners on a wildcard
+// address accept both IPv4 and IPv6 connections, where the host supports
+// IPv6, and otherwise follow the address.
+const (
+	familyDual = "dual"
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+var listenFamilies = []string{familyDual, familyIPv4, familyIPv6}
+
+// network returns the network and address to listen on for lc, binding
+// the wildcard address of its family if it is for one family only.
+func (lc listenerConfig) network() (string, string) {
+	host, port, err := net.SplitHostPort(lc.Addr)
+	if err != nil {
+		// Let Listen report it
+		return "tcp", lc.Addr
+	}
+	ip := net.ParseIP(host)
+	wildcard := host == "" || ip != nil && ip.IsUnspecified()
+	switch lc.Family {
+	case familyIPv4:
+		if wildcard {
+			host = "0.0.0.0"
+		}
+		return "tcp4", net.JoinHostPort(host, port)
+	case familyIPv6:
+		if wildcard {
+			host = "::"
+		}
+		return "tcp6", net.JoinHostPort(host, port)
+	}
+	return "tcp", lc.Addr
+}
+
+// parseListener parses a -listener flag,
+// addr=host:port[,cert=file,key=file|,acme][,client-ca=file[,client-auth=optional]][,group=name][,family=ipv6].
+func parseListener(s string) (listenerConfig, error) {
+	var lc listenerConfig
+	for _, opt := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(opt, "=")
+		switch k {
+		case "addr":
+			lc.Addr = v
+		case "cert":
+			lc.Cert = v
+		case "key":
+			lc.Key = v
+		case "acme":
+			lc.ACME = true
+		case "admin":
+			lc.Admin = true
+		case "client-ca":
+			lc.ClientCA = v
+		case "client-auth":
+			if v != clientAuthRequire && v != clientAuthOptional {
+				return lc, fmt.Errorf("unknown listener client-auth [%s], expected %s or %s", v, clientAuthRequire, clientAuthOptional)
+			}
+			lc.ClientAuth = v
+		case "group":
+			lc.Group = v
+		case "family":
+			if !slices.Contains(listenFamilies, v) {
+				return lc, fmt.Errorf("unknown listener family [%s], expected one of %s", v, strings.Join(listenFamilies, ", "))
+			}
+			lc.Family = v
+		default:
+			return lc, fmt.Errorf("unknown listener option [%s]", opt)
+		}
+	}
+	if lc.Addr == "" {
+		return lc, fmt.Errorf("listener [%s] has no addr", s)
+	}
+	if lc.ACME && lc.Cert != "" {
+		return lc, fmt.Errorf("listener [%s] can't use both acme and cert", s)
+	}
+	if (lc.Cert == "") != (lc.Key == "") {
+		return lc, fmt.Errorf("listener [%s] needs both cert and key for TLS", s)
+	}
+	if lc.Cert != "" {
+		if _, err := tls.LoadX509KeyPair(lc.Cert, lc.Key); err != nil {
+			return lc, fmt.Errorf("listener [%s]: %w", s, err)
+		}
+	}
+	if (lc.ClientCA != "" || lc.ClientAuth != "") && lc.Cert == "" && !lc.ACME {
+		return lc, fmt.Errorf("listener [%s] needs TLS to verify client certificates", s)
+	}
+	if lc.ClientAuth != "" && lc.ClientCA == "" {
+		return lc, fmt.Errorf("listener [%s] needs a client-ca to verify client certificates", s)
+	}
+	if lc.ClientCA != "" {
+		if _, err := lc.tlsConfig(nil); err != nil {
+			return lc, fmt.Errorf("listener [%s]: %w", s, err)
+		}
+	}
+	return lc, nil
+}
+
+func (lc listenerConfig) String() string {
+	s := lc.Addr
+	if lc.ClientCA != "" {
+		s += " (mTLS)"
+	} else if lc.Cert != "" || lc.ACME {
+		s += " (TLS)"
+	}
+	if lc.Challenges {
+		s += " for ACME challenges"
+	}
+	if lc.Admin {
+		s += " for the admin API"
+	}
+	if lc.Family != "" && lc.Family != familyDual {
+		s += " (" + lc.Family + " only)"
+	}
+	if lc.Group != "" {
+		s += " for group " + lc.Group
+	}
+	return s
+}
+
+// tlsConfig returns the TLS configuration of lc, getting its certificates
+// from getCertificate.
+func (lc listenerConfig) tlsConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Config, error) {
+	cfg := &tls.Config{GetCertificate: getCertificate}
+	if lc.ClientCA == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(lc.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", lc.ClientCA)
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if lc.ClientAuth == clientAuthOptional {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// serve serves srv on l, over TLS if configured, in which case
+// srv.TLSConfig is expected to be set up to get its certificates.
+func (lc listenerConfig) serve(srv *http.Server, l net.Listener) error {
+	if lc.Cert != "" || lc.ACME {
+		return srv.ServeTLS(l, "", "")
+	}
+	return srv.Serve(l)
+}
+
+// serverLimits bound how long clients may take over their requests, and how
+// large their headers may be, on every listener.
+type serverLimits struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+}
+
+// check adds any limits which can't work to invalid.
+func (sl serverLimits) check(invalid *configErrors) {
+	if sl.ReadTimeout < 0 || sl.ReadHeaderTimeout < 0 || sl.WriteTimeout < 0 || sl.IdleTimeout < 0 {
+		invalid.addf("server timeouts can't be negative")
+	}
+	if sl.ReadHeaderTimeout == 0 {
+		invalid.addf("server-read-header-timeout must be set, or clients may hold connections open by sending headers slowly")
+	}
+	if sl.ReadTimeout > 0 && sl.ReadHeaderTimeout > sl.ReadTimeout {
+		invalid.addf("server-read-header-timeout %v is longer than server-read-timeout %v, which covers the headers too", sl.ReadHeaderTimeout, sl.ReadTimeout)
+	}
+	if sl.MaxHeaderBytes <= 0 {
+		invalid.addf("server-max-header-bytes must be positive")
+	}
+}
+
+// server returns a server for h on addr, applying the limits.
+func (sl serverLimits) server(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadTimeout:       sl.ReadTimeout,
+		ReadHeaderTimeout: sl.ReadHeaderTimeout,
+		WriteTimeout:      sl.WriteTimeout,
+		IdleTimeout:       sl.IdleTimeout,
+		MaxHeaderBytes:    sl.MaxHeaderBytes,
+	}
+}
+
+// server serves one listener.
+type server struct {
+	*http.Server
+	cfg listenerConfig
+	l   net.Listener
+}
+
+// withGroup restricts the requests h proxies to upstreams in group.
+func withGroup(h http.Handler, group string) http.Handler {
+	if group == "" {
+		return h
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), groupKey, group)))
+	})
+}
+
+// inGroup returns the upstreams in the group of the listener req arrived
+// on, those without a group for listeners without one. Probes reach every
+// upstream.
+func inGroup(req *http.Request, upstreams map[string]upstream) (map[string]upstream, string) {
+	if req.Context().Value(probeKey) != nil {
+		return upstreams, ""
+	}
+	group, _ := req.Context().Value(groupKey).(string)
+	for name, ups := range upstreams {
+		if ups.Group != group {
+			delete(upstreams, name)
+		}
+	}
+	return upstreams, group
+}
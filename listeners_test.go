@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenerGroups(t *testing.T) {
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN upstreams with and without a group, and a listener for the group
+		called := make(chan string, 2)
+		for _, ups := range []upstream{{Name: "public"}, {Name: "internal", Group: "internal"}} {
+			srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+				called <- ups.Name
+			}))
+			defer srv.Close()
+			ups.Callback = srv.URL
+			register(url, ups, t)
+		}
+		internal := httptest.NewServer(withGroup(rp.handler, "internal"))
+		defer internal.Close()
+
+		for _, tc := range []struct{ url, want string }{{url, "public"}, {internal.URL, "internal"}} {
+			// WHEN
+			if status := getStatus(tc.url, t); status != 200 {
+				t.Fatalf("expected 200, got %v", status)
+			}
+
+			// THEN only the listener's group is called
+			if got := <-called; got != tc.want {
+				t.Errorf("expected %s to be called, got %s", tc.want, got)
+			}
+			if len(called) != 0 {
+				t.Errorf("expected only %s to be called, got %s too", tc.want, <-called)
+			}
+		}
+	})
+}
+
+func TestParseListener(t *testing.T) {
+	lc, err := parseListener("addr=127.0.0.1:9443,group=internal")
+	if err != nil || lc.Addr != "127.0.0.1:9443" || lc.Group != "internal" {
+		t.Errorf("unexpected listener %+v, %v", lc, err)
+	}
+	if lc, err := parseListener("addr=127.0.0.1:9444,admin"); err != nil || !lc.Admin {
+		t.Errorf("expected an admin listener, got %+v, %v", lc, err)
+	}
+	for _, s := range []string{"group=internal", "addr=:1,cert=c.pem", "addr=:1,port=2", "addr=:1,cert=missing.pem,key=missing.pem", "addr=:1,family=ipv5", "addr=:1,client-ca=ca.pem", "addr=:1,acme,client-auth=optional"} {
+		if _, err := parseListener(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestListenerFamily(t *testing.T) {
+	for _, tc := range []struct {
+		lc                    listenerConfig
+		wantNetwork, wantAddr string
+	}{
+		{listenerConfig{Addr: "0.0.0.0:9876", Family: familyDual}, "tcp", "0.0.0.0:9876"},
+		{listenerConfig{Addr: "0.0.0.0:9876", Family: familyIPv6}, "tcp6", "[::]:9876"},
+		{listenerConfig{Addr: "[::]:9876", Family: familyIPv4}, "tcp4", "0.0.0.0:9876"},
+		{listenerConfig{Addr: "[2001:db8::1]:9876", Family: familyIPv6}, "tcp6", "[2001:db8::1]:9876"},
+	} {
+		network, addr := tc.lc.network()
+		if network != tc.wantNetwork || addr != tc.wantAddr {
+			t.Errorf("%+v: expected %s %s, got %s %s", tc.lc, tc.wantNetwork, tc.wantAddr, network, addr)
+		}
+	}
+}
+
+var testServerLimits = serverLimits{
+	ReadTimeout:       30 * time.Second,
+	ReadHeaderTimeout: 5 * time.Second,
+	WriteTimeout:      40 * time.Second,
+	IdleTimeout:       2 * time.Minute,
+	MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+}
+
+func TestServerLimitsCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		change  func(sl *serverLimits)
+		invalid bool
+	}{
+		{"defaults", func(sl *serverLimits) {}, false},
+		{"no read or idle timeout", func(sl *serverLimits) { sl.ReadTimeout, sl.IdleTimeout = 0, 0 }, false},
+		{"header timeout beyond an unlimited read", func(sl *serverLimits) { sl.ReadTimeout, sl.ReadHeaderTimeout = 0, time.Minute }, false},
+		{"negative read timeout", func(sl *serverLimits) { sl.ReadTimeout = -time.Second }, true},
+		{"negative write timeout", func(sl *serverLimits) { sl.WriteTimeout = -time.Second }, true},
+		{"negative idle timeout", func(sl *serverLimits) { sl.IdleTimeout = -time.Second }, true},
+		{"no header timeout", func(sl *serverLimits) { sl.ReadHeaderTimeout = 0 }, true},
+		{"header timeout beyond read", func(sl *serverLimits) { sl.ReadHeaderTimeout = time.Minute }, true},
+		{"no header bytes", func(sl *serverLimits) { sl.MaxHeaderBytes = 0 }, true},
+		{"negative header bytes", func(sl *serverLimits) { sl.MaxHeaderBytes = -1 }, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// GIVEN
+			sl := testServerLimits
+			tc.change(&sl)
+
+			// WHEN
+			var invalid configErrors
+			sl.check(&invalid)
+
+			// THEN
+			if (len(invalid) > 0) != tc.invalid {
+				t.Errorf("expected invalid: %v, got %v", tc.invalid, invalid)
+			}
+		})
+	}
+}
+
+// serveWithLimits serves a proxy on a local port with sl, returning its
+// address.
+func serveWithLimits(t *testing.T, sl serverLimits) string {
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := sl.server(l.Addr().String(), rp.handler)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return l.Addr().String()
+}
+
+func TestServerLimits(t *testing.T) {
+	const request = "GET /upstreams HTTP/1.1\r\nHost: regproxy\r\n"
+	for _, tc := range []struct {
+		name   string
+		change func(sl *serverLimits)
+		// send is written to a new connection, then wait passes
+		send string
+		wait time.Duration
+		// want is the start of the response, "" for the connection to be
+		// closed without one
+		want string
+	}{
+		{"complete request", func(sl *serverLimits) {}, request + "\r\n", 0, "HTTP/1.1 200"},
+		{"slow headers", func(sl *serverLimits) { sl.ReadHeaderTimeout = 50 * time.Millisecond }, request, 200 * time.Millisecond, ""},
+		{"headers within timeout", func(sl *serverLimits) { sl.ReadHeaderTimeout = time.Second }, request, 50 * time.Millisecond, "HTTP/1.1 200"},
+		{"large headers", func(sl *serverLimits) { sl.MaxHeaderBytes = 1024 }, request + "X-Padding: " + strings.Repeat("a", 8<<10) + "\r\n\r\n", 0, "HTTP/1.1 431"},
+		{"headers within limit", func(sl *serverLimits) {}, request + "X-Padding: " + strings.Repeat("a", 8<<10) + "\r\n\r\n", 0, "HTTP/1.1 200"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// GIVEN a server with the limits
+			sl := testServerLimits
+			tc.change(&sl)
+			conn, err := net.Dial("tcp", serveWithLimits(t, sl))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// WHEN a request is sent, the rest of its headers coming after
+			// a wait
+			if _, err := io.WriteString(conn, tc.send); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(tc.wait)
+			if !strings.HasSuffix(tc.send, "\r\n\r\n") {
+				_, _ = io.WriteString(conn, "\r\n")
+			}
+
+			// THEN
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if tc.want == "" {
+				if err == nil {
+					t.Errorf("expected the connection closed, got %q", line)
+				}
+				return
+			}
+			if !strings.HasPrefix(line, tc.want) {
+				t.Errorf("expected %q, got %q, %v", tc.want, line, err)
+			}
+		})
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	// GIVEN a keep-alive connection which has served a request
+	sl := testServerLimits
+	sl.IdleTimeout = 50 * time.Millisecond
+	conn, err := net.Dial("tcp", serveWithLimits(t, sl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	_, _ = io.WriteString(conn, "GET /upstreams HTTP/1.1\r\nHost: regproxy\r\n\r\n")
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	// WHEN it's left idle
+	time.Sleep(200 * time.Millisecond)
+
+	// THEN the server has closed it
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected the idle connection to be closed, got %v", err)
+	}
+}
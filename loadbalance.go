@@ -0,0 +1,166 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Balance mode policies for choosing the upstream to send a request to
+const (
+	balanceRoundRobin       = "round-robin"
+	balanceWeighted         = "weighted"
+	balanceLeastConnections = "least-connections"
+	balanceConsistentHash   = "consistent-hash"
+)
+
+var balancePolicies = []string{balanceRoundRobin, balanceWeighted, balanceLeastConnections, balanceConsistentHash}
+
+// parseHashKey parses the request attribute requests are hashed on with the
+// consistent-hash policy: header:<name>, query:<name>, path or client-ip.
+func parseHashKey(s string) (func(*http.Request) string, error) {
+	kind, name, _ := strings.Cut(s, ":")
+	switch {
+	case kind == "header" && name != "":
+		return func(req *http.Request) string { return req.Header.Get(name) }, nil
+	case kind == "query" && name != "":
+		return func(req *http.Request) string { return req.URL.Query().Get(name) }, nil
+	case s == "path":
+		return func(req *http.Request) string { return req.URL.Path }, nil
+	case s == "client-ip":
+		return func(req *http.Request) string {
+			host, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				return req.RemoteAddr
+			}
+			return host
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid hash key %q, expected header:<name>, query:<name>, path or client-ip", s)
+}
+
+// loadBalancer picks a single upstream for each request in balance mode.
+type loadBalancer struct {
+	policy  string
+	hashKey func(*http.Request) string
+	next    atomic.Uint64
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func newLoadBalancer(policy string, hashKey string) *loadBalancer {
+	lb := &loadBalancer{policy: policy, inFlight: make(map[string]int)}
+	if policy == balanceConsistentHash {
+		// main has already checked the key
+		lb.hashKey, _ = parseHashKey(hashKey)
+	}
+	return lb
+}
+
+// pick chooses one of upstreams for req, upstreams mustn't be empty.
+func (lb *loadBalancer) pick(req *http.Request, upstreams map[string]upstream) upstream {
+	list := make([]upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		list = append(list, u)
+	}
+	slices.SortFunc(list, func(a, b upstream) int { return cmp.Compare(a.Name, b.Name) })
+	switch lb.policy {
+	case balanceWeighted:
+		total := 0
+		for _, u := range list {
+			total += max(u.Weight, 1)
+		}
+		n := rand.Intn(total)
+		for _, u := range list {
+			if n -= max(u.Weight, 1); n < 0 {
+				return u
+			}
+		}
+	case balanceLeastConnections:
+		// Start from the round-robin position so ties are shared out
+		start := int(lb.next.Add(1) % uint64(len(list)))
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		best := list[start]
+		for i := 1; i < len(list); i++ {
+			u := list[(start+i)%len(list)]
+			if lb.inFlight[u.Name] < lb.inFlight[best.Name] {
+				best = u
+			}
+		}
+		return best
+	case balanceConsistentHash:
+		// Requests without the key are shared out round-robin
+		if key := lb.hashKey(req); key != "" {
+			return rendezvous(key, list)
+		}
+	}
+	return list[lb.next.Add(1)%uint64(len(list))]
+}
+
+// rendezvous picks the upstream with the highest weighted score for key
+// (Rendezvous or Highest Random Weight hashing), so a key stays on the same
+// upstream, and only the keys of an upstream which is removed, or those
+// taken by one which is added, move.
+func rendezvous(key string, list []upstream) upstream {
+	var best upstream
+	bestScore := math.Inf(-1)
+	for _, u := range list {
+		// Weight the hash as -w/ln(x)
+		x := hashUnit(u.Name, key)
+		if score := -float64(max(u.Weight, 1)) / math.Log(x); score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best
+}
+
+func (lb *loadBalancer) started(name string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.inFlight[name]++
+}
+
+func (lb *loadBalancer) finished(name string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.inFlight[name]--; lb.inFlight[name] <= 0 {
+		delete(lb.inFlight, name)
+	}
+}
+
+// balance sends the request to a single upstream chosen by BalancePolicy,
+// for using regproxy as a load balancer in front of registered replicas
+// rather than fanning requests out to all of them.
+func (p *RegProxy) balance(resp http.ResponseWriter, req *http.Request, body *requestBody, upstreams map[string]upstream) {
+	ups := p.lb.pick(req, upstreams)
+	// Count the connection until the response has been copied to the client
+	p.lb.started(ups.Name)
+	defer p.lb.finished(ups.Name)
+	r, err := p.forward(req, body, ups)
+	p.writeResult(resp, req, result{ups: ups, resp: r, err: err})
+}
+
+// hashUnit hashes a and b together into (0, 1), uniformly.
+func hashUnit(a, b string) float64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(a))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(b))
+	// FNV's high bits hardly depend on the last bytes hashed, so mix them
+	// (the splitmix64 finalizer) before mapping the hash into (0, 1)
+	z := h.Sum64()
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return (float64(z>>11) + 0.5) / (1 << 53)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestBalanceRoundRobin(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeBalance
+	cfg.BalancePolicy = balanceRoundRobin
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN three replicas
+		var mu sync.Mutex
+		calls := make(map[string]int)
+		for _, name := range []string{"a", "b", "c"} {
+			srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls[name]++
+			}))
+			defer srv.Close()
+			register(url, upstream{Name: name, Callback: srv.URL}, t)
+		}
+
+		// WHEN
+		for range 6 {
+			if status := getStatus(url, t); status != 200 {
+				t.Errorf("expected 200, got %v", status)
+			}
+		}
+
+		// THEN each request went to one replica, in turn
+		mu.Lock()
+		defer mu.Unlock()
+		if calls["a"] != 2 || calls["b"] != 2 || calls["c"] != 2 {
+			t.Errorf("expected two calls to each replica, got %v", calls)
+		}
+	})
+}
+
+func TestBalanceWeighted(t *testing.T) {
+	// GIVEN
+	lb := newLoadBalancer(balanceWeighted, "")
+	upstreams := map[string]upstream{"heavy": {Name: "heavy", Weight: 3}, "light": {Name: "light"}}
+
+	// WHEN
+	heavy := 0
+	for range 1000 {
+		if lb.pick(nil, upstreams).Name == "heavy" {
+			heavy++
+		}
+	}
+
+	// THEN requests are shared in proportion to weight
+	if heavy < 700 || heavy > 800 {
+		t.Errorf("expected about 750 picks of the heavy upstream, got %v", heavy)
+	}
+}
+
+func TestBalanceLeastConnections(t *testing.T) {
+	// GIVEN a replica with a request in flight
+	lb := newLoadBalancer(balanceLeastConnections, "")
+	upstreams := map[string]upstream{"a": {Name: "a"}, "b": {Name: "b"}}
+	lb.started("a")
+
+	// THEN the idle replica is picked
+	for range 4 {
+		if u := lb.pick(nil, upstreams); u.Name != "b" {
+			t.Errorf("expected the idle replica, got %s", u.Name)
+		}
+	}
+
+	// WHEN it finishes THEN both are picked again
+	lb.finished("a")
+	picked := map[string]bool{}
+	for range 4 {
+		picked[lb.pick(nil, upstreams).Name] = true
+	}
+	if !picked["a"] || !picked["b"] {
+		t.Errorf("expected both replicas to be picked, got %v", picked)
+	}
+}
+
+func TestBalanceConsistentHash(t *testing.T) {
+	// GIVEN requests hashed on a customer header
+	lb := newLoadBalancer(balanceConsistentHash, "header:X-Customer")
+	upstreams := map[string]upstream{"a": {Name: "a"}, "b": {Name: "b"}, "c": {Name: "c"}}
+	pick := func(customer string) string {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("X-Customer", customer)
+		return lb.pick(req, upstreams).Name
+	}
+	before := make(map[string]string)
+	for i := range 300 {
+		customer := strconv.Itoa(i)
+		before[customer] = pick(customer)
+	}
+
+	// THEN a customer always lands on the same upstream
+	if pick("7") != before["7"] {
+		t.Error("expected the same upstream for the same customer")
+	}
+
+	// WHEN an upstream is added
+	upstreams["d"] = upstream{Name: "d"}
+
+	// THEN only the customers it takes move
+	moved := 0
+	for customer, was := range before {
+		if now := pick(customer); now != was {
+			moved++
+			if now != "d" {
+				t.Errorf("customer %s moved from %s to %s, not the new upstream", customer, was, now)
+			}
+		}
+	}
+	if moved < 40 || moved > 110 {
+		t.Errorf("expected about a quarter of customers to move, %v did", moved)
+	}
+}
+
+func TestParseHashKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/orders?customer=42", nil)
+	req.Header.Set("X-Tenant", "acme")
+	for key, want := range map[string]string{"header:X-Tenant": "acme", "query:customer": "42", "path": "/orders", "client-ip": "192.0.2.1"} {
+		f, err := parseHashKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f(req); got != want {
+			t.Errorf("%s: expected %q, got %q", key, want, got)
+		}
+	}
+	for _, key := range []string{"", "header:", "cookie:x"} {
+		if _, err := parseHashKey(key); err == nil {
+			t.Errorf("expected %q to be rejected", key)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errLoopDetected is returned for upstreams whose callback is this proxy.
+var errLoopDetected = errors.New("forwarding loop detected")
+
+// selfAddrRefresh is how often the host name and interface addresses are
+// looked up again, should they change while running
+const selfAddrRefresh = time.Minute
+
+// selfAddrs caches the host name and interface addresses isSelf compares
+// callbacks with, which are too slow to look up on every forward. The zero
+// value looks them up when first needed.
+type selfAddrs struct {
+	mu       sync.Mutex
+	updated  time.Time
+	hostname string
+	ips      []net.IP
+}
+
+func (s *selfAddrs) get() (string, []net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := time.Now(); now.Sub(s.updated) >= selfAddrRefresh {
+		s.updated = now
+		s.hostname, _ = os.Hostname()
+		s.ips = nil
+		addrs, _ := net.InterfaceAddrs()
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				s.ips = append(s.ips, ipNet.IP)
+			}
+		}
+	}
+	return s.hostname, s.ips
+}
+
+// seenBefore reports whether req has already passed through this instance,
+// which means a callback somewhere leads back to us. Via can't be used for
+// this, it only names the product and so is the same for every instance.
+func (p *RegProxy) seenBefore(req *http.Request) bool {
+	for _, v := range req.Header.Values(forwardedByHeader) {
+		for _, id := range strings.Split(v, ",") {
+			if strings.TrimSpace(id) == p.cfg.InstanceID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isSelf reports whether a callback points straight back at an address this
+// proxy listens on. This catches the obvious misregistrations before any
+// request is sent; anything subtler, e.g. via DNS or a load balancer, is
+// caught by seenBefore when the request comes back around.
+func (p *RegProxy) isSelf(callback *url.URL) bool {
+	hostname, ips := p.self.get()
+	for _, addr := range append([]string{p.cfg.ListenAddr}, p.cfg.ExtraListenAddrs...) {
+		if addr != "" && pointsAt(callback, addr, hostname, ips) {
+			return true
+		}
+	}
+	return false
+}
+
+// pointsAt reports whether callback is listenAddr, on a host with hostname
+// and the interface addresses ips.
+func pointsAt(callback *url.URL, listenAddr, hostname string, ips []net.IP) bool {
+	listenHost, listenPort, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return false
+	}
+	port := callback.Port()
+	if port == "" {
+		switch callback.Scheme {
+		case "https":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+	if port != listenPort {
+		return false
+	}
+	host := callback.Hostname()
+	if strings.EqualFold(host, listenHost) || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if hostname != "" && strings.EqualFold(host, hostname) {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	// Bound to every interface, so any local address is us
+	if lip := net.ParseIP(listenHost); listenHost == "" || lip != nil && lip.IsUnspecified() {
+		for _, local := range ips {
+			if local.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
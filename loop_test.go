@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestLoopDetectedByHeader(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		defer withStatusUpstreams(url, t, 200)()
+
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set(forwardedByHeader, "other-instance, test-instance")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != http.StatusLoopDetected {
+			t.Errorf("expected 508, got %v", r.StatusCode)
+		}
+	})
+}
+
+func TestLoopViaSelfRegistration(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN a callback pointing back at the proxy
+		register(url, upstream{Name: "self", Callback: url}, t)
+
+		// WHEN
+		r, err := http.Get(url)
+
+		// THEN the request comes back around once and is stopped
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != http.StatusLoopDetected {
+			t.Errorf("expected 508, got %v", r.StatusCode)
+		}
+	})
+}
+
+func TestLoopDetectedBySelfAddress(t *testing.T) {
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	srv := httptest.NewServer(rp.handler)
+	defer srv.Close()
+	rp.cfg.ListenAddr = srv.Listener.Addr().String()
+	// GIVEN a callback to the proxy's own address, by another name
+	u, _ := url.Parse(srv.URL)
+	register(srv.URL, upstream{Name: "self", Callback: "http://localhost:" + u.Port()}, t)
+
+	// WHEN
+	r, err := http.Get(srv.URL)
+
+	// THEN nothing is forwarded at all
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StatusCode != http.StatusLoopDetected {
+		t.Errorf("expected 508, got %v", r.StatusCode)
+	}
+}
+
+func TestIsSelf(t *testing.T) {
+	cfg := testConfig()
+	cfg.ListenAddr = "0.0.0.0:9876"
+	cfg.ExtraListenAddrs = []string{"127.0.0.1:9443"}
+	rp := &RegProxy{cfg: cfg}
+	hostname, _ := os.Hostname()
+	cases := map[string]bool{
+		"http://127.0.0.1:9876":        true,
+		"http://localhost:9876":        true,
+		"https://127.0.0.1:9443":       true,
+		"http://" + hostname + ":9876": true,
+		"http://127.0.0.1:9877":        false,
+		"http://example.com:9876":      false,
+		"http://10.255.0.1":            false,
+	}
+	for callback, expected := range cases {
+		u, _ := url.Parse(callback)
+		if rp.isSelf(u) != expected {
+			t.Errorf("isSelf(%s) expected %v", callback, expected)
+		}
+	}
+}
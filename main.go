@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -14,13 +14,19 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.mercari.io/go-dnscache"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
 )
 
 func isSuccess(r *http.Response) bool {
@@ -28,192 +34,728 @@ func isSuccess(r *http.Response) bool {
 }
 
 func badRequest(resp http.ResponseWriter, errMsg string) {
-	resp.WriteHeader(400)
-	_, _ = resp.Write([]byte(errMsg))
+	writeProblem(resp, newProblem(400, errMsg))
 }
 
 func errResp(resp http.ResponseWriter, e error) {
-	resp.WriteHeader(500)
-	_, _ = resp.Write([]byte(e.Error()))
+	if errors.Is(e, errStorageConflict) {
+		writeProblem(resp, newProblem(http.StatusConflict, e.Error()))
+		return
+	}
+	if errors.Is(e, errHandingOver) {
+		resp.Header().Set("Retry-After", "1")
+		writeProblem(resp, newProblem(http.StatusServiceUnavailable, e.Error()))
+		return
+	}
+	writeProblem(resp, newProblem(500, e.Error()))
 }
 
-type RegStorage interface {
-	Put(string, *url.URL) error
-	All() (map[string]*url.URL, error)
-}
+// errStorageConflict is returned by storage shared between instances when
+// another instance changed an upstream since this one last read it.
+var errStorageConflict = errors.New("upstream was changed by another instance, retry")
 
-type RegStorageMemory struct {
-	upstreams map[string]*url.URL
-}
+// errHandingOver is returned by storage kept in memory once it has been
+// handed to a new process, which wouldn't see any later change.
+var errHandingOver = errors.New("registry is being handed over to a new process, retry")
 
-func (m *RegStorageMemory) Put(name string, url *url.URL) error {
-	m.upstreams[name] = url
-	return nil
+type RegStorage interface {
+	Put(upstream) error
+	Delete(name string) error
+	All() (map[string]upstream, error)
+	// ReplaceAll atomically replaces every upstream.
+	ReplaceAll(map[string]upstream) error
 }
-func (m *RegStorageMemory) All() (map[string]*url.URL, error) {
-	return maps.Clone(m.upstreams), nil
+
+// storageFlusher is storage which holds changes back to write them later, so
+// must be flushed before the process stops.
+type storageFlusher interface {
+	Flush(ctx context.Context) error
 }
 
-type RegStorageFile struct {
-	fileName string
+type RegStorageMemory struct {
+	mu        sync.RWMutex
+	upstreams map[string]upstream
+	// handingOver refuses writes once the upstreams are handed over
+	handingOver bool
 }
 
-func NewRegStorageFile(fileName string) (*RegStorageFile, error) {
-	content, err := os.ReadFile(fileName)
-	if os.IsNotExist(err) {
-		if err := os.WriteFile(fileName, []byte{}, os.ModePerm); err != nil {
-			return nil, err
-		}
-	} else if err != nil {
-		return nil, err
+func (m *RegStorageMemory) Put(u upstream) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handingOver {
+		return errHandingOver
 	}
-	upstreams, err := parseMap(content)
-	if err != nil {
-		return nil, err
-	}
-	for name, u := range upstreams {
-		ups := upstream{
-			Name:     name,
-			Callback: u.String(),
-		}
-		log.Printf("Adding upstream from file %v", ups)
+	m.upstreams[u.Name] = u
+	return nil
+}
+func (m *RegStorageMemory) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handingOver {
+		return errHandingOver
 	}
-	return &RegStorageFile{fileName: fileName}, nil
+	delete(m.upstreams, name)
+	return nil
 }
-
-func (m *RegStorageFile) Put(name string, url *url.URL) error {
-	mm, err := m.All()
-	if err != nil {
-		return err
+func (m *RegStorageMemory) ReplaceAll(upstreams map[string]upstream) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handingOver {
+		return errHandingOver
 	}
-	mm[name] = url
-	return m.write(mm)
+	m.upstreams = maps.Clone(upstreams)
+	return nil
 }
-func (m *RegStorageFile) write(content map[string]*url.URL) error {
-	sb := strings.Builder{}
-	for name, u := range content {
-		sb.WriteString(name)
-		sb.WriteString("=")
-		sb.WriteString(u.String())
-		sb.WriteString("\n")
-	}
-	return os.WriteFile(m.fileName, []byte(sb.String()), os.ModePerm)
+func (m *RegStorageMemory) All() (map[string]upstream, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return maps.Clone(m.upstreams), nil
 }
-func (m *RegStorageFile) All() (map[string]*url.URL, error) {
-	file, err := os.ReadFile(m.fileName)
-	if err != nil {
-		return nil, err
-	}
-	return parseMap(file)
+
+// handover returns the upstreams for a new process taking over, refusing
+// any more writes until resume.
+func (m *RegStorageMemory) handover() map[string]upstream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handingOver = true
+	return maps.Clone(m.upstreams)
 }
 
-func parseMap(file []byte) (map[string]*url.URL, error) {
-	scan := bufio.NewScanner(bytes.NewReader(file))
-	res := make(map[string]*url.URL)
-	for scan.Scan() {
-		strs := strings.Split(scan.Text(), "=")
-		if len(strs) != 2 {
-			return nil, errors.New(fmt.Sprintf("corrupt storage, read invalid line [%s]", scan.Text()))
-		}
-		u, err := url.Parse(strs[1])
-		if err != nil {
-			return nil, err
-		}
-		res[strs[0]] = u
-	}
-	return res, nil
+// resume accepts writes again after a handover failed.
+func (m *RegStorageMemory) resume() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handingOver = false
 }
 
+type ctxKey int
+
+const (
+	egressProxyKey ctxKey = iota
+	deliveryKey
+	groupKey
+	probeKey
+)
+
 type RegProxy struct {
+	cfg       Config
 	client    *http.Client
 	storage   RegStorage
 	writeLock sync.Mutex
 	handler   http.Handler
+	// admin serves the admin API alone, for listeners with the admin option
+	admin http.Handler
+	// grpc serves the admin service of admin.proto, under admin
+	grpc      *grpc.Server
+	self      selfAddrs
+	metrics   *proxyMetrics
+	calls     *callLimiter
+	leader    *leader
+	limiter   *rateLimiter
+	admission *admission
+	slow      *slowDetector
+	probes    probeHistory
+	faults    *faultInjector
+	nats      *natsPublisher
+	sinks     map[string]Sink
+	jwt       *jwtValidator
+	tokens    *tokenExchanger
+	retries   *retrier
+	lb        *loadBalancer
+	queues    *requestQueues
+	slos      *sloTracker
+	stored    *storageHealth
+	vault     *vaultClient
+	secrets   *secretFiles
+	bodies    *bodyLogger
+	har       *harRecorder
+	audit     *auditLog
+	// secretRefs limits the secrets registrations may refer to
+	secretRefs secretRefPolicy
+	// results sends result callbacks, to wherever callers ask
+	results *http.Client
+	// maintenance holds requests back while upstream work is underway
+	maintenance *maintenance
+	experiment  *experiment
+	// qos shares the requests in flight out between classes of requests
+	qos *qos
+	// upstreamLimits smooths calls to upstreams registered with a rate limit
+	upstreamLimits *upstreamLimiters
+	// deadlines sheds requests whose client will give up before the
+	// upstreams are likely to answer
+	deadlines *deadlines
+	// dedup suppresses repeated deliveries of the same request
+	dedup *dedup
+	// conns counts the transport's connections to each upstream
+	conns *connStats
+	// rolloutKey is the request attribute which keeps requests on the same
+	// side of a rollout, or nil to split them at random
+	rolloutKey func(*http.Request) string
+	// asyncCalls counts the goroutines forwardAsync has started which
+	// haven't finished
+	asyncCalls atomic.Int64
 }
 
 func (p *RegProxy) proxy(resp http.ResponseWriter, req *http.Request) {
-	rc := make(chan *http.Response)
-	ec := make(chan error)
+	arrived := time.Now()
+	if len(p.cfg.AllowedMethods) > 0 && !slices.Contains(p.cfg.AllowedMethods, req.Method) {
+		methodNotAllowed(resp, p.cfg.AllowedMethods...)
+		return
+	}
+	if reason := p.admission.admit(); reason != "" {
+		p.metrics.shedRequests.inc(reason)
+		resp.Header().Set("Retry-After", "1")
+		writeProblem(resp, newProblem(http.StatusServiceUnavailable, "Overloaded ("+reason+"), try again later"))
+		return
+	}
+	defer p.admission.done()
+	class, ok := p.qos.acquire(req)
+	if !ok {
+		p.metrics.shedRequests.inc(shedClass)
+		resp.Header().Set("Retry-After", "1")
+		writeProblem(resp, newProblem(http.StatusServiceUnavailable, "Overloaded (class "+class.name+" full), try again later"))
+		return
+	}
+	defer p.qos.release(class)
+
+	if p.limiter != nil {
+		if ok, scope, retry := p.limiter.allow(req); !ok {
+			p.metrics.rateLimited.inc(scope)
+			resp.Header().Set("Retry-After", retryAfter(retry))
+			writeProblem(resp, newProblem(http.StatusTooManyRequests, "Rate limit exceeded ("+scope+")"))
+			return
+		}
+	}
+
+	if !p.jwt.authenticate(resp, req) {
+		p.metrics.unauthorized.inc()
+		return
+	}
+	setClientCert(req)
 
 	// Validate the request
-	upstreams, err := p.storage.All()
+	upstreams, err := p.stored.all()
 	if err != nil {
 		errResp(resp, err)
 		return
 	}
+	upstreams, group := inGroup(req, upstreams)
+	// Probes go to every upstream, whatever its content types
+	if req.Context().Value(probeKey) == nil {
+		if other := forContentType(req, upstreams); len(upstreams) < 1 && other > 0 {
+			writeProblem(resp, newProblem(http.StatusUnsupportedMediaType, "No upstreams registered for content type "+req.Header.Get("Content-Type")))
+			return
+		}
+	}
+	// Probes go to every upstream, whatever its bucket
+	if bucket := p.experiment.bucket(req); bucket != "" && req.Context().Value(probeKey) == nil {
+		p.metrics.experimentRequests.inc(bucket)
+		inBucket(upstreams, bucket)
+		req.Header.Set(bucketHeader, bucket)
+		resp.Header().Set(bucketHeader, bucket)
+	}
+	p.applyRollouts(req, upstreams, time.Now())
+	if paused := withoutPaused(upstreams); len(upstreams) < 1 && paused > 0 {
+		writeProblem(resp, newProblem(http.StatusServiceUnavailable, "Every upstream is paused"))
+		return
+	}
 	if len(upstreams) < 1 {
+		if group != "" {
+			badRequest(resp, "No upstreams registered in group "+group)
+			return
+		}
 		badRequest(resp, "No upstreams registered")
 		return
 	}
+	if p.seenBefore(req) {
+		log.Printf("Rejecting request %s which has already been through this proxy", req.URL.Path)
+		writeProblem(resp, newProblem(http.StatusLoopDetected, errLoopDetected.Error()))
+		return
+	}
+
+	resultCallback := req.Header.Get(callbackHeader)
+	if resultCallback != "" {
+		if err := validateResultCallback(resultCallback); err != nil {
+			badRequest(resp, err.Error())
+			return
+		}
+	}
+
+	// During maintenance requests are queued or turned away, though probes
+	// still go through to show when the upstreams are back
+	mode := p.cfg.Mode
+	if req.Context().Value(probeKey) == nil {
+		switch p.maintenance.mode() {
+		case maintenanceReject:
+			p.maintenance.reject(resp)
+			return
+		case maintenanceQueue:
+			if !queueable(mode) {
+				p.maintenance.reject(resp)
+				return
+			}
+			mode = modeQueue
+		}
+		delayed, err := p.checkDelay(req)
+		if err != nil {
+			badRequest(resp, "Invalid "+delayHeader+": "+err.Error())
+			return
+		}
+		if delayed {
+			if !queueable(mode) {
+				badRequest(resp, delayHeader+" isn't supported in "+mode+" mode, which chooses between upstreams")
+				return
+			}
+			mode = modeQueue
+		}
+		if p.doomed(req, mode, upstreams, arrived) {
+			p.metrics.shedRequests.inc(shedDeadline)
+			resp.Header().Set("Retry-After", "1")
+			writeProblem(resp, newProblem(http.StatusServiceUnavailable, "Upstreams unlikely to answer within "+timeoutHeader+", try again later"))
+			return
+		}
+	}
+
+	// Reserve room for the upstream calls this request will make
+	slots, ok := p.calls.tryAcquire(callSlots(mode, len(upstreams)))
+	if !ok {
+		p.metrics.rejectedCalls.inc()
+		resp.Header().Set("Retry-After", "1")
+		writeProblem(resp, newProblem(http.StatusServiceUnavailable, "Too many upstream calls in flight, try again later"))
+		return
+	}
 
 	// Read in the whole body, we'll need a new reader for each upstream
-	b, e := io.ReadAll(req.Body)
+	body, e := readRequestBody(req.Body, p.cfg.SpoolThreshold, p.cfg.SpoolDir)
 	if e != nil {
+		p.calls.release(slots)
 		errResp(resp, e)
 		return
 	}
+	if problem := p.checkSchemas(req, group, body); problem != "" {
+		p.calls.release(slots)
+		_ = body.Close()
+		writeProblem(resp, newProblem(http.StatusUnprocessableEntity, problem))
+		return
+	}
+	if tenant := req.Header.Get(p.cfg.RateLimitTenantHeader); tenant != "" {
+		p.metrics.tenantBytes.add(float64(body.size), tenant, bytesReceived)
+		cw := &countingWriter{ResponseWriter: resp}
+		defer func() {
+			p.metrics.tenantBytes.add(float64(cw.n), tenant, bytesSent)
+		}()
+		resp = cw
+	}
+	if body.spooled() {
+		p.metrics.spooledRequests.inc()
+		p.metrics.spooledBytes.add(float64(body.size))
+	}
 
-	// Call upstreams in parallel
-	for name, callback := range upstreams {
-		go func(name string, callback *url.URL) {
-			// Note although there is an existing
-			// net/http/httputil.ReverseProxy implementation, it doesn't let us
-			// forward to _multiple_ upstreams and choose a response based on header
-			// so we can't use it here unfortunately
-			req2 := req.Clone(req.Context())
-			req2.RequestURI = "" // Isn't allowed to be set on client requests
-			req2.Body = io.NopCloser(bytes.NewReader(b))
-			req2.URL.Host = callback.Host
-			req2.URL.Scheme = callback.Scheme
-			log.Printf("Forwarding request %s to upstream %s at %s", req2.URL.Path, name, callback)
-			resp2, err := p.client.Do(req2)
+	// Synthetic probes attach their own delivery to read the outcomes from
+	d := deliveryFrom(req.Context())
+	if d == nil {
+		d = &delivery{started: time.Now(), requestID: requestID(req)}
+		req = req.WithContext(withDelivery(req.Context(), d))
+	}
+	if d.trace.traceID == "" {
+		d.trace = p.sampleTrace(req, extractTrace(req.Header))
+	}
+	d.dryRun = p.cfg.DryRun || req.Header.Get(dryRunHeader) == "1"
+	if p.bodies.sampled() {
+		d.logBodies = true
+		p.bodies.logRequest(req, body, d)
+	}
+	d.har = p.har.sampled()
+	resp.Header().Set(requestIDHeader, d.requestID)
+	if p.cfg.CompressResponses && acceptsGzip(req.Header.Get("Accept-Encoding")) {
+		gz := &gzipWriter{ResponseWriter: resp, minSize: p.cfg.CompressMinBytes, types: p.cfg.CompressTypes}
+		defer func() {
+			if err := gz.Close(); err != nil {
+				log.Printf("Failed to finish compressed response to %s: %v", req.URL.Path, err)
+			}
+		}()
+		resp = gz
+	}
+	if p.cfg.ResultHeaders != resultHeadersOff {
+		resp = &resultHeaderWriter{ResponseWriter: resp, format: p.cfg.ResultHeaders, d: d}
+	}
+	var sr *statusRecorder
+	if resultCallback != "" || p.nats != nil || p.audit != nil {
+		sr = &statusRecorder{ResponseWriter: resp}
+		resp = sr
+	}
+	// Upstream calls may outlive this handler, only let go of the body and
+	// call slots once they have all finished
+	defer func() {
+		go func() {
+			defer logPanic(p.metrics.panics, "delivery of "+req.URL.Path)
+			d.pending.Wait()
+			// A dry run publishes nothing either
+			if p.nats != nil && req.Header.Get(probeHeader) == "" && !d.dryRun {
+				p.nats.publishDelivery(req, body, sr.status, d)
+			}
+			if p.audit != nil && req.Header.Get(probeHeader) == "" {
+				p.audit.record(req, sr.status, d)
+			}
+			p.calls.release(slots)
+			if err := body.Close(); err != nil {
+				log.Printf("Failed to clean up request body for %s: %v", req.URL.Path, err)
+			}
+		}()
+	}()
+	if resultCallback != "" {
+		defer func() {
+			go p.sendResultCallback(resultCallback, req, sr.status, d)
+		}()
+	}
 
-			if err != nil {
-				log.Printf("Error forwarding request %s to upstream %s at %s: %v", req2.URL.Path, name, callback, err)
-				ec <- err
-			} else {
-				log.Printf("Success forwarding request %s to upstream %s at %s: %v", req2.URL.Path, name, callback, resp2.StatusCode)
-				rc <- resp2
+	switch mode {
+	case modeHedge:
+		p.hedge(resp, req, body, upstreams)
+	case modeSequential:
+		p.sequential(resp, req, body, upstreams)
+	case modeFailover:
+		p.failover(resp, req, body, upstreams)
+	case modeCompare:
+		p.compare(resp, req, body, upstreams)
+	case modeBalance:
+		p.balance(resp, req, body, upstreams)
+	case modeQueue:
+		p.queue(resp, req, body, upstreams)
+	default:
+		p.fanOut(resp, req, body, upstreams)
+	}
+}
+
+// forward delivers req with body to a single upstream through the sink for
+// its callback's scheme, recording the outcome on the request's delivery.
+func (p *RegProxy) forward(req *http.Request, body *requestBody, ups upstream) (resp2 *http.Response, err error) {
+	start := time.Now()
+	d := deliveryFrom(req.Context())
+	dryRun := d != nil && d.dryRun
+	defer func() {
+		if v := recover(); v != nil {
+			if resp2 != nil {
+				_ = resp2.Body.Close()
 			}
-		}(name, callback)
+			resp2, err = nil, p.upstreamPanic(ups, v)
+		}
+		took := time.Since(start)
+		d.record(ups, resp2, err, took)
+		if dryRun {
+			return
+		}
+		p.slow.observe(ups.Name, took)
+		p.deadlines.observe(ups.Name, took)
+		if ups.SLO != nil {
+			p.slos.observe(ups.Name, ups.SLO.good(p.cfg.SuccessStatuses, resp2, err, took), time.Now())
+		}
+	}()
+	raw := ups.Callback
+	if isCallbackTemplate(raw) {
+		if raw, err = expandCallback(raw, req); err != nil {
+			log.Printf("Failed to expand callback for upstream %s: %v", ups.Name, err)
+			return nil, err
+		}
 	}
-	var latestSuccess *http.Response
-	var latestErr *http.Response
+	callback, err := url.Parse(raw)
+	if err != nil {
+		log.Printf("Invalid callback for upstream %s: %v", ups.Name, err)
+		return nil, err
+	}
+	sink, ok := p.sinks[callback.Scheme]
+	if !ok {
+		log.Printf("No sink for upstream %s at %s", ups.Name, callback)
+		return nil, fmt.Errorf("unsupported callback scheme [%s]", callback.Scheme)
+	}
+	if !dryRun {
+		duplicate, delivered, dupErr := p.checkDuplicate(req, body, ups)
+		if dupErr != nil {
+			return nil, dupErr
+		}
+		if duplicate != nil {
+			log.Printf("Not delivering request %s to upstream %s again within its dedup window", req.URL.Path, ups.Name)
+			return duplicate, nil
+		}
+		defer func() { delivered(resp2, err) }()
+	}
+	translated, err := p.translate(ups, body)
+	if err != nil {
+		log.Printf("Failed to translate request %s for upstream %s: %v", req.URL.Path, ups.Name, err)
+		return nil, err
+	}
+	if translated != body {
+		defer translated.Close()
+		body = translated
+	}
+	if dryRun {
+		return p.dryRun(req, body, ups, callback), nil
+	}
+	har := p.startHAR(req, body, ups, callback, start)
+	defer func() {
+		resp2 = har.finish(resp2, err)
+	}()
+	if ups, err = p.resolveSecrets(req.Context(), ups); err != nil {
+		return nil, err
+	}
+	req = withCookiePolicy(req, ups)
+	exchanged, err := p.tokens.exchange(req, ups)
+	if err != nil {
+		return nil, err
+	}
+	req = exchanged
+	if err := p.upstreamLimits.wait(req.Context(), ups); err != nil {
+		return nil, err
+	}
+	resp2, err = p.retries.do(req, ups.Name, func() (*http.Response, error) {
+		return p.faults.do(req, ups.Name, func(req *http.Request) (*http.Response, error) {
+			p.metrics.upstreamBytes.add(float64(body.size), ups.Name, bytesSent)
+			return sink.Deliver(req, body, ups, callback)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp2, err = p.limitResponse(ups, resp2); err != nil {
+		return nil, err
+	}
+	ups.ResponseHeaders.apply(resp2.Header)
+	resp2 = p.countResponse(ups, resp2)
+	return p.bodies.logResponse(req, ups, resp2), nil
+}
+
+// fanOut calls every upstream in parallel. By default it waits for all of
+// them, otherwise it may respond as soon as the -fanout-respond policy has
+// its answer, leaving the other calls to finish in the background.
+func (p *RegProxy) fanOut(resp http.ResponseWriter, req *http.Request, body *requestBody, upstreams map[string]upstream) {
+	// Buffered so that no call is left blocked sending its result if we
+	// stop waiting for it
+	rc := make(chan result, len(upstreams))
+
+	// Call upstreams in parallel
+	calls := req
+	if p.cfg.FanOutRespond == fanOutEarly || p.cfg.FanOutRespond == fanOutPrimary {
+		// Calls may outlive this handler, only cancel them if the client goes
+		calls = req.WithContext(context.WithoutCancel(req.Context()))
+	}
+	cancels := make(callCancels, len(upstreams))
+	background := false
+	defer func() {
+		if !background {
+			cancels.cancelAll()
+		}
+	}()
+	for _, ups := range upstreams {
+		cancels[ups.Name] = p.forwardAsync(calls, body, ups, rc)
+	}
+	var primary upstream
+	for _, ups := range upstreams {
+		if primary.Name == "" || comparePriority(ups, primary) < 0 {
+			primary = ups
+		}
+	}
+	var results []result
 	dc := req.Context().Done()
 	// Wait for _all_ the responses, it's interesting to know which ones succeeded and
 	// which ones failed during a single call.
 	for range upstreams {
 		select {
 		case latest := <-rc:
-			if isSuccess(latest) {
-				latestSuccess = latest
-			} else {
-				latestErr = latest
+			results = append(results, latest)
+			if p.decided(latest, primary.Name) {
+				background = true
+				go func(n int) {
+					discardResults(rc, n)
+					cancels.cancelAll()
+				}(len(upstreams) - len(results))
+				if p.cfg.FanOutRespond == fanOutPrimary {
+					for _, r := range results[:len(results)-1] {
+						r.close()
+					}
+					results = results[len(results)-1:]
+				}
+				p.respond(resp, req, results)
+				return
 			}
-		case e = <-ec:
 		// If our own client cancelled, we should stop waiting
-		case _ = <-dc:
-			errResp(resp, req.Context().Err())
+		case <-dc:
+			go discardResults(rc, len(upstreams)-len(results))
+			for _, r := range results {
+				r.close()
+			}
+			p.upstreamErrResp(resp, req, req.Context().Err())
 			return
 		}
 	}
+	p.respond(resp, req, results)
+}
+
+// decided says whether the latest result decides the fan-out response, by
+// the -fanout-respond policy: with early, when it's one the prefer policy
+// picks over any other, with primary, when it's the primary's.
+func (p *RegProxy) decided(latest result, primary string) bool {
+	switch p.cfg.FanOutRespond {
+	case fanOutEarly:
+		return p.ok(latest) == (p.cfg.Prefer == preferSuccess)
+	case fanOutPrimary:
+		return latest.ups.Name == primary
+	}
+	return false
+}
+
+// respond returns the response picked from a set of upstream results in the
+// order they completed by the -status-policy, or with the fixed policy a
+// report of every upstream's outcome.
+func (p *RegProxy) respond(resp http.ResponseWriter, req *http.Request, results []result) {
+	var rr *http.Response
+	var e error
+	switch p.cfg.StatusPolicy {
+	case statusFixed:
+		for _, r := range results {
+			r.close()
+		}
+		writeJSON(resp, p.cfg.FixedStatus, newDeliveryReport(req, p.cfg.FixedStatus, deliveryFrom(req.Context())).public())
+		return
+	case statusPrimary:
+		r := slices.MinFunc(results, func(a, b result) int { return comparePriority(a.ups, b.ups) })
+		rr, e = r.resp, r.err
+	case statusWorst, statusBest:
+		r := p.rankResults(results, p.cfg.StatusPolicy == statusWorst)
+		rr, e = r.resp, r.err
+	default:
+		rr, e = p.latestResult(results)
+	}
+	for _, r := range results {
+		if r.resp != nil && r.resp != rr {
+			_ = r.resp.Body.Close()
+		}
+	}
 	// Any errors, oopsie
 	if e != nil {
-		errResp(resp, e)
+		if rr != nil {
+			_ = rr.Body.Close()
+		}
+		p.upstreamErrResp(resp, req, e)
 		return
 	}
-	// Prefer to return non-success responses
-	var rr = latestSuccess
-	if latestErr != nil {
+	writeResponse(resp, rr)
+}
+
+// latestResult picks the response for the latest status policy. By default
+// any error wins, otherwise the latest non-success response is preferred over
+// the latest success; preferring success reverses that, so one healthy
+// upstream is enough.
+func (p *RegProxy) latestResult(results []result) (*http.Response, error) {
+	var latestSuccess *http.Response
+	var latestErr *http.Response
+	var e error
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			e = r.err
+		case p.ok(r):
+			latestSuccess = r.resp
+		default:
+			latestErr = r.resp
+		}
+	}
+	var rr *http.Response
+	if p.cfg.Prefer == preferSuccess {
 		rr = latestErr
+		if latestSuccess != nil {
+			rr = latestSuccess
+			e = nil
+		}
+	} else {
+		// Prefer to return non-success responses
+		rr = latestSuccess
+		if latestErr != nil {
+			rr = latestErr
+		}
+	}
+	return rr, e
+}
+
+// writeResponse copies an upstream's response to the client.
+func writeResponse(resp http.ResponseWriter, rr *http.Response) {
+	defer rr.Body.Close()
+	removeHopByHopHeaders(rr.Header)
+	for k, vv := range rr.Header {
+		resp.Header()[k] = append(resp.Header()[k], vv...)
 	}
 	resp.WriteHeader(rr.StatusCode)
-	_ = rr.Write(resp)
+	buf := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(buf)
+	// Hide any ReaderFrom so that CopyBuffer really uses our buffer
+	_, _ = io.CopyBuffer(struct{ io.Writer }{resp}, rr.Body, *buf)
 }
 
 type upstream struct {
 	Name     string `json:"name"`
 	Callback string `json:"callback"`
+	// Priority orders upstreams for the modes which don't call them all at
+	// once, lowest first. The lowest priority upstream is the primary.
+	Priority int `json:"priority,omitempty"`
+	// Weight shares the load between upstreams of the same priority, those
+	// with a higher weight being tried first more often
+	Weight int `json:"weight,omitempty"`
+	// Proxy optionally overrides the outbound proxy from the environment for
+	// this upstream: an http, https or socks5 URL, or "direct" for none.
+	Proxy string `json:"proxy,omitempty"`
+	// Labels are free-form metadata, kept with the registration and exported
+	// with the registry but not otherwise interpreted.
+	Labels map[string]string `json:"labels,omitempty"`
+	// PathMode says how the callback's path and the request's are composed,
+	// defaulting to the proxy's -path-mode. StripPrefix is removed from the
+	// request's path in strip mode.
+	PathMode    string `json:"pathMode,omitempty"`
+	StripPrefix string `json:"stripPrefix,omitempty"`
+	// Rewrite rules are applied to the request's path, first match only,
+	// before it's composed with the callback's
+	Rewrite []rewriteRule `json:"rewrite,omitempty"`
+	// Query optionally renames, removes and sets query parameters
+	Query *queryRules `json:"query,omitempty"`
+	// CookiePolicy says whether the request's cookies are passed on (the
+	// default), stripped, or only those in AllowCookies are passed on
+	CookiePolicy string   `json:"cookiePolicy,omitempty"`
+	AllowCookies []string `json:"allowCookies,omitempty"`
+	// TokenExchange optionally swaps the request's bearer token for one the
+	// upstream accepts
+	TokenExchange *tokenExchange `json:"tokenExchange,omitempty"`
+	// Group optionally puts the upstream in a group, so that it's only
+	// called for requests to listeners serving that group rather than the
+	// default listener
+	Group string `json:"group,omitempty"`
+	// SLO optionally sets an objective for calls to the upstream, whose
+	// error budget burn rates are reported
+	SLO *upstreamSLO `json:"slo,omitempty"`
+	// Paused upstreams are left out of the fan-out, e.g. during their
+	// maintenance window, until resumed
+	Paused bool `json:"paused,omitempty"`
+	// Buckets optionally restricts the upstream to requests in these
+	// experiment buckets
+	Buckets []string `json:"buckets,omitempty"`
+	// Rollout optionally gives the upstream a growing share of requests
+	// over time, taken from the upstream it replaces
+	Rollout *rollout `json:"rollout,omitempty"`
+	// DelayMs optionally holds back requests queued for the upstream for
+	// this long after they were accepted
+	DelayMs int64 `json:"delayMs,omitempty"`
+	// RateLimit optionally smooths calls to the upstream to the capacity
+	// it declares
+	RateLimit *upstreamRateLimit `json:"rateLimit,omitempty"`
+	// ContentTypes optionally restricts the upstream to requests with
+	// these media types, e.g. application/fhir+json or application/*
+	ContentTypes []string `json:"contentTypes,omitempty"`
+	// Translations optionally name the -translation mappings applied to
+	// request bodies, in order, before they're sent to the upstream
+	Translations []string `json:"translations,omitempty"`
+	// ResponseHeaders optionally limits which of the upstream's response
+	// headers are passed on to the client
+	ResponseHeaders *responseHeaderRules `json:"responseHeaders,omitempty"`
+	// DedupWindowMs optionally skips delivering a request to the upstream
+	// again if the same request was delivered within this long
+	DedupWindowMs int64 `json:"dedupWindowMs,omitempty"`
 }
 
 func (p *RegProxy) register(resp http.ResponseWriter, req *http.Request) {
@@ -223,101 +765,829 @@ func (p *RegProxy) register(resp http.ResponseWriter, req *http.Request) {
 		badRequest(resp, err.Error())
 		return
 	}
-	upstream, err := url.Parse(q.Callback)
-	if err != nil {
-		log.Println("Failed to parse URL")
+	if err := p.validateRegistration(q); err != nil {
 		badRequest(resp, err.Error())
 		return
 	}
 
+	overwrite := false
+	if v := req.URL.Query().Get("overwrite"); v != "" {
+		if overwrite, err = strconv.ParseBool(v); err != nil {
+			badRequest(resp, fmt.Sprintf("Invalid overwrite [%s], expected true or false", v))
+			return
+		}
+	}
+
 	p.writeLock.Lock()
 	defer p.writeLock.Unlock()
+	// As with PUT /upstreams/{name}, don't let a registration silently take
+	// over a name another consumer holds
+	existing, exists, err := p.lookupUpstream(q.Name)
+	if err != nil {
+		errResp(resp, err)
+		return
+	}
+	if exists && !overwrite && existing.Callback != q.Callback {
+		writeProblem(resp, newProblem(http.StatusConflict, fmt.Sprintf("Upstream [%s] is already registered with a different callback, register with ?overwrite=true to replace it", q.Name)))
+		return
+	}
+	keepPaused(&q, existing, exists)
+	if exists && reflect.DeepEqual(existing, q) {
+		resp.WriteHeader(204)
+		return
+	}
 	log.Printf("Adding upstream %v", q)
-	if err := p.storage.Put(q.Name, upstream); err != nil {
+	if err := p.storage.Put(q); err != nil {
 		errResp(resp, err)
 		return
 	}
+	p.registryChanged()
 	resp.WriteHeader(204)
 }
 
 func (p *RegProxy) health(resp http.ResponseWriter, _ *http.Request) {
 	// https://inadarei.github.io/rfc-healthcheck/
-	resp.WriteHeader(200)
 	resp.Header().Add("Content-Type", "application/health+json")
+	resp.WriteHeader(200)
+	if !p.stored.healthy() {
+		// Still proxying, with the last known registry
+		_, _ = resp.Write([]byte(`{"status": "warn", "output": "storage is down"}`))
+		return
+	}
 	_, _ = resp.Write([]byte(`{"status": "pass"}`))
 }
 
-func NewRegProxy(
-	clientHttpTimeout, clientDialTimeout, clientKeepAliveInterval, dnsCacheRefresh, dnsLookupTimeout, clientMaxIdleTimeout *time.Duration,
-	clientMaxIdleConnections *int64,
-	useDnsCachePtr *bool,
-	storage RegStorage,
-) *RegProxy {
-	dc := (&net.Dialer{
-		Timeout:   *clientDialTimeout,
-		KeepAlive: *clientKeepAliveInterval,
+// Config holds the tunables for a RegProxy, normally populated from the
+// command line flags.
+type Config struct {
+	ClientHttpTimeout        time.Duration
+	ClientDialTimeout        time.Duration
+	ClientKeepAliveInterval  time.Duration
+	ClientMaxIdleConnections int64
+	ClientMaxIdleTimeout     time.Duration
+	UseDnsCache              bool
+	DnsCacheRefresh          time.Duration
+	DnsLookupTimeout         time.Duration
+	BalanceAddrs             bool
+	AddrUnhealthyCooldown    time.Duration
+	ClientFallbackDelay      time.Duration
+	Mode                     string
+	HedgeDelay               time.Duration
+	SequentialOnFailure      string
+	BalancePolicy            string
+	BalanceHashKey           string
+	QueueMaxLength           int
+	QueueMinBackoff          time.Duration
+	QueueMaxBackoff          time.Duration
+	QueueMaxAttempts         int
+	QueueDeadLetter          string
+	QueueOutboxDir           string
+	MaxDelay                 time.Duration
+	JSONSchemas              []schemaRule
+	DeadlineWindow           time.Duration
+	UpstreamRateLimitMaxWait time.Duration
+	QoSClasses               []qosClassConfig
+	QoSRules                 []qosRule
+	QoSDefaultClass          string
+	QoSQueueTimeout          time.Duration
+	CompareIgnoreFields      []string
+	CompareLogSample         float64
+	SpoolThreshold           int64
+	SpoolDir                 string
+	MaxUpstreamCalls         int64
+	SuccessStatuses          statusRanges
+	Prefer                   string
+	ResultHeaders            string
+	ViaName                  string
+	InstanceID               string
+	ListenAddr               string
+	ExtraListenAddrs         []string
+	LeaderLeaseTTL           time.Duration
+	RateLimitGlobal          int64
+	RateLimitTenant          int64
+	RateLimitWindow          time.Duration
+	RateLimitTenantHeader    string
+	MaxInFlightRequests      int64
+	MaxHeapBytes             int64
+	SlowUpstreamSLO          time.Duration
+	SlowUpstreamWindow       time.Duration
+	SlowUpstreamSustain      time.Duration
+	SlowUpstreamWebhook      string
+	StorageHealthInterval    time.Duration
+	StorageMaxBackoff        time.Duration
+	StorageCacheRefresh      time.Duration
+	ProbeInterval            time.Duration
+	ProbeMethod              string
+	ProbePath                string
+	ProbeBody                string
+	FaultInjection           bool
+	NATSURL                  string
+	NATSSubject              string
+	NATSPublish              string
+	FileSinkDir              string
+	PathMode                 string
+	MaxResponseBytes         int64
+	ResponseLimitPolicy      string
+	ExecSinks                map[string]string
+	Translations             map[string]translator
+	AllowedMethods           []string
+	CompressResponses        bool
+	CompressMinBytes         int
+	CompressTypes            []string
+	TracePropagation         []string
+	TraceSampler             string
+	TraceSampleRatio         float64
+	TraceSampleRoutes        []traceSampleRoute
+	DisablePrometheus        bool
+	MaxRetries               int
+	RetryBackoff             time.Duration
+	RetryBudget              float64
+	JWKSURL                  string
+	JWKSRefresh              time.Duration
+	JWTIssuer                string
+	JWTAudience              string
+	JWTLeeway                time.Duration
+	VaultAddr                string
+	VaultTokenFile           string
+	VaultCacheTTL            time.Duration
+	SecretReloadInterval     time.Duration
+	SecretFileDir            string
+	VaultPathPrefixes        []string
+	BodyLogSample            float64
+	BodyLogMaxBytes          int64
+	BodyLogRedactFields      []string
+	BodyLogRedactPatterns    []*regexp.Regexp
+	AuditSink                string
+	AuditRetention           time.Duration
+	FanOutRespond            string
+	StatusPolicy             string
+	FixedStatus              int
+	MaintenancePage          []byte
+	MaintenancePageType      string
+	MaintenanceRetryAfter    time.Duration
+	DryRun                   bool
+	ExperimentKey            string
+	ExperimentBuckets        []experimentBucket
+	RolloutKey               string
+	HARSample                float64
+	HAREntries               int
+
+	// ResultCallbackAllowNetworks are the non-public networks result
+	// callbacks may be sent to
+	ResultCallbackAllowNetworks []*net.IPNet
+	// AdminListener serves the admin API only on listeners with the admin
+	// option, proxying its paths on the others
+	AdminListener bool
+}
+
+func NewRegProxy(cfg Config, storage RegStorage) *RegProxy {
+	baseDial := (&net.Dialer{
+		Timeout:       cfg.ClientDialTimeout,
+		KeepAlive:     cfg.ClientKeepAliveInterval,
+		FallbackDelay: cfg.ClientFallbackDelay,
 	}).DialContext
+	dc := baseDial
+	lookup := func(ctx context.Context, host string) ([]net.IP, error) {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
 
 	// Use a caching DNS resolver
 	// https://www.reddit.com/r/golang/comments/9wk812/go_package_for_caching_dns_lookup_results_in/
-	if *useDnsCachePtr {
+	if cfg.UseDnsCache {
 		logger, err := zap.NewDevelopment()
 		if err != nil {
 			log.Fatal(err)
 		}
-		resolver, err := dnscache.New(*dnsCacheRefresh, *dnsLookupTimeout, logger)
+		resolver, err := dnscache.New(cfg.DnsCacheRefresh, cfg.DnsLookupTimeout, logger)
 		if err != nil {
 			log.Fatal(err)
 		}
 		dc = dnscache.DialFunc(resolver, dc)
+		lookup = func(_ context.Context, host string) ([]net.IP, error) {
+			return resolver.Fetch(host)
+		}
 		log.Printf("Using DNS cache")
 	}
+	// Spread connections over all of the addresses a callback resolves to
+	if cfg.BalanceAddrs {
+		dc = newAddrBalancer(lookup, baseDial, cfg.AddrUnhealthyCooldown, cfg.ClientFallbackDelay, cfg.ClientDialTimeout).DialContext
+		log.Printf("Balancing connections across resolved addresses")
+	}
+	metrics := newProxyMetrics()
+	conns := newConnStats(metrics)
 	client := &http.Client{
 		Transport: &http.Transport{
-			Proxy:           http.ProxyFromEnvironment,
-			DialContext:     dc,
-			MaxIdleConns:    int(*clientMaxIdleConnections),
-			IdleConnTimeout: *clientMaxIdleTimeout,
+			Proxy:           egressProxy,
+			DialContext:     conns.dial(dc),
+			MaxIdleConns:    int(cfg.ClientMaxIdleConnections),
+			IdleConnTimeout: cfg.ClientMaxIdleTimeout,
 		},
-		Timeout: *clientHttpTimeout,
+		Timeout: cfg.ClientHttpTimeout,
 	}
 	rp := &RegProxy{
+		cfg:     cfg,
 		storage: storage,
 		client:  client,
+		metrics: metrics,
+		conns:   conns,
+		calls:   newCallLimiter(cfg.MaxUpstreamCalls),
+		leader:  newLeader(storage, cfg.InstanceID, cfg.LeaderLeaseTTL),
+		limiter: newRateLimiter(cfg, storage),
+		admission: &admission{
+			maxInFlight:  cfg.MaxInFlightRequests,
+			maxHeapBytes: cfg.MaxHeapBytes,
+		},
 	}
+	if cfg.SlowUpstreamSLO > 0 {
+		rp.slow = &slowDetector{
+			slo:       cfg.SlowUpstreamSLO,
+			window:    cfg.SlowUpstreamWindow,
+			sustain:   cfg.SlowUpstreamSustain,
+			webhook:   cfg.SlowUpstreamWebhook,
+			client:    client,
+			events:    rp.metrics.slowEvents,
+			upstreams: make(map[string]*upstreamLatency),
+		}
+	}
+	rp.metrics.gaugeFunc("regproxy_upstream_calls_in_flight", "Upstream calls currently reserved by proxied requests.", func() float64 {
+		return float64(rp.calls.inFlight.Load())
+	})
+	rp.metrics.gaugeFunc("regproxy_upstream_goroutines", "Goroutines calling upstreams in the background, which would keep growing if any were leaked.", func() float64 {
+		return float64(rp.asyncCalls.Load())
+	})
+	rp.metrics.gaugeFunc("regproxy_requests_in_flight", "Proxied requests currently being handled.", func() float64 {
+		return float64(rp.admission.inFlight.Load())
+	})
+	rp.metrics.gaugeFunc("regproxy_queued_requests", "Requests waiting in queue mode to be delivered to an upstream.", func() float64 {
+		return float64(rp.queues.length())
+	})
+	rp.stored = newStorageHealth(storage, cfg)
+	rp.metrics.gaugeFunc("regproxy_storage_healthy", "Whether the storage backend answered when last asked, requests being routed with the last known registry while it doesn't.", func() float64 {
+		if rp.stored.healthy() {
+			return 1
+		}
+		return 0
+	})
+	rp.slos = newSLOTracker()
+	rp.metrics.gaugeVecFunc("regproxy_slo_burn_rate", "How fast upstreams with an SLO are spending their error budget, by window, 1 spending it exactly over the SLO period.", []string{"upstream", "window"}, rp.sloBurnRateGauge)
+	rp.metrics.gaugeVecFunc("regproxy_upstream_connections_open", "Connections open to each upstream, idle or not.", []string{"upstream"}, rp.conns.openGauge)
+	rp.metrics.gaugeVecFunc("regproxy_upstream_connections_idle", "Connections to each upstream waiting idle to be reused.", []string{"upstream"}, rp.conns.idleGauge)
+	rp.metrics.gaugeVecFunc("regproxy_rollout_percent", "The percent of requests each upstream being rolled out gets now.", []string{"upstream"}, rp.rolloutGauge)
+	rp.metrics.gaugeFunc("regproxy_leader", "Whether this instance is the leader, which runs background tasks for the cluster.", func() float64 {
+		if rp.leader.isLeader() {
+			return 1
+		}
+		return 0
+	})
+	build := currentBuild()
+	rp.metrics.gaugeVecFunc("regproxy_build_info", "The running build, always 1.", []string{"version", "commit", "go_version"}, func() map[string]float64 {
+		return map[string]float64{labelKey([]string{build.Version, build.Commit, build.GoVersion}): 1}
+	})
+	rp.metrics.gaugeFunc("regproxy_maintenance", "Whether maintenance is underway, requests being queued or rejected rather than forwarded.", func() float64 {
+		if rp.maintenance.mode() != maintenanceOff {
+			return 1
+		}
+		return 0
+	})
 	sm := http.NewServeMux()
-	sm.HandleFunc("/health", rp.health)
-	sm.HandleFunc("/register", rp.register)
-	sm.HandleFunc("/", rp.proxy)
+	admin := http.NewServeMux()
+	for _, mux := range []*http.ServeMux{sm, admin} {
+		mux.HandleFunc("/health", rp.health)
+		if !cfg.DisablePrometheus {
+			mux.HandleFunc("/metrics", rp.metrics.handler)
+		}
+	}
+	handleAdmin(admin, "/register", rp.register)
+	handleAdmin(admin, "/upstreams", rp.upstreamList)
+	handleAdmin(admin, "/upstreams/{name}", rp.upstreamResource)
+	handleAdmin(admin, "/upstreams/{name}/pause", rp.pauseUpstream)
+	handleAdmin(admin, "/upstreams/{name}/resume", rp.resumeUpstream)
+	handleAdmin(admin, "/admin/registry/export", rp.exportRegistry)
+	handleAdmin(admin, "/admin/registry/import", rp.importRegistry)
+	handleAdmin(admin, "/admin/probe", rp.probeReport)
+	handleAdmin(admin, "/admin/openapi.json", rp.openAPI)
+	handleAdmin(admin, "/admin/maintenance", rp.maintenanceResource)
+	handleAdmin(admin, "/admin/stats", rp.statsReport)
+	handleAdmin(admin, "/admin/version", rp.versionReport)
+	handleAdmin(admin, "/admin/har", rp.harExport)
+	rp.grpc = newGRPCAdmin(rp)
+	handleAdmin(admin, "/"+grpcAdminService+"/{method}", rp.grpcAdmin)
+	rp.sinks = newSinks(rp, cfg)
+	rp.jwt = newJWTValidator(cfg)
+	rp.retries = newRetrier(cfg, rp.metrics)
+	rp.upstreamLimits = newUpstreamLimiters(cfg, rp.metrics.upstreamLimited)
+	rp.deadlines = newDeadlines(cfg)
+	rp.dedup = newDedup(rp.metrics.duplicates, cfg.RateLimitTenantHeader)
+	// Classes take over limiting the requests in flight, each to its share
+	if rp.qos = newQoS(cfg, rp.metrics.qosRequests); rp.qos != nil {
+		rp.admission.maxInFlight = 0
+	}
+	rp.metrics.gaugeVecFunc("regproxy_qos_in_flight", "Proxied requests being handled, by QoS class.", []string{"class"}, rp.qos.inFlightGauge)
+	rp.lb = newLoadBalancer(cfg.BalancePolicy, cfg.BalanceHashKey)
+	rp.queues = newRequestQueues(rp, cfg)
+	rp.tokens = newTokenExchanger(&http.Client{Timeout: 10 * time.Second})
+	rp.secrets = newSecretFiles()
+	rp.secretRefs = newSecretRefPolicy(cfg)
+	rp.results = newResultClient(cfg.ResultCallbackAllowNetworks, cfg.ClientHttpTimeout)
+	rp.maintenance = newMaintenance(cfg)
+	rp.experiment = newExperiment(cfg)
+	if cfg.RolloutKey != "" {
+		// main has already checked the key
+		rp.rolloutKey, _ = parseHashKey(cfg.RolloutKey)
+	}
+	rp.bodies = newBodyLogger(cfg)
+	rp.har = newHARRecorder(cfg)
+	rp.vault = newVaultClient(cfg, os.Getenv, rp.secrets)
+	if cfg.NATSURL != "" {
+		// main has already checked the URL
+		client, _ := newNATSClient(cfg.NATSURL)
+		rp.nats = &natsPublisher{client: client, subject: cfg.NATSSubject, publish: cfg.NATSPublish}
+	}
+	if cfg.FaultInjection {
+		rp.faults = newFaultInjector(rp.metrics.faultsInjected)
+		handleAdmin(admin, "/admin/faults", rp.faultList)
+		handleAdmin(admin, "/admin/faults/{name}", rp.faultResource)
+	}
+	if g, ok := storage.(*RegStorageGossip); ok {
+		sm.HandleFunc(gossipPath, g.handler)
+	}
+	rp.admin = admin
+	if cfg.AdminListener {
+		sm.HandleFunc("/", rp.proxy)
+	} else {
+		sm.Handle("/", adminOrProxy(admin, http.HandlerFunc(rp.proxy)))
+	}
 	rp.handler = sm
 	return rp
 }
 
+// adminOrProxy serves the paths of the admin API from admin, and proxies
+// the rest.
+func adminOrProxy(admin *http.ServeMux, proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if _, pattern := admin.Handler(req); pattern != "" {
+			admin.ServeHTTP(resp, req)
+			return
+		}
+		proxy.ServeHTTP(resp, req)
+	})
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if _, ok := clientCommands[os.Args[1]]; ok {
+			os.Exit(runClientCommand(os.Args[1], os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+	// validate takes the proxy's own flags, checking them instead of serving
+	validateOnly := len(os.Args) > 1 && os.Args[1] == "validate"
+	if validateOnly {
+		os.Args = slices.Delete(os.Args, 1, 2)
+	}
 	hostPtr := flag.String("host", "0.0.0.0", "The host to bind to")
 	portPtr := flag.Int("port", 9876, "The port to bind to")
-	serverReadTimeout := flag.Duration("server-read-timeout", 1*time.Second, "server read timeout")
-	serverWriteTimeout := flag.Duration("server-write-timeout", 40*time.Second, "server write timeout")
-	clientHttpTimeout := flag.Duration("client-http-timeout", 40*time.Second, "client timeout (for upstreams)")
-	clientDialTimeout := flag.Duration("client-dial-timeout", 1*time.Second, "client dialer timeout")
-	clientKeepAliveInterval := flag.Duration("client-keep-alive-interval", -1*time.Second, "client keep-alive interval")
-	clientMaxIdleConnections := flag.Int64("client-max-idle-conns", 1, "client max idle connections (for connection pooling)")
-	clientMaxIdleTimeout := flag.Duration("client-max-idle-timeout", 1*time.Second, "client idle connection timeout (for connection pooling)")
-	useDnsCachePtr := flag.Bool("use-dns-cache", true, "use an internal DNS cache")
-	dnsCacheRefresh := flag.Duration("dns-cache-refresh", 100*time.Hour, "interval for refrshing DNS cache")
-	dnsLookupTimeout := flag.Duration("dns-lookup-timeout", 5*time.Second, "timeout for DNS lookups")
-	registryStoreLocation := flag.String("storage-location", "memory", "registry data storage file location, or 'memory' for in-memory only")
+	var limits serverLimits
+	flag.DurationVar(&limits.ReadTimeout, "server-read-timeout", 30*time.Second, "server read timeout, for the whole request including its body, 0 for none")
+	flag.DurationVar(&limits.ReadHeaderTimeout, "server-read-header-timeout", 5*time.Second, "server timeout for reading request headers")
+	flag.DurationVar(&limits.WriteTimeout, "server-write-timeout", 40*time.Second, "server write timeout, 0 for none")
+	flag.DurationVar(&limits.IdleTimeout, "server-idle-timeout", 2*time.Minute, "how long the server keeps idle keep-alive connections open, 0 for as long as the read timeout")
+	flag.IntVar(&limits.MaxHeaderBytes, "server-max-header-bytes", http.DefaultMaxHeaderBytes, "largest request headers the server accepts, in bytes")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "on SIGTERM, or after handing over to a new process on SIGHUP, how long to let requests in flight finish")
+	serverTCPKeepAlive := flag.Duration("server-tcp-keepalive", 3*time.Minute, "TCP keep-alive period for client connections, negative to disable")
+	listenFamily := flag.String("listen-family", familyDual, "IP family to listen on: "+familyDual+" (IPv4 and IPv6 on wildcard addresses, where supported), "+familyIPv4+" or "+familyIPv6+" only")
+	certReloadInterval := flag.Duration("tls-cert-reload-interval", 30*time.Second, "how often to check listeners' cert and key files for changes, reloading them without a restart")
+	var acmeDomains []string
+	flag.Func("acme-domains", "comma separated domains to obtain a TLS certificate for from an ACME CA such as Let's Encrypt, for listeners with the acme option", func(s string) error {
+		acmeDomains = strings.Split(s, ",")
+		return nil
+	})
+	acmeDirectory := flag.String("acme-directory", letsEncrypt, "ACME directory URL of the CA to obtain certificates from")
+	acmeEmail := flag.String("acme-email", "", "contact email for the ACME account, for expiry notices from the CA")
+	acmeCacheDir := flag.String("acme-cache-dir", "acme", "directory to keep the ACME account key and certificate in across restarts")
+	statsdAddr := flag.String("statsd-addr", "", "host:port of a StatsD server to push metrics to over UDP, in addition to serving them for Prometheus")
+	statsdFormat := flag.String("statsd-format", statsdPlain, "the StatsD dialect: "+statsdPlain+", with labels appended to metric names, or "+statsdDog+", with labels as tags")
+	statsdPrefix := flag.String("statsd-prefix", "regproxy.", "prefix for metric names pushed to StatsD")
+	statsdTags := flag.String("statsd-tags", "", "comma separated tags added to every metric with dogstatsd, e.g. env:prod,team:platform")
+	statsdInterval := flag.Duration("statsd-interval", 10*time.Second, "how often metrics are pushed to StatsD")
+	acmeHTTPAddr := flag.String("acme-http-addr", ":80", "address to answer ACME HTTP-01 challenges on, redirecting other requests to HTTPS. Must be reachable on port 80 of the domains")
+	var cfg Config
+	var extraListeners []listenerConfig
+	flag.Func("listener", "an additional address to serve on, as addr=host:port[,cert=file,key=file|,acme][,client-ca=file[,client-auth=optional]][,group=name][,family=ipv6][,admin], over TLS with cert and key or a certificate for -acme-domains, verifying client certificates against client-ca, only proxying to upstreams registered in the group if set, and overriding -listen-family if set. With admin it serves the admin API alone, which the other listeners then proxy the paths of. May be repeated", func(s string) error {
+		lc, err := parseListener(s)
+		extraListeners = append(extraListeners, lc)
+		cfg.ExtraListenAddrs = append(cfg.ExtraListenAddrs, lc.Addr)
+		return err
+	})
+	flag.DurationVar(&cfg.ClientHttpTimeout, "client-http-timeout", 40*time.Second, "client timeout (for upstreams)")
+	flag.DurationVar(&cfg.ClientDialTimeout, "client-dial-timeout", 1*time.Second, "client dialer timeout")
+	flag.DurationVar(&cfg.ClientKeepAliveInterval, "client-keep-alive-interval", -1*time.Second, "client keep-alive interval")
+	flag.Int64Var(&cfg.ClientMaxIdleConnections, "client-max-idle-conns", 1, "client max idle connections (for connection pooling)")
+	flag.DurationVar(&cfg.ClientMaxIdleTimeout, "client-max-idle-timeout", 1*time.Second, "client idle connection timeout (for connection pooling)")
+	flag.BoolVar(&cfg.UseDnsCache, "use-dns-cache", true, "use an internal DNS cache")
+	flag.DurationVar(&cfg.DnsCacheRefresh, "dns-cache-refresh", 100*time.Hour, "interval for refrshing DNS cache")
+	flag.DurationVar(&cfg.DnsLookupTimeout, "dns-lookup-timeout", 5*time.Second, "timeout for DNS lookups")
+	flag.BoolVar(&cfg.BalanceAddrs, "client-balance-addrs", true, "spread upstream connections across all resolved addresses of a callback host")
+	flag.DurationVar(&cfg.AddrUnhealthyCooldown, "client-addr-unhealthy-cooldown", 10*time.Second, "how long to skip a resolved address after a failed dial")
+	flag.DurationVar(&cfg.ClientFallbackDelay, "client-fallback-delay", defaultFallbackDelay, "for upstream hosts with both IPv4 and IPv6 addresses, how long to wait for the preferred family before also trying the other (Happy Eyeballs), negative to disable")
+	flag.StringVar(&cfg.Mode, "mode", modeFanOut, "how requests are delivered to upstreams: "+strings.Join(modes, ", "))
+	flag.DurationVar(&cfg.HedgeDelay, "hedge-delay", 100*time.Millisecond, "in hedge mode, how long to wait for an upstream before also trying the next one")
+	flag.StringVar(&cfg.BalancePolicy, "balance-policy", balanceRoundRobin, "in balance mode, how the upstream for each request is chosen: "+strings.Join(balancePolicies, ", "))
+	flag.StringVar(&cfg.ExperimentKey, "experiment-key", "", "the request attribute hashed to assign requests to -experiment-buckets: header:<name>, query:<name>, path or client-ip")
+	flag.Func("experiment-buckets", "comma separated bucket=weight shares of requests for an A/B experiment, e.g. control=90,canary=10. Upstreams registered with buckets only get requests in them, and requests without the -experiment-key go to the first bucket", func(s string) error {
+		var err error
+		cfg.ExperimentBuckets, err = parseExperimentBuckets(s)
+		return err
+	})
+	flag.StringVar(&cfg.RolloutKey, "rollout-key", "", "the request attribute hashed to keep requests on the same side of upstreams' rollouts: header:<name>, query:<name>, path or client-ip. By default each request is split at random")
+	flag.StringVar(&cfg.BalanceHashKey, "balance-hash-key", "client-ip", "with the consistent-hash balance policy, the request attribute hashed to choose an upstream: header:<name>, query:<name>, path or client-ip")
+	flag.IntVar(&cfg.QueueMaxLength, "queue-max-length", 10000, "in queue mode, the most requests queued for each upstream before requests are rejected with 503, 0 for no limit")
+	flag.DurationVar(&cfg.QueueMinBackoff, "queue-min-backoff", time.Second, "in queue mode, how long to wait before first retrying a failed delivery")
+	flag.DurationVar(&cfg.QueueMaxBackoff, "queue-max-backoff", time.Minute, "in queue mode, the longest to wait between retries of a failed delivery")
+	flag.DurationVar(&cfg.MaxDelay, "max-delay", 24*time.Hour, "the longest a request may ask to be delayed with "+delayHeader+", 0 for no limit")
+	flag.DurationVar(&cfg.DeadlineWindow, "deadline-window", 5*time.Minute, "the rolling window of upstream latencies used to shed requests which won't be answered within their "+timeoutHeader+", 0 to never shed them")
+	flag.IntVar(&cfg.QueueMaxAttempts, "queue-max-attempts", 0, "in queue mode, how many times to try delivering a request before giving up on it, 0 for no limit. Requests refused with a client error other than 408, 425 or 429 are given up on straight away")
+	flag.StringVar(&cfg.QueueDeadLetter, "queue-dead-letter", "", "in queue mode, a callback, such as file:///dead-letter.jsonl or an HTTP URL, to send requests given up on to rather than dropping them")
+	flag.StringVar(&cfg.QueueOutboxDir, "queue-outbox-dir", "", "in queue mode, a directory to persist each request in before it's accepted, until every upstream has had it, so none are lost if the proxy stops. Requests left in it are delivered again on startup. Requests are stored with their headers, credentials included, in plaintext, readable only by the proxy's user")
+	flag.StringVar(&cfg.SequentialOnFailure, "sequential-on-failure", sequentialStop, "in sequential mode, whether to "+sequentialStop+" or "+sequentialContinue+" delivering to later upstreams after one fails")
+	flag.Func("compare-ignore-fields", "in compare mode, comma separated JSON field paths to ignore, e.g. meta.timestamp,items.*.id", func(s string) error {
+		cfg.CompareIgnoreFields = strings.Split(s, ",")
+		return nil
+	})
+	flag.Float64Var(&cfg.CompareLogSample, "compare-log-sample", 1, "in compare mode, the fraction of differences to log, between 0 and 1")
+	flag.StringVar(&cfg.AuditSink, "audit-sink", "", "where to record every proxied request for auditing: a directory to keep a file of records per day in, or an http(s) URL to POST each record to")
+	flag.DurationVar(&cfg.AuditRetention, "audit-retention", 0, "with an audit directory, how long audit files are kept before they're deleted, 0 for ever")
+	flag.Float64Var(&cfg.BodyLogSample, "body-log-sample", 0, "the fraction of requests whose bodies, and their upstreams' response bodies, are logged for debugging, between 0 and 1")
+	flag.Int64Var(&cfg.BodyLogMaxBytes, "body-log-max-bytes", 4096, "how much of each body is logged, in bytes")
+	flag.Func("body-log-redact-fields", "comma separated JSON field paths whose values are redacted from logged bodies, e.g. patient.name,items.*.nhsNumber", func(s string) error {
+		cfg.BodyLogRedactFields = strings.Split(s, ",")
+		return nil
+	})
+	flag.Func("body-log-redact-pattern", "a regular expression whose matches are redacted from logged bodies, e.g. [0-9]{3} ?[0-9]{3} ?[0-9]{4}. May be repeated", func(s string) error {
+		re, err := regexp.Compile(s)
+		cfg.BodyLogRedactPatterns = append(cfg.BodyLogRedactPatterns, re)
+		return err
+	})
+	flag.Float64Var(&cfg.HARSample, "har-sample", 0, "the fraction of requests whose upstream calls are captured, with bodies redacted as for -body-log-sample, for export as a HAR from /admin/har, between 0 and 1")
+	flag.IntVar(&cfg.HAREntries, "har-entries", 100, "how many of the most recent captured upstream calls /admin/har keeps")
+	flag.Int64Var(&cfg.SpoolThreshold, "spool-threshold", 10<<20, "request bodies larger than this many bytes are spooled to disk rather than held in memory, 0 to disable")
+	flag.StringVar(&cfg.SpoolDir, "spool-dir", os.TempDir(), "directory for spooled request bodies")
+	flag.Int64Var(&cfg.MaxUpstreamCalls, "max-upstream-calls", 0, "maximum upstream calls in flight across all requests, beyond which requests are rejected with 503, 0 for no limit")
+	cfg.SuccessStatuses = defaultSuccessStatuses
+	flag.Func("success-statuses", "upstream statuses which count as success, e.g. 200-299,304 (default "+defaultSuccessStatuses.String()+")", func(s string) error {
+		ranges, err := parseStatusRanges(s)
+		cfg.SuccessStatuses = ranges
+		return err
+	})
+	flag.IntVar(&cfg.MaxRetries, "max-retries", 0, "times to retry an upstream call failing with an error, 502, 503 or 504, for idempotent requests or those with an Idempotency-Key")
+	flag.DurationVar(&cfg.RetryBackoff, "retry-backoff", 100*time.Millisecond, "the base of the jittered exponential backoff between retries")
+	flag.Float64Var(&cfg.RetryBudget, "retry-budget", 0.2, "retries allowed as a fraction of upstream calls, so failing upstreams aren't swamped with retries")
+	flag.BoolVar(&cfg.DisablePrometheus, "disable-prometheus", false, "don't serve metrics for Prometheus at /metrics, e.g. when they are pushed to StatsD instead")
+	flag.Func("json-schema", "validates request bodies under a path prefix, path:<prefix>=<file>, or arriving on a listener in an upstream group, group:<name>=<file>, against the JSON Schema in file, rejecting invalid bodies with 422 before they reach any upstream. May be repeated", func(s string) error {
+		r, err := parseSchemaRule(s)
+		cfg.JSONSchemas = append(cfg.JSONSchemas, r)
+		return err
+	})
+	flag.BoolVar(&cfg.CompressResponses, "compress-responses", false, "gzip responses to clients which accept it, unless the upstream already encoded them")
+	flag.IntVar(&cfg.CompressMinBytes, "compress-min-bytes", 1024, "with -compress-responses, the smallest response compressed, in bytes")
+	cfg.CompressTypes = defaultCompressTypes
+	flag.Func("compress-types", "with -compress-responses, comma separated media types compressed, which may be wildcards such as text/* or application/*+json (default "+strings.Join(defaultCompressTypes, ",")+")", func(s string) error {
+		cfg.CompressTypes = strings.Split(s, ",")
+		return validateContentTypes(cfg.CompressTypes)
+	})
+	flag.Func("allowed-methods", "comma separated HTTP methods to proxy, e.g. POST,PUT, rejecting others with 405 (default all)", func(s string) error {
+		cfg.AllowedMethods = strings.Split(strings.ToUpper(s), ",")
+		return nil
+	})
+	cfg.TracePropagation = []string{traceW3C}
+	flag.Func("trace-propagation", "comma separated trace context formats to send upstreams: "+traceW3C+" (traceparent), "+traceB3+" (a single b3 header) and "+traceB3Multi+" (X-B3-* headers) (default "+traceW3C+")", func(s string) error {
+		formats, err := parseTracePropagation(s)
+		cfg.TracePropagation = formats
+		return err
+	})
+	flag.StringVar(&cfg.TraceSampler, "trace-sampler", sampleParentBased, "whether to tell upstreams to sample traces: "+sampleAlways+", "+sampleRatio+" (-trace-sample-ratio of them) or "+sampleParentBased+" (as the caller decided, or by ratio for new traces)")
+	flag.Float64Var(&cfg.TraceSampleRatio, "trace-sample-ratio", 1, "the share of traces sampled by the "+sampleRatio+" and "+sampleParentBased+" samplers")
+	flag.Func("trace-sample-route", "/path/prefix=ratio overriding -trace-sample-ratio for requests under a path, e.g. /webhooks/=0.01, may be repeated", func(s string) error {
+		r, err := parseTraceSampleRoute(s)
+		cfg.TraceSampleRoutes = append(cfg.TraceSampleRoutes, r)
+		return err
+	})
+	flag.StringVar(&cfg.FanOutRespond, "fanout-respond", fanOutWaitAll, "in fanout mode, whether to respond once "+fanOutWaitAll+" upstreams have answered, as "+fanOutEarly+" as their answers decide the response, or with the "+fanOutPrimary+" upstream's answer, finishing other calls in the background")
+	flag.StringVar(&cfg.StatusPolicy, "status-policy", statusLatest, "how the status returned is chosen when several upstreams answer: "+statusLatest+", by -prefer, the "+statusPrimary+" upstream's, the "+statusWorst+" or "+statusBest+", or "+statusFixed+" with every upstream's outcome in the body")
+	flag.IntVar(&cfg.FixedStatus, "fixed-status", http.StatusMultiStatus, "the status returned with -status-policy="+statusFixed)
+	maintenancePage := flag.String("maintenance-page", "", "file served with a 503 to requests during maintenance in reject mode, instead of a problem document")
+	flag.DurationVar(&cfg.MaintenanceRetryAfter, "maintenance-retry-after", time.Minute, "the Retry-After given to requests rejected during maintenance, 0 for none")
+	flag.StringVar(&cfg.Prefer, "prefer", preferError, "when upstreams disagree, whether to return the "+preferError+" or the "+preferSuccess+" response")
+	flag.StringVar(&cfg.ResultHeaders, "result-headers", resultHeadersOff, "summarise each upstream's outcome in response headers: "+resultHeadersOff+", "+resultHeadersEach+" (one "+resultHeaderPrefix+"<name> header per upstream) or "+resultHeadersJSON+" (a single "+resultsHeader+" header)")
+	flag.StringVar(&cfg.ViaName, "via-name", "regproxy", "name this proxy gives itself in the Via header of forwarded requests")
+	hostname, _ := os.Hostname()
+	flag.StringVar(&cfg.InstanceID, "instance-id", hostname, "identifies this proxy instance in the "+forwardedByHeader+" header of forwarded requests, and when electing a leader")
+	flag.Int64Var(&cfg.MaxInFlightRequests, "max-in-flight-requests", 0, "maximum proxied requests handled at once, beyond which new ones are shed with 503, 0 for no limit")
+	flag.Func("qos-classes", "comma separated class=weight shares of -max-in-flight-requests, e.g. critical=70,bulk=30, so a spike in one class of requests can't starve another. Requests are put in classes by -qos-rule", func(s string) error {
+		var err error
+		cfg.QoSClasses, err = parseQoSClasses(s)
+		return err
+	})
+	flag.Func("qos-rule", "puts requests in a QoS class by a header, class=header:<name>[:<value>], or a path prefix, class=path:<prefix>. The first matching rule applies. May be repeated", func(s string) error {
+		r, err := parseQoSRule(s)
+		cfg.QoSRules = append(cfg.QoSRules, r)
+		return err
+	})
+	flag.StringVar(&cfg.QoSDefaultClass, "qos-default-class", "", "the QoS class of requests no -qos-rule matches, by default the first of -qos-classes")
+	flag.DurationVar(&cfg.QoSQueueTimeout, "qos-queue-timeout", time.Second, "how long a request waits for room in its QoS class before it's shed with 503, 0 to shed straight away")
+	flag.Int64Var(&cfg.MaxHeapBytes, "max-heap-bytes", 0, "heap size in bytes beyond which new proxied requests are shed with 503, 0 for no limit")
+	flag.DurationVar(&cfg.SlowUpstreamSLO, "slow-upstream-slo", 0, "p95 latency beyond which an upstream is reported as slow, 0 to disable")
+	flag.DurationVar(&cfg.SlowUpstreamWindow, "slow-upstream-window", time.Minute, "the rolling window upstream p95 latency is measured over")
+	flag.DurationVar(&cfg.SlowUpstreamSustain, "slow-upstream-sustain", 2*time.Minute, "how long an upstream's p95 must stay over the SLO before it's reported as slow")
+	flag.StringVar(&cfg.SlowUpstreamWebhook, "slow-upstream-webhook", "", "URL to POST slow and recovered upstream events to")
+	flag.DurationVar(&cfg.ProbeInterval, "probe-interval", 0, "how often to send a synthetic probe request through to every upstream, 0 to disable")
+	flag.StringVar(&cfg.ProbeMethod, "probe-method", http.MethodGet, "method of the synthetic probe request")
+	flag.StringVar(&cfg.ProbePath, "probe-path", "/", "path of the synthetic probe request")
+	flag.StringVar(&cfg.ProbeBody, "probe-body", "", "body of the synthetic probe request")
+	flag.StringVar(&cfg.NATSURL, "nats-url", "", "nats://host:port server to publish every proxied request to, if any")
+	flag.StringVar(&cfg.NATSSubject, "nats-subject", "regproxy.requests", "NATS subject to publish to")
+	flag.StringVar(&cfg.NATSPublish, "nats-publish", natsPublishRequests, "what to publish to NATS for each request once its upstream calls finish: "+natsPublishRequests+" (the request itself) or "+natsPublishResults+" (a JSON summary of the delivery)")
+	flag.Int64Var(&cfg.MaxResponseBytes, "max-response-bytes", 0, "largest upstream response body to pass on, 0 for no limit")
+	flag.StringVar(&cfg.ResponseLimitPolicy, "response-limit-policy", responseLimitFail, "what to do with a response over max-response-bytes: "+responseLimitFail+" with a 502, or "+responseLimitTruncate+" it, marking it with an "+truncatedHeader+" header")
+	flag.StringVar(&cfg.PathMode, "path-mode", pathRequest, "how upstreams without their own pathMode compose the path they are sent from their callback's path and the request's: "+strings.Join(pathModes, ", "))
+	flag.StringVar(&cfg.FileSinkDir, "file-sink-dir", "", "directory under which upstreams registered as file:///name.jsonl append requests, file sinks are disabled if empty")
+	cfg.ExecSinks = make(map[string]string)
+	cfg.Translations = make(map[string]translator)
+	flag.Func("translation", "name=/path/to/mapping.json converting request bodies between payload versions, for upstreams registered with the name in their translations, may be repeated", func(s string) error {
+		name, t, err := parseTranslation(s)
+		cfg.Translations[name] = t
+		return err
+	})
+	flag.Func("exec-sink", "name=/path/to/command run with each request for upstreams registered as exec://name, may be repeated", func(s string) error {
+		name, command, ok := strings.Cut(s, "=")
+		if !ok || name == "" || command == "" {
+			return fmt.Errorf("expected name=command, got [%s]", s)
+		}
+		cfg.ExecSinks[name] = command
+		return nil
+	})
+	flag.StringVar(&cfg.JWKSURL, "jwt-jwks-url", "", "if set, proxied requests need a bearer JWT signed by one of the keys published at this JWKS URL, and are rejected with 401 otherwise")
+	flag.DurationVar(&cfg.JWKSRefresh, "jwt-jwks-refresh", time.Hour, "how often to fetch the JWKS again, as well as when a token is signed by an unknown key")
+	flag.StringVar(&cfg.JWTIssuer, "jwt-issuer", "", "if set, the iss claim JWTs must have")
+	flag.StringVar(&cfg.JWTAudience, "jwt-audience", "", "if set, an aud claim JWTs must have")
+	flag.DurationVar(&cfg.JWTLeeway, "jwt-leeway", time.Minute, "allowance for clock skew when checking JWT expiry")
+	flag.StringVar(&cfg.VaultAddr, "vault-addr", os.Getenv("VAULT_ADDR"), "address of the HashiCorp Vault server that vault: references in registrations are resolved with, authenticating with the token in VAULT_TOKEN")
+	flag.StringVar(&cfg.VaultTokenFile, "vault-token-file", "", "file to read the Vault token from instead of VAULT_TOKEN, such as one kept fresh by Vault Agent. Reloaded when it changes")
+	flag.Func("result-callback-allow-networks", "comma separated CIDRs of non-public networks result callbacks may be sent to, e.g. 10.20.0.0/16. Otherwise only public addresses are", func(s string) error {
+		for _, c := range strings.Split(s, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(c))
+			if err != nil {
+				return err
+			}
+			cfg.ResultCallbackAllowNetworks = append(cfg.ResultCallbackAllowNetworks, n)
+		}
+		return nil
+	})
+	flag.Func("vault-path-prefixes", "comma separated Vault paths under which vault: references in registrations may read secrets, e.g. secret/data/regproxy. vault: references are refused if unset", func(s string) error {
+		cfg.VaultPathPrefixes = strings.Split(s, ",")
+		return nil
+	})
+	flag.StringVar(&cfg.SecretFileDir, "secret-file-dir", "", "directory holding the files which file: references in registrations may read secrets from, such as where Kubernetes secrets are mounted. file: references are refused if empty")
+	flag.DurationVar(&cfg.SecretReloadInterval, "secret-file-reload-interval", 30*time.Second, "how often to check secret files, referred to as file: in registrations or given as -vault-token-file, for changes, reloading them without a restart")
+	flag.DurationVar(&cfg.VaultCacheTTL, "vault-cache-ttl", 5*time.Minute, "how long secrets read from Vault are cached, unless their lease is shorter")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "log and count what would be sent to each upstream without sending anything, for rehearsing routing changes. Single requests can be dry run with an "+dryRunHeader+": 1 header")
+	flag.BoolVar(&cfg.FaultInjection, "enable-fault-injection", false, "serve the /admin/faults API for injecting latency, errors and dropped responses, for chaos testing. Never enable in production")
+	flag.Int64Var(&cfg.RateLimitGlobal, "rate-limit-global", 0, "maximum proxied requests per rate limit window across all callers, 0 for no limit. Shared between instances with redis storage")
+	flag.Int64Var(&cfg.RateLimitTenant, "rate-limit-tenant", 0, "maximum proxied requests per rate limit window for each tenant, 0 for no limit")
+	flag.DurationVar(&cfg.RateLimitWindow, "rate-limit-window", time.Second, "the window rate limits are counted over")
+	flag.DurationVar(&cfg.UpstreamRateLimitMaxWait, "upstream-rate-limit-max-wait", 5*time.Second, "the longest a call waits for room under its upstream's rate limit, with the queue policy, before it fails")
+	flag.StringVar(&cfg.RateLimitTenantHeader, "rate-limit-tenant-header", "X-Tenant-Id", "request header identifying the tenant for per-tenant rate limits, audit records, byte counts and duplicate detection")
+	flag.DurationVar(&cfg.LeaderLeaseTTL, "leader-lease-ttl", 15*time.Second, "with shared storage, how long the leader's lease lasts without renewal before another instance takes over")
+	registryStoreLocation := flag.String("storage-location", "memory", "registry data storage file location, s3://bucket/key or gs://bucket/object for object storage, dynamodb://table, redis://[:password@]host[:port][/db], or 'memory' for in-memory only")
+	var gossipPeers []string
+	flag.Func("gossip-peers", "with in-memory storage, comma separated base URLs of other instances to share registrations with, e.g. http://regproxy-2:9876", func(s string) error {
+		gossipPeers = strings.Split(s, ",")
+		return nil
+	})
+	gossipInterval := flag.Duration("gossip-interval", 2*time.Second, "how often to exchange registrations with a gossip peer")
+	gossipTombstoneRetention := flag.Duration("gossip-tombstone-retention", defaultTombstoneRetention, "how long gossiping instances remember a deletion, so the longest an instance may be cut off from its peers without bringing deleted upstreams back when it returns")
+	storageTTL := flag.Duration("storage-ttl", 0, "with dynamodb storage, how long a registration lasts unless renewed, 0 for ever")
+	flag.DurationVar(&cfg.StorageHealthInterval, "storage-health-interval", 10*time.Second, "how often the storage backend is checked, 0 to only notice it failing when proxying")
+	flag.DurationVar(&cfg.StorageMaxBackoff, "storage-max-backoff", time.Minute, "the longest to wait between checks of a storage backend which is down")
+	flag.DurationVar(&cfg.StorageCacheRefresh, "storage-cache-refresh", 2*time.Second, "with redis or dynamodb storage, how often the local copy of the registry requests are routed with is refreshed, 0 to read storage for every request")
+	storageFlushInterval := flag.Duration("storage-flush-interval", 5*time.Second, "with object storage, how often registry changes are written back and other instances' changes picked up")
+	printVersion := flag.Bool("version", false, "print the version and exit")
+	configFile := flag.String("config", "", "a YAML file of flag names and values, e.g. mode: failover, with a list for flags which may be repeated. Flags given on the command line override it")
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(currentBuild())
+		return
+	}
+	var invalid configErrors
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile, flag.CommandLine); err != nil {
+			invalid.addf("config: %v", err)
+		}
+	}
+
+	cfg.ListenAddr = net.JoinHostPort(*hostPtr, strconv.Itoa(*portPtr))
+
+	if !validateOnly {
+		log.Println("Starting regproxy with args")
+		log.Println(os.Args)
+	}
 
-	log.Println("Starting regproxy with args")
-	log.Println(os.Args)
+	if !slices.Contains(modes, cfg.Mode) {
+		invalid.addf("unknown mode %s, expected one of %s", cfg.Mode, strings.Join(modes, ", "))
+	}
+	if !slices.Contains(fanOutPolicies, cfg.FanOutRespond) {
+		invalid.addf("unknown fanout-respond policy %s, expected one of %s", cfg.FanOutRespond, strings.Join(fanOutPolicies, ", "))
+	}
+	if !slices.Contains(statusPolicies, cfg.StatusPolicy) {
+		invalid.addf("unknown status policy %s, expected one of %s", cfg.StatusPolicy, strings.Join(statusPolicies, ", "))
+	}
+	if cfg.FixedStatus < 200 || cfg.FixedStatus > 599 {
+		invalid.addf("fixed-status %d isn't a final HTTP status", cfg.FixedStatus)
+	}
+	if *maintenancePage != "" {
+		var err error
+		if cfg.MaintenancePage, cfg.MaintenancePageType, err = readMaintenancePage(*maintenancePage); err != nil {
+			invalid.addf("failed to read the maintenance page: %v", err)
+		}
+	}
+	if cfg.Prefer != preferError && cfg.Prefer != preferSuccess {
+		invalid.addf("unknown prefer policy %s, expected %s or %s", cfg.Prefer, preferError, preferSuccess)
+	}
+	if !slices.Contains([]string{resultHeadersOff, resultHeadersEach, resultHeadersJSON}, cfg.ResultHeaders) {
+		invalid.addf("unknown result-headers format %s", cfg.ResultHeaders)
+	}
+	if !slices.Contains(pathModes, cfg.PathMode) || cfg.PathMode == pathStrip {
+		invalid.addf("unknown path mode %s, expected %s, %s or %s", cfg.PathMode, pathRequest, pathReplace, pathPrefix)
+	}
+	if *gossipTombstoneRetention <= 0 {
+		invalid.addf("gossip-tombstone-retention must be positive")
+	}
+	if err := checkSpoolDir(cfg.SpoolThreshold, cfg.SpoolDir); err != nil {
+		invalid.add(err)
+	}
+	if !slices.Contains(listenFamilies, *listenFamily) {
+		invalid.addf("unknown listen family %s, expected one of %s", *listenFamily, strings.Join(listenFamilies, ", "))
+	}
+	if cfg.ResponseLimitPolicy != responseLimitFail && cfg.ResponseLimitPolicy != responseLimitTruncate {
+		invalid.addf("unknown response limit policy %s, expected %s or %s", cfg.ResponseLimitPolicy, responseLimitFail, responseLimitTruncate)
+	}
+	if cfg.ProbeInterval > 0 && len(cfg.AllowedMethods) > 0 && !slices.Contains(cfg.AllowedMethods, cfg.ProbeMethod) {
+		invalid.addf("probe method %s isn't one of the allowed methods %s", cfg.ProbeMethod, strings.Join(cfg.AllowedMethods, ","))
+	}
+	limits.check(&invalid)
+	if cfg.RetryBudget < 0 || cfg.RetryBackoff < 0 {
+		invalid.addf("retry-budget and retry-backoff can't be negative")
+	}
+	if cfg.NATSPublish != natsPublishRequests && cfg.NATSPublish != natsPublishResults {
+		invalid.addf("unknown nats-publish option %s, expected %s or %s", cfg.NATSPublish, natsPublishRequests, natsPublishResults)
+	}
+	if cfg.NATSURL != "" {
+		if _, err := newNATSClient(cfg.NATSURL); err != nil {
+			invalid.add(err)
+		}
+	}
+	if cfg.SequentialOnFailure != sequentialStop && cfg.SequentialOnFailure != sequentialContinue {
+		invalid.addf("unknown sequential-on-failure policy %s, expected %s or %s", cfg.SequentialOnFailure, sequentialStop, sequentialContinue)
+	}
+	if !slices.Contains(balancePolicies, cfg.BalancePolicy) {
+		invalid.addf("unknown balance policy %s, expected one of %s", cfg.BalancePolicy, strings.Join(balancePolicies, ", "))
+	}
+	if !slices.Contains(traceSamplers, cfg.TraceSampler) {
+		invalid.addf("unknown trace sampler %s, expected one of %s", cfg.TraceSampler, strings.Join(traceSamplers, ", "))
+	}
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		invalid.addf("trace-sample-ratio must be between 0 and 1")
+	}
+	if cfg.BodyLogSample > 1 || cfg.BodyLogMaxBytes < 0 {
+		invalid.addf("body-log-sample must be no more than 1, and body-log-max-bytes can't be negative")
+	}
+	if cfg.HARSample > 1 || cfg.HAREntries < 0 {
+		invalid.addf("har-sample must be no more than 1, and har-entries can't be negative")
+	}
+	sortTraceSampleRoutes(cfg.TraceSampleRoutes)
+	if cfg.QueueMinBackoff <= 0 || cfg.QueueMaxBackoff < cfg.QueueMinBackoff {
+		invalid.addf("queue-min-backoff must be positive, and no more than queue-max-backoff")
+	}
+	if cfg.QueueMaxAttempts < 0 {
+		invalid.addf("queue-max-attempts can't be negative")
+	}
+	if cfg.QueueDeadLetter != "" {
+		if err := validateUpstream(upstream{Name: deadLetterName, Callback: cfg.QueueDeadLetter}); err != nil {
+			invalid.addf("queue-dead-letter: %v", err)
+		}
+	}
+	if cfg.BalancePolicy == balanceConsistentHash {
+		if _, err := parseHashKey(cfg.BalanceHashKey); err != nil {
+			invalid.add(err)
+		}
+	}
+	if len(cfg.QoSClasses) > 0 {
+		if cfg.MaxInFlightRequests <= 0 {
+			invalid.addf("qos-classes share out -max-in-flight-requests, which must be set")
+		}
+		isClass := func(name string) bool {
+			return slices.ContainsFunc(cfg.QoSClasses, func(c qosClassConfig) bool { return c.name == name })
+		}
+		for _, r := range cfg.QoSRules {
+			if !isClass(r.class) {
+				invalid.addf("qos-rule class [%s] isn't one of -qos-classes", r.class)
+			}
+		}
+		if cfg.QoSDefaultClass != "" && !isClass(cfg.QoSDefaultClass) {
+			invalid.addf("qos-default-class [%s] isn't one of -qos-classes", cfg.QoSDefaultClass)
+		}
+	} else if len(cfg.QoSRules) > 0 {
+		invalid.addf("qos-rule needs -qos-classes")
+	}
+	if len(cfg.ExperimentBuckets) > 0 {
+		if _, err := parseHashKey(cfg.ExperimentKey); err != nil {
+			invalid.addf("experiment-key: %v", err)
+		}
+	}
+	if cfg.RolloutKey != "" {
+		if _, err := parseHashKey(cfg.RolloutKey); err != nil {
+			invalid.addf("rollout-key: %v", err)
+		}
+	}
+	if len(acmeDomains) == 0 && slices.ContainsFunc(extraListeners, func(lc listenerConfig) bool { return lc.ACME }) {
+		invalid.addf("listeners with the acme option need -acme-domains")
+	}
+	if validateOnly {
+		invalid = append(invalid, validateDeployment(cfg, *registryStoreLocation, *storageTTL, extraListeners)...)
+		os.Exit(invalid.report(os.Stdout, os.Stderr))
+	}
+	if len(invalid) > 0 {
+		log.Fatal(errors.Join(invalid...))
+	}
 
 	var storage RegStorage
-	if *registryStoreLocation == "memory" {
-		storage = &RegStorageMemory{upstreams: make(map[string]*url.URL)}
-		log.Println("using in-memory storage")
+	objects, isObject, err := newObjectStore(*registryStoreLocation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dynamo, isDynamo, err := newDynamoStorage(*registryStoreLocation, *storageTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	redis, isRedis, err := newRedisStorage(*registryStoreLocation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if isRedis {
+		storage = redis
+		log.Printf("using redis storage at %s\n", redis.client.Options().Addr)
+	} else if isDynamo {
+		storage = dynamo
+		log.Printf("using dynamodb storage in table %s\n", dynamo.table)
+	} else if isObject {
+		lease, _, err := newObjectStore(*registryStoreLocation + ".leader")
+		if err != nil {
+			log.Fatal(err)
+		}
+		st, err := NewRegStorageObject(context.Background(), objects, lease)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go st.Run(context.Background(), *storageFlushInterval)
+		storage = st
+		log.Printf("using object storage at %s\n", objects)
+	} else if *registryStoreLocation == "memory" && len(gossipPeers) > 0 {
+		secret := os.Getenv(gossipSecretEnv)
+		if len(secret) < 16 {
+			log.Fatalf("gossiping needs a shared secret of at least 16 bytes in %s", gossipSecretEnv)
+		}
+		st := NewRegStorageGossip(cfg.InstanceID, []byte(secret))
+		st.tombstoneRetention = *gossipTombstoneRetention
+		var entries map[string]gossipEntry
+		if inherited, err := inheritedRegistry(&entries); err != nil {
+			log.Fatal(err)
+		} else if inherited {
+			st.merge(entries)
+			log.Printf("%d gossiped registrations handed over", len(entries))
+		}
+		go st.Run(context.Background(), &http.Client{Timeout: 5 * time.Second}, gossipPeers, *gossipInterval)
+		storage = st
+		log.Printf("using in-memory storage, gossiping with %s\n", strings.Join(gossipPeers, ", "))
+	} else if *registryStoreLocation == "memory" {
+		var upstreams map[string]upstream
+		inherited, err := inheritedRegistry(&upstreams)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if upstreams == nil {
+			upstreams = make(map[string]upstream)
+		}
+		storage = &RegStorageMemory{upstreams: upstreams}
+		if inherited {
+			log.Printf("using in-memory storage, with %d upstreams handed over", len(upstreams))
+		} else {
+			log.Println("using in-memory storage")
+		}
 	} else {
-		st, err := NewRegStorageFile(*registryStoreLocation)
+		aead, err := storageCipher(os.Getenv)
+		if err != nil {
+			log.Fatal(err)
+		}
+		st, err := NewRegStorageFile(*registryStoreLocation, aead)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -325,23 +1595,97 @@ func main() {
 		log.Printf("using file storage at %s\n", *registryStoreLocation)
 	}
 
-	rp := NewRegProxy(
-		clientHttpTimeout,
-		clientDialTimeout,
-		clientKeepAliveInterval,
-		dnsCacheRefresh,
-		dnsLookupTimeout,
-		clientMaxIdleTimeout,
-		clientMaxIdleConnections,
-		useDnsCachePtr,
-		storage,
-	)
-
-	srv := http.Server{
-		Addr:         net.JoinHostPort(*hostPtr, strconv.Itoa(*portPtr)),
-		Handler:      rp.handler,
-		ReadTimeout:  *serverReadTimeout,
-		WriteTimeout: *serverWriteTimeout,
-	}
-	log.Fatal(srv.ListenAndServe())
+	// As the ACME challenge listener is an address of ours too
+	if slices.ContainsFunc(extraListeners, func(lc listenerConfig) bool { return lc.ACME }) {
+		cfg.ExtraListenAddrs = append(cfg.ExtraListenAddrs, *acmeHTTPAddr)
+	}
+	cfg.AdminListener = slices.ContainsFunc(extraListeners, func(lc listenerConfig) bool { return lc.Admin })
+	if !cfg.AdminListener {
+		log.Printf("Serving the admin API alongside the proxy, so its paths such as /upstreams and /admin/ aren't proxied: add a -listener with the admin option to separate them")
+	}
+	rp := NewRegProxy(cfg, storage)
+	if rp.audit, err = newAuditLog(cfg, rp.metrics.auditFailures); err != nil {
+		log.Fatal(err)
+	}
+	if rp.queues.outbox, err = newOutbox(cfg.QueueOutboxDir); err != nil {
+		log.Fatal(err)
+	}
+	if err := rp.queues.recover(); err != nil {
+		log.Fatal(err)
+	}
+	go rp.leader.Run(context.Background())
+	if _, err := newOTLPMeterProvider(context.Background(), rp.metrics.registry, cfg.InstanceID); err != nil {
+		log.Fatal(err)
+	}
+	if *statsdAddr != "" {
+		var tags []string
+		if *statsdTags != "" {
+			tags = strings.Split(*statsdTags, ",")
+		}
+		statsd, err := newStatsDExporter(rp.metrics.registry, *statsdAddr, *statsdPrefix, *statsdFormat, tags)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go statsd.Run(context.Background(), *statsdInterval)
+	}
+	if rp.slow != nil {
+		go rp.slow.Run(context.Background())
+	}
+	if rp.stored.interval > 0 {
+		go rp.stored.Run(context.Background())
+	}
+	go rp.secrets.Run(context.Background(), cfg.SecretReloadInterval)
+	if cfg.ProbeInterval > 0 {
+		go rp.runProbes(context.Background())
+	}
+	if isDynamo && *storageTTL > 0 {
+		go rp.leader.every(context.Background(), time.Minute, "expired upstream sweep", dynamo.sweepExpired)
+	}
+
+	listeners := append([]listenerConfig{{Addr: cfg.ListenAddr}}, extraListeners...)
+	var acme *autocert.Manager
+	if slices.ContainsFunc(listeners, func(lc listenerConfig) bool { return lc.ACME }) {
+		acme = newACMEManager(*acmeDirectory, *acmeEmail, acmeDomains, *acmeCacheDir)
+		listeners = append(listeners, listenerConfig{Addr: *acmeHTTPAddr, Challenges: true})
+	}
+	for i := range listeners {
+		if listeners[i].Family == "" {
+			listeners[i].Family = *listenFamily
+		}
+	}
+	ls, err := listen(listeners, *serverTCPKeepAlive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var servers []*server
+	for i, lc := range listeners {
+		handler := rp.handler
+		if lc.Admin {
+			handler = rp.admin
+		}
+		srv := limits.server(lc.Addr, recoverPanics(withGroup(handler, lc.Group), rp.metrics.panics))
+		var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+		if lc.ACME {
+			getCertificate = acme.GetCertificate
+		}
+		if lc.Cert != "" {
+			certs, err := newCertReloader(lc.Cert, lc.Key)
+			if err != nil {
+				log.Fatalf("listener %s: %v", lc, err)
+			}
+			go certs.Run(context.Background(), *certReloadInterval)
+			getCertificate = certs.getCertificate
+		}
+		if getCertificate != nil {
+			if srv.TLSConfig, err = lc.tlsConfig(getCertificate); err != nil {
+				log.Fatalf("listener %s: %v", lc, err)
+			}
+		}
+		if lc.Challenges {
+			srv.Handler = acme.HTTPHandler(nil)
+		}
+		servers = append(servers, &server{Server: srv, cfg: lc, l: ls[i]})
+	}
+	serveUntilStopped(servers, storage, *shutdownTimeout)
+	rp.queues.close()
 }
@@ -11,34 +11,52 @@ import (
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
-func withRegProxy(t *testing.T, f func(url string, t *testing.T)) {
+func testConfig() Config {
 	//serverReadTimeout := 1 * time.Second
 	// serverWriteTimeout := 40 * time.Second
-	clientHttpTimeout := 1 * time.Second
-	clientDialTimeout := 1 * time.Second
-	clientKeepAliveInterval := -1 * time.Second
-	clientMaxIdleConnections := int64(1)
-	clientMaxIdleTimeout := 1 * time.Second
-	useDnsCache := true
-	dnsCacheRefresh := 100 * time.Hour
-	dnsLookupTimeout := 5 * time.Second
-	rp := NewRegProxy(&clientHttpTimeout,
-		&clientDialTimeout,
-		&clientKeepAliveInterval,
-		&dnsCacheRefresh,
-		&dnsLookupTimeout,
-		&clientMaxIdleTimeout,
-		&clientMaxIdleConnections,
-		&useDnsCache,
-		&RegStorageMemory{upstreams: make(map[string]*url.URL)})
+	return Config{
+		ClientHttpTimeout:        1 * time.Second,
+		ClientDialTimeout:        1 * time.Second,
+		ClientKeepAliveInterval:  -1 * time.Second,
+		ClientMaxIdleConnections: 1,
+		ClientMaxIdleTimeout:     1 * time.Second,
+		UseDnsCache:              true,
+		DnsCacheRefresh:          100 * time.Hour,
+		DnsLookupTimeout:         5 * time.Second,
+		BalanceAddrs:             true,
+		AddrUnhealthyCooldown:    10 * time.Second,
+		Mode:                     modeFanOut,
+		HedgeDelay:               100 * time.Millisecond,
+		SequentialOnFailure:      sequentialStop,
+		CompareLogSample:         1,
+		SuccessStatuses:          defaultSuccessStatuses,
+		Prefer:                   preferError,
+		ResultHeaders:            resultHeadersOff,
+		ViaName:                  "regproxy",
+		InstanceID:               "test-instance",
+		LeaderLeaseTTL:           time.Second,
+		RateLimitWindow:          time.Second,
+		RateLimitTenantHeader:    "X-Tenant-Id",
+	}
+}
+
+func withRegProxy(t *testing.T, f func(url string, t *testing.T)) {
+	withRegProxyConfig(t, testConfig(), f)
+}
+
+func withRegProxyConfig(t *testing.T, cfg Config, f func(url string, t *testing.T)) {
+	withRegProxyInstance(t, NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)}), f)
+}
+
+func withRegProxyInstance(t *testing.T, rp *RegProxy, f func(url string, t *testing.T)) {
 	srv := httptest.NewServer(rp.handler)
 	defer srv.Close()
 	f(srv.URL, t)
@@ -59,6 +77,14 @@ func TestRegister(t *testing.T) {
 			"{flugelhorn}",
 			400,
 		},
+		{
+			"{\"name\":\"foo\",\"callback\":\"baz\",\"proxy\":\"socks5://gateway:1080\"}",
+			204,
+		},
+		{
+			"{\"name\":\"foo\",\"callback\":\"baz\",\"proxy\":\"ftp://gateway\"}",
+			400,
+		},
 	}
 	for _, tcase := range cases {
 		withRegProxy(t, func(url string, t *testing.T) {
@@ -99,6 +125,50 @@ func TestConcurrentRegister(t *testing.T) {
 	})
 }
 
+func TestRegisterDuplicateName(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN a registered upstream
+		register(url, upstream{Name: "orders", Callback: "http://blue"}, t)
+		post := func(query string, u upstream) int {
+			b, _ := json.Marshal(u)
+			r, err := http.Post(url+"/register"+query, "application/json", bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = r.Body.Close()
+			return r.StatusCode
+		}
+
+		// WHEN the same registration is repeated, THEN it succeeds
+		if s := post("", upstream{Name: "orders", Callback: "http://blue"}); s != 204 {
+			t.Errorf("expected an identical registration to return 204, got %d", s)
+		}
+		// WHEN the name is registered with another callback, THEN it conflicts
+		if s := post("", upstream{Name: "orders", Callback: "http://green"}); s != 409 {
+			t.Errorf("expected a different callback to return 409, got %d", s)
+		}
+		// unless it is to be overwritten
+		if s := post("?overwrite=true", upstream{Name: "orders", Callback: "http://green"}); s != 204 {
+			t.Errorf("expected an overwrite to return 204, got %d", s)
+		}
+		if s := post("?overwrite=maybe", upstream{Name: "orders", Callback: "http://green"}); s != 400 {
+			t.Errorf("expected an invalid overwrite to return 400, got %d", s)
+		}
+		r, err := http.Get(url + "/upstreams/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		var got upstream
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Callback != "http://green" {
+			t.Errorf("expected the overwritten callback, got %s", got.Callback)
+		}
+	})
+}
+
 func register(url string, u upstream, t *testing.T) {
 	b, _ := json.Marshal(u)
 	r, err := http.Post(url+"/register", "application/json", bytes.NewReader(b))
@@ -142,14 +212,14 @@ func TestHappyPath(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		_, err = ioutil.ReadAll(r.Body)
+		rb, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			t.Fatal(err)
 		}
-		/*rbs := string(rb)
+		rbs := string(rb)
 		if rbs != testResponse {
 			t.Errorf("Expected %v, but got %v", testResponse, rbs)
-		}*/
+		}
 	})
 }
 
@@ -255,6 +325,50 @@ func TestTimeout(t *testing.T) {
 	})
 }
 
+func TestEgressProxy(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN an upstream which is only reachable through an egress proxy
+		var proxied string
+		egress := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			proxied = req.URL.Path
+			rr.Write([]byte("ok"))
+		}))
+		defer egress.Close()
+		register(url, upstream{
+			Name:     "foo",
+			Callback: "http://behind.the.gateway",
+			Proxy:    egress.URL,
+		}, t)
+
+		// WHEN
+		r, err := http.Get(url + "/hook")
+
+		// THEN the request went via the proxy
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+		if proxied != "/hook" {
+			t.Errorf("expected request to be proxied, got %q", proxied)
+		}
+	})
+}
+
+func TestParseMapLegacy(t *testing.T) {
+	m, err := parseMap([]byte("foo=http://localhost:3000\n{\"name\":\"bar\",\"callback\":\"http://localhost:3001\",\"proxy\":\"direct\"}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["foo"].Callback != "http://localhost:3000" {
+		t.Errorf("unexpected legacy entry %v", m["foo"])
+	}
+	if m["bar"].Callback != "http://localhost:3001" || m["bar"].Proxy != "direct" {
+		t.Errorf("unexpected entry %v", m["bar"])
+	}
+}
+
 func TestFileStorage(t *testing.T) {
 	// Storage location
 	file := path.Join(os.TempDir(), "regproxy2_test_"+strconv.Itoa(int(rand.Uint32())))
@@ -281,28 +395,12 @@ func TestFileStorage(t *testing.T) {
 	}
 
 	// Test 1, start regproxy, register and check callbacks
-	clientHttpTimeout := 1 * time.Second
-	clientDialTimeout := 1 * time.Second
-	clientKeepAliveInterval := -1 * time.Second
-	clientMaxIdleConnections := int64(1)
-	clientMaxIdleTimeout := 1 * time.Second
-	useDnsCache := true
-	dnsCacheRefresh := 100 * time.Hour
-	dnsLookupTimeout := 5 * time.Second
 	{
-		st, err := NewRegStorageFile(file)
+		st, err := NewRegStorageFile(file, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
-		rp := NewRegProxy(&clientHttpTimeout,
-			&clientDialTimeout,
-			&clientKeepAliveInterval,
-			&dnsCacheRefresh,
-			&dnsLookupTimeout,
-			&clientMaxIdleTimeout,
-			&clientMaxIdleConnections,
-			&useDnsCache,
-			st)
+		rp := NewRegProxy(testConfig(), st)
 		srv := httptest.NewServer(rp.handler)
 		defer srv.Close()
 
@@ -326,19 +424,11 @@ func TestFileStorage(t *testing.T) {
 	}
 	// Test 2, restart regproxy but don't register, check persisted callbacks are used
 	{
-		st, err := NewRegStorageFile(file)
+		st, err := NewRegStorageFile(file, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
-		rp := NewRegProxy(&clientHttpTimeout,
-			&clientDialTimeout,
-			&clientKeepAliveInterval,
-			&dnsCacheRefresh,
-			&dnsLookupTimeout,
-			&clientMaxIdleTimeout,
-			&clientMaxIdleConnections,
-			&useDnsCache,
-			st)
+		rp := NewRegProxy(testConfig(), st)
 		srv := httptest.NewServer(rp.handler)
 		defer srv.Close()
 
@@ -358,3 +448,108 @@ func TestFileStorage(t *testing.T) {
 		}
 	}
 }
+
+func TestAllowedMethods(t *testing.T) {
+	cfg := testConfig()
+	cfg.AllowedMethods = []string{http.MethodPost, http.MethodPut}
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN
+		called := false
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			called = true
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "foo", Callback: srv.URL}, t)
+
+		// WHEN a crawler GETs the proxy
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it isn't fanned out
+		if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "POST, PUT" || called {
+			t.Errorf("expected 405 without calling upstream, got %v %q, called %v", resp.StatusCode, resp.Header.Get("Allow"), called)
+		}
+
+		// WHEN a webhook is POSTed
+		resp, err = http.Post(url, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it is
+		if resp.StatusCode != 200 || !called {
+			t.Errorf("expected 200 from upstream, got %v, called %v", resp.StatusCode, called)
+		}
+	})
+}
+
+func TestFanOutClientCancelLeaksNoGoroutines(t *testing.T) {
+	// GIVEN an upstream which answers only once the client has given up
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			<-release
+		}))
+		defer slow.Close()
+		fast := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {}))
+		defer fast.Close()
+		register(url, upstream{Name: "slow", Callback: slow.URL}, t)
+		register(url, upstream{Name: "fast", Callback: fast.URL}, t)
+
+		// WHEN the client cancels mid fan-out
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			_ = resp.Body.Close()
+		}
+		// Let the proxy notice the client has gone before the upstream answers
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+
+		// THEN every upstream call's goroutine finishes
+		deadline := time.Now().Add(2 * time.Second)
+		for rp.asyncCalls.Load() != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := rp.asyncCalls.Load(); n != 0 {
+			t.Errorf("expected no upstream goroutines left, got %d", n)
+		}
+	})
+}
+
+func TestAdminListener(t *testing.T) {
+	// GIVEN a proxy serving its admin API on a listener of its own
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(resp, "from upstream")
+	}))
+	defer upstreamSrv.Close()
+	cfg := testConfig()
+	cfg.AdminListener = true
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	admin := httptest.NewServer(rp.admin)
+	defer admin.Close()
+	proxy := httptest.NewServer(rp.handler)
+	defer proxy.Close()
+	if r := doJSON(t, "PUT", admin.URL+"/upstreams/foo", `{"callback":"`+upstreamSrv.URL+`"}`, nil); r.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 from the admin listener, got %v", r.StatusCode)
+	}
+
+	// WHEN the admin API's paths are called on the proxy's listener
+	r, err := http.Get(proxy.URL + "/upstreams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(r.Body)
+	r.Body.Close()
+
+	// THEN they're proxied
+	if string(body) != "from upstream" {
+		t.Errorf("expected /upstreams to be proxied, got %v %s", r.StatusCode, body)
+	}
+}
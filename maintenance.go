@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maintenance modes, set with PUT /admin/maintenance
+const (
+	maintenanceOff    = "off"
+	maintenanceQueue  = "queue"
+	maintenanceReject = "reject"
+)
+
+var maintenanceModes = []string{maintenanceOff, maintenanceQueue, maintenanceReject}
+
+// maintenanceState is what GET and PUT /admin/maintenance exchange.
+type maintenanceState struct {
+	Mode  string     `json:"mode"`
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// maintenance is the proxy-wide switch for when upstream work is underway,
+// so requests aren't forwarded into a backend set known to be broken. In
+// queue mode requests are accepted with 202 and held, in reject mode they
+// get a 503. Either way queued requests aren't delivered until maintenance
+// ends. It is held by each instance, not shared across a cluster.
+type maintenance struct {
+	page        []byte
+	contentType string
+	retryAfter  time.Duration
+
+	mu    sync.Mutex
+	state maintenanceState
+	// over is closed when maintenance ends
+	over chan struct{}
+}
+
+func newMaintenance(cfg Config) *maintenance {
+	return &maintenance{
+		page:        cfg.MaintenancePage,
+		contentType: cfg.MaintenancePageType,
+		retryAfter:  cfg.MaintenanceRetryAfter,
+		state:       maintenanceState{Mode: maintenanceOff},
+	}
+}
+
+// readMaintenancePage reads the page served in reject mode, with its
+// content type by extension, or else by sniffing it.
+func readMaintenancePage(name string) ([]byte, string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, "", err
+	}
+	ct := mime.TypeByExtension(filepath.Ext(name))
+	if ct == "" {
+		ct = http.DetectContentType(b)
+	}
+	return b, ct, nil
+}
+
+func (m *maintenance) mode() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.Mode
+}
+
+func (m *maintenance) set(mode string) maintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mode == m.state.Mode {
+		return m.state
+	}
+	switch {
+	case mode == maintenanceOff:
+		close(m.over)
+		m.over = nil
+		m.state = maintenanceState{Mode: maintenanceOff}
+		log.Printf("Maintenance over")
+		return m.state
+	case m.over == nil:
+		m.over = make(chan struct{})
+		now := time.Now()
+		m.state.Since = &now
+	}
+	m.state.Mode = mode
+	log.Printf("Maintenance underway, in %s mode", mode)
+	return m.state
+}
+
+// wait blocks until maintenance is over, if it is underway.
+func (m *maintenance) wait() {
+	m.mu.Lock()
+	over := m.over
+	m.mu.Unlock()
+	if over != nil {
+		<-over
+	}
+}
+
+// reject answers a request during maintenance in reject mode, with the
+// configured page if there is one.
+func (m *maintenance) reject(resp http.ResponseWriter) {
+	if m.retryAfter > 0 {
+		resp.Header().Set("Retry-After", strconv.Itoa(int(m.retryAfter.Round(time.Second).Seconds())))
+	}
+	if m.page == nil {
+		writeProblem(resp, newProblem(http.StatusServiceUnavailable, "Upstreams are under maintenance"))
+		return
+	}
+	resp.Header().Set("Content-Type", m.contentType)
+	resp.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = resp.Write(m.page)
+}
+
+// maintenanceResource handles GET and PUT /admin/maintenance.
+func (p *RegProxy) maintenanceResource(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		p.maintenance.mu.Lock()
+		state := p.maintenance.state
+		p.maintenance.mu.Unlock()
+		writeJSON(resp, http.StatusOK, state)
+	case http.MethodPut:
+		var s maintenanceState
+		if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+			badRequest(resp, err.Error())
+			return
+		}
+		if !slices.Contains(maintenanceModes, s.Mode) {
+			badRequest(resp, fmt.Sprintf("Unknown maintenance mode [%s], expected one of %s", s.Mode, strings.Join(maintenanceModes, ", ")))
+			return
+		}
+		writeJSON(resp, http.StatusOK, p.maintenance.set(s.Mode))
+	default:
+		methodNotAllowed(resp, http.MethodGet, http.MethodHead, http.MethodPut)
+	}
+}
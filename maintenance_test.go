@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceReject(t *testing.T) {
+	// GIVEN a maintenance page
+	cfg := testConfig()
+	cfg.MaintenancePage = []byte("<h1>Back soon</h1>")
+	cfg.MaintenancePageType = "text/html"
+	cfg.MaintenanceRetryAfter = 5 * time.Minute
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "orders", Callback: srv.URL}, t)
+
+		// WHEN maintenance starts, rejecting requests
+		if r := doJSON(t, "PUT", url+"/admin/maintenance", `{"mode":"reject"}`, nil); r.StatusCode != 200 {
+			t.Fatalf("expected 200, got %v", r.StatusCode)
+		}
+		resp, err := http.Post(url+"/orders", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		// THEN requests get the page, without the upstream being called
+		if resp.StatusCode != 503 || string(body) != "<h1>Back soon</h1>" || resp.Header.Get("Retry-After") != "300" {
+			t.Errorf("expected the maintenance page, got %v %s %s", resp.StatusCode, resp.Header.Get("Retry-After"), body)
+		}
+		if calls.Load() != 0 {
+			t.Errorf("expected no upstream calls, got %d", calls.Load())
+		}
+
+		// WHEN maintenance is over, THEN requests are forwarded again
+		doJSON(t, "PUT", url+"/admin/maintenance", `{"mode":"off"}`, nil)
+		resp, err = http.Post(url+"/orders", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != 200 || calls.Load() != 1 {
+			t.Errorf("expected the request to be forwarded, got %v with %d calls", resp.StatusCode, calls.Load())
+		}
+	})
+}
+
+func TestMaintenanceQueue(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN maintenance which queues requests
+		called := make(chan struct{}, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			called <- struct{}{}
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "orders", Callback: srv.URL}, t)
+		doJSON(t, "PUT", url+"/admin/maintenance", `{"mode":"queue"}`, nil)
+
+		// WHEN a request arrives
+		resp, err := http.Post(url+"/orders", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it is accepted, but only delivered once maintenance is over
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("expected 202, got %v", resp.StatusCode)
+		}
+		select {
+		case <-called:
+			t.Fatal("expected no delivery during maintenance")
+		case <-time.After(100 * time.Millisecond):
+		}
+		doJSON(t, "PUT", url+"/admin/maintenance", `{"mode":"off"}`, nil)
+		select {
+		case <-called:
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the queued request to be delivered")
+		}
+	})
+}
+
+func TestMaintenanceRejectsUnknownMode(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		if r := doJSON(t, "PUT", url+"/admin/maintenance", `{"mode":"nap"}`, nil); r.StatusCode != 400 {
+			t.Errorf("expected 400, got %v", r.StatusCode)
+		}
+	})
+}
+
+func TestMaintenanceQueueInBalanceMode(t *testing.T) {
+	// GIVEN a mode which delivers to only one upstream
+	cfg := testConfig()
+	cfg.Mode = modeBalance
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "a", Callback: srv.URL}, t)
+		register(url, upstream{Name: "b", Callback: srv.URL}, t)
+		doJSON(t, "PUT", url+"/admin/maintenance", `{"mode":"queue"}`, nil)
+
+		// WHEN a request arrives
+		resp, err := http.Post(url+"/orders", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it is rejected rather than queued for both upstreams
+		doJSON(t, "PUT", url+"/admin/maintenance", `{"mode":"off"}`, nil)
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %v", resp.StatusCode)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if calls.Load() != 0 {
+			t.Errorf("expected no upstream calls, got %d", calls.Load())
+		}
+	})
+}
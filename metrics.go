@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// registry is a minimal metrics registry rendering the Prometheus text
+// exposition format, enough for the handful of metrics regproxy reports
+// without pulling in a client library.
+type registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	writeTo(w io.Writer)
+	// visit calls f with each of the metric's current values, by its label
+	// values
+	visit(f func(name, help, kind string, labels, values []string, value float64))
+}
+
+func newRegistry() *registry {
+	return &registry{}
+}
+
+func (r *registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *registry) handler(resp http.ResponseWriter, _ *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.write(resp)
+}
+
+// write renders every metric in the text exposition format.
+func (r *registry) write(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		m.writeTo(w)
+	}
+}
+
+// counter registers a counter, optionally partitioned by labels.
+func (r *registry) counter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+// gaugeFunc registers a gauge whose value is read from f when scraped.
+func (r *registry) gaugeFunc(name, help string, f func() float64) {
+	r.register(&valueFunc{name: name, help: help, kind: "gauge", f: f})
+}
+
+// counterFunc registers a counter kept by something else, such as the Go
+// runtime, whose value is read from f when scraped.
+func (r *registry) counterFunc(name, help string, f func() float64) {
+	r.register(&valueFunc{name: name, help: help, kind: "counter", f: f})
+}
+
+type valueFunc struct {
+	name string
+	help string
+	kind string
+	f    func() float64
+}
+
+func (v *valueFunc) writeTo(w io.Writer) {
+	writeSamples(w, v.name, v.help, v.kind, nil, map[string]float64{"": v.f()})
+}
+
+func (v *valueFunc) visit(f func(name, help, kind string, labels, values []string, value float64)) {
+	f(v.name, v.help, v.kind, nil, nil, v.f())
+}
+
+// gaugeVecFunc registers a gauge partitioned by labels, whose values are
+// read from f, keyed by labelKey, when scraped.
+func (r *registry) gaugeVecFunc(name, help string, labels []string, f func() map[string]float64) {
+	r.register(&gaugeVecFunc{name: name, help: help, labels: labels, f: f})
+}
+
+type gaugeVecFunc struct {
+	name   string
+	help   string
+	labels []string
+	f      func() map[string]float64
+}
+
+func (g *gaugeVecFunc) writeTo(w io.Writer) {
+	writeSamples(w, g.name, g.help, "gauge", g.labels, g.f())
+}
+
+func (g *gaugeVecFunc) visit(f func(name, help, kind string, labels, values []string, value float64)) {
+	for k, v := range g.f() {
+		f(g.name, g.help, "gauge", g.labels, strings.Split(k, "\x00"), v)
+	}
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(n float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += n
+}
+
+func (c *counterVec) value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelKey(labelValues)]
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeSamples(w, c.name, c.help, "counter", c.labels, c.values)
+}
+
+func (c *counterVec) visit(f func(name, help, kind string, labels, values []string, value float64)) {
+	c.mu.Lock()
+	values := maps.Clone(c.values)
+	c.mu.Unlock()
+	for k, v := range values {
+		var lv []string
+		if len(c.labels) > 0 {
+			lv = strings.Split(k, "\x00")
+		}
+		f(c.name, c.help, "counter", c.labels, lv, v)
+	}
+}
+
+// visit calls f with every value of every metric.
+func (r *registry) visit(f func(name, help, kind string, labels, values []string, value float64)) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+	for _, m := range metrics {
+		m.visit(f)
+	}
+}
+
+// labelKey joins label values into a map key, NUL can't appear in a label.
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\x00")
+}
+
+func writeSamples(w io.Writer, name, help, kind string, labels []string, values map[string]float64) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(w, "%s%s %v\n", name, formatLabels(labels, k, ""), values[k])
+	}
+}
+
+// formatLabels renders {name="value",...} for a label key, with an optional
+// extra pre-formatted pair such as le="0.5" for histogram buckets.
+func formatLabels(labels []string, key string, extra string) string {
+	if len(labels) == 0 && extra == "" {
+		return ""
+	}
+	var pairs []string
+	if len(labels) > 0 {
+		for i, v := range strings.Split(key, "\x00") {
+			if i < len(labels) {
+				pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabel(v)))
+			}
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// proxyMetrics are the metrics a RegProxy reports about itself.
+type proxyMetrics struct {
+	*registry
+	compareResults     *counterVec
+	spooledRequests    *counterVec
+	spooledBytes       *counterVec
+	rejectedCalls      *counterVec
+	rateLimited        *counterVec
+	shedRequests       *counterVec
+	invalidPayloads    *counterVec
+	translations       *counterVec
+	duplicates         *counterVec
+	upstreamBytes      *counterVec
+	connsAcquired      *counterVec
+	dialErrors         *counterVec
+	tlsHandshakes      *counterVec
+	tlsHandshakeTime   *counterVec
+	tenantBytes        *counterVec
+	dryRunCalls        *counterVec
+	experimentRequests *counterVec
+	upstreamLimited    *counterVec
+	qosRequests        *counterVec
+	slowEvents         *counterVec
+	probeResults       *counterVec
+	faultsInjected     *counterVec
+	oversizedResponses *counterVec
+	unauthorized       *counterVec
+	retries            *counterVec
+	retriesDenied      *counterVec
+	queueRejected      *counterVec
+	queueGivenUp       *counterVec
+	auditFailures      *counterVec
+	panics             *counterVec
+}
+
+func newProxyMetrics() *proxyMetrics {
+	r := newRegistry()
+	registerRuntimeMetrics(r)
+	return &proxyMetrics{
+		registry:           r,
+		compareResults:     r.counter("regproxy_compare_total", "Comparisons of shadow upstream responses against the primary, by result.", "upstream", "result"),
+		spooledRequests:    r.counter("regproxy_spooled_requests_total", "Requests whose body was spooled to disk."),
+		spooledBytes:       r.counter("regproxy_spooled_bytes_total", "Bytes of request bodies spooled to disk."),
+		rejectedCalls:      r.counter("regproxy_upstream_calls_rejected_total", "Requests rejected because the upstream call limit was reached."),
+		upstreamBytes:      r.counter("regproxy_upstream_bytes_total", "Body bytes sent to and received from each upstream.", "upstream", "direction"),
+		connsAcquired:      r.counter("regproxy_upstream_connections_acquired_total", "Connections taken for calls to each upstream, by whether an idle one was reused.", "upstream", "reused"),
+		dialErrors:         r.counter("regproxy_upstream_dial_errors_total", "Connections to each upstream which couldn't be dialed.", "upstream"),
+		tlsHandshakes:      r.counter("regproxy_upstream_tls_handshakes_total", "TLS handshakes completed with each upstream.", "upstream"),
+		tlsHandshakeTime:   r.counter("regproxy_upstream_tls_handshake_seconds_total", "Time spent in TLS handshakes with each upstream.", "upstream"),
+		tenantBytes:        r.counter("regproxy_tenant_bytes_total", "Body bytes received from and sent to each tenant, by the tenant header.", "tenant", "direction"),
+		duplicates:         r.counter("regproxy_duplicates_suppressed_total", "Upstream calls skipped as the same request was delivered within the upstream's dedup window.", "upstream"),
+		translations:       r.counter("regproxy_translations_total", "Request bodies put through a payload translation, by whether it applied, was skipped or failed.", "translation", "outcome"),
+		invalidPayloads:    r.counter("regproxy_invalid_payloads_total", "Requests rejected for a body which doesn't match a JSON schema, by schema.", "schema"),
+		shedRequests:       r.counter("regproxy_requests_shed_total", "Requests shed by admission control, by reason.", "reason"),
+		slowEvents:         r.counter("regproxy_slow_upstream_events_total", "Upstreams becoming slow or recovering against the latency SLO.", "upstream", "state"),
+		probeResults:       r.counter("regproxy_probe_results_total", "Synthetic probe calls to each upstream, by result.", "upstream", "result"),
+		oversizedResponses: r.counter("regproxy_oversized_responses_total", "Upstream responses over the size limit, by what was done with them.", "upstream", "policy"),
+		faultsInjected:     r.counter("regproxy_faults_injected_total", "Upstream calls affected by fault injection, by fault.", "upstream", "fault"),
+		rateLimited:        r.counter("regproxy_rate_limited_total", "Requests rejected by rate limits, by the limit exceeded.", "scope"),
+		unauthorized:       r.counter("regproxy_unauthorized_requests_total", "Requests rejected for not having a valid token."),
+		retries:            r.counter("regproxy_retries_total", "Upstream calls retried after failing.", "upstream"),
+		retriesDenied:      r.counter("regproxy_retries_denied_total", "Failed upstream calls not retried because the retry budget was spent.", "upstream"),
+		queueRejected:      r.counter("regproxy_queue_rejected_total", "Requests not queued for an upstream because its queue was full.", "upstream"),
+		queueGivenUp:       r.counter("regproxy_queue_given_up_total", "Queued requests given up on after a client error or too many attempts.", "upstream"),
+		auditFailures:      r.counter("regproxy_audit_failures_total", "Requests whose audit record couldn't be written."),
+		panics:             r.counter("regproxy_panics_total", "Panics recovered from, by where they happened.", "where"),
+		experimentRequests: r.counter("regproxy_experiment_requests_total", "Requests by the experiment bucket they were assigned to.", "bucket"),
+		dryRunCalls:        r.counter("regproxy_dry_run_calls_total", "Upstream calls logged but not made, in a dry run.", "upstream"),
+		qosRequests:        r.counter("regproxy_qos_requests_total", "Proxied requests by QoS class, and whether they were admitted, had to wait, or were shed.", "class", "outcome"),
+		upstreamLimited:    r.counter("regproxy_upstream_rate_limited_total", "Upstream calls over the upstream's rate limit, by whether they were delayed or shed.", "upstream", "outcome"),
+	}
+}
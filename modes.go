@@ -0,0 +1,260 @@
+package main
+
+import (
+	"cmp"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	// modeFanOut calls every upstream in parallel and waits for them all
+	modeFanOut = "fanout"
+	// modeHedge calls the primary upstream, falling back to backups when it is slow
+	modeHedge = "hedge"
+	// modeSequential calls upstreams one at a time in priority order
+	modeSequential = "sequential"
+	// modeFailover calls upstreams in priority order until one succeeds
+	modeFailover = "failover"
+	// modeCompare calls every upstream, returning the primary's response and
+	// diffing the others against it
+	modeCompare = "compare"
+	// modeBalance calls a single upstream, chosen by the balance policy
+	modeBalance = "balance"
+	// modeQueue accepts requests straight away, delivering them to each
+	// upstream in order in the background
+	modeQueue = "queue"
+)
+
+var modes = []string{modeFanOut, modeHedge, modeSequential, modeFailover, modeCompare, modeBalance, modeQueue}
+
+// queueable reports whether requests can be queued instead of being
+// delivered in mode, as they still go to every upstream. Queueing them in a
+// mode which chooses between upstreams would deliver them to all instead.
+func queueable(mode string) bool {
+	return mode == modeFanOut || mode == modeSequential || mode == modeQueue
+}
+
+// Sequential mode policies for when an upstream fails
+const (
+	sequentialStop     = "stop"
+	sequentialContinue = "continue"
+)
+
+// Fan-out mode policies for when to respond to the client
+const (
+	// fanOutWaitAll responds once every upstream has answered
+	fanOutWaitAll = "all"
+	// fanOutEarly responds as soon as the answers so far decide the response
+	fanOutEarly = "early"
+	// fanOutPrimary responds with the primary upstream's answer
+	fanOutPrimary = "primary"
+)
+
+var fanOutPolicies = []string{fanOutWaitAll, fanOutEarly, fanOutPrimary}
+
+type result struct {
+	ups  upstream
+	resp *http.Response
+	err  error
+}
+
+// ok reports whether an upstream call succeeded, by the configured success
+// statuses.
+func (p *RegProxy) ok(r result) bool {
+	return r.err == nil && p.cfg.SuccessStatuses.contains(r.resp.StatusCode)
+}
+
+func (r result) close() {
+	if r.resp != nil {
+		_ = r.resp.Body.Close()
+	}
+}
+
+// byPriority orders upstreams lowest priority first, by name within the same
+// priority so the order is stable between requests.
+func byPriority(upstreams map[string]upstream) []upstream {
+	res := make([]upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		res = append(res, u)
+	}
+	slices.SortFunc(res, comparePriority)
+	return res
+}
+
+// byWeightedPriority orders upstreams as byPriority, except that where
+// upstreams of the same priority have weights they're shuffled, each being
+// more likely to come first in proportion to its weight, to share the load
+// between them. It's only for failover: the other modes rely on the order
+// being stable, or on the primary always being the same upstream.
+func byWeightedPriority(upstreams map[string]upstream) []upstream {
+	res := byPriority(upstreams)
+	for start := 0; start < len(res); {
+		end := start + 1
+		for end < len(res) && res[end].Priority == res[start].Priority {
+			end++
+		}
+		weightedShuffle(res[start:end])
+		start = end
+	}
+	return res
+}
+
+// comparePriority orders upstreams by priority, then name, so the primary
+// is always the first.
+func comparePriority(a, b upstream) int {
+	return cmp.Or(cmp.Compare(a.Priority, b.Priority), cmp.Compare(a.Name, b.Name))
+}
+
+// weightedShuffle orders upstreams by weighted random sampling, if any of
+// them has a weight, where those without count as weight 1.
+func weightedShuffle(upstreams []upstream) {
+	if !slices.ContainsFunc(upstreams, func(u upstream) bool { return u.Weight > 0 }) {
+		return
+	}
+	// Efraimidis-Spirakis: sort by a random key u^(1/w), highest first
+	keys := make(map[string]float64, len(upstreams))
+	for _, u := range upstreams {
+		keys[u.Name] = math.Pow(rand.Float64(), 1/float64(max(u.Weight, 1)))
+	}
+	slices.SortFunc(upstreams, func(a, b upstream) int {
+		return cmp.Compare(keys[b.Name], keys[a.Name])
+	})
+}
+
+// discardResults closes the bodies of the n results still to arrive on
+// results, for upstreams whose response we no longer need.
+func discardResults(results <-chan result, n int) {
+	for i := 0; i < n; i++ {
+		r := <-results
+		r.close()
+	}
+}
+
+// hedge sends the request to the primary upstream straight away, and to each
+// backup in turn whenever HedgeDelay passes without an answer or the previous
+// attempt fails. The first successful response is returned to the client.
+// Requests which can't safely be sent twice only go to the primary, as a
+// backup could repeat their side effects.
+func (p *RegProxy) hedge(resp http.ResponseWriter, req *http.Request, body *requestBody, upstreams map[string]upstream) {
+	ordered := byPriority(upstreams)
+	if !canRetry(req) {
+		ordered = ordered[:1]
+	}
+	// Buffered so that late responses never block their goroutine
+	results := make(chan result, len(ordered))
+	cancels := make(callCancels, len(ordered))
+	defer cancels.cancelAll()
+	sent, pending := 0, 0
+	launchNext := func() {
+		ups := ordered[sent]
+		cancels[ups.Name] = p.forwardAsync(req, body, ups, results)
+		sent++
+		pending++
+	}
+
+	launchNext()
+	timer := time.NewTimer(p.cfg.HedgeDelay)
+	defer timer.Stop()
+	var failed result
+	dc := req.Context().Done()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if p.ok(r) {
+				// We have our answer, stop the backups which are still going
+				cancels.cancelExcept(r.ups.Name)
+				go discardResults(results, pending)
+				writeResponse(resp, r.resp)
+				return
+			}
+			failed.close()
+			failed = r
+			// No point waiting out the delay for an attempt we know has failed
+			if sent < len(ordered) {
+				launchNext()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(p.cfg.HedgeDelay)
+			}
+		case <-timer.C:
+			if sent < len(ordered) {
+				launchNext()
+				timer.Reset(p.cfg.HedgeDelay)
+			}
+		// If our own client cancelled, we should stop waiting
+		case <-dc:
+			go discardResults(results, pending)
+			p.upstreamErrResp(resp, req, req.Context().Err())
+			return
+		}
+	}
+	// Every upstream failed, report the last failure
+	p.writeResult(resp, req, failed)
+}
+
+// writeResult returns a single upstream's outcome to the client.
+func (p *RegProxy) writeResult(resp http.ResponseWriter, req *http.Request, r result) {
+	if r.err != nil {
+		p.upstreamErrResp(resp, req, r.err)
+		return
+	}
+	writeResponse(resp, r.resp)
+}
+
+// sequential calls each upstream in priority order, waiting for one to finish
+// before starting the next, for consumers which rely on causal ordering.
+// Depending on SequentialOnFailure a failure either stops delivery to the
+// remaining upstreams or is reported once everyone has been tried.
+func (p *RegProxy) sequential(resp http.ResponseWriter, req *http.Request, body *requestBody, upstreams map[string]upstream) {
+	var results []result
+	for _, ups := range byPriority(upstreams) {
+		// If our own client cancelled, there is no point carrying on
+		if err := req.Context().Err(); err != nil {
+			results = append(results, result{ups: ups, err: err})
+			break
+		}
+		r, err := p.forward(req, body, ups)
+		res := result{ups: ups, resp: r, err: err}
+		results = append(results, res)
+		if !p.ok(res) && p.cfg.SequentialOnFailure == sequentialStop {
+			log.Printf("Upstream %s failed, not delivering to the remaining upstreams", ups.Name)
+			break
+		}
+	}
+	p.respond(resp, req, results)
+}
+
+// failover calls upstreams in priority order and returns the first successful
+// response, so the backups are only called when the primary is failing.
+func (p *RegProxy) failover(resp http.ResponseWriter, req *http.Request, body *requestBody, upstreams map[string]upstream) {
+	var failed result
+	for _, ups := range byWeightedPriority(upstreams) {
+		// If our own client cancelled, there is no point carrying on
+		if err := req.Context().Err(); err != nil {
+			failed.close()
+			p.upstreamErrResp(resp, req, err)
+			return
+		}
+		r, err := p.forward(req, body, ups)
+		res := result{ups: ups, resp: r, err: err}
+		if p.ok(res) {
+			failed.close()
+			writeResponse(resp, res.resp)
+			return
+		}
+		log.Printf("Upstream %s failed, failing over to the next upstream", ups.Name)
+		failed.close()
+		failed = res
+	}
+	// Every upstream failed, report the last failure
+	p.writeResult(resp, req, failed)
+}
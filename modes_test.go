@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedgeSlowPrimary(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeHedge
+	cfg.HedgeDelay = 50 * time.Millisecond
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a slow primary and a fast backup
+		primary := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+			rr.Write([]byte("primary"))
+		}))
+		backup := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.Write([]byte("backup"))
+		}))
+		defer primary.Close()
+		defer backup.Close()
+		register(url, upstream{Name: "primary", Callback: primary.URL, Priority: 1}, t)
+		register(url, upstream{Name: "backup", Callback: backup.URL, Priority: 2}, t)
+
+		// WHEN
+		start := time.Now()
+		r, err := http.Get(url)
+
+		// THEN the backup answers without waiting for the primary
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+			t.Errorf("expected hedged response before the primary finished, took %v", elapsed)
+		}
+	})
+}
+
+func TestHedgeFastPrimary(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeHedge
+	cfg.HedgeDelay = 500 * time.Millisecond
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a fast primary
+		var backupCalls atomic.Int32
+		primary := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.Write([]byte("primary"))
+		}))
+		backup := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			backupCalls.Add(1)
+			rr.Write([]byte("backup"))
+		}))
+		defer primary.Close()
+		defer backup.Close()
+		register(url, upstream{Name: "primary", Callback: primary.URL, Priority: 1}, t)
+		register(url, upstream{Name: "backup", Callback: backup.URL, Priority: 2}, t)
+
+		// WHEN
+		r, err := http.Get(url)
+
+		// THEN the backup is never called
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+		if n := backupCalls.Load(); n != 0 {
+			t.Errorf("expected no calls to the backup, got %d", n)
+		}
+	})
+}
+
+func TestHedgeFailingPrimary(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeHedge
+	cfg.HedgeDelay = 10 * time.Second
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a primary which errors
+		primary := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.WriteHeader(503)
+		}))
+		backup := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.Write([]byte("backup"))
+		}))
+		defer primary.Close()
+		defer backup.Close()
+		register(url, upstream{Name: "primary", Callback: primary.URL, Priority: 1}, t)
+		register(url, upstream{Name: "backup", Callback: backup.URL, Priority: 2}, t)
+
+		// WHEN
+		r, err := http.Get(url)
+
+		// THEN the backup is tried straight away rather than after the delay
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+	})
+}
+
+func TestHedgeNotIdempotent(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeHedge
+	cfg.HedgeDelay = 50 * time.Millisecond
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a slow primary and a backup
+		var backupCalls atomic.Int32
+		primary := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			rr.Write([]byte("primary"))
+		}))
+		backup := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			backupCalls.Add(1)
+			rr.Write([]byte("backup"))
+		}))
+		defer primary.Close()
+		defer backup.Close()
+		register(url, upstream{Name: "primary", Callback: primary.URL, Priority: 1}, t)
+		register(url, upstream{Name: "backup", Callback: backup.URL, Priority: 2}, t)
+
+		// WHEN a POST without an idempotency key is sent
+		r, err := http.Post(url, "application/json", strings.NewReader(`{}`))
+
+		// THEN only the primary is called, however long it takes
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+		if n := backupCalls.Load(); n != 0 {
+			t.Errorf("expected no calls to the backup, got %d", n)
+		}
+	})
+}
+
+// orderedUpstreams registers one test server per status, in priority order,
+// recording the order in which they are called.
+func orderedUpstreams(url string, t *testing.T, statuses ...int) (*[]string, func()) {
+	var mu sync.Mutex
+	var called []string
+	var servers []*httptest.Server
+	for i, status := range statuses {
+		name := fmt.Sprintf("ups-%d", i)
+		status := status
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			called = append(called, name)
+			mu.Unlock()
+			rr.WriteHeader(status)
+		}))
+		servers = append(servers, srv)
+	}
+	// Register in reverse to show that priority, not registration order, counts
+	for i := len(servers) - 1; i >= 0; i-- {
+		register(url, upstream{Name: fmt.Sprintf("ups-%d", i), Callback: servers[i].URL, Priority: i}, t)
+	}
+	return &called, func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+}
+
+func TestSequentialOrder(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeSequential
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN
+		called, done := orderedUpstreams(url, t, 200, 200, 200)
+		defer done()
+
+		// WHEN
+		r, err := http.Get(url)
+
+		// THEN every upstream is called in priority order
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+		if fmt.Sprint(*called) != "[ups-0 ups-1 ups-2]" {
+			t.Errorf("unexpected call order %v", *called)
+		}
+	})
+}
+
+func TestSequentialStopOnFailure(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeSequential
+	cfg.SequentialOnFailure = sequentialStop
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN the second upstream fails
+		called, done := orderedUpstreams(url, t, 200, 500, 200)
+		defer done()
+
+		// WHEN
+		r, err := http.Get(url)
+
+		// THEN the third upstream is never called
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 500 {
+			t.Errorf("expected 500, got %v", r.StatusCode)
+		}
+		if fmt.Sprint(*called) != "[ups-0 ups-1]" {
+			t.Errorf("unexpected call order %v", *called)
+		}
+	})
+}
+
+func TestSequentialContinueOnFailure(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeSequential
+	cfg.SequentialOnFailure = sequentialContinue
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN the second upstream fails
+		called, done := orderedUpstreams(url, t, 200, 500, 200)
+		defer done()
+
+		// WHEN
+		r, err := http.Get(url)
+
+		// THEN the failure is reported but everyone was called
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 500 {
+			t.Errorf("expected 500, got %v", r.StatusCode)
+		}
+		if fmt.Sprint(*called) != "[ups-0 ups-1 ups-2]" {
+			t.Errorf("unexpected call order %v", *called)
+		}
+	})
+}
+
+func TestFailoverPrimaryHealthy(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeFailover
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN
+		called, done := orderedUpstreams(url, t, 200, 200)
+		defer done()
+
+		// WHEN
+		r, err := http.Get(url)
+
+		// THEN only the primary is called
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+		if fmt.Sprint(*called) != "[ups-0]" {
+			t.Errorf("unexpected calls %v", *called)
+		}
+	})
+}
+
+func TestFailoverToBackup(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeFailover
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a failing primary
+		called, done := orderedUpstreams(url, t, 503, 200, 200)
+		defer done()
+
+		// WHEN
+		r, err := http.Get(url)
+
+		// THEN the first backup answers and the second isn't needed
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+		if fmt.Sprint(*called) != "[ups-0 ups-1]" {
+			t.Errorf("unexpected calls %v", *called)
+		}
+	})
+}
+
+func TestFailoverAllFail(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeFailover
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN
+		_, done := orderedUpstreams(url, t, 503, 502)
+		defer done()
+
+		// WHEN
+		r, err := http.Get(url)
+
+		// THEN the last failure is returned
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 502 {
+			t.Errorf("expected 502, got %v", r.StatusCode)
+		}
+	})
+}
+
+func TestHedgeCancelsLosers(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeHedge
+	cfg.HedgeDelay = 50 * time.Millisecond
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a primary which hangs until its caller goes away
+		cancelled := make(chan struct{})
+		primary := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+				close(cancelled)
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		backup := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.Write([]byte("backup"))
+		}))
+		defer primary.Close()
+		defer backup.Close()
+		register(url, upstream{Name: "primary", Callback: primary.URL, Priority: 1}, t)
+		register(url, upstream{Name: "backup", Callback: backup.URL, Priority: 2}, t)
+
+		// WHEN the backup wins
+		r, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != 200 {
+			t.Errorf("expected 200, got %v", r.StatusCode)
+		}
+
+		// THEN the call to the primary is abandoned
+		select {
+		case <-cancelled:
+		case <-time.After(500 * time.Millisecond):
+			t.Errorf("expected the call to the primary to be cancelled")
+		}
+	})
+}
+
+func TestByPriorityWeights(t *testing.T) {
+	// GIVEN a weighted pair of backups
+	upstreams := map[string]upstream{
+		"primary": {Name: "primary"},
+		"heavy":   {Name: "heavy", Priority: 1, Weight: 9},
+		"light":   {Name: "light", Priority: 1},
+	}
+
+	// WHEN ordered many times
+	heavyFirst := 0
+	for range 1000 {
+		ordered := byWeightedPriority(upstreams)
+		if ordered[0].Name != "primary" {
+			t.Fatalf("expected the primary first, got %v", ordered)
+		}
+		if ordered[1].Name == "heavy" {
+			heavyFirst++
+		}
+	}
+
+	// THEN the heavier backup comes first in proportion to its weight
+	if heavyFirst < 850 || heavyFirst > 950 {
+		t.Errorf("expected the heavy backup first about 900 times, got %v", heavyFirst)
+	}
+}
+
+func TestFanOutRespondPrimary(t *testing.T) {
+	cfg := testConfig()
+	cfg.FanOutRespond = fanOutPrimary
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a fast primary and a slow shadow
+		var shadowDone atomic.Bool
+		primary := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.Write([]byte("primary"))
+		}))
+		shadow := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+			shadowDone.Store(true)
+			rr.WriteHeader(500)
+		}))
+		defer primary.Close()
+		defer shadow.Close()
+		register(url, upstream{Name: "primary", Callback: primary.URL, Priority: 1}, t)
+		register(url, upstream{Name: "shadow", Callback: shadow.URL, Priority: 2}, t)
+
+		// WHEN
+		start := time.Now()
+		r, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Body.Close()
+
+		// THEN the primary's answer is returned without waiting for the shadow
+		if r.StatusCode != 200 {
+			t.Errorf("expected the primary's 200, got %v", r.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("expected a response before the shadow finished, took %v", elapsed)
+		}
+		// AND the shadow call still finishes in the background
+		time.Sleep(500 * time.Millisecond)
+		if !shadowDone.Load() {
+			t.Error("expected the shadow call to finish")
+		}
+	})
+}
+
+func TestFanOutRespondEarly(t *testing.T) {
+	cfg := testConfig()
+	cfg.FanOutRespond = fanOutEarly
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a failing upstream and a slow one
+		failing := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.WriteHeader(503)
+		}))
+		slow := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+		}))
+		defer failing.Close()
+		defer slow.Close()
+		register(url, upstream{Name: "failing", Callback: failing.URL}, t)
+		register(url, upstream{Name: "slow", Callback: slow.URL}, t)
+
+		// WHEN
+		start := time.Now()
+		r, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Body.Close()
+
+		// THEN the failure decides the response straight away, as errors are preferred
+		if r.StatusCode != 503 {
+			t.Errorf("expected 503, got %v", r.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("expected a response before the slow upstream finished, took %v", elapsed)
+		}
+	})
+}
+
+func TestByPriorityIgnoresWeights(t *testing.T) {
+	// GIVEN weighted upstreams of the same priority
+	upstreams := map[string]upstream{
+		"a": {Name: "a", Weight: 1},
+		"b": {Name: "b", Weight: 99},
+	}
+
+	// WHEN ordered for the modes which need a stable order
+	for range 100 {
+		// THEN they're always by name
+		if ordered := byPriority(upstreams); ordered[0].Name != "a" {
+			t.Fatalf("expected a stable order, got %v", ordered)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// What to publish to NATS for each proxied request
+const (
+	natsPublishRequests = "requests"
+	natsPublishResults  = "results"
+)
+
+// natsClient publishes to a NATS server, connecting on first use. The
+// connection reconnects by itself after that, and is only replaced once it
+// has given up. Each publish is flushed, so it's known the server has
+// processed it.
+type natsClient struct {
+	url     string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+// newNATSClient connects to nats://[user:pass@|token@]host[:port] servers.
+func newNATSClient(location string) (*natsClient, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("invalid NATS URL [%s], expected nats://host:port", location)
+	}
+	return &natsClient{url: location, timeout: 5 * time.Second}, nil
+}
+
+func (c *natsClient) connection() (*nats.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil || c.conn.IsClosed() {
+		conn, err := nats.Connect(c.url, nats.Name("regproxy"), nats.Timeout(c.timeout))
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	return c.conn, nil
+}
+
+// publish sends data to subject, with headers if there are any.
+func (c *natsClient) publish(ctx context.Context, subject string, header http.Header, data []byte) error {
+	conn, err := c.connection()
+	if err != nil {
+		return err
+	}
+	if err := conn.PublishMsg(&nats.Msg{Subject: subject, Header: nats.Header(header), Data: data}); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return conn.FlushWithContext(ctx)
+}
+
+// natsPublisher publishes every proxied request, or the results of
+// delivering it, to a NATS subject once its upstream calls have finished, so
+// other systems can follow the webhook stream without registering a callback.
+type natsPublisher struct {
+	client  *natsClient
+	subject string
+	publish string
+}
+
+// publishDelivery publishes what this proxy was configured to for req. In
+// requests mode the body is published, with the request line, request ID
+// and status as Regproxy- headers alongside the request's own, but for
+// credentials. In results mode the delivery report sent to result callbacks
+// is published as JSON.
+func (n *natsPublisher) publishDelivery(req *http.Request, body *requestBody, status int, d *delivery) {
+	var header http.Header
+	var data []byte
+	if n.publish == natsPublishResults {
+		b, err := json.Marshal(newDeliveryReport(req, status, d).public())
+		if err != nil {
+			log.Printf("Failed to encode delivery of %s for NATS: %v", req.URL.Path, err)
+			return
+		}
+		data = b
+	} else {
+		r := body.reader()
+		b, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			log.Printf("Failed to read body of %s for NATS: %v", req.URL.Path, err)
+			return
+		}
+		data = b
+		header = messageHeaders(req.Header)
+		header.Set("Regproxy-Method", req.Method)
+		header.Set("Regproxy-Path", req.URL.RequestURI())
+		header.Set("Regproxy-Request-Id", d.requestID)
+		header.Set("Regproxy-Status", fmt.Sprint(status))
+	}
+	if err := n.client.publish(context.Background(), n.subject, header, data); err != nil {
+		log.Printf("Failed to publish %s %s to NATS subject %s: %v", n.publish, req.URL.Path, n.subject, err)
+	}
+}
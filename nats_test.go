@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATS accepts publishes, as a NATS server would without any
+// subscribers.
+type fakeNATS struct {
+	mu       sync.Mutex
+	connects []string
+	msgs     []natsMsg
+}
+
+type natsMsg struct {
+	subject string
+	header  string
+	data    string
+}
+
+func startFakeNATS(t *testing.T) (*fakeNATS, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	f := &fakeNATS{}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f, "nats://" + l.Addr().String()
+}
+
+func (f *fakeNATS) serve(c net.Conn) {
+	defer c.Close()
+	fmt.Fprint(c, "INFO {\"headers\":true,\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CONNECT":
+			f.mu.Lock()
+			f.connects = append(f.connects, strings.TrimSpace(strings.TrimPrefix(line, "CONNECT")))
+			f.mu.Unlock()
+		case "PING":
+			fmt.Fprint(c, "PONG\r\n")
+		case "PUB", "HPUB":
+			m := natsMsg{subject: fields[1]}
+			hdr := 0
+			if fields[0] == "HPUB" {
+				hdr, _ = strconv.Atoi(fields[2])
+			}
+			total, _ := strconv.Atoi(fields[len(fields)-1])
+			buf := make([]byte, total+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			m.header, m.data = string(buf[:hdr]), string(buf[hdr:total])
+			f.mu.Lock()
+			f.msgs = append(f.msgs, m)
+			f.mu.Unlock()
+		}
+	}
+}
+
+func (f *fakeNATS) waitForMsg(t *testing.T) natsMsg {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		f.mu.Lock()
+		if len(f.msgs) > 0 {
+			m := f.msgs[0]
+			f.mu.Unlock()
+			return m
+		}
+		f.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("nothing was published")
+	return natsMsg{}
+}
+
+func TestPublishRequestsToNATS(t *testing.T) {
+	nats, location := startFakeNATS(t)
+	cfg := testConfig()
+	cfg.NATSURL = location
+	cfg.NATSSubject = "webhooks"
+	cfg.NATSPublish = natsPublishRequests
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN
+		defer withStatusUpstreams(url, t, 200)()
+
+		// WHEN
+		req, _ := http.NewRequest("POST", url+"/hook", strings.NewReader("payload"))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN
+		m := nats.waitForMsg(t)
+		if strings.Contains(m.header, "Authorization") {
+			t.Errorf("expected the caller's credentials to be left out of %q", m.header)
+		}
+		if m.subject != "webhooks" || m.data != "payload" {
+			t.Errorf("unexpected message %+v", m)
+		}
+		for _, want := range []string{"NATS/1.0\r\n", "Regproxy-Method: POST\r\n", "Regproxy-Path: /hook\r\n", "Regproxy-Status: 200\r\n", "Content-Type: text/plain\r\n", "Regproxy-Request-Id: " + resp.Header.Get(requestIDHeader) + "\r\n"} {
+			if !strings.Contains(m.header, want) {
+				t.Errorf("expected header %q in %q", want, m.header)
+			}
+		}
+	})
+}
+
+func TestPublishResultsToNATS(t *testing.T) {
+	nats, location := startFakeNATS(t)
+	cfg := testConfig()
+	cfg.NATSURL = strings.Replace(location, "nats://", "nats://user:secret@", 1)
+	cfg.NATSSubject = "results"
+	cfg.NATSPublish = natsPublishResults
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN
+		defer withStatusUpstreams(url, t, 200, 500)()
+
+		// WHEN
+		status := getStatus(url, t)
+
+		// THEN
+		m := nats.waitForMsg(t)
+		var report deliveryReport
+		if err := json.Unmarshal([]byte(m.data), &report); err != nil {
+			t.Fatal(err)
+		}
+		if m.header != "" || report.Status != status || len(report.Upstreams) != 2 {
+			t.Errorf("unexpected report %+v", report)
+		}
+		nats.mu.Lock()
+		defer nats.mu.Unlock()
+		if !strings.Contains(nats.connects[0], `"user":"user"`) || !strings.Contains(nats.connects[0], `"pass":"secret"`) {
+			t.Errorf("expected credentials in %s", nats.connects[0])
+		}
+	})
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// errPreconditionFailed means an object was changed by someone else since we
+// read it.
+var errPreconditionFailed = errors.New("object has been modified concurrently")
+
+// objectStore is a single object in a cloud object store, read and written
+// with optimistic concurrency on the store's own version (an S3 ETag or a
+// GCS generation).
+type objectStore interface {
+	// get returns the object and its version, or a nil body and empty
+	// version when it doesn't exist yet.
+	get(ctx context.Context) ([]byte, string, error)
+	// put writes the object if it's still at version, where an empty version
+	// means it must not exist yet, returning errPreconditionFailed if not.
+	put(ctx context.Context, body []byte, version string) error
+	String() string
+}
+
+// newObjectStore opens s3://bucket/key or gs://bucket/object locations.
+func newObjectStore(location string) (objectStore, bool, error) {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "s3" && u.Scheme != "gs") {
+		return nil, false, nil
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, true, fmt.Errorf("object storage location [%s] needs a bucket and an object name", location)
+	}
+	if u.Scheme == "s3" {
+		return newS3Object(u.Host, key), true, nil
+	}
+	return newGCSObject(&http.Client{Timeout: 30 * time.Second}, u.Host, key), true, nil
+}
+
+// RegStorageObject keeps the registry as a single JSON object in S3 or GCS,
+// for deployments with nothing but a bucket to persist to. Reads are served
+// from memory and changes are written back every flush interval. Each write
+// back re-reads the object and replays our changes on top under a version
+// precondition, so several instances can share one object without losing
+// each other's registrations, and each picks up the others' on the way.
+type RegStorageObject struct {
+	store objectStore
+	// lease, if set, is a separate object for leader election
+	lease *objectLease
+
+	mu        sync.Mutex
+	upstreams map[string]upstream
+	// pending are changes made since the last successful write back
+	pending []func(map[string]upstream)
+	// flushing is held while writing back, so changes are written in the
+	// order they were made
+	flushing sync.Mutex
+}
+
+func NewRegStorageObject(ctx context.Context, store objectStore, lease objectStore) (*RegStorageObject, error) {
+	s := &RegStorageObject{store: store}
+	if lease != nil {
+		s.lease = &objectLease{store: lease}
+	}
+	upstreams, _, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ups := range upstreams {
+		log.Printf("Adding upstream from %s %v", store, ups)
+	}
+	s.upstreams = upstreams
+	return s, nil
+}
+
+func (s *RegStorageObject) Put(u upstream) error {
+	return s.change(func(m map[string]upstream) { m[u.Name] = u })
+}
+func (s *RegStorageObject) Delete(name string) error {
+	return s.change(func(m map[string]upstream) { delete(m, name) })
+}
+func (s *RegStorageObject) ReplaceAll(upstreams map[string]upstream) error {
+	upstreams = maps.Clone(upstreams)
+	return s.change(func(m map[string]upstream) {
+		clear(m)
+		maps.Copy(m, upstreams)
+	})
+}
+func (s *RegStorageObject) All() (map[string]upstream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.upstreams), nil
+}
+
+func (s *RegStorageObject) acquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	if s.lease == nil {
+		return true, nil
+	}
+	return s.lease.acquireLease(ctx, name, holder, ttl)
+}
+
+func (s *RegStorageObject) change(f func(map[string]upstream)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s.upstreams)
+	s.pending = append(s.pending, f)
+	return nil
+}
+
+// Run writes back changes every interval until ctx is done, then makes a
+// final attempt.
+func (s *RegStorageObject) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.flush(ctx); err != nil {
+				log.Printf("Failed to write registry to %s: %v", s.store, err)
+			}
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := s.flush(final); err != nil {
+				log.Printf("Failed to write registry to %s: %v", s.store, err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// Flush writes back any changes now, rather than waiting for the next flush
+// interval, so they aren't lost when the process stops.
+func (s *RegStorageObject) Flush(ctx context.Context) error {
+	return s.flush(ctx)
+}
+
+// maxFlushAttempts bounds retries when other instances keep winning the race
+// to write the object
+const maxFlushAttempts = 5
+
+func (s *RegStorageObject) flush(ctx context.Context) error {
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+	s.mu.Lock()
+	ops := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	err := errPreconditionFailed
+	for attempt := 0; attempt < maxFlushAttempts && errors.Is(err, errPreconditionFailed); attempt++ {
+		var remote map[string]upstream
+		var version string
+		remote, version, err = s.load(ctx)
+		if err != nil {
+			break
+		}
+		for _, op := range ops {
+			op(remote)
+		}
+		if len(ops) > 0 {
+			err = s.write(ctx, remote, version)
+			if err != nil {
+				continue
+			}
+		}
+		s.mu.Lock()
+		// Anything changed while we were writing goes on top of what's stored
+		for _, op := range s.pending {
+			op(remote)
+		}
+		s.upstreams = remote
+		s.mu.Unlock()
+	}
+	if err != nil {
+		// Keep the changes for the next attempt, ahead of any made since
+		s.mu.Lock()
+		s.pending = append(ops, s.pending...)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *RegStorageObject) load(ctx context.Context) (map[string]upstream, string, error) {
+	body, version, err := s.store.get(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	upstreams := make(map[string]upstream)
+	if body == nil {
+		return upstreams, "", nil
+	}
+	var snap registrySnapshot
+	if err := json.Unmarshal(body, &snap); err != nil {
+		return nil, "", fmt.Errorf("corrupt registry object %s: %w", s.store, err)
+	}
+	for _, u := range snap.Upstreams {
+		upstreams[u.Name] = u
+	}
+	return upstreams, version, nil
+}
+
+func (s *RegStorageObject) write(ctx context.Context, upstreams map[string]upstream, version string) error {
+	snap := registrySnapshot{Version: snapshotVersion, Exported: time.Now().UTC()}
+	for _, u := range upstreams {
+		snap.Upstreams = append(snap.Upstreams, u)
+	}
+	body, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return s.store.put(ctx, body, version)
+}
+
+// s3Object is an object in S3, or anything speaking its API, using
+// conditional writes on the ETag.
+type s3Object struct {
+	client *s3.Client
+	bucket string
+	key    string
+}
+
+func newS3Object(bucket, key string) *s3Object {
+	client := s3.NewFromConfig(awsConfig(), func(o *s3.Options) {
+		o.BaseEndpoint = awsEndpointOverride("S3")
+		// Stand-ins such as MinIO are addressed by path rather than by
+		// bucket host names, and may not know the newer checksums
+		if o.BaseEndpoint != nil {
+			o.UsePathStyle = true
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+	})
+	return &s3Object{client: client, bucket: bucket, key: key}
+}
+
+func (o *s3Object) String() string {
+	return "s3://" + o.bucket + "/" + o.key
+}
+
+func (o *s3Object) get(ctx context.Context) ([]byte, string, error) {
+	out, err := o.client.GetObject(ctx, &s3.GetObjectInput{Bucket: &o.bucket, Key: &o.key})
+	if awsStatus(err) == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer out.Body.Close()
+	body, err := io.ReadAll(out.Body)
+	return body, aws.ToString(out.ETag), err
+}
+
+func (o *s3Object) put(ctx context.Context, body []byte, version string) error {
+	in := &s3.PutObjectInput{
+		Bucket:      &o.bucket,
+		Key:         &o.key,
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	if version == "" {
+		in.IfNoneMatch = aws.String("*")
+	} else {
+		in.IfMatch = &version
+	}
+	_, err := o.client.PutObject(ctx, in)
+	switch awsStatus(err) {
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return errPreconditionFailed
+	}
+	return err
+}
+
+// gcsObject is an object in Google Cloud Storage, using its JSON API with
+// generation preconditions.
+type gcsObject struct {
+	client   *http.Client
+	endpoint string
+	bucket   string
+	object   string
+	token    func(ctx context.Context) (string, error)
+}
+
+func newGCSObject(client *http.Client, bucket, object string) *gcsObject {
+	o := &gcsObject{client: client, endpoint: "https://storage.googleapis.com", bucket: bucket, object: object}
+	// The conventional variable for pointing clients at a local emulator,
+	// which doesn't need authenticating
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		o.endpoint = strings.TrimSuffix(host, "/")
+		o.token = func(context.Context) (string, error) { return "", nil }
+		return o
+	}
+	o.token = (&gcpTokenSource{client: client}).token
+	return o
+}
+
+func (o *gcsObject) String() string {
+	return "gs://" + o.bucket + "/" + o.object
+}
+
+func (o *gcsObject) do(req *http.Request) (*http.Response, error) {
+	token, err := o.token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return o.client.Do(req)
+}
+
+func (o *gcsObject) get(ctx context.Context) ([]byte, string, error) {
+	u := o.endpoint + "/storage/v1/b/" + url.PathEscape(o.bucket) + "/o/" + url.PathEscape(o.object) + "?alt=media"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := o.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", objectStoreError(resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	return body, resp.Header.Get("X-Goog-Generation"), err
+}
+
+func (o *gcsObject) put(ctx context.Context, body []byte, version string) error {
+	if version == "" {
+		// Generation 0 means the object mustn't exist
+		version = "0"
+	}
+	q := url.Values{"uploadType": {"media"}, "name": {o.object}, "ifGenerationMatch": {version}}
+	u := o.endpoint + "/upload/storage/v1/b/" + url.PathEscape(o.bucket) + "/o?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return errPreconditionFailed
+	}
+	return objectStoreError(resp)
+}
+
+// gcpTokenSource gets access tokens for the instance's service account from
+// the GCE metadata server, or uses GOOGLE_OAUTH_ACCESS_TOKEN if set.
+type gcpTokenSource struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	current string
+	expires time.Time
+}
+
+const gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+func (s *gcpTokenSource) token(ctx context.Context) (string, error) {
+	if t := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); t != "" {
+		return t, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != "" && time.Now().Before(s.expires) {
+		return s.current, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching access token from metadata server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", objectStoreError(resp)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	s.current = t.AccessToken
+	// Refresh a minute early so a token never expires in flight
+	s.expires = time.Now().Add(time.Duration(t.ExpiresIn)*time.Second - time.Minute)
+	return s.current, nil
+}
+
+func objectStoreError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s returned %s: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+}
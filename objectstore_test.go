@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeObject is an in-memory objectStore with numbered versions
+type fakeObject struct {
+	mu      sync.Mutex
+	body    []byte
+	version int
+	// raced, when set, is run once just before a put to simulate another
+	// instance getting in first
+	raced func()
+}
+
+func (o *fakeObject) get(context.Context) ([]byte, string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.body == nil {
+		return nil, "", nil
+	}
+	return o.body, strconv.Itoa(o.version), nil
+}
+
+func (o *fakeObject) put(_ context.Context, body []byte, version string) error {
+	if r := o.raced; r != nil {
+		o.raced = nil
+		r()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	current := ""
+	if o.body != nil {
+		current = strconv.Itoa(o.version)
+	}
+	if version != current {
+		return errPreconditionFailed
+	}
+	o.body = body
+	o.version++
+	return nil
+}
+
+func (o *fakeObject) String() string {
+	return "fake"
+}
+
+func TestObjectStorageInstancesConverge(t *testing.T) {
+	// GIVEN two instances sharing an object
+	obj := &fakeObject{}
+	a, err := NewRegStorageObject(context.Background(), obj, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewRegStorageObject(context.Background(), obj, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN each registers an upstream and writes back, b losing a race to a
+	_ = a.Put(upstream{Name: "a", Callback: "http://a"})
+	_ = b.Put(upstream{Name: "b", Callback: "http://b"})
+	obj.raced = func() {
+		if err := a.flush(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := b.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN neither registration is lost and both instances see both
+	for name, s := range map[string]*RegStorageObject{"a": a, "b": b} {
+		all, _ := s.All()
+		if len(all) != 2 {
+			t.Errorf("instance %s expected both upstreams, got %v", name, all)
+		}
+	}
+}
+
+func TestObjectStorageKeepsChangesWhenWriteFails(t *testing.T) {
+	// GIVEN an object which is always changed under us
+	obj := &fakeObject{}
+	s, err := NewRegStorageObject(context.Background(), obj, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Put(upstream{Name: "a", Callback: "http://a"})
+	obj.version = -1
+	obj.body = []byte(`{"version":1,"upstreams":[]}`)
+	var bump func()
+	bump = func() {
+		obj.version--
+		obj.raced = bump
+	}
+	obj.raced = bump
+
+	// WHEN
+	err = s.flush(context.Background())
+
+	// THEN the change is kept to try again
+	if err != errPreconditionFailed {
+		t.Errorf("expected precondition failure, got %v", err)
+	}
+	obj.raced = nil
+	if err := s.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewRegStorageObject(context.Background(), obj, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := reloaded.All(); len(all) != 1 {
+		t.Errorf("expected the upstream to be written, got %v", all)
+	}
+}
+
+func TestS3ObjectPreconditions(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	var stored []byte
+	etag := `"1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/registry/regproxy.json" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") == "" {
+			t.Error("request wasn't signed")
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if stored == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			_, _ = w.Write(stored)
+		case http.MethodPut:
+			if (stored == nil && r.Header.Get("If-None-Match") != "*") || (stored != nil && r.Header.Get("If-Match") != etag) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			stored, _ = io.ReadAll(r.Body)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_ENDPOINT_URL_S3", srv.URL)
+	obj := newS3Object("bucket", "registry/regproxy.json")
+
+	// WHEN created, then written against a stale version
+	if err := obj.put(context.Background(), []byte("{}"), ""); err != nil {
+		t.Fatal(err)
+	}
+	err := obj.put(context.Background(), []byte("{}"), `"0"`)
+
+	// THEN
+	if err != errPreconditionFailed {
+		t.Errorf("expected precondition failure, got %v", err)
+	}
+	body, version, err := obj.get(context.Background())
+	if err != nil || string(body) != "{}" || version != etag {
+		t.Errorf("unexpected object %s version %s error %v", body, version, err)
+	}
+}
+
+func TestObjectStorageFlushedOnStop(t *testing.T) {
+	// GIVEN a registration acknowledged but not yet written back
+	obj := &fakeObject{}
+	s, err := NewRegStorageObject(context.Background(), obj, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{Server: &http.Server{Handler: NewRegProxy(testConfig(), s).handler}, l: l}
+	go func() { _ = srv.Serve(l) }()
+	register("http://"+l.Addr().String(), upstream{Name: "orders", Callback: "http://orders"}, t)
+
+	// WHEN the proxy stops
+	stopServing([]*server{srv}, s, time.Second)
+
+	// THEN the registration has been written
+	reloaded, err := NewRegStorageObject(context.Background(), obj, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := reloaded.All(); all["orders"].Callback != "http://orders" {
+		t.Errorf("expected the registration to be written on stopping, got %v", all)
+	}
+}
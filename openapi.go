@@ -0,0 +1,22 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes the admin API, for generating clients and contract
+// tests. It's kept by hand alongside the handlers.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPI serves GET /admin/openapi.json.
+func (p *RegProxy) openAPI(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		methodNotAllowed(resp, http.MethodGet, http.MethodHead)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	_, _ = resp.Write(openAPISpec)
+}
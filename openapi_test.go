@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type openAPIDoc struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// WHEN
+		resp, err := http.Get(url + "/admin/openapi.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		// THEN
+		var doc openAPIDoc
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || !strings.HasPrefix(doc.OpenAPI, "3.") {
+			t.Errorf("expected an OpenAPI 3 document, got %v %q", resp.StatusCode, doc.OpenAPI)
+		}
+	})
+}
+
+func TestOpenAPIMatchesHandlers(t *testing.T) {
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatal(err)
+	}
+	mux := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)}).admin.(*http.ServeMux)
+
+	// Every documented path is served by an admin handler, not proxied,
+	// and under the version prefix unless it has its own servers
+	for path, ops := range doc.Paths {
+		prefixes := []string{"", apiPrefix}
+		if _, ok := ops["servers"]; ok {
+			prefixes = prefixes[:1]
+		}
+		for method := range ops {
+			if method == "parameters" || method == "servers" {
+				continue
+			}
+			for _, prefix := range prefixes {
+				req := httptest.NewRequest(strings.ToUpper(method), prefix+strings.ReplaceAll(path, "{name}", "foo"), nil)
+				if _, pattern := mux.Handler(req); pattern == "" {
+					t.Errorf("%s %s%s isn't an admin endpoint", method, prefix, path)
+				}
+			}
+		}
+	}
+
+	// The upstream schema has every registration field
+	var fields []string
+	typ := reflect.TypeOf(upstream{})
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	var documented []string
+	for name := range doc.Components.Schemas["Upstream"].Properties {
+		documented = append(documented, name)
+	}
+	slices.Sort(fields)
+	slices.Sort(documented)
+	if !slices.Equal(fields, documented) {
+		t.Errorf("expected the Upstream schema to have %v, got %v", fields, documented)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// otlpProtobuf is the only OTLP/HTTP encoding the OpenTelemetry Go exporter
+// speaks
+const otlpProtobuf = "http/protobuf"
+
+// newOTLPMeterProvider pushes the metrics to an OpenTelemetry collector with
+// the OpenTelemetry SDK's OTLP/HTTP exporter, so they can share a pipeline
+// with traces. It's configured by the standard OTEL_* environment variables,
+// read by the SDK itself, and returns nil if no OTLP endpoint is set. The
+// provider exports every OTEL_METRIC_EXPORT_INTERVAL until shut down.
+func newOTLPMeterProvider(ctx context.Context, reg *registry, instanceID string) (*sdkmetric.MeterProvider, error) {
+	if os.Getenv("OTEL_METRICS_EXPORTER") == "none" {
+		return nil, nil
+	}
+	// Unlike the SDK, which defaults to a local collector, only export when
+	// asked to
+	if firstEnv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", "OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return nil, nil
+	}
+	if protocol := firstEnv("OTEL_EXPORTER_OTLP_METRICS_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != otlpProtobuf {
+		return nil, fmt.Errorf("unsupported OTLP protocol %s, only %s is supported", protocol, otlpProtobuf)
+	}
+	exporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP exporter configuration: %w", err)
+	}
+	defaults := []attribute.KeyValue{attribute.String("service.name", "regproxy")}
+	if instanceID != "" {
+		defaults = append(defaults, attribute.String("service.instance.id", instanceID))
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx, resource.WithAttributes(defaults...), resource.WithTelemetrySDK(), resource.WithFromEnv())
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %w", err)
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Printf("Failed to export metrics: %v", err)
+	}))
+	reader := sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithProducer(registryProducer{reg: reg, start: time.Now()}))
+	return sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res)), nil
+}
+
+// firstEnv returns the first of the environment variables which is set.
+func firstEnv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// registryProducer hands the registry's metrics to the SDK as they are on
+// each export: counters as cumulative sums since start, labels as
+// attributes.
+type registryProducer struct {
+	reg   *registry
+	start time.Time
+}
+
+func (p registryProducer) Produce(context.Context) ([]metricdata.ScopeMetrics, error) {
+	now := time.Now()
+	var metrics []metricdata.Metrics
+	byName := make(map[string]int)
+	p.reg.visit(func(name, help, kind string, labels, values []string, value float64) {
+		i, ok := byName[name]
+		if !ok {
+			m := metricdata.Metrics{Name: name, Description: help}
+			if kind == "counter" {
+				m.Data = metricdata.Sum[float64]{Temporality: metricdata.CumulativeTemporality, IsMonotonic: true}
+			} else {
+				m.Data = metricdata.Gauge[float64]{}
+			}
+			i = len(metrics)
+			byName[name] = i
+			metrics = append(metrics, m)
+		}
+		var attrs []attribute.KeyValue
+		for j, l := range labels {
+			if j < len(values) {
+				attrs = append(attrs, attribute.String(l, values[j]))
+			}
+		}
+		dp := metricdata.DataPoint[float64]{Attributes: attribute.NewSet(attrs...), Time: now, Value: value}
+		switch data := metrics[i].Data.(type) {
+		case metricdata.Sum[float64]:
+			dp.StartTime = p.start
+			data.DataPoints = append(data.DataPoints, dp)
+			metrics[i].Data = data
+		case metricdata.Gauge[float64]:
+			data.DataPoints = append(data.DataPoints, dp)
+			metrics[i].Data = data
+		}
+	})
+	return []metricdata.ScopeMetrics{{Scope: instrumentation.Scope{Name: "regproxy"}, Metrics: metrics}}, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPExport(t *testing.T) {
+	// GIVEN a collector
+	var got colmetricpb.ExportMetricsServiceRequest
+	var path, auth, encoding string
+	collector := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		path, auth, encoding = req.URL.Path, req.Header.Get("Authorization"), req.Header.Get("Content-Encoding")
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := io.ReadAll(gz)
+		if err := proto.Unmarshal(body, &got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL+"/")
+	t.Setenv("OTEL_EXPORTER_OTLP_COMPRESSION", "gzip")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer%20secret")
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "deployment.environment=test")
+	reg := newRegistry()
+	retries := reg.counter("regproxy_retries_total", "Retried calls", "upstream")
+	reg.gaugeFunc("regproxy_requests_in_flight", "", func() float64 { return 3 })
+	retries.add(2, "foo")
+	provider, err := newOTLPMeterProvider(context.Background(), reg, "proxy-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Shutdown(context.Background())
+
+	// WHEN
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN
+	if path != "/v1/metrics" || auth != "Bearer secret" || encoding != "gzip" {
+		t.Errorf("expected a gzipped POST to /v1/metrics with the headers, got %s %s with %q", path, encoding, auth)
+	}
+	if len(got.ResourceMetrics) != 1 || len(got.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("expected one resource and scope, got %v", &got)
+	}
+	resource := make(map[string]string)
+	for _, a := range got.ResourceMetrics[0].Resource.Attributes {
+		resource[a.Key] = a.Value.GetStringValue()
+	}
+	if resource["service.name"] != "regproxy" || resource["service.instance.id"] != "proxy-1" || resource["deployment.environment"] != "test" {
+		t.Errorf("unexpected resource %v", resource)
+	}
+	metrics := make(map[string]*metricpb.Metric)
+	for _, m := range got.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+	sum := metrics["regproxy_retries_total"].GetSum()
+	if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE || len(sum.DataPoints) != 1 {
+		t.Fatalf("expected a cumulative sum, got %v", metrics["regproxy_retries_total"])
+	}
+	if dp := sum.DataPoints[0]; dp.GetAsDouble() != 2 || len(dp.Attributes) != 1 || dp.Attributes[0].Key != "upstream" || dp.Attributes[0].Value.GetStringValue() != "foo" || dp.StartTimeUnixNano == 0 {
+		t.Errorf("unexpected data point %v", dp)
+	}
+	gauge := metrics["regproxy_requests_in_flight"].GetGauge()
+	if gauge == nil || len(gauge.DataPoints) != 1 || gauge.DataPoints[0].GetAsDouble() != 3 {
+		t.Errorf("expected a gauge of 3, got %v", metrics["regproxy_requests_in_flight"])
+	}
+}
+
+func TestOTLPMeterProviderConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		enabled bool
+		err     bool
+	}{
+		{"unset", nil, false, false},
+		{"disabled", map[string]string{"OTEL_METRICS_EXPORTER": "none", "OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, false, false},
+		{"endpoint", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318"}, true, false},
+		{"metrics endpoint", map[string]string{"OTEL_EXPORTER_OTLP_METRICS_ENDPOINT": "http://collector:4318/v1/metrics"}, true, false},
+		{"grpc", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317", "OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"}, false, true},
+		{"json", map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_EXPORTER_OTLP_METRICS_PROTOCOL": "http/json"}, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, k := range []string{"OTEL_METRICS_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", "OTEL_EXPORTER_OTLP_PROTOCOL", "OTEL_EXPORTER_OTLP_METRICS_PROTOCOL"} {
+				t.Setenv(k, tc.env[k])
+			}
+			provider, err := newOTLPMeterProvider(context.Background(), newRegistry(), "")
+			if (err != nil) != tc.err || (provider != nil) != tc.enabled {
+				t.Errorf("expected enabled: %v, error: %v, got %v, %v", tc.enabled, tc.err, provider, err)
+			}
+			if provider != nil {
+				_ = provider.Shutdown(context.Background())
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outbox persists requests accepted in queue mode until every upstream has
+// had them, so a crash or power loss never drops a request which was
+// answered 202. Each request is written to <id>.req, its metadata on the
+// first line followed by its body, and synced before it's acknowledged.
+// Delivery to each upstream is committed by appending the upstream's name to
+// <id>.done and syncing it, and both files are removed once every upstream
+// has had the request. A delivery made just before a crash, whose line
+// wasn't synced, is made again on recovery, as at-least-once delivery
+// allows.
+//
+// Requests are kept with their headers, credentials included, as they're
+// needed to deliver them again, so the directory is only readable by the
+// proxy's user.
+type outbox struct {
+	dir string
+	seq atomic.Int64
+	// opened is when this process started using the outbox, anything
+	// written since being its own
+	opened time.Time
+
+	mu sync.Mutex
+	// own are the requests this process added and is still delivering
+	own map[string]bool
+	// locked holds the directory locked once this process is the one
+	// recovering requests from it
+	locked *os.File
+}
+
+// outboxRecord is the first line of a request's file.
+type outboxRecord struct {
+	RequestID  string      `json:"requestId"`
+	Accepted   time.Time   `json:"accepted"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Host       string      `json:"host"`
+	Header     http.Header `json:"header"`
+	RemoteAddr string      `json:"remoteAddr"`
+	Upstreams  []string    `json:"upstreams"`
+}
+
+// newOutbox returns nil if queued requests are only held in memory.
+func newOutbox(dir string) (*outbox, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &outbox{dir: dir, opened: time.Now(), own: make(map[string]bool)}, nil
+}
+
+// lock takes an exclusive lock on the outbox, held until the process
+// exits, so that only one process recovers requests from it at a time. With
+// wait it waits for another process to release it, otherwise reporting
+// whether it was taken.
+func (o *outbox) lock(wait bool) (bool, error) {
+	d, err := os.Open(o.dir)
+	if err != nil {
+		return false, err
+	}
+	locked, err := lockFile(d, wait)
+	if !locked {
+		_ = d.Close()
+		return false, err
+	}
+	o.mu.Lock()
+	o.locked = d
+	o.mu.Unlock()
+	return true, nil
+}
+
+// add persists req, with body, for delivery to upstreams.
+func (o *outbox) add(req *http.Request, body *requestBody, upstreams []string, d *delivery) (*outboxEntry, error) {
+	// Named to sort in the order requests were accepted
+	id := fmt.Sprintf("%020d-%06d", d.started.UnixNano(), o.seq.Add(1)%1e6)
+	rec := outboxRecord{
+		RequestID:  d.requestID,
+		Accepted:   d.started,
+		Method:     req.Method,
+		URL:        req.URL.RequestURI(),
+		Host:       req.Host,
+		Header:     req.Header,
+		RemoteAddr: req.RemoteAddr,
+		Upstreams:  upstreams,
+	}
+	o.mu.Lock()
+	o.own[id] = true
+	o.mu.Unlock()
+	err := replaceFile(filepath.Join(o.dir, id+".req"), false, 0o600, func(w io.Writer) error {
+		if err := json.NewEncoder(w).Encode(rec); err != nil {
+			return err
+		}
+		r := body.reader()
+		defer r.Close()
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		o.mu.Lock()
+		delete(o.own, id)
+		o.mu.Unlock()
+		return nil, err
+	}
+	return o.entry(id, upstreams), nil
+}
+
+func (o *outbox) entry(id string, upstreams []string) *outboxEntry {
+	e := &outboxEntry{o: o, id: id, remaining: make(map[string]bool, len(upstreams))}
+	for _, name := range upstreams {
+		e.remaining[name] = true
+	}
+	return e
+}
+
+// outboxEntry is a persisted request, which some upstreams haven't had.
+type outboxEntry struct {
+	o  *outbox
+	id string
+
+	mu        sync.Mutex
+	remaining map[string]bool
+}
+
+// complete commits delivery of the request to ups, removing the request once
+// every upstream has had it. A nil entry isn't persisted.
+func (e *outboxEntry) complete(ups string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.remaining[ups] {
+		return
+	}
+	delete(e.remaining, ups)
+	if len(e.remaining) == 0 {
+		e.o.remove(e.id)
+		return
+	}
+	if err := e.o.markDone(e.id, ups); err != nil {
+		log.Printf("Failed to record delivery of request %s to upstream %s, it will be delivered again on recovery: %v", e.id, ups, err)
+	}
+}
+
+func (o *outbox) markDone(id, ups string) error {
+	line, _ := json.Marshal(ups)
+	f, err := os.OpenFile(filepath.Join(o.dir, id+".done"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// remove deletes a request every upstream has had. Removing its .req file
+// commits that, what's left of the .done file is cleaned up on recovery.
+func (o *outbox) remove(id string) {
+	o.mu.Lock()
+	delete(o.own, id)
+	o.mu.Unlock()
+	if err := os.Remove(filepath.Join(o.dir, id+".req")); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove delivered request %s from the outbox: %v", id, err)
+		return
+	}
+	if err := os.Remove(filepath.Join(o.dir, id+".done")); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove delivered request %s from the outbox: %v", id, err)
+	}
+	syncDir(o.dir)
+}
+
+// done reads the upstreams which have had a request. A line torn by a crash
+// is ignored, so that delivery is made again.
+func (o *outbox) done(id string) (map[string]bool, error) {
+	b, err := os.ReadFile(filepath.Join(o.dir, id+".done"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool)
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		var name string
+		if json.Unmarshal(line, &name) == nil {
+			done[name] = true
+		}
+	}
+	return done, nil
+}
+
+// pending lists the ids of the requests in the outbox in the order they
+// were accepted, other than those this process added itself, cleaning up
+// files left by a crash part way through writing or removing a request.
+func (o *outbox) pending() ([]string, error) {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var ids []string
+	reqs := make(map[string]bool)
+	for _, f := range files {
+		if id, ok := strings.CutSuffix(f.Name(), ".req"); ok {
+			reqs[id] = true
+			if !o.own[id] {
+				ids = append(ids, id)
+			}
+		}
+	}
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name(), ".done")
+		if strings.Contains(f.Name(), ".req.tmp-") {
+			// Unless it's one of ours, still being written
+			if fi, err := f.Info(); err != nil || fi.ModTime().After(o.opened) {
+				continue
+			}
+		} else if !ok || reqs[id] {
+			continue
+		}
+		_ = os.Remove(filepath.Join(o.dir, f.Name()))
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// recover queues the requests in the outbox again for the upstreams which
+// haven't had them, oldest first, so they are delivered before any new
+// requests. Upstreams which have been removed since are skipped.
+//
+// A process taking over with SIGHUP finds the outbox locked by the one it
+// replaces, which is still delivering the requests it has in hand, so it
+// waits for that to stop before recovering what's left rather than
+// delivering them twice at once. Requests accepted meanwhile are delivered
+// as usual, so those recovered then follow them.
+func (qs *requestQueues) recover() error {
+	if qs.outbox == nil {
+		return nil
+	}
+	locked, err := qs.outbox.lock(false)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		log.Printf("Waiting for the process handing over to stop before recovering requests from the outbox in %s", qs.outbox.dir)
+		go func() {
+			if _, err := qs.outbox.lock(true); err != nil {
+				log.Printf("Failed to lock the outbox in %s, not recovering requests from it: %v", qs.outbox.dir, err)
+				return
+			}
+			if err := qs.recoverPending(); err != nil {
+				log.Printf("Failed to recover requests from the outbox: %v", err)
+			}
+		}()
+		return nil
+	}
+	return qs.recoverPending()
+}
+
+// recoverPending queues the requests left in the outbox, holding its lock.
+func (qs *requestQueues) recoverPending() error {
+	ids, err := qs.outbox.pending()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := qs.recoverRequest(id); err != nil {
+			return fmt.Errorf("recovering request %s from the outbox: %w", id, err)
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("Recovered %d queued requests from the outbox in %s", len(ids), qs.outbox.dir)
+	}
+	return nil
+}
+
+func (qs *requestQueues) recoverRequest(id string) error {
+	rec, body, err := qs.readRequest(id)
+	if err != nil {
+		return err
+	}
+	done, err := qs.outbox.done(id)
+	if err != nil {
+		_ = body.Close()
+		return err
+	}
+	target, err := url.ParseRequestURI(rec.URL)
+	if err != nil {
+		_ = body.Close()
+		return err
+	}
+	d := &delivery{started: rec.Accepted, requestID: rec.RequestID}
+	req := (&http.Request{
+		Method:     rec.Method,
+		URL:        target,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     rec.Header,
+		Host:       rec.Host,
+		RemoteAddr: rec.RemoteAddr,
+		RequestURI: rec.URL,
+	}).WithContext(withDelivery(context.Background(), d))
+
+	var remaining []string
+	for _, name := range rec.Upstreams {
+		if !done[name] {
+			remaining = append(remaining, name)
+		}
+	}
+	entry := qs.outbox.entry(id, remaining)
+	for _, name := range remaining {
+		ups, registered, err := qs.p.lookupUpstream(name)
+		if err != nil {
+			// Left in the outbox, for the next time the proxy starts
+			log.Printf("Failed to look up upstream %s for recovered request %s: %v", name, id, err)
+			continue
+		}
+		if !registered {
+			log.Printf("Upstream %s was removed, dropping its recovered request %s", name, id)
+			entry.complete(name)
+			continue
+		}
+		d.pending.Add(1)
+		qs.enqueue(queuedRequest{req: req, body: body, ups: ups, entry: entry, due: dueAt(req, ups, rec.Accepted)}, 0)
+	}
+	if len(remaining) == 0 {
+		qs.outbox.remove(id)
+	}
+	go func() {
+		d.pending.Wait()
+		if err := body.Close(); err != nil {
+			log.Printf("Failed to clean up body of recovered request %s: %v", id, err)
+		}
+	}()
+	return nil
+}
+
+// readRequest reads a request's metadata and body from its file.
+func (qs *requestQueues) readRequest(id string) (outboxRecord, *requestBody, error) {
+	var rec outboxRecord
+	f, err := os.Open(filepath.Join(qs.outbox.dir, id+".req"))
+	if err != nil {
+		return rec, nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return rec, nil, err
+	}
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return rec, nil, err
+	}
+	body, err := readRequestBody(r, qs.p.cfg.SpoolThreshold, qs.p.cfg.SpoolDir)
+	return rec, body, err
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile can't lock files here, so an outbox isn't protected from a
+// process taking over with SIGHUP, which isn't supported either.
+func lockFile(f *os.File, wait bool) (bool, error) {
+	return true, nil
+}
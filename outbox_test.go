@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutboxRemovesDelivered(t *testing.T) {
+	// GIVEN queue mode with an outbox
+	cfg := testConfig()
+	cfg.Mode = modeQueue
+	cfg.QueueMinBackoff = 10 * time.Millisecond
+	cfg.QueueMaxBackoff = 20 * time.Millisecond
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	dir := t.TempDir()
+	rp.queues.outbox, _ = newOutbox(dir)
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		called := make(chan struct{}, 2)
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			called <- struct{}{}
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "a", Callback: srv.URL}, t)
+		register(url, upstream{Name: "b", Callback: srv.URL}, t)
+
+		// WHEN a request is accepted and delivered
+		resp, err := http.Post(url+"/records", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected 202, got %v", resp.StatusCode)
+		}
+		for range 2 {
+			select {
+			case <-called:
+			case <-time.After(2 * time.Second):
+				t.Fatal("expected the request to be delivered to both upstreams")
+			}
+		}
+
+		// THEN it's removed from the outbox
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			files, _ := os.ReadDir(dir)
+			if len(files) == 0 {
+				break
+			}
+			if time.Since(start) > 2*time.Second {
+				t.Fatalf("expected an empty outbox, got %v", files)
+			}
+		}
+	})
+}
+
+func TestOutboxRecovers(t *testing.T) {
+	// GIVEN a request left in the outbox, which only upstream a had for
+	// sure, b's line being torn by a crash
+	dir := t.TempDir()
+	o, _ := newOutbox(dir)
+	req := httptest.NewRequest("PUT", "/records/1?x=y", nil)
+	req.Header.Set("X-Patient", "42")
+	body, _ := readRequestBody(strings.NewReader(`{"id":1}`), 0, "")
+	entry, err := o.add(req, body, []string{"a", "b", "c"}, &delivery{started: time.Now(), requestID: "req-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = o.markDone(entry.id, "a")
+	f, _ := os.OpenFile(filepath.Join(dir, entry.id+".done"), os.O_WRONLY|os.O_APPEND, 0)
+	_, _ = f.WriteString(`"b`)
+	_ = f.Close()
+
+	var mu sync.Mutex
+	got := make(map[string]string)
+	delivered := make(chan struct{}, 3)
+	upstreams := make(map[string]upstream)
+	for _, name := range []string{"a", "b"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			got[name] = r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("X-Patient") + " " + string(b)
+			mu.Unlock()
+			delivered <- struct{}{}
+		}))
+		defer srv.Close()
+		upstreams[name] = upstream{Name: name, Callback: srv.URL}
+	}
+
+	// WHEN the proxy starts again, c having been removed meanwhile
+	cfg := testConfig()
+	cfg.QueueMinBackoff = 10 * time.Millisecond
+	cfg.QueueMaxBackoff = 20 * time.Millisecond
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: upstreams})
+	rp.queues.outbox, _ = newOutbox(dir)
+	if err := rp.queues.recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN the request is delivered again to b only
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the recovered request to be delivered")
+	}
+	select {
+	case <-delivered:
+		t.Fatal("expected only one delivery")
+	case <-time.After(100 * time.Millisecond):
+	}
+	mu.Lock()
+	if got["b"] != `PUT /records/1?x=y 42 {"id":1}` || got["a"] != "" {
+		t.Errorf("expected the request to be delivered to b as it was accepted, got %v", got)
+	}
+	mu.Unlock()
+
+	// AND the outbox is emptied
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		files, _ := os.ReadDir(dir)
+		if len(files) == 0 {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("expected an empty outbox, got %v", files)
+		}
+	}
+}
+
+func TestOutboxWaitsForProcessHandingOver(t *testing.T) {
+	// GIVEN an outbox locked by the process handing over, which still has a
+	// request in hand
+	dir := t.TempDir()
+	parent, _ := newOutbox(dir)
+	if locked, err := parent.lock(false); !locked || err != nil {
+		t.Fatalf("expected to lock the outbox, got %v %v", locked, err)
+	}
+	body, _ := readRequestBody(strings.NewReader(`{"id":1}`), 0, "")
+	if _, err := parent.add(httptest.NewRequest("POST", "/records", nil), body, []string{"a"}, &delivery{started: time.Now(), requestID: "req-1"}); err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan struct{}, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+	}))
+	defer srv.Close()
+
+	// WHEN the new process starts
+	cfg := testConfig()
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: map[string]upstream{"a": {Name: "a", Callback: srv.URL}}})
+	rp.queues.outbox, _ = newOutbox(dir)
+	if err := rp.queues.recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN it leaves the request to the old process
+	select {
+	case <-delivered:
+		t.Fatal("expected no delivery while the old process holds the outbox")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// WHEN the old process stops
+	_ = parent.locked.Close()
+
+	// THEN what it left is recovered
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the request to be recovered once the old process stopped")
+	}
+}
+
+func TestOutboxFilesArePrivate(t *testing.T) {
+	// GIVEN
+	dir := filepath.Join(t.TempDir(), "outbox")
+	o, err := newOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN a request with credentials is added
+	req := httptest.NewRequest("POST", "/records", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	body, _ := readRequestBody(strings.NewReader("{}"), 0, "")
+	entry, err := o.add(req, body, []string{"a"}, &delivery{started: time.Now(), requestID: "req-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN only the proxy's user can read it
+	if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0o700 {
+		t.Errorf("expected the directory to be 0700, got %v %v", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, entry.id+".req")); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected the request to be 0600, got %v %v", fi.Mode(), err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// errUpstreamPanic is the error of an upstream call which panicked, which
+// fails that call alone rather than the whole process.
+var errUpstreamPanic = errors.New("upstream call panicked")
+
+// Where panics are recovered, as the label of regproxy_panics_total
+const (
+	panicHandler    = "handler"
+	panicUpstream   = "upstream"
+	panicBackground = "background"
+)
+
+// upstreamPanic turns a value recovered from a panic calling ups into an
+// error, logging it with the stack.
+func (p *RegProxy) upstreamPanic(ups upstream, v any) error {
+	p.metrics.panics.inc(panicUpstream)
+	log.Printf("Panic calling upstream %s: %v\n%s", ups.Name, v, debug.Stack())
+	return fmt.Errorf("%w: %v", errUpstreamPanic, v)
+}
+
+// recoverPanics answers requests whose handler panics with a 500, rather
+// than having the server drop the connection. Requests deliberately aborted
+// with http.ErrAbortHandler still are.
+func recoverPanics(h http.Handler, panics *counterVec) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			panics.inc(panicHandler)
+			log.Printf("Panic handling %s %s: %v\n%s", req.Method, req.URL.Path, v, debug.Stack())
+			writeProblem(resp, newProblem(http.StatusInternalServerError, "Internal error"))
+		}()
+		h.ServeHTTP(resp, req)
+	})
+}
+
+// logPanic recovers from a panic in a background goroutine, so what went
+// wrong is logged without taking the process down. It must be deferred.
+func logPanic(panics *counterVec, what string) {
+	if v := recover(); v != nil {
+		panics.inc(panicBackground)
+		log.Printf("Panic in %s: %v\n%s", what, v, debug.Stack())
+	}
+}
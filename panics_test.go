@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// panicSink panics delivering anything.
+type panicSink struct{}
+
+func (panicSink) Deliver(*http.Request, *requestBody, upstream, *url.URL) (*http.Response, error) {
+	panic("transformer bug")
+}
+
+func TestUpstreamPanicFailsThatUpstreamOnly(t *testing.T) {
+	// GIVEN an upstream whose calls panic, alongside a healthy one
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	rp.sinks["boom"] = panicSink{}
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "healthy", Callback: srv.URL}, t)
+		register(url, upstream{Name: "broken", Callback: "boom://broken"}, t)
+
+		// WHEN a request is fanned out
+		resp, err := http.Post(url+"/orders", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		// THEN the broken upstream fails with a 500, and the healthy one is still called
+		var pr problem
+		if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 500 || len(pr.Upstreams) != 1 || pr.Upstreams[0].Name != "broken" || !strings.Contains(pr.Upstreams[0].Error, "panicked") {
+			t.Errorf("expected a 500 for the broken upstream, got %v %+v", resp.StatusCode, pr)
+		}
+		if calls.Load() != 1 {
+			t.Errorf("expected the healthy upstream to be called, got %d calls", calls.Load())
+		}
+		if n := rp.metrics.panics.value(panicUpstream); n != 1 {
+			t.Errorf("expected the panic to be counted, got %v", n)
+		}
+	})
+}
+
+func TestHandlerPanicAnswers500(t *testing.T) {
+	// GIVEN a handler which panics
+	panics := newRegistry().counter("panics", "", "where")
+	h := recoverPanics(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("bug")
+	}), panics)
+
+	// WHEN
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	// THEN
+	if rec.Code != 500 || rec.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("expected a 500 problem, got %v %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Ways of composing the path sent to an upstream from its callback's path
+// and the request's
+const (
+	// pathRequest sends the request's path, ignoring the callback's
+	pathRequest = "request"
+	// pathReplace sends the callback's path, ignoring the request's
+	pathReplace = "replace"
+	// pathPrefix prefixes the request's path with the callback's
+	pathPrefix = "prefix"
+	// pathStrip removes stripPrefix from the request's path, then prefixes
+	// what's left with the callback's
+	pathStrip = "strip"
+)
+
+var pathModes = []string{pathRequest, pathReplace, pathPrefix, pathStrip}
+
+func validatePathMode(u upstream) error {
+	switch u.PathMode {
+	case "", pathRequest, pathReplace, pathPrefix, pathStrip:
+	default:
+		return fmt.Errorf("unknown pathMode [%s], expected one of %s", u.PathMode, strings.Join(pathModes, ", "))
+	}
+	if u.StripPrefix != "" && u.PathMode != pathStrip {
+		return fmt.Errorf("stripPrefix is only used with pathMode %s", pathStrip)
+	}
+	return nil
+}
+
+// targetURL points target, a copy of the request's URL, at an upstream with
+// the given callback, rewriting its path and query as the upstream says.
+func targetURL(target *url.URL, callback *url.URL, ups upstream, pathMode string) {
+	target.Host = callback.Host
+	target.Scheme = callback.Scheme
+	rewritePath(target, ups.Rewrite)
+	if isCallbackTemplate(ups.Callback) {
+		// A template says where the request's path goes, if anywhere
+		target.Path, target.RawPath = callback.Path, callback.RawPath
+		if callback.RawQuery != "" {
+			target.RawQuery = callback.RawQuery
+		}
+	} else {
+		composePath(target, callback, ups, pathMode)
+	}
+	ups.Query.apply(target)
+}
+
+// composePath sets the path of target, a copy of the request's URL, for an
+// upstream with the given callback, using the upstream's path mode or
+// otherwise def.
+func composePath(target *url.URL, callback *url.URL, ups upstream, def string) {
+	mode := ups.PathMode
+	if mode == "" {
+		mode = def
+	}
+	base := strings.TrimSuffix(callback.EscapedPath(), "/")
+	var path string
+	switch mode {
+	case pathReplace:
+		path = callback.EscapedPath()
+	case pathPrefix:
+		path = base + target.EscapedPath()
+	case pathStrip:
+		rest := strings.TrimPrefix(target.EscapedPath(), ups.StripPrefix)
+		if !strings.HasPrefix(rest, "/") {
+			rest = "/" + rest
+		}
+		path = base + rest
+	default:
+		return
+	}
+	if path == "" {
+		path = "/"
+	}
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		// Both halves were valid escaped paths, so this can't happen
+		return
+	}
+	target.Path, target.RawPath = unescaped, path
+}
+
+// rewriteRule rewrites the path of requests to an upstream, for when it
+// lays out its URLs differently to the others. A rule either replaces a
+// prefix, or matches the whole path against a regular expression and
+// expands the replacement, where $1 and so on are the regexp's groups.
+type rewriteRule struct {
+	Prefix  string `json:"prefix,omitempty"`
+	Regexp  string `json:"regexp,omitempty"`
+	Replace string `json:"replace"`
+}
+
+// rewriteRegexps caches compiled rule regexps, which are checked when the
+// rules are registered.
+var rewriteRegexps sync.Map
+
+func (r rewriteRule) regexp() (*regexp.Regexp, error) {
+	if re, ok := rewriteRegexps.Load(r.Regexp); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(`^(?:` + r.Regexp + `)$`)
+	if err != nil {
+		return nil, err
+	}
+	rewriteRegexps.Store(r.Regexp, re)
+	return re, nil
+}
+
+func validateRewrites(rules []rewriteRule) error {
+	for i, r := range rules {
+		if (r.Prefix == "") == (r.Regexp == "") {
+			return fmt.Errorf("rewrite rule %d needs one of prefix or regexp", i+1)
+		}
+		if r.Regexp != "" {
+			if _, err := r.regexp(); err != nil {
+				return fmt.Errorf("rewrite rule %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rewritePath applies the first of rules which matches target's path.
+func rewritePath(target *url.URL, rules []rewriteRule) {
+	path := target.EscapedPath()
+	for _, r := range rules {
+		var rewritten string
+		if r.Prefix != "" {
+			if !strings.HasPrefix(path, r.Prefix) {
+				continue
+			}
+			rewritten = r.Replace + strings.TrimPrefix(path, r.Prefix)
+		} else {
+			re, err := r.regexp()
+			if err != nil {
+				continue
+			}
+			m := re.FindStringSubmatchIndex(path)
+			if m == nil {
+				continue
+			}
+			rewritten = string(re.ExpandString(nil, r.Replace, path, m))
+		}
+		if !strings.HasPrefix(rewritten, "/") {
+			rewritten = "/" + rewritten
+		}
+		if unescaped, err := url.PathUnescape(rewritten); err == nil {
+			target.Path, target.RawPath = unescaped, rewritten
+		}
+		return
+	}
+}
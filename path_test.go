@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestComposePath(t *testing.T) {
+	for _, tc := range []struct {
+		callback, request string
+		ups               upstream
+		want              string
+	}{
+		{"http://h/api/v2/hook", "/orders", upstream{}, "/orders"},
+		{"http://h/api/v2/hook", "/orders", upstream{PathMode: pathReplace}, "/api/v2/hook"},
+		{"http://h", "/orders", upstream{PathMode: pathReplace}, "/"},
+		{"http://h/api/", "/orders/1", upstream{PathMode: pathPrefix}, "/api/orders/1"},
+		{"http://h", "/orders/1", upstream{PathMode: pathPrefix}, "/orders/1"},
+		{"http://h/v2", "/legacy/orders", upstream{PathMode: pathStrip, StripPrefix: "/legacy"}, "/v2/orders"},
+		{"http://h/v2", "/other/orders", upstream{PathMode: pathStrip, StripPrefix: "/legacy"}, "/v2/other/orders"},
+		{"http://h/a%2Fb", "/c%2Fd", upstream{PathMode: pathPrefix}, "/a%2Fb/c%2Fd"},
+	} {
+		callback, _ := url.Parse(tc.callback)
+		target, _ := url.Parse(tc.request)
+		composePath(target, callback, tc.ups, pathRequest)
+		if got := target.EscapedPath(); got != tc.want {
+			t.Errorf("%s + %s (%s): expected %s, got %s", tc.callback, tc.request, tc.ups.PathMode, tc.want, got)
+		}
+	}
+}
+
+func TestCallbackPathPrefix(t *testing.T) {
+	cfg := testConfig()
+	cfg.PathMode = pathPrefix
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN
+		var gotPath string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotPath = r.URL.Path
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "a", Callback: srv.URL + "/api/v2"}, t)
+
+		// WHEN
+		status := getStatus(url, t)
+
+		// THEN
+		if status != 200 || gotPath != "/api/v2/" {
+			t.Errorf("unexpected %v to path %s", status, gotPath)
+		}
+	})
+}
+
+func TestPathModeValidation(t *testing.T) {
+	if err := validateUpstream(upstream{Name: "a", Callback: "http://h", PathMode: "sideways"}); err == nil {
+		t.Error("expected an unknown path mode to be rejected")
+	}
+	if err := validateUpstream(upstream{Name: "a", Callback: "http://h", StripPrefix: "/x"}); err == nil {
+		t.Error("expected stripPrefix without strip mode to be rejected")
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	rules := []rewriteRule{
+		{Prefix: "/legacy/", Replace: "/v2/"},
+		{Regexp: `/old/(\w+)/(.*)`, Replace: "/new/$2/$1"},
+		{Regexp: `/items`, Replace: "catalogue"},
+	}
+	for request, want := range map[string]string{
+		"/legacy/orders":  "/v2/orders",
+		"/old/orders/1/x": "/new/1/x/orders",
+		"/items":          "/catalogue",
+		"/items/1":        "/items/1",
+		"/somewhere/else": "/somewhere/else",
+		"/legacy/old/a/b": "/v2/old/a/b",
+	} {
+		target, _ := url.Parse(request)
+		rewritePath(target, rules)
+		if got := target.EscapedPath(); got != want {
+			t.Errorf("%s: expected %s, got %s", request, want, got)
+		}
+	}
+}
+
+func TestRewriteValidation(t *testing.T) {
+	for _, rules := range [][]rewriteRule{
+		{{Replace: "/x"}},
+		{{Prefix: "/a", Regexp: "/b", Replace: "/x"}},
+		{{Regexp: "/(unclosed", Replace: "/x"}},
+	} {
+		if err := validateUpstream(upstream{Name: "a", Callback: "http://h", Rewrite: rules}); err == nil {
+			t.Errorf("expected %v to be rejected", rules)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Buffers are pooled across requests to keep allocation churn, and so GC
+// pressure, down under sustained load.
+//
+// Note the outbound *http.Request clones aren't pooled: the transport may
+// still be writing a request's body after the response has arrived, so we
+// can never be sure when it is safe to reuse one.
+
+// maxPooledBuffer stops the odd huge body from pinning memory in the pool
+const maxPooledBuffer = 4 << 20
+
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(b)
+}
+
+// copyBufPool holds scratch space for streaming response bodies to clients
+var copyBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 32<<10)
+		return &b
+	},
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeHeader marks synthetic probe requests, so upstreams can recognise
+// and discard them.
+const probeHeader = "X-Regproxy-Probe"
+
+// Probe results, as reported by regproxy_probe_results_total
+const (
+	probeSuccess = "success"
+	probeFailure = "failure"
+)
+
+// probeHistory holds the latest synthetic probe report.
+type probeHistory struct {
+	mu   sync.Mutex
+	last *deliveryReport
+}
+
+// runProbes sends a canary request through the proxy every ProbeInterval
+// until ctx is done, verifying the whole path to every upstream even when
+// there is no real traffic. Only the leader probes, so upstreams see one
+// probe per interval however many replicas there are.
+func (p *RegProxy) runProbes(ctx context.Context) {
+	p.leader.every(ctx, p.cfg.ProbeInterval, "synthetic probe", func(ctx context.Context) error {
+		p.probe(ctx)
+		return nil
+	})
+}
+
+// probe sends one canary request through the proxy handler, exactly as a
+// client request would go, and records each upstream's outcome.
+func (p *RegProxy) probe(ctx context.Context) *deliveryReport {
+	d := &delivery{started: time.Now(), requestID: "probe-" + newRequestID()}
+	ctx = context.WithValue(withDelivery(ctx, d), probeKey, true)
+	req, err := http.NewRequestWithContext(ctx, p.cfg.ProbeMethod, p.cfg.ProbePath, strings.NewReader(p.cfg.ProbeBody))
+	if err != nil {
+		log.Printf("Invalid probe request: %v", err)
+		return nil
+	}
+	req.Header.Set(probeHeader, "1")
+	req.Header.Set(requestIDHeader, d.requestID)
+	w := &probeWriter{header: make(http.Header)}
+	p.handler.ServeHTTP(w, req)
+	d.pending.Wait()
+
+	report := &deliveryReport{
+		RequestID:  d.requestID,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Status:     w.status,
+		Started:    d.started,
+		DurationMs: time.Since(d.started).Milliseconds(),
+		Upstreams:  d.snapshot(),
+	}
+	for _, o := range report.Upstreams {
+		if o.Error == "" && p.cfg.SuccessStatuses.contains(o.Status) {
+			p.metrics.probeResults.inc(o.Name, probeSuccess)
+		} else {
+			p.metrics.probeResults.inc(o.Name, probeFailure)
+			log.Printf("Probe %s to upstream %s failed: status %d error [%s]", d.requestID, o.Name, o.Status, o.Error)
+		}
+	}
+	p.probes.mu.Lock()
+	p.probes.last = report
+	p.probes.mu.Unlock()
+	return report
+}
+
+// probeReport serves GET /admin/probe, the latest probe's outcomes.
+func (p *RegProxy) probeReport(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(resp, http.MethodGet)
+		return
+	}
+	p.probes.mu.Lock()
+	last := p.probes.last
+	p.probes.mu.Unlock()
+	if last == nil {
+		writeProblem(resp, newProblem(http.StatusNotFound, "No probe has run yet"))
+		return
+	}
+	writeJSON(resp, http.StatusOK, last)
+}
+
+// probeWriter discards a probe's response, keeping only the status.
+type probeWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *probeWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *probeWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *probeWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	cfg := testConfig()
+	cfg.ProbeMethod = http.MethodPost
+	cfg.ProbePath = "/canary"
+	cfg.ProbeBody = "ping"
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN one healthy and one failing upstream
+		var probed *http.Request
+		ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			probed = r
+		}))
+		defer ok.Close()
+		broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer broken.Close()
+		register(url, upstream{Name: "ok", Callback: ok.URL}, t)
+		register(url, upstream{Name: "broken", Callback: broken.URL}, t)
+
+		// WHEN
+		report := rp.probe(context.Background())
+
+		// THEN each upstream's outcome is recorded
+		if report == nil || len(report.Upstreams) != 2 || report.Status != http.StatusInternalServerError {
+			t.Fatalf("unexpected report %+v", report)
+		}
+		if probed == nil || probed.URL.Path != "/canary" || probed.Header.Get(probeHeader) != "1" {
+			t.Errorf("unexpected probe request %v", probed)
+		}
+		if rp.metrics.probeResults.value("ok", probeSuccess) != 1 || rp.metrics.probeResults.value("broken", probeFailure) != 1 {
+			t.Error("expected probe results counted")
+		}
+
+		// and the latest report is served
+		r, err := http.Get(url + "/admin/probe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		var served deliveryReport
+		if err := json.NewDecoder(r.Body).Decode(&served); err != nil {
+			t.Fatal(err)
+		}
+		if served.RequestID != report.RequestID {
+			t.Errorf("expected the latest report, got %v", served)
+		}
+	})
+}
+
+func TestProbeOnlyByLeader(t *testing.T) {
+	cfg := testConfig()
+	cfg.ProbeInterval = 5 * time.Millisecond
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN an upstream, and an instance which isn't the leader
+		var probes atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			probes.Add(1)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "ok", Callback: srv.URL}, t)
+		rp.leader.held.Store(false)
+
+		// WHEN probes have had time to run
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		rp.runProbes(ctx)
+
+		// THEN none were sent
+		if n := probes.Load(); n != 0 {
+			t.Errorf("expected no probes from a follower, got %d", n)
+		}
+	})
+}
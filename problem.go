@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// requestIDHeader carries the ID used to correlate a proxied request across
+// our logs, the upstreams and any error returned to the caller.
+const requestIDHeader = "X-Request-Id"
+
+// problem is an RFC 7807 problem details body.
+type problem struct {
+	Type      string    `json:"type"`
+	Title     string    `json:"title"`
+	Status    int       `json:"status"`
+	Detail    string    `json:"detail,omitempty"`
+	Instance  string    `json:"instance,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	Upstreams []outcome `json:"upstreams,omitempty"`
+}
+
+func newProblem(status int, detail string) problem {
+	return problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+func writeProblem(resp http.ResponseWriter, p problem) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		// Can't happen for the types in a problem, but don't lose the error
+		resp.WriteHeader(p.Status)
+		_, _ = resp.Write([]byte(p.Detail))
+		return
+	}
+	resp.Header().Set("Content-Type", "application/problem+json")
+	resp.WriteHeader(p.Status)
+	_, _ = resp.Write(b)
+}
+
+// upstreamErrResp reports a failed proxied request, including which
+// upstreams failed and how, so callers can act on it programmatically.
+func (p *RegProxy) upstreamErrResp(resp http.ResponseWriter, req *http.Request, e error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(e, errLoopDetected):
+		status = http.StatusLoopDetected
+	case errors.Is(e, errResponseTooLarge):
+		status = http.StatusBadGateway
+	}
+	pr := newProblem(status, publicError(e))
+	pr.Instance = req.URL.Path
+	if d := deliveryFrom(req.Context()); d != nil {
+		pr.RequestID = d.requestID
+		for _, o := range d.snapshot() {
+			if o.Error != "" || !p.cfg.SuccessStatuses.contains(o.Status) {
+				pr.Upstreams = append(pr.Upstreams, o.public())
+			}
+		}
+	}
+	writeProblem(resp, pr)
+}
+
+// publicError describes a failed upstream call to clients, without the
+// URL, host or address called, which are the upstream's callback and can
+// carry internal hosts and credentials.
+func publicError(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "lookup failed: " + dnsErr.Err
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op + ": " + opErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// requestID returns the caller's request ID, or makes one up.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	return newRequestID()
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProblemResponse(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN one working and one unreachable upstream
+		ok := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			if req.Header.Get(requestIDHeader) != "req-123" {
+				t.Errorf("expected the request ID to be forwarded, got %q", req.Header.Get(requestIDHeader))
+			}
+		}))
+		defer ok.Close()
+		register(url, upstream{Name: "ok", Callback: ok.URL}, t)
+		register(url, upstream{Name: "broken", Callback: "http://seriously.not.a.top.level.domain"}, t)
+
+		// WHEN
+		req, _ := http.NewRequest("GET", url+"/hook", nil)
+		req.Header.Set(requestIDHeader, "req-123")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the error says which upstream failed
+		if r.StatusCode != 500 {
+			t.Errorf("expected 500, got %v", r.StatusCode)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("expected problem+json, got %s", ct)
+		}
+		b, _ := io.ReadAll(r.Body)
+		var pr problem
+		if err := json.Unmarshal(b, &pr); err != nil {
+			t.Fatal(err)
+		}
+		if pr.Status != 500 || pr.RequestID != "req-123" || pr.Instance != "/hook" {
+			t.Errorf("unexpected problem %+v", pr)
+		}
+		if len(pr.Upstreams) != 1 || pr.Upstreams[0].Name != "broken" || pr.Upstreams[0].Error == "" {
+			t.Errorf("expected only the broken upstream to be reported, got %+v", pr.Upstreams)
+		}
+		// AND it doesn't give away where the upstream is
+		if strings.Contains(string(b), "seriously.not") {
+			t.Errorf("expected no callback URLs, got %s", b)
+		}
+	})
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		defer withStatusUpstreams(url, t, 200)()
+		r, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Header.Get(requestIDHeader)) != 32 {
+			t.Errorf("expected a generated request ID, got %q", r.Header.Get(requestIDHeader))
+		}
+	})
+}
+
+func TestPublicError(t *testing.T) {
+	refused := &url.Error{Op: "Post", URL: "http://orders.internal/hook?key=secret", Err: &net.OpError{
+		Op: "dial", Net: "tcp", Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}, Err: errors.New("connect: connection refused"),
+	}}
+	for _, c := range []struct {
+		err      error
+		expected string
+	}{
+		{refused, "dial: connect: connection refused"},
+		{&url.Error{Op: "Post", URL: "http://orders.internal/hook?key=secret", Err: context.DeadlineExceeded}, "context deadline exceeded"},
+		{errResponseTooLarge, errResponseTooLarge.Error()},
+	} {
+		if got := publicError(c.err); got != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.err, c.expected, got)
+		}
+	}
+}
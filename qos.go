@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// shedClass is the reason a request is shed when its QoS class is full
+const shedClass = "class_full"
+
+// qosClassConfig is a class of requests and its weight, its share of
+// -max-in-flight-requests.
+type qosClassConfig struct {
+	name   string
+	weight int
+}
+
+// qosRule puts requests with a header, or a path prefix, in a class.
+type qosRule struct {
+	class  string
+	header string
+	value  string
+	prefix string
+}
+
+// parseQoSClasses parses name=weight pairs, e.g. critical=70,bulk=30.
+func parseQoSClasses(s string) ([]qosClassConfig, error) {
+	var classes []qosClassConfig
+	for _, pair := range strings.Split(s, ",") {
+		name, w, ok := strings.Cut(pair, "=")
+		weight, err := strconv.Atoi(w)
+		if !ok || name == "" || err != nil || weight <= 0 {
+			return nil, fmt.Errorf("expected class=weight, with a positive weight, got [%s]", pair)
+		}
+		if slices.ContainsFunc(classes, func(c qosClassConfig) bool { return c.name == name }) {
+			return nil, fmt.Errorf("class [%s] is listed more than once", name)
+		}
+		classes = append(classes, qosClassConfig{name: name, weight: weight})
+	}
+	return classes, nil
+}
+
+// parseQoSRule parses class=header:<name>[:<value>] or class=path:<prefix>.
+func parseQoSRule(s string) (qosRule, error) {
+	class, matcher, _ := strings.Cut(s, "=")
+	kind, arg, _ := strings.Cut(matcher, ":")
+	r := qosRule{class: class}
+	switch kind {
+	case "header":
+		r.header, r.value, _ = strings.Cut(arg, ":")
+	case "path":
+		r.prefix = arg
+	}
+	if class == "" || r.header == "" && r.prefix == "" {
+		return r, fmt.Errorf("expected class=header:<name>[:<value>] or class=path:<prefix>, got [%s]", s)
+	}
+	return r, nil
+}
+
+func (r qosRule) matches(req *http.Request) bool {
+	if r.prefix != "" {
+		return strings.HasPrefix(req.URL.Path, r.prefix)
+	}
+	v := req.Header.Get(r.header)
+	if r.value == "" {
+		return v != ""
+	}
+	return strings.EqualFold(v, r.value)
+}
+
+// qosClass holds its share of the requests in flight.
+type qosClass struct {
+	name     string
+	sem      *semaphore.Weighted
+	inFlight atomic.Int64
+}
+
+// qos splits -max-in-flight-requests between classes of requests by weight,
+// so that a spike in one class, say bulk exports, can't starve another of
+// room, say clinical webhooks. A request waits up to wait for room in its
+// class, first come first served, and is shed if there still isn't any.
+// A nil qos puts every request in the same class.
+type qos struct {
+	classes  []*qosClass
+	rules    []qosRule
+	def      *qosClass
+	wait     time.Duration
+	requests *counterVec
+}
+
+func newQoS(cfg Config, requests *counterVec) *qos {
+	if len(cfg.QoSClasses) == 0 || cfg.MaxInFlightRequests <= 0 {
+		return nil
+	}
+	total := 0
+	for _, c := range cfg.QoSClasses {
+		total += c.weight
+	}
+	q := &qos{rules: cfg.QoSRules, wait: cfg.QoSQueueTimeout, requests: requests}
+	for _, c := range cfg.QoSClasses {
+		slots := max(1, cfg.MaxInFlightRequests*int64(c.weight)/int64(total))
+		class := &qosClass{name: c.name, sem: semaphore.NewWeighted(slots)}
+		q.classes = append(q.classes, class)
+		if c.name == cfg.QoSDefaultClass {
+			q.def = class
+		}
+	}
+	if q.def == nil {
+		q.def = q.classes[0]
+	}
+	return q
+}
+
+// classify returns the class of the first rule req matches, or the default.
+func (q *qos) classify(req *http.Request) *qosClass {
+	for _, r := range q.rules {
+		if r.matches(req) {
+			for _, c := range q.classes {
+				if c.name == r.class {
+					return c
+				}
+			}
+		}
+	}
+	return q.def
+}
+
+// acquire takes room for req in its class, reporting the class and whether
+// there was room. An admitted request must be released.
+func (q *qos) acquire(req *http.Request) (*qosClass, bool) {
+	if q == nil {
+		return nil, true
+	}
+	c := q.classify(req)
+	if !c.sem.TryAcquire(1) {
+		if q.wait <= 0 {
+			q.requests.inc(c.name, "shed")
+			return c, false
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), q.wait)
+		defer cancel()
+		if c.sem.Acquire(ctx, 1) != nil {
+			q.requests.inc(c.name, "shed")
+			return c, false
+		}
+		q.requests.inc(c.name, "queued")
+	} else {
+		q.requests.inc(c.name, "admitted")
+	}
+	c.inFlight.Add(1)
+	return c, true
+}
+
+func (q *qos) release(c *qosClass) {
+	if q == nil {
+		return
+	}
+	c.inFlight.Add(-1)
+	c.sem.Release(1)
+}
+
+// inFlightGauge reports the requests in flight in each class.
+func (q *qos) inFlightGauge() map[string]float64 {
+	values := make(map[string]float64)
+	if q == nil {
+		return values
+	}
+	for _, c := range q.classes {
+		values[labelKey([]string{c.name})] = float64(c.inFlight.Load())
+	}
+	return values
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQoSRule(t *testing.T) {
+	for _, c := range []struct {
+		rule     string
+		expected qosRule
+	}{
+		{"bulk=path:/export/", qosRule{class: "bulk", prefix: "/export/"}},
+		{"critical=header:X-Priority:high", qosRule{class: "critical", header: "X-Priority", value: "high"}},
+		{"critical=header:X-Clinical", qosRule{class: "critical", header: "X-Clinical"}},
+	} {
+		if got, err := parseQoSRule(c.rule); err != nil || got != c.expected {
+			t.Errorf("%s: expected %+v, got %+v, %v", c.rule, c.expected, got, err)
+		}
+	}
+	for _, rule := range []string{"bulk", "bulk=query:x", "=path:/export/", "bulk=path:"} {
+		if _, err := parseQoSRule(rule); err == nil {
+			t.Errorf("expected %s to be rejected", rule)
+		}
+	}
+}
+
+func TestQoSClassesDontStarve(t *testing.T) {
+	// GIVEN room for one request in each of two classes, bulk by path
+	cfg := testConfig()
+	cfg.MaxInFlightRequests = 2
+	cfg.QoSClasses = []qosClassConfig{{"critical", 1}, {"bulk", 1}}
+	cfg.QoSRules = []qosRule{{class: "bulk", prefix: "/export/"}}
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		release := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			if strings.HasPrefix(req.URL.Path, "/export/") {
+				<-release
+			}
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "records", Callback: srv.URL}, t)
+		post := func(path string) int {
+			resp, err := http.Post(url+path, "application/json", strings.NewReader("{}"))
+			if err != nil {
+				t.Error(err)
+				return 0
+			}
+			_ = resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		// WHEN a bulk export fills its class
+		done := make(chan int)
+		go func() { done <- post("/export/1") }()
+		time.Sleep(100 * time.Millisecond)
+
+		// THEN more bulk traffic is shed, while clinical requests still get through
+		if status := post("/export/2"); status != http.StatusServiceUnavailable {
+			t.Errorf("expected the second export to be shed, got %v", status)
+		}
+		if status := post("/webhooks/lab-result"); status != http.StatusOK {
+			t.Errorf("expected the webhook to be handled, got %v", status)
+		}
+		close(release)
+		if status := <-done; status != http.StatusOK {
+			t.Errorf("expected the first export to be handled, got %v", status)
+		}
+	})
+}
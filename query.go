@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+)
+
+// queryRules change the query string of requests to an upstream, e.g. to
+// add an API key one legacy upstream wants as a parameter. Parameters are
+// renamed, then removed, then set.
+type queryRules struct {
+	Rename map[string]string `json:"rename,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+}
+
+func validateQueryRules(q *queryRules) error {
+	if q == nil {
+		return nil
+	}
+	for from, to := range q.Rename {
+		if from == "" || to == "" {
+			return errors.New("query parameters can't be renamed from or to an empty name")
+		}
+	}
+	for _, name := range q.Remove {
+		if name == "" {
+			return errors.New("an empty query parameter can't be removed")
+		}
+	}
+	for name := range q.Set {
+		if name == "" {
+			return errors.New("an empty query parameter can't be set")
+		}
+	}
+	return nil
+}
+
+// apply changes target's query string, leaving it untouched if there are
+// no rules so its encoding is kept.
+func (q *queryRules) apply(target *url.URL) {
+	if q == nil {
+		return
+	}
+	values := target.Query()
+	for from, to := range q.Rename {
+		if vv, ok := values[from]; ok {
+			delete(values, from)
+			values[to] = append(values[to], vv...)
+		}
+	}
+	for _, name := range q.Remove {
+		values.Del(name)
+	}
+	for name, v := range q.Set {
+		values.Set(name, v)
+	}
+	target.RawQuery = values.Encode()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryRules(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN
+		var gotQuery string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = r.URL.RawQuery
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "legacy", Callback: srv.URL, Query: &queryRules{
+			Rename: map[string]string{"customer": "client_id"},
+			Remove: []string{"debug"},
+			Set:    map[string]string{"api_key": "secret"},
+		}}, t)
+
+		// WHEN
+		resp, err := http.Get(url + "/orders?customer=7&debug=1&page=2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN
+		if gotQuery != "api_key=secret&client_id=7&page=2" {
+			t.Errorf("unexpected query %s", gotQuery)
+		}
+	})
+}
+
+func TestQueryRulesValidation(t *testing.T) {
+	if err := validateUpstream(upstream{Name: "a", Callback: "http://h", Query: &queryRules{Set: map[string]string{"": "x"}}}); err == nil {
+		t.Error("expected an empty parameter name to be rejected")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The dead letter callback is called as this upstream, with headers saying
+// which upstream gave up on the request and its last answer, a status or
+// "error".
+const (
+	deadLetterName           = "dead-letter"
+	deadLetterUpstreamHeader = "X-Regproxy-Dead-Letter-Upstream"
+	deadLetterOutcomeHeader  = "X-Regproxy-Dead-Letter-Outcome"
+)
+
+// queuedRequest is a request waiting to be delivered to one upstream. It
+// holds a place in the request's delivery, which keeps its body alive.
+type queuedRequest struct {
+	req  *http.Request
+	body *requestBody
+	ups  upstream
+	// entry is the request in the outbox, if it's persisted
+	entry *outboxEntry
+	// due is when the request may be delivered, if it's delayed
+	due time.Time
+}
+
+func (q queuedRequest) done() {
+	q.entry.complete(q.ups.Name)
+	deliveryFrom(q.req.Context()).pending.Done()
+}
+
+// upstreamQueue is the FIFO of requests for one upstream. Only the head is
+// ever being delivered, so requests reach the upstream in the order they
+// arrived, and a failing upstream only holds up its own queue.
+type upstreamQueue struct {
+	mu      sync.Mutex
+	pending []queuedRequest
+}
+
+// requestQueues delivers requests in queue mode, at least once and in order
+// for each upstream, retrying failures with exponential backoff between
+// minBackoff and maxBackoff. A request the upstream refuses with a client
+// error, or which fails maxAttempts times, is given up on and sent to the
+// dead letter callback instead, if there is one. Queues are held in memory,
+// so requests still queued when the proxy stops are lost, unless they're
+// also persisted in the outbox.
+type requestQueues struct {
+	p           *RegProxy
+	maxLength   int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+	deadLetter  string
+	outbox      *outbox
+
+	mu     sync.Mutex
+	queues map[string]*upstreamQueue
+	// changed is closed, and replaced, when the registry changes, waking
+	// workers to deliver to the upstream as it's now registered
+	changed chan struct{}
+	stop    chan struct{}
+}
+
+func newRequestQueues(p *RegProxy, cfg Config) *requestQueues {
+	return &requestQueues{
+		p:           p,
+		maxLength:   cfg.QueueMaxLength,
+		minBackoff:  cfg.QueueMinBackoff,
+		maxBackoff:  cfg.QueueMaxBackoff,
+		maxAttempts: cfg.QueueMaxAttempts,
+		deadLetter:  cfg.QueueDeadLetter,
+		queues:      make(map[string]*upstreamQueue),
+		changed:     make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+}
+
+// notify wakes the workers waiting for a request to be due or to retry it,
+// after the registry has changed.
+func (qs *requestQueues) notify() {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	close(qs.changed)
+	qs.changed = make(chan struct{})
+}
+
+// close stops the workers, leaving what's queued undelivered.
+func (qs *requestQueues) close() {
+	close(qs.stop)
+}
+
+// changes returns a channel closed when the registry next changes.
+func (qs *requestQueues) changes() <-chan struct{} {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return qs.changed
+}
+
+// sleep waits for d, or until changed is closed, reporting false if the
+// queues were stopped meanwhile.
+func (qs *requestQueues) sleep(d time.Duration, changed <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-changed:
+	case <-qs.stop:
+		return false
+	}
+	return true
+}
+
+// length is the number of requests queued for every upstream.
+func (qs *requestQueues) length() int {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	n := 0
+	for _, q := range qs.queues {
+		q.mu.Lock()
+		n += len(q.pending)
+		q.mu.Unlock()
+	}
+	return n
+}
+
+// push adds r to the back of its upstream's queue, starting a worker for the
+// queue if there isn't one, and reports whether there was room.
+func (qs *requestQueues) push(r queuedRequest) bool {
+	return qs.enqueue(r, qs.maxLength)
+}
+
+// enqueue is push, with room for maxLength requests, or any number if it
+// isn't positive.
+func (qs *requestQueues) enqueue(r queuedRequest, maxLength int) bool {
+	// Locking q before letting go of qs means its worker can't retire it in
+	// between, leaving r in a queue nobody delivers
+	qs.mu.Lock()
+	q, ok := qs.queues[r.ups.Name]
+	if !ok {
+		q = &upstreamQueue{}
+		qs.queues[r.ups.Name] = q
+		go qs.work(r.ups.Name, q)
+	}
+	q.mu.Lock()
+	qs.mu.Unlock()
+	defer q.mu.Unlock()
+	if maxLength > 0 && len(q.pending) >= maxLength {
+		return false
+	}
+	q.pending = append(q.pending, r)
+	return true
+}
+
+// work delivers the requests in q one at a time, only moving on from each
+// once it has succeeded, been given up on or its upstream has been removed.
+// Each attempt goes to the upstream as it's registered at the time, so a
+// queue follows changes to its registration, a change cutting short the
+// wait before the next attempt. Nothing is delivered during maintenance, nor
+// before it's due, which holds up the requests behind it too, keeping them in
+// order. The worker retires the queue once it's empty, a new one being
+// started for the next request.
+func (qs *requestQueues) work(name string, q *upstreamQueue) {
+	backoff := qs.minBackoff
+	attempts := 0
+	for {
+		// Taken before looking up the upstream, so no change is missed
+		changed := qs.changes()
+		head, ok := qs.next(name, q)
+		if !ok {
+			return
+		}
+		if wait := time.Until(head.due); wait > 0 {
+			if !qs.sleep(wait, changed) {
+				return
+			}
+			continue
+		}
+		qs.p.maintenance.wait()
+
+		ups, registered, err := qs.p.lookupUpstream(name)
+		switch {
+		case err != nil:
+			// Carry on with the registration the request was queued with
+			// while storage is down
+			ups = head.ups
+		case !registered:
+			log.Printf("Upstream %s was removed, dropping its queued requests", name)
+			qs.pop(q, -1)
+			backoff, attempts = qs.minBackoff, 0
+			continue
+		}
+		res := result{ups: ups}
+		res.resp, res.err = qs.p.forward(head.req, head.body, ups)
+		ok = qs.p.ok(res)
+		permanent := !ok && permanentFailure(res.resp)
+		res.close()
+		attempts++
+		if ok || permanent || (qs.maxAttempts > 0 && attempts >= qs.maxAttempts) {
+			if !ok {
+				qs.giveUp(head, res, attempts)
+			}
+			qs.pop(q, 1)
+			backoff, attempts = qs.minBackoff, 0
+			continue
+		}
+		log.Printf("Failed to deliver queued request %s to upstream %s, retrying in %v", head.req.URL.Path, name, backoff)
+		if !qs.sleep(backoff, changed) {
+			return
+		}
+		backoff = min(backoff*2, qs.maxBackoff)
+	}
+}
+
+// permanentFailure says whether an upstream's answer won't change however
+// often the request is retried: a client error, other than those asking to
+// try again later.
+func permanentFailure(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return resp.StatusCode >= 400 && resp.StatusCode < 500
+}
+
+// giveUp stops trying to deliver r, sending it to the dead letter callback
+// if there is one, with the upstream and its last answer in headers.
+func (qs *requestQueues) giveUp(r queuedRequest, res result, attempts int) {
+	qs.p.metrics.queueGivenUp.inc(r.ups.Name)
+	outcome := "error"
+	if res.resp != nil {
+		outcome = strconv.Itoa(res.resp.StatusCode)
+	}
+	if qs.deadLetter == "" {
+		log.Printf("Giving up on queued request %s to upstream %s after %d attempts (%s), dropping it", r.req.URL.Path, r.ups.Name, attempts, outcome)
+		return
+	}
+	log.Printf("Giving up on queued request %s to upstream %s after %d attempts (%s), sending it to the dead letter callback", r.req.URL.Path, r.ups.Name, attempts, outcome)
+	req := r.req.Clone(r.req.Context())
+	req.Header.Set(deadLetterUpstreamHeader, r.ups.Name)
+	req.Header.Set(deadLetterOutcomeHeader, outcome)
+	dl := result{ups: upstream{Name: deadLetterName, Callback: qs.deadLetter}}
+	dl.resp, dl.err = qs.p.forward(req, r.body, dl.ups)
+	if !qs.p.ok(dl) {
+		log.Printf("Failed to send queued request %s to the dead letter callback, dropping it", r.req.URL.Path)
+	}
+	dl.close()
+}
+
+// next returns the request at the head of q, or retires q and reports false
+// if it's empty.
+func (qs *requestQueues) next(name string, q *upstreamQueue) (queuedRequest, bool) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		delete(qs.queues, name)
+		return queuedRequest{}, false
+	}
+	return q.pending[0], true
+}
+
+// pop removes the first n requests from q, or all of them if n is negative.
+func (qs *requestQueues) pop(q *upstreamQueue, n int) {
+	q.mu.Lock()
+	if n < 0 || n > len(q.pending) {
+		n = len(q.pending)
+	}
+	done := q.pending[:n]
+	q.pending = append([]queuedRequest(nil), q.pending[n:]...)
+	q.mu.Unlock()
+	for _, r := range done {
+		r.done()
+	}
+}
+
+// queue accepts the request for delivery to every upstream in the
+// background, answering 202 once it is queued. If an upstream's queue is
+// full the client gets a 503 to retry later, though the request may already
+// be queued for other upstreams, which is allowed by at-least-once delivery.
+// With an outbox, the request is persisted before it's queued.
+func (p *RegProxy) queue(resp http.ResponseWriter, req *http.Request, body *requestBody, upstreams map[string]upstream) {
+	// Probes are delivered straight away, so they measure the upstreams
+	// rather than how long the queues are
+	if req.Context().Value(probeKey) != nil {
+		p.fanOut(resp, req, body, upstreams)
+		return
+	}
+	d := deliveryFrom(req.Context())
+	// Queued requests outlive this handler, and mustn't be cancelled with it
+	queued := req.Clone(context.WithoutCancel(req.Context()))
+	ordered := byPriority(upstreams)
+	var entry *outboxEntry
+	if p.queues.outbox != nil {
+		names := make([]string, len(ordered))
+		for i, ups := range ordered {
+			names[i] = ups.Name
+		}
+		var err error
+		if entry, err = p.queues.outbox.add(queued, body, names, d); err != nil {
+			log.Printf("Failed to persist request %s in the outbox: %v", d.requestID, err)
+			writeProblem(resp, newProblem(http.StatusServiceUnavailable, "Failed to persist the request for delivery"))
+			return
+		}
+	}
+	var full []string
+	for _, ups := range ordered {
+		d.pending.Add(1)
+		if !p.queues.push(queuedRequest{req: queued, body: body, ups: ups, entry: entry, due: dueAt(queued, ups, d.started)}) {
+			d.pending.Done()
+			entry.complete(ups.Name)
+			p.metrics.queueRejected.inc(ups.Name)
+			full = append(full, ups.Name)
+		}
+	}
+	if len(full) > 0 {
+		resp.Header().Set("Retry-After", "1")
+		writeProblem(resp, newProblem(http.StatusServiceUnavailable, "Queue full for upstreams "+strings.Join(full, ", ")))
+		return
+	}
+	resp.WriteHeader(http.StatusAccepted)
+}
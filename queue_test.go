@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueDeliversInOrder(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeQueue
+	cfg.QueueMinBackoff = 10 * time.Millisecond
+	cfg.QueueMaxBackoff = 20 * time.Millisecond
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a flaky upstream and a healthy one
+		var mu sync.Mutex
+		got := make(map[string][]string)
+		failures := 2
+		for _, name := range []string{"flaky", "healthy"} {
+			srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if name == "flaky" && failures > 0 {
+					failures--
+					rr.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				got[name] = append(got[name], req.URL.Path)
+			}))
+			defer srv.Close()
+			register(url, upstream{Name: name, Callback: srv.URL}, t)
+		}
+
+		// WHEN requests are sent
+		for i := range 3 {
+			resp, err := http.Post(fmt.Sprintf("%s/%d", url, i), "application/json", strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+
+			// THEN they are accepted straight away
+			if resp.StatusCode != http.StatusAccepted {
+				t.Errorf("expected 202, got %v", resp.StatusCode)
+			}
+		}
+
+		// AND each upstream gets every request, in order, despite failures
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mu.Lock()
+			flaky, healthy := fmt.Sprint(got["flaky"]), fmt.Sprint(got["healthy"])
+			mu.Unlock()
+			if flaky == "[/0 /1 /2]" && healthy == "[/0 /1 /2]" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected every request in order, got flaky %s healthy %s", flaky, healthy)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestQueueFull(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeQueue
+	cfg.QueueMaxLength = 1
+	cfg.QueueMinBackoff = time.Hour
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN an upstream which is down
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "down", Callback: srv.URL}, t)
+
+		// WHEN its queue fills up
+		first := getStatus(url, t)
+		second := getStatus(url, t)
+
+		// THEN further requests are rejected
+		if first != http.StatusAccepted || second != http.StatusServiceUnavailable {
+			t.Errorf("expected 202 then 503, got %v then %v", first, second)
+		}
+		if rp.metrics.queueRejected.value("down") != 1 {
+			t.Error("expected the rejection to be counted")
+		}
+	})
+}
+
+func TestQueueFollowsRegistration(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeQueue
+	cfg.QueueMinBackoff = 10 * time.Millisecond
+	cfg.QueueMaxBackoff = 20 * time.Millisecond
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN a request queued for an upstream which is down
+		down := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer down.Close()
+		delivered := make(chan string, 1)
+		moved := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			delivered <- req.URL.Path
+		}))
+		defer moved.Close()
+		register(url, upstream{Name: "billing", Callback: down.URL}, t)
+		resp, err := http.Post(url+"/invoices", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// WHEN the upstream is registered at a new callback
+		if err := rp.storage.Put(upstream{Name: "billing", Callback: moved.URL}); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the queued request is delivered there
+		select {
+		case path := <-delivered:
+			if path != "/invoices" {
+				t.Errorf("expected /invoices, got %s", path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the queued request to reach the new callback")
+		}
+
+		// AND the queue's worker stops once it's empty
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+			rp.queues.mu.Lock()
+			n := len(rp.queues.queues)
+			rp.queues.mu.Unlock()
+			if n == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the empty queue to be retired, got %d queues", n)
+			}
+		}
+	})
+}
+
+func TestQueueRetriesStraightAwayWhenReregistered(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = modeQueue
+	cfg.QueueMinBackoff = time.Hour
+	cfg.QueueMaxBackoff = time.Hour
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a request waiting to be retried against an upstream which is down
+		attempted := make(chan struct{}, 1)
+		down := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.WriteHeader(http.StatusServiceUnavailable)
+			attempted <- struct{}{}
+		}))
+		defer down.Close()
+		delivered := make(chan string, 1)
+		moved := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			delivered <- req.URL.Path
+		}))
+		defer moved.Close()
+		register(url, upstream{Name: "billing", Callback: down.URL}, t)
+		resp, err := http.Post(url+"/invoices", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		<-attempted
+
+		// WHEN the upstream is registered at a new callback
+		if r := doJSON(t, "PUT", url+"/register?overwrite=true", `{"name":"billing","callback":"`+moved.URL+`"}`, nil); r.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected 204, got %v", r.StatusCode)
+		}
+
+		// THEN the request is delivered there without waiting out the backoff
+		select {
+		case path := <-delivered:
+			if path != "/invoices" {
+				t.Errorf("expected /invoices, got %s", path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the queued request to reach the new callback")
+		}
+	})
+}
+
+func TestQueueGivesUp(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		status      int
+		maxAttempts int
+		attempts    int32
+	}{
+		{"client error", http.StatusBadRequest, 0, 1},
+		{"too many attempts", http.StatusServiceUnavailable, 3, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// GIVEN a dead letter callback
+			deadLetters := make(chan http.Header, 1)
+			deadLetter := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+				deadLetters <- req.Header
+			}))
+			defer deadLetter.Close()
+			cfg := testConfig()
+			cfg.Mode = modeQueue
+			cfg.QueueMinBackoff = time.Millisecond
+			cfg.QueueMaxBackoff = time.Millisecond
+			cfg.QueueMaxAttempts = tc.maxAttempts
+			cfg.QueueDeadLetter = deadLetter.URL
+			rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+			withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+				// AND an upstream which fails
+				var mu sync.Mutex
+				var attempts int32
+				srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+					mu.Lock()
+					attempts++
+					mu.Unlock()
+					rr.WriteHeader(tc.status)
+				}))
+				defer srv.Close()
+				register(url, upstream{Name: "billing", Callback: srv.URL}, t)
+
+				// WHEN a request is queued
+				resp, err := http.Post(url+"/invoices", "application/json", strings.NewReader("{}"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = resp.Body.Close()
+
+				// THEN it's given up on, to the dead letter callback
+				select {
+				case h := <-deadLetters:
+					if h.Get(deadLetterUpstreamHeader) != "billing" || h.Get(deadLetterOutcomeHeader) != fmt.Sprint(tc.status) {
+						t.Errorf("unexpected dead letter headers %v", h)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("expected the request to be sent to the dead letter callback")
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if attempts != tc.attempts {
+					t.Errorf("expected %d attempts, got %d", tc.attempts, attempts)
+				}
+				if n := rp.metrics.queueGivenUp.value("billing"); n != 1 {
+					t.Errorf("expected 1 request given up on, got %v", n)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// counterStore counts requests per key within fixed windows.
+type counterStore interface {
+	// incr adds one to key's count for the window starting at start and
+	// returns the new count.
+	incr(ctx context.Context, key string, start time.Time, window time.Duration) (int64, error)
+}
+
+// rateLimiter enforces a global limit on proxied requests per window, and a
+// per-tenant one keyed by a request header. With Redis storage the counts
+// are shared, so the limits hold across every replica; otherwise each
+// instance counts for itself.
+type rateLimiter struct {
+	global       int64
+	perTenant    int64
+	window       time.Duration
+	tenantHeader string
+	counters     counterStore
+}
+
+func newRateLimiter(cfg Config, storage RegStorage) *rateLimiter {
+	if cfg.RateLimitGlobal <= 0 && cfg.RateLimitTenant <= 0 {
+		return nil
+	}
+	l := &rateLimiter{
+		global:       cfg.RateLimitGlobal,
+		perTenant:    cfg.RateLimitTenant,
+		window:       cfg.RateLimitWindow,
+		tenantHeader: cfg.RateLimitTenantHeader,
+	}
+	if s, ok := storage.(*RegStorageRedis); ok {
+		l.counters = &redisCounters{client: s.client}
+	} else {
+		l.counters = &localCounters{counts: make(map[string]int64)}
+	}
+	return l
+}
+
+// allow reports whether req is within the limits, and if not which scope it
+// exceeded and how long until the window resets. If the counters can't be
+// reached requests are allowed, as the limits protect upstreams rather than
+// being worth an outage.
+func (l *rateLimiter) allow(req *http.Request) (bool, string, time.Duration) {
+	now := time.Now()
+	start := now.Truncate(l.window)
+	retry := start.Add(l.window).Sub(now)
+	if l.global > 0 && !l.within(req.Context(), "global", start, l.global) {
+		return false, "global", retry
+	}
+	if tenant := req.Header.Get(l.tenantHeader); l.perTenant > 0 && tenant != "" {
+		if !l.within(req.Context(), "tenant:"+tenant, start, l.perTenant) {
+			return false, "tenant", retry
+		}
+	}
+	return true, "", 0
+}
+
+func (l *rateLimiter) within(ctx context.Context, key string, start time.Time, limit int64) bool {
+	n, err := l.counters.incr(ctx, key, start, l.window)
+	if err != nil {
+		log.Printf("Failed to check rate limit %s, allowing request: %v", key, err)
+		return true
+	}
+	return n <= limit
+}
+
+// retryAfter formats a Retry-After header value, rounding up so clients
+// don't retry into the same window.
+func retryAfter(d time.Duration) string {
+	secs := int64((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
+
+// localCounters counts in memory, for one instance.
+type localCounters struct {
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int64
+}
+
+func (c *localCounters) incr(_ context.Context, key string, start time.Time, _ time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !start.Equal(c.start) {
+		c.start = start
+		clear(c.counts)
+	}
+	c.counts[key]++
+	return c.counts[key], nil
+}
+
+// redisCounters shares counts through Redis, one key per scope and window
+// which expires once the window has passed.
+type redisCounters struct {
+	client *redis.Client
+}
+
+func (c *redisCounters) incr(ctx context.Context, key string, start time.Time, window time.Duration) (int64, error) {
+	k := "regproxy:ratelimit:" + key + ":" + strconv.FormatInt(start.UnixMilli(), 10)
+	var incr *redis.IntCmd
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, k)
+		pipe.PExpire(ctx, k, 2*window)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimitPerTenant(t *testing.T) {
+	cfg := testConfig()
+	cfg.RateLimitTenant = 1
+	cfg.RateLimitWindow = time.Hour
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		defer withStatusUpstreams(url, t, 200)()
+		get := func(tenant string) *http.Response {
+			req, _ := http.NewRequest("GET", url, nil)
+			req.Header.Set("X-Tenant-Id", tenant)
+			r, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Body.Close()
+			return r
+		}
+
+		// WHEN tenant a sends two requests and b one
+		first, second, other := get("a"), get("a"), get("b")
+
+		// THEN only a's second is limited
+		if first.StatusCode != 200 || other.StatusCode != 200 {
+			t.Errorf("expected 200s, got %v and %v", first.StatusCode, other.StatusCode)
+		}
+		if second.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expected 429, got %v", second.StatusCode)
+		}
+		if second.Header.Get("Retry-After") == "" {
+			t.Error("expected a Retry-After header")
+		}
+	})
+}
+
+func TestRetryAfterRoundsUp(t *testing.T) {
+	if got := retryAfter(1500 * time.Millisecond); got != "2" {
+		t.Errorf("expected 2, got %s", got)
+	}
+	if got := retryAfter(0); got != "1" {
+		t.Errorf("expected 1, got %s", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPoolSize bounds the connections kept to the server by each instance
+const redisPoolSize = 8
+
+// redisUpstreamsKey is the hash holding every registration, by name
+const redisUpstreamsKey = "regproxy:upstreams"
+
+// RegStorageRedis keeps the registry in a Redis hash, shared by every
+// instance pointed at the same server.
+type RegStorageRedis struct {
+	client *redis.Client
+}
+
+// newRedisStorage opens redis://[:password@]host[:port][/db] locations.
+func newRedisStorage(location string) (*RegStorageRedis, bool, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "redis" {
+		return nil, false, nil
+	}
+	opts, err := redis.ParseURL(location)
+	if err != nil {
+		return nil, true, err
+	}
+	opts.DialTimeout = 5 * time.Second
+	opts.ReadTimeout = 5 * time.Second
+	opts.WriteTimeout = 5 * time.Second
+	opts.PoolSize = redisPoolSize
+	s := &RegStorageRedis{client: redis.NewClient(opts)}
+	upstreams, err := s.All()
+	if err != nil {
+		_ = s.client.Close()
+		return nil, true, err
+	}
+	for _, ups := range upstreams {
+		log.Printf("Adding upstream from redis %v", ups)
+	}
+	return s, true, nil
+}
+
+func (s *RegStorageRedis) Put(u upstream) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(context.Background(), redisUpstreamsKey, u.Name, b).Err()
+}
+
+func (s *RegStorageRedis) Delete(name string) error {
+	return s.client.HDel(context.Background(), redisUpstreamsKey, name).Err()
+}
+
+func (s *RegStorageRedis) ReplaceAll(upstreams map[string]upstream) error {
+	values := make([]any, 0, 2*len(upstreams))
+	for name, u := range upstreams {
+		b, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		values = append(values, name, b)
+	}
+	_, err := s.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Del(context.Background(), redisUpstreamsKey)
+		if len(values) > 0 {
+			pipe.HSet(context.Background(), redisUpstreamsKey, values...)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *RegStorageRedis) All() (map[string]upstream, error) {
+	fields, err := s.client.HGetAll(context.Background(), redisUpstreamsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]upstream, len(fields))
+	for _, v := range fields {
+		var u upstream
+		if err := json.Unmarshal([]byte(v), &u); err != nil {
+			return nil, fmt.Errorf("corrupt storage, invalid upstream [%s]: %w", v, err)
+		}
+		res[u.Name] = u
+	}
+	return res, nil
+}
+
+// redisLeaseScript renews the lease if holder has it, or takes it if nobody does
+var redisLeaseScript = redis.NewScript(`if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('pexpire', KEYS[1], ARGV[2]) end
+if redis.call('set', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then return 1 end
+return 0`)
+
+func (s *RegStorageRedis) acquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	n, err := redisLeaseScript.Run(ctx, s.client, []string{"regproxy:lease:" + name}, holder, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func startFakeRedis(t *testing.T) string {
+	return "redis://" + miniredis.RunT(t).Addr()
+}
+
+func TestRedisStorage(t *testing.T) {
+	// GIVEN
+	s, _, err := newRedisStorage(startFakeRedis(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN
+	_ = s.Put(upstream{Name: "a", Callback: "http://a"})
+	_ = s.Put(upstream{Name: "b", Callback: "http://b", Labels: map[string]string{"team": "x"}})
+	_ = s.Delete("a")
+
+	// THEN
+	all, err := s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all["b"].Labels["team"] != "x" {
+		t.Errorf("unexpected upstreams %v", all)
+	}
+
+	// WHEN replaced
+	if err := s.ReplaceAll(map[string]upstream{"c": {Name: "c", Callback: "http://c"}}); err != nil {
+		t.Fatal(err)
+	}
+	all, _ = s.All()
+	if _, ok := all["c"]; len(all) != 1 || !ok {
+		t.Errorf("unexpected upstreams after replace %v", all)
+	}
+}
+
+func TestRedisLease(t *testing.T) {
+	// GIVEN
+	s, _, err := newRedisStorage(startFakeRedis(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// WHEN two instances try for the lease
+	first, err := s.acquireLease(ctx, "leader", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := s.acquireLease(ctx, "leader", "b", time.Minute)
+	renewed, _ := s.acquireLease(ctx, "leader", "a", time.Minute)
+
+	// THEN only the first has it, and can renew it
+	if !first || second || !renewed {
+		t.Errorf("expected only a to hold the lease, got %v %v %v", first, second, renewed)
+	}
+}
+
+func TestRateLimitSharedThroughRedis(t *testing.T) {
+	// GIVEN two instances sharing redis, with a global limit of 2
+	location := startFakeRedis(t)
+	cfg := testConfig()
+	cfg.RateLimitGlobal = 2
+	cfg.RateLimitWindow = time.Hour
+	var statuses []int
+	for i := 0; i < 2; i++ {
+		s, _, err := newRedisStorage(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		withRegProxyInstance(t, NewRegProxy(cfg, s), func(url string, t *testing.T) {
+			if i == 0 {
+				defer withStatusUpstreams(url, t, 200)()
+			}
+			// WHEN each sends two requests
+			for j := 0; j < 2; j++ {
+				statuses = append(statuses, getStatus(url, t))
+			}
+		})
+	}
+
+	// THEN only the first two in total get through
+	if fmt.Sprint(statuses) != fmt.Sprint([]int{200, 200, http.StatusTooManyRequests, http.StatusTooManyRequests}) {
+		t.Errorf("unexpected statuses %v", statuses)
+	}
+}
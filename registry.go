@@ -0,0 +1,555 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// validateUpstream checks a registration before it is stored.
+func validateUpstream(u upstream) error {
+	if isCallbackTemplate(u.Callback) {
+		if err := validateCallbackTemplate(u.Callback); err != nil {
+			return err
+		}
+	}
+	callback, err := url.Parse(u.Callback)
+	if err != nil {
+		log.Println("Failed to parse URL")
+		return err
+	}
+	switch q := callback.Query(); callback.Scheme {
+	case "kafka":
+		if callback.Host == "" || strings.Trim(callback.Path, "/") == "" {
+			return errors.New("A kafka callback needs brokers and a topic, as kafka://broker:9092/topic")
+		}
+		useTLS, err := kafkaTLS(callback)
+		if err != nil {
+			return err
+		}
+		if callback.User != nil && !useTLS {
+			return errors.New("A kafka callback with credentials needs tls=true, so they aren't sent in the clear")
+		}
+	case "amqp", "amqps":
+		if callback.Host == "" || q.Get("exchange")+q.Get("routingKey") == "" {
+			return errors.New("An amqp callback needs a broker and an exchange or routing key, as amqp://broker:5672/vhost?exchange=name&routingKey=key")
+		}
+	case "file":
+		if _, err := fileSinkPath("", callback); err != nil {
+			return err
+		}
+	case "exec":
+		if callback.Host == "" {
+			return errors.New("An exec callback needs the name of a command, as exec://name")
+		}
+	}
+	if u.Weight < 0 {
+		return errors.New("weight can't be negative")
+	}
+	if u.DelayMs < 0 {
+		return errors.New("delayMs can't be negative")
+	}
+	if u.DedupWindowMs < 0 {
+		return errors.New("dedupWindowMs can't be negative")
+	}
+	if slices.Contains(u.Buckets, "") {
+		return errors.New("bucket names can't be empty")
+	}
+	if slices.Contains(u.Translations, "") {
+		return errors.New("translation names can't be empty")
+	}
+	if err := validateContentTypes(u.ContentTypes); err != nil {
+		return err
+	}
+	if err := validateRollout(u); err != nil {
+		return err
+	}
+	if err := validateUpstreamRateLimit(u.RateLimit); err != nil {
+		return err
+	}
+	if err := validateSLO(u.SLO); err != nil {
+		return err
+	}
+	if err := validatePathMode(u); err != nil {
+		return err
+	}
+	if err := validateRewrites(u.Rewrite); err != nil {
+		return err
+	}
+	if err := validateQueryRules(u.Query); err != nil {
+		return err
+	}
+	if err := validateResponseHeaderRules(u.ResponseHeaders); err != nil {
+		return err
+	}
+	if err := validateCookiePolicy(u); err != nil {
+		return err
+	}
+	if err := validateTokenExchange(u.TokenExchange); err != nil {
+		return err
+	}
+	return validateEgressProxy(u.Proxy)
+}
+
+// validateRegistration checks an upstream being registered, including that
+// any secrets it refers to are ones the operator allows it to.
+func (p *RegProxy) validateRegistration(u upstream) error {
+	if err := validateUpstream(u); err != nil {
+		return err
+	}
+	if err := validateDelay(u, p.cfg.Mode); err != nil {
+		return err
+	}
+	if err := validateTranslations(u, p.cfg.Translations); err != nil {
+		return err
+	}
+	return validateSecretRefs(u, p.secretRefs)
+}
+
+// registryChanged is called once this instance has changed the registry.
+func (p *RegProxy) registryChanged() {
+	p.stored.changed()
+	p.queues.notify()
+}
+
+// etag identifies the stored state of an upstream, for clients to make
+// conditional updates with If-Match and If-None-Match.
+func etag(u upstream) string {
+	b, _ := json.Marshal(u)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// matchesETag reports whether an If-Match or If-None-Match header value
+// matches tag, where * matches anything that exists.
+func matchesETag(header string, tag string, exists bool) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" && exists {
+			return true
+		}
+		if exists && strings.TrimPrefix(v, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Bulk registration modes for PUT /upstreams
+const (
+	bulkReplace = "replace"
+	bulkMerge   = "merge"
+)
+
+// upstreamList handles /upstreams: GET lists every registration by name,
+// PUT registers many at once.
+func (p *RegProxy) upstreamList(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		p.putUpstreams(resp, req)
+		return
+	default:
+		methodNotAllowed(resp, http.MethodGet, http.MethodPut)
+		return
+	}
+	list, err := p.sortedUpstreams()
+	if err != nil {
+		errResp(resp, err)
+		return
+	}
+	for i := range list {
+		list[i].Callback = redactCallback(list[i].Callback)
+	}
+	writeJSON(resp, http.StatusOK, list)
+}
+
+// secretQueryParams are callback query parameters taken to hold credentials,
+// by any part of their name, case-insensitively.
+var secretQueryParams = []string{"token", "key", "secret", "password", "sig", "auth", "credential"}
+
+// redactCallback hides the credentials a callback may hold, in its userinfo
+// or query, for listing it. The export has them in full, for restoring.
+func redactCallback(callback string) string {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return redacted
+	}
+	changed := false
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		} else {
+			u.User = url.User("xxxxx")
+		}
+		changed = true
+	}
+	q := u.Query()
+	for k := range q {
+		lower := strings.ToLower(k)
+		if slices.ContainsFunc(secretQueryParams, func(s string) bool { return strings.Contains(lower, s) }) {
+			q[k] = []string{"xxxxx"}
+			changed = true
+		}
+	}
+	if !changed {
+		return callback
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (p *RegProxy) sortedUpstreams() ([]upstream, error) {
+	upstreams, err := p.storage.All()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// upstreamResource handles /upstreams/{name}. The mux pattern isn't method
+// qualified, otherwise other methods would fall through to the proxy.
+func (p *RegProxy) upstreamResource(resp http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		p.getUpstream(resp, name)
+	case http.MethodPut:
+		p.putUpstream(resp, req, name)
+	case http.MethodDelete:
+		p.deleteUpstream(resp, req, name)
+	default:
+		methodNotAllowed(resp, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// putUpstreams applies an array of upstreams in one go, so tooling can
+// converge the registry in a single call. With ?mode=replace (default) the
+// registry ends up holding exactly those upstreams, with ?mode=merge they are
+// added to or updated in it. Either every upstream is applied or none is.
+func (p *RegProxy) putUpstreams(resp http.ResponseWriter, req *http.Request) {
+	mode, err := bulkMode(req)
+	if err != nil {
+		badRequest(resp, err.Error())
+		return
+	}
+	var list []upstream
+	if err := json.NewDecoder(req.Body).Decode(&list); err != nil {
+		badRequest(resp, err.Error())
+		return
+	}
+	overwrite := false
+	if v := req.URL.Query().Get("overwrite"); v != "" {
+		if overwrite, err = strconv.ParseBool(v); err != nil {
+			badRequest(resp, fmt.Sprintf("Invalid overwrite [%s], expected true or false", v))
+			return
+		}
+	}
+	incoming, err := p.validateUpstreams(list)
+	if err != nil {
+		badRequest(resp, err.Error())
+		return
+	}
+	if err := p.applyUpstreams(incoming, mode, overwrite); err != nil {
+		if errors.Is(err, errCallbackConflict) {
+			writeProblem(resp, newProblem(http.StatusConflict, err.Error()))
+			return
+		}
+		errResp(resp, err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func bulkMode(req *http.Request) (string, error) {
+	mode := req.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		return bulkReplace, nil
+	case bulkReplace, bulkMerge:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Unknown mode [%s], expected %s or %s", mode, bulkReplace, bulkMerge)
+}
+
+// validateUpstreams checks every upstream in a bulk update, keyed by name.
+func (p *RegProxy) validateUpstreams(list []upstream) (map[string]upstream, error) {
+	incoming := make(map[string]upstream, len(list))
+	for _, u := range list {
+		if u.Name == "" {
+			return nil, errors.New("Every upstream needs a name")
+		}
+		if _, dup := incoming[u.Name]; dup {
+			return nil, fmt.Errorf("Upstream [%s] is listed more than once", u.Name)
+		}
+		if err := p.validateRegistration(u); err != nil {
+			return nil, fmt.Errorf("Upstream [%s]: %w", u.Name, err)
+		}
+		incoming[u.Name] = u
+	}
+	return incoming, nil
+}
+
+// errCallbackConflict is returned by a bulk update which would change the
+// callback of a registered upstream without being told to overwrite it.
+var errCallbackConflict = errors.New("already registered with a different callback")
+
+// applyUpstreams replaces the registry with incoming, or merges incoming
+// into it, in a single storage write. Unless overwrite is set, nothing is
+// written if any upstream would be given a different callback, as a single
+// PUT or /register would refuse it.
+func (p *RegProxy) applyUpstreams(incoming map[string]upstream, mode string, overwrite bool) error {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	current, err := p.storage.All()
+	if err != nil {
+		return err
+	}
+	incoming = maps.Clone(incoming)
+	names := make([]string, 0, len(incoming))
+	for name := range incoming {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u := incoming[name]
+		existing, exists := current[name]
+		if exists && !overwrite && existing.Callback != u.Callback {
+			return fmt.Errorf("Upstream [%s] is %w, put with ?overwrite=true to replace it", name, errCallbackConflict)
+		}
+		keepPaused(&u, existing, exists)
+		incoming[name] = u
+	}
+	next := incoming
+	if mode == bulkMerge {
+		maps.Copy(current, incoming)
+		next = current
+	}
+	log.Printf("Setting %d upstreams (%s)", len(incoming), mode)
+	if err := p.storage.ReplaceAll(next); err != nil {
+		return err
+	}
+	p.registryChanged()
+	return nil
+}
+
+func (p *RegProxy) lookupUpstream(name string) (upstream, bool, error) {
+	upstreams, err := p.storage.All()
+	if err != nil {
+		return upstream{}, false, err
+	}
+	u, ok := upstreams[name]
+	return u, ok, nil
+}
+
+func (p *RegProxy) getUpstream(resp http.ResponseWriter, name string) {
+	u, ok, err := p.lookupUpstream(name)
+	if err != nil {
+		errResp(resp, err)
+		return
+	}
+	if !ok {
+		writeProblem(resp, newProblem(http.StatusNotFound, fmt.Sprintf("No upstream named [%s]", name)))
+		return
+	}
+	resp.Header().Set("ETag", etag(u))
+	writeJSON(resp, http.StatusOK, u)
+}
+
+// putUpstream creates or replaces an upstream. Repeating a PUT is harmless,
+// but changing the callback of an existing upstream is refused with 409
+// unless the client proves which version it is replacing with If-Match.
+func (p *RegProxy) putUpstream(resp http.ResponseWriter, req *http.Request, name string) {
+	var u upstream
+	if err := json.NewDecoder(req.Body).Decode(&u); err != nil {
+		badRequest(resp, err.Error())
+		return
+	}
+	if u.Name == "" {
+		u.Name = name
+	}
+	if u.Name != name {
+		badRequest(resp, fmt.Sprintf("Upstream name [%s] doesn't match the path [%s]", u.Name, name))
+		return
+	}
+	if err := p.validateRegistration(u); err != nil {
+		badRequest(resp, err.Error())
+		return
+	}
+
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	existing, exists, err := p.lookupUpstream(name)
+	if err != nil {
+		errResp(resp, err)
+		return
+	}
+	ifMatch := req.Header.Get("If-Match")
+	if !p.preconditionsMet(resp, req, existing, exists) {
+		return
+	}
+	if exists && ifMatch == "" && existing.Callback != u.Callback {
+		writeProblem(resp, newProblem(http.StatusConflict, fmt.Sprintf("Upstream [%s] is already registered with a different callback", name)))
+		return
+	}
+	keepPaused(&u, existing, exists)
+	if !exists || !reflect.DeepEqual(existing, u) {
+		log.Printf("Adding upstream %v", u)
+		if err := p.storage.Put(u); err != nil {
+			errResp(resp, err)
+			return
+		}
+		p.registryChanged()
+	}
+	resp.Header().Set("ETag", etag(u))
+	if !exists {
+		resp.Header().Set("Location", "/upstreams/"+url.PathEscape(name))
+		resp.WriteHeader(http.StatusCreated)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (p *RegProxy) deleteUpstream(resp http.ResponseWriter, req *http.Request, name string) {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	existing, exists, err := p.lookupUpstream(name)
+	if err != nil {
+		errResp(resp, err)
+		return
+	}
+	if !p.preconditionsMet(resp, req, existing, exists) {
+		return
+	}
+	if !exists {
+		writeProblem(resp, newProblem(http.StatusNotFound, fmt.Sprintf("No upstream named [%s]", name)))
+		return
+	}
+	log.Printf("Removing upstream %v", existing)
+	if err := p.storage.Delete(name); err != nil {
+		errResp(resp, err)
+		return
+	}
+	p.registryChanged()
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// preconditionsMet evaluates If-Match and If-None-Match against the stored
+// upstream, writing 412 if either fails.
+func (p *RegProxy) preconditionsMet(resp http.ResponseWriter, req *http.Request, existing upstream, exists bool) bool {
+	if msg := failedPrecondition(req.Header, existing, exists); msg != "" {
+		writeProblem(resp, newProblem(http.StatusPreconditionFailed, msg))
+		return false
+	}
+	return true
+}
+
+// failedPrecondition evaluates If-Match and If-None-Match against the stored
+// upstream, returning why they fail, if they do.
+func failedPrecondition(h http.Header, existing upstream, exists bool) string {
+	tag := ""
+	if exists {
+		tag = etag(existing)
+	}
+	if v := h.Get("If-Match"); v != "" && !matchesETag(v, tag, exists) {
+		return "Upstream has changed since it was read"
+	}
+	if v := h.Get("If-None-Match"); v != "" && matchesETag(v, tag, exists) {
+		return "Upstream already exists"
+	}
+	return ""
+}
+
+func methodNotAllowed(resp http.ResponseWriter, allowed ...string) {
+	resp.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeProblem(resp, newProblem(http.StatusMethodNotAllowed, "Method not allowed"))
+}
+
+func writeJSON(resp http.ResponseWriter, status int, v any) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	if err := json.NewEncoder(resp).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+func (p *RegProxy) pauseUpstream(resp http.ResponseWriter, req *http.Request) {
+	p.setPaused(resp, req, true)
+}
+
+func (p *RegProxy) resumeUpstream(resp http.ResponseWriter, req *http.Request) {
+	p.setPaused(resp, req, false)
+}
+
+// setPaused pauses or resumes an upstream, keeping the rest of its
+// registration. Its stats are kept too, being by name.
+func (p *RegProxy) setPaused(resp http.ResponseWriter, req *http.Request, paused bool) {
+	if req.Method != http.MethodPost {
+		methodNotAllowed(resp, http.MethodPost)
+		return
+	}
+	name := req.PathValue("name")
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	u, exists, err := p.lookupUpstream(name)
+	if err != nil {
+		errResp(resp, err)
+		return
+	}
+	if !exists {
+		writeProblem(resp, newProblem(http.StatusNotFound, fmt.Sprintf("No upstream named [%s]", name)))
+		return
+	}
+	if u.Paused != paused {
+		u.Paused = paused
+		if paused {
+			log.Printf("Pausing upstream %s", name)
+		} else {
+			log.Printf("Resuming upstream %s", name)
+		}
+		if err := p.storage.Put(u); err != nil {
+			errResp(resp, err)
+			return
+		}
+		p.registryChanged()
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// keepPaused carries the pause of an upstream being registered again over
+// to its new registration, so that a client which knows nothing of pausing,
+// such as a deployment re-registering it, doesn't resume it part way
+// through its maintenance. Only resuming it does.
+func keepPaused(u *upstream, existing upstream, exists bool) {
+	if exists && existing.Paused {
+		u.Paused = true
+	}
+}
+
+// withoutPaused removes paused upstreams, returning how many there were.
+func withoutPaused(upstreams map[string]upstream) int {
+	n := 0
+	for name, ups := range upstreams {
+		if ups.Paused {
+			delete(upstreams, name)
+			n++
+		}
+	}
+	return n
+}
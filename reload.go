@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment variables telling a process started by upgrade which of its
+// file descriptors were handed over by the process it replaces
+const (
+	listenerFDsEnv = "REGPROXY_LISTENER_FDS"
+	readyFDEnv     = "REGPROXY_READY_FD"
+	registryFDEnv  = "REGPROXY_REGISTRY_FD"
+)
+
+// listen returns the listeners handed over by the process this one
+// replaces, if any, otherwise new ones for each config. Listeners are handed
+// over in the order they are configured, so must be the same in both.
+func listen(listeners []listenerConfig, keepAlive time.Duration) ([]net.Listener, error) {
+	var ls []net.Listener
+	if fds, ok := os.LookupEnv(listenerFDsEnv); ok {
+		_ = os.Unsetenv(listenerFDsEnv)
+		for _, s := range strings.Split(fds, ",") {
+			fd, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid inherited listener %q", s)
+			}
+			f := os.NewFile(uintptr(fd), "listener")
+			l, err := net.FileListener(f)
+			_ = f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to use inherited listener: %w", err)
+			}
+			ls = append(ls, l)
+		}
+		if len(ls) != len(listeners) {
+			return nil, fmt.Errorf("inherited %d listeners, but %d are configured", len(ls), len(listeners))
+		}
+		log.Printf("Serving on listeners inherited from process %d", os.Getppid())
+		return ls, nil
+	}
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	for _, cfg := range listeners {
+		network, addr := cfg.network()
+		l, err := lc.Listen(context.Background(), network, addr)
+		if err != nil {
+			for _, l := range ls {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func inheritedFile(env, name string) *os.File {
+	fd, err := strconv.Atoi(os.Getenv(env))
+	if err != nil {
+		return nil
+	}
+	// Our own children mustn't think they inherited it too
+	_ = os.Unsetenv(env)
+	return os.NewFile(uintptr(fd), name)
+}
+
+// inheritedRegistry decodes the registry handed over by the process this
+// one replaces, if any, into v: the upstreams of in-memory storage, or the
+// entries of gossiping storage.
+func inheritedRegistry(v any) (bool, error) {
+	f := inheritedFile(registryFDEnv, "registry")
+	if f == nil {
+		return false, nil
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return true, fmt.Errorf("failed to read inherited registry: %w", err)
+	}
+	return true, nil
+}
+
+// signalReady tells the process this one replaces, if any, that it is
+// serving, so the old one can stop.
+func signalReady() {
+	if f := inheritedFile(readyFDEnv, "ready"); f != nil {
+		_, _ = f.Write([]byte{1})
+		_ = f.Close()
+	}
+}
+
+// upgrade starts a new copy of this executable, with the same arguments,
+// to take over serving from ls without refusing any connections: both accept
+// from the same sockets until this process stops. The registry kept in
+// memory, if given, is handed over too. It returns once the new process is
+// serving, or with an error if it doesn't start within timeout, leaving
+// this process serving.
+func upgrade(ls []net.Listener, registry any, timeout time.Duration) error {
+	var files []*os.File
+	var fds []string
+	for _, l := range ls {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			return errors.New("listener can't be handed over")
+		}
+		f, err := tl.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// Extra files start from descriptor 3 in the new process
+		fds = append(fds, strconv.Itoa(3+len(files)))
+		files = append(files, f)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	defer readyW.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		listenerFDsEnv+"="+strings.Join(fds, ","),
+		readyFDEnv+"="+strconv.Itoa(2+len(cmd.ExtraFiles)))
+	var regW *os.File
+	if registry != nil {
+		regR, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer regR.Close()
+		regW = w
+		cmd.ExtraFiles = append(cmd.ExtraFiles, regR)
+		cmd.Env = append(cmd.Env, registryFDEnv+"="+strconv.Itoa(2+len(cmd.ExtraFiles)))
+	}
+	if err := cmd.Start(); err != nil {
+		if regW != nil {
+			_ = regW.Close()
+		}
+		return err
+	}
+	log.Printf("Started process %d to take over", cmd.Process.Pid)
+	if regW != nil {
+		go func() {
+			defer regW.Close()
+			if err := json.NewEncoder(regW).Encode(registry); err != nil {
+				log.Printf("Failed to hand over registry: %v", err)
+			}
+		}()
+	}
+	// Only the child should hold the write end now, so a child which exits
+	// early is seen as EOF
+	_ = readyW.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := io.ReadFull(readyR, b)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("process %d didn't start serving: %w", cmd.Process.Pid, err)
+	}
+	// The new process carries on once this one exits
+	go func() { _ = cmd.Wait() }()
+	return nil
+}
+
+// serveUntilStopped serves each server on its listener until told to stop
+// by a signal. SIGTERM and SIGINT stop them gracefully, letting requests in
+// flight finish for up to drain. SIGHUP first starts a new copy of the
+// executable to take over, for upgrading without dropping traffic, and stops
+// once it is serving.
+func serveUntilStopped(servers []*server, storage RegStorage, drain time.Duration) {
+	var ls []net.Listener
+	for _, srv := range servers {
+		ls = append(ls, srv.l)
+		go func() {
+			log.Printf("Serving on %v", srv.cfg)
+			if err := srv.cfg.serve(srv.Server, srv.l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	signalReady()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			if os.Getpid() == 1 {
+				// Our exit would end the container, and the new process with it
+				log.Printf("Not handing over on SIGHUP as process 1, restart the container instead")
+				continue
+			}
+			if err := upgrade(ls, handoverRegistry(storage), drain); err != nil {
+				log.Printf("Failed to hand over to a new process, carrying on: %v", err)
+				resumeRegistry(storage)
+				continue
+			}
+		}
+		log.Printf("Stopping on %v, waiting up to %v for requests in flight", sig, drain)
+		stopServing(servers, storage, drain)
+		return
+	}
+}
+
+// handoverRegistry returns what of storage a new process taking over needs
+// handed to it, as it's only kept in memory, after writing back any changes
+// storage is holding so that the new process reads them. Storage kept in
+// memory refuses writes from then on with a 503, as the new process
+// wouldn't see them, while this one drains.
+func handoverRegistry(storage RegStorage) any {
+	switch s := storage.(type) {
+	case *RegStorageMemory:
+		return s.handover()
+	case *RegStorageGossip:
+		return s.handover()
+	case storageFlusher:
+		ctx, cancel := context.WithTimeout(context.Background(), storageFlushTimeout)
+		defer cancel()
+		if err := s.Flush(ctx); err != nil {
+			log.Printf("Failed to write back registry changes before handing over, the new process may not see them until this one stops: %v", err)
+		}
+	}
+	return nil
+}
+
+// resumeRegistry accepts writes to storage again when a handover failed.
+func resumeRegistry(storage RegStorage) {
+	switch s := storage.(type) {
+	case *RegStorageMemory:
+		s.resume()
+	case *RegStorageGossip:
+		s.resume()
+	}
+}
+
+// storageFlushTimeout bounds writing back storage's last changes on stopping
+const storageFlushTimeout = 10 * time.Second
+
+// stopServing stops the servers gracefully, letting requests in flight
+// finish for up to drain, then writes back any changes storage is holding,
+// as registrations acknowledged since it last did so would otherwise be lost.
+func stopServing(servers []*server, storage RegStorage, drain time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Stopped serving on %v before requests in flight finished: %v", srv.cfg, err)
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	if f, ok := storage.(storageFlusher); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), storageFlushTimeout)
+		defer cancel()
+		if err := f.Flush(ctx); err != nil {
+			log.Printf("Failed to write back the last registry changes: %v", err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// handOver sets env to a duplicate of f's descriptor, as a previous process
+// would, leaving f to be closed as usual.
+func handOver(t *testing.T, env string, f *os.File) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(env, strconv.Itoa(fd))
+}
+
+func TestListenInheritsListener(t *testing.T) {
+	// GIVEN a listener handed over by a previous process
+	orig, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	f, err := orig.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	handOver(t, listenerFDsEnv, f)
+
+	// WHEN
+	ls, err := listen([]listenerConfig{{Addr: "127.0.0.1:0"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls[0].Close()
+
+	// THEN it is served on rather than a new one, and not handed on again
+	if len(ls) != 1 || ls[0].Addr().String() != orig.Addr().String() {
+		t.Errorf("expected to listen on %v, got %v", orig.Addr(), ls)
+	}
+	if _, ok := os.LookupEnv(listenerFDsEnv); ok {
+		t.Errorf("expected %s to be unset", listenerFDsEnv)
+	}
+}
+
+func TestInheritedRegistry(t *testing.T) {
+	// GIVEN nothing handed over
+	var upstreams map[string]upstream
+	if inherited, err := inheritedRegistry(&upstreams); inherited || err != nil {
+		t.Fatalf("expected nothing inherited, got %v, %v", inherited, err)
+	}
+
+	// GIVEN a registry handed over
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	handOver(t, registryFDEnv, r)
+	go func() {
+		defer w.Close()
+		_ = json.NewEncoder(w).Encode(map[string]upstream{"foo": {Name: "foo", Callback: "http://foo"}})
+	}()
+
+	// WHEN
+	inherited, err := inheritedRegistry(&upstreams)
+
+	// THEN
+	if err != nil || !inherited {
+		t.Fatalf("expected registry inherited, got %v, %v", inherited, err)
+	}
+	if upstreams["foo"].Callback != "http://foo" {
+		t.Errorf("unexpected registry %v", upstreams)
+	}
+}
+
+func TestHandoverRegistry(t *testing.T) {
+	// GIVEN object storage holding back a change
+	obj := &fakeObject{}
+	objects, err := NewRegStorageObject(context.Background(), obj, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = objects.Put(upstream{Name: "orders", Callback: "http://orders"})
+
+	// WHEN handing over
+	if registry := handoverRegistry(objects); registry != nil {
+		t.Errorf("expected nothing to hand over, got %v", registry)
+	}
+
+	// THEN it's written for the new process to read
+	reloaded, err := NewRegStorageObject(context.Background(), obj, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := reloaded.All(); all["orders"].Callback != "http://orders" {
+		t.Errorf("expected the change to be written, got %v", all)
+	}
+
+	// GIVEN gossiping storage
+	gossip := NewRegStorageGossip("a", []byte("0123456789abcdef"))
+	_ = gossip.Put(upstream{Name: "orders", Callback: "http://orders"})
+	_ = gossip.Put(upstream{Name: "billing", Callback: "http://billing"})
+	_ = gossip.Delete("billing")
+
+	// WHEN handing over
+	b, _ := json.Marshal(handoverRegistry(gossip))
+	var entries map[string]gossipEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN its entries go, deletions included
+	if len(entries) != 2 || !entries["billing"].Deleted || entries["orders"].Upstream.Callback != "http://orders" {
+		t.Errorf("unexpected entries handed over %v", entries)
+	}
+}
+
+func TestNoRegistryChangesAfterHandover(t *testing.T) {
+	memory := &RegStorageMemory{upstreams: make(map[string]upstream)}
+	rp := NewRegProxy(testConfig(), memory)
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN the registry has been handed over
+		register(url, upstream{Name: "orders", Callback: "http://orders"}, t)
+		handoverRegistry(memory)
+
+		// WHEN it's changed, THEN it's refused for the client to retry
+		for _, r := range []*http.Response{
+			doJSON(t, "PUT", url+"/upstreams/billing", `{"callback":"http://billing"}`, nil),
+			doJSON(t, "DELETE", url+"/upstreams/orders", "", nil),
+			doJSON(t, "PUT", url+"/upstreams", `[]`, nil),
+		} {
+			if r.StatusCode != http.StatusServiceUnavailable || r.Header.Get("Retry-After") == "" {
+				t.Errorf("expected 503 with Retry-After, got %v", r.StatusCode)
+			}
+		}
+		if names := listNames(t, url); names != "orders" {
+			t.Errorf("expected orders, got %s", names)
+		}
+
+		// WHEN the handover fails, THEN changes are accepted again
+		resumeRegistry(memory)
+		if r := doJSON(t, "PUT", url+"/upstreams/billing", `{"callback":"http://billing"}`, nil); r.StatusCode != http.StatusCreated {
+			t.Errorf("expected 201, got %v", r.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// framingHeaders describe how to read a response's body, so are passed on
+// whatever an upstream's response header rules say
+var framingHeaders = []string{"Content-Length", "Content-Encoding", "Transfer-Encoding"}
+
+// responseHeaderRules say which of an upstream's response headers are passed
+// on to the client, so that internal headers, such as a shadow system's
+// debug info or hostnames, never leak out. With an allow list only the
+// headers on it are kept, and headers on the deny list are always dropped.
+// A name ending in * matches any header starting with the rest, e.g.
+// X-Debug-*. Names are matched case-insensitively.
+type responseHeaderRules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+func validateResponseHeaderRules(r *responseHeaderRules) error {
+	if r == nil {
+		return nil
+	}
+	for _, name := range append(r.Allow, r.Deny...) {
+		if name == "" || strings.ContainsAny(name, " :") {
+			return errors.New("responseHeaders names can't be empty or contain spaces or colons")
+		}
+	}
+	return nil
+}
+
+// apply removes the headers the rules don't let through from h.
+func (r *responseHeaderRules) apply(h http.Header) {
+	if r == nil {
+		return
+	}
+	for name := range h {
+		if matchesHeader(framingHeaders, name) {
+			continue
+		}
+		if len(r.Allow) > 0 && !matchesHeader(r.Allow, name) || matchesHeader(r.Deny, name) {
+			delete(h, name)
+		}
+	}
+}
+
+// matchesHeader reports whether name matches any of patterns.
+func matchesHeader(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
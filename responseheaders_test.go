@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseHeaderRules(t *testing.T) {
+	for _, c := range []struct {
+		rules    responseHeaderRules
+		expected string
+	}{
+		{responseHeaderRules{Deny: []string{"x-debug-*", "Server"}}, "Content-Length,Content-Type,X-Request-Id"},
+		{responseHeaderRules{Allow: []string{"Content-Type"}}, "Content-Length,Content-Type"},
+		{responseHeaderRules{Allow: []string{"X-*"}, Deny: []string{"X-Debug-Host"}}, "Content-Length,X-Debug-Trace,X-Request-Id"},
+	} {
+		h := http.Header{}
+		for _, name := range []string{"Content-Length", "Content-Type", "Server", "X-Debug-Host", "X-Debug-Trace", "X-Request-Id"} {
+			h.Set(name, "1")
+		}
+		c.rules.apply(h)
+		var got []string
+		for _, name := range []string{"Content-Length", "Content-Type", "Server", "X-Debug-Host", "X-Debug-Trace", "X-Request-Id"} {
+			if h.Get(name) != "" {
+				got = append(got, name)
+			}
+		}
+		if strings.Join(got, ",") != c.expected {
+			t.Errorf("%+v: expected %s, got %v", c.rules, c.expected, got)
+		}
+	}
+}
+
+func TestUpstreamResponseHeaders(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN a shadow system which sends internal headers, registered to drop them
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.Header().Set("X-Debug-Host", "shadow-7.internal")
+			rr.Header().Set("X-Result", "stored")
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "shadow", Callback: srv.URL, ResponseHeaders: &responseHeaderRules{Deny: []string{"X-Debug-*"}}}, t)
+
+		// WHEN a request is proxied
+		resp, err := http.Post(url+"/orders", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN the internal header doesn't reach the client, and the rest do
+		if resp.Header.Get("X-Debug-Host") != "" || resp.Header.Get("X-Result") != "stored" {
+			t.Errorf("expected only X-Result to be passed on, got %v", resp.Header)
+		}
+	})
+}
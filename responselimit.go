@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// What to do with an upstream response bigger than -max-response-bytes
+const (
+	responseLimitTruncate = "truncate"
+	responseLimitFail     = "fail"
+)
+
+// truncatedHeader marks a response cut short at the size limit
+const truncatedHeader = "X-Regproxy-Truncated"
+
+var errResponseTooLarge = errors.New("upstream response too large")
+
+// limitResponse applies the response size limit to an upstream's response,
+// so a misbehaving upstream can't stream gigabytes through the proxy. When
+// the upstream doesn't give the length up front, up to the limit is
+// buffered to find it out before anything is sent on.
+func (p *RegProxy) limitResponse(ups upstream, resp *http.Response) (*http.Response, error) {
+	limit := p.cfg.MaxResponseBytes
+	if limit <= 0 || (resp.ContentLength >= 0 && resp.ContentLength <= limit) {
+		return resp, nil
+	}
+	body := resp.Body
+	if resp.ContentLength < 0 {
+		var buf bytes.Buffer
+		_, err := io.CopyN(&buf, resp.Body, limit+1)
+		if err != nil && err != io.EOF {
+			_ = resp.Body.Close()
+			return nil, err
+		}
+		if int64(buf.Len()) <= limit {
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{&buf, body}
+			return resp, nil
+		}
+		body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buf, body), body}
+	}
+
+	p.metrics.oversizedResponses.inc(ups.Name, p.cfg.ResponseLimitPolicy)
+	if p.cfg.ResponseLimitPolicy == responseLimitFail {
+		_ = body.Close()
+		log.Printf("Response from upstream %s is over the %d byte limit", ups.Name, limit)
+		return nil, fmt.Errorf("%w, over %d bytes", errResponseTooLarge, limit)
+	}
+	log.Printf("Truncating response from upstream %s to %d bytes", ups.Name, limit)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, limit), body}
+	resp.ContentLength = limit
+	resp.Header.Set("Content-Length", strconv.FormatInt(limit, 10))
+	resp.Header.Set(truncatedHeader, "true")
+	return resp, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// withSizedUpstream registers an upstream responding with size bytes, in two
+// chunks without a Content-Length if chunked.
+func withSizedUpstream(t *testing.T, url string, size int, chunked bool) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", size)
+		if chunked {
+			_, _ = io.WriteString(w, body[:size/2])
+			w.(http.Flusher).Flush()
+			_, _ = io.WriteString(w, body[size/2:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		_, _ = io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	register(url, upstream{Name: "big", Callback: srv.URL}, t)
+}
+
+func getBody(t *testing.T, url string) (*http.Response, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestResponseLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		policy     string
+		size       int
+		chunked    bool
+		wantStatus int
+		wantLen    int
+		truncated  bool
+	}{
+		{"within limit", responseLimitFail, 100, false, 200, 100, false},
+		{"within limit chunked", responseLimitFail, 100, true, 200, 100, false},
+		{"fail", responseLimitFail, 101, false, http.StatusBadGateway, -1, false},
+		{"fail chunked", responseLimitFail, 10000, true, http.StatusBadGateway, -1, false},
+		{"truncate", responseLimitTruncate, 101, false, 200, 100, true},
+		{"truncate chunked", responseLimitTruncate, 10000, true, 200, 100, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MaxResponseBytes = 100
+			cfg.ResponseLimitPolicy = tc.policy
+			withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+				// GIVEN
+				withSizedUpstream(t, url, tc.size, tc.chunked)
+
+				// WHEN
+				resp, body := getBody(t, url)
+
+				// THEN
+				if resp.StatusCode != tc.wantStatus {
+					t.Errorf("expected %v, got %v", tc.wantStatus, resp.StatusCode)
+				}
+				if tc.wantLen >= 0 && len(body) != tc.wantLen {
+					t.Errorf("expected %d bytes, got %d", tc.wantLen, len(body))
+				}
+				if (resp.Header.Get(truncatedHeader) != "") != tc.truncated {
+					t.Errorf("unexpected %s header %q", truncatedHeader, resp.Header.Get(truncatedHeader))
+				}
+			})
+		})
+	}
+}
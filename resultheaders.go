@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Ways of summarising upstream outcomes in response headers
+const (
+	resultHeadersOff  = "off"
+	resultHeadersEach = "each"
+	resultHeadersJSON = "json"
+)
+
+const (
+	// resultHeaderPrefix is followed by the upstream name, one header each
+	resultHeaderPrefix = "X-Regproxy-Result-"
+	// resultsHeader holds a JSON array of every upstream's outcome
+	resultsHeader = "X-Regproxy-Results"
+)
+
+// resultHeaderWriter adds a summary of each upstream's outcome to the
+// response headers just before they are sent, so callers get delivery
+// visibility whichever upstream's response they are given.
+type resultHeaderWriter struct {
+	http.ResponseWriter
+	format      string
+	d           *delivery
+	wroteHeader bool
+}
+
+func (w *resultHeaderWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.addResultHeaders()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *resultHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *resultHeaderWriter) addResultHeaders() {
+	outcomes := w.d.snapshot()
+	for i, o := range outcomes {
+		outcomes[i] = o.public()
+	}
+	h := w.Header()
+	switch w.format {
+	case resultHeadersEach:
+		for _, o := range outcomes {
+			h.Set(resultHeaderPrefix+headerSafe(o.Name), o.summary())
+		}
+	case resultHeadersJSON:
+		b, err := json.Marshal(outcomes)
+		if err == nil {
+			h.Set(resultsHeader, string(b))
+		}
+	}
+}
+
+// summary describes an outcome in a line, like "200 (34ms)".
+func (o outcome) summary() string {
+	if o.Error != "" {
+		// Header values can't span lines
+		return fmt.Sprintf("error %s (%dms)", strings.ReplaceAll(o.Error, "\n", " "), o.DurationMs)
+	}
+	return fmt.Sprintf("%d (%dms)", o.Status, o.DurationMs)
+}
+
+// headerSafe replaces anything which isn't allowed in a header name.
+func headerSafe(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 128 && (r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '-'
+	}, name)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestResultHeadersEach(t *testing.T) {
+	cfg := testConfig()
+	cfg.ResultHeaders = resultHeadersEach
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN upstreams "a" and "b"
+		defer withStatusUpstreams(url, t, 200, 404)()
+
+		// WHEN
+		r, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN each upstream's outcome is in a header
+		if v := r.Header.Get(resultHeaderPrefix + "a"); !regexp.MustCompile(`^200 \(\d+ms\)$`).MatchString(v) {
+			t.Errorf("unexpected result header for a: %q", v)
+		}
+		if v := r.Header.Get(resultHeaderPrefix + "b"); !regexp.MustCompile(`^404 \(\d+ms\)$`).MatchString(v) {
+			t.Errorf("unexpected result header for b: %q", v)
+		}
+	})
+}
+
+func TestResultHeadersJSON(t *testing.T) {
+	cfg := testConfig()
+	cfg.ResultHeaders = resultHeadersJSON
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		defer withStatusUpstreams(url, t, 200, 200)()
+		r, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outcomes []outcome
+		if err := json.Unmarshal([]byte(r.Header.Get(resultsHeader)), &outcomes); err != nil {
+			t.Fatal(err)
+		}
+		if len(outcomes) != 2 {
+			t.Errorf("expected 2 outcomes, got %+v", outcomes)
+		}
+		for _, o := range outcomes {
+			if o.Name == "" || o.Callback != "" {
+				t.Errorf("expected the upstream's name but not its callback, got %+v", o)
+			}
+		}
+	})
+}
+
+func TestHeaderSafe(t *testing.T) {
+	if s := headerSafe("my upstream_1/é"); s != "my-upstream-1--" {
+		t.Errorf("unexpected header name %q", s)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader marks a request as safe to retry even though its
+// method isn't idempotent, the upstream being expected to deduplicate it
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxRetryBalance caps the retries a retryBudget can save up, so a long
+// quiet spell can't bank enough for a retry storm when an upstream fails
+const maxRetryBalance = 10
+
+// retrier retries upstream calls which fail with an error or a 502, 503 or
+// 504, up to max times each with jittered exponential backoff. Only
+// idempotent requests, or those with an Idempotency-Key, are retried, so
+// upstreams aren't made to repeat side effects. A nil retrier doesn't retry.
+type retrier struct {
+	max     int
+	backoff time.Duration
+	budget  *retryBudget
+	retries *counterVec
+	denied  *counterVec
+}
+
+// retryBudget limits retries to a fraction of upstream calls: each call
+// earns ratio of a retry and each retry spends a whole one.
+type retryBudget struct {
+	ratio float64
+
+	mu      sync.Mutex
+	balance float64
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.balance = min(b.balance+b.ratio, maxRetryBalance)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+func newRetrier(cfg Config, metrics *proxyMetrics) *retrier {
+	if cfg.MaxRetries <= 0 {
+		return nil
+	}
+	return &retrier{
+		max:     cfg.MaxRetries,
+		backoff: cfg.RetryBackoff,
+		budget:  &retryBudget{ratio: cfg.RetryBudget},
+		retries: metrics.retries,
+		denied:  metrics.retriesDenied,
+	}
+}
+
+// canRetry says whether req may safely be sent to an upstream more than once.
+func canRetry(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get(idempotencyKeyHeader) != ""
+}
+
+// shouldRetry says whether a call's outcome is worth another attempt.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, errLoopDetected)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// do makes call to the upstream name, retrying it while it fails and both
+// the request and the budget allow.
+func (r *retrier) do(req *http.Request, name string, call func() (*http.Response, error)) (*http.Response, error) {
+	resp, err := call()
+	if r == nil {
+		return resp, err
+	}
+	r.budget.deposit()
+	if !canRetry(req) {
+		return resp, err
+	}
+	for attempt := 0; attempt < r.max && shouldRetry(resp, err); attempt++ {
+		if !r.budget.withdraw() {
+			r.denied.inc(name)
+			break
+		}
+		wait := time.Duration(rand.Int63n(int64(r.backoff<<attempt) + 1))
+		select {
+		case <-req.Context().Done():
+			return resp, err
+		case <-time.After(wait):
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		log.Printf("Retrying request %s to upstream %s", req.URL.Path, name)
+		r.retries.inc(name)
+		resp, err = call()
+	}
+	return resp, err
+}
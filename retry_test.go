@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetries(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxRetries = 2
+	cfg.RetryBudget = 1
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN an upstream which fails the first call to each request
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			if calls.Add(1)%2 == 1 {
+				rr.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "foo", Callback: srv.URL}, t)
+
+		// WHEN an idempotent request is made
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it is retried
+		if resp.StatusCode != 200 || calls.Load() != 2 {
+			t.Errorf("expected success after a retry, got %v after %v calls", resp.StatusCode, calls.Load())
+		}
+
+		// WHEN a POST is made
+		calls.Store(0)
+		resp, err = http.Post(url, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it isn't
+		if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 1 {
+			t.Errorf("expected the failure without a retry, got %v after %v calls", resp.StatusCode, calls.Load())
+		}
+
+		// WHEN a POST with an idempotency key is made
+		calls.Store(0)
+		req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("{}"))
+		req.Header.Set(idempotencyKeyHeader, "abc")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it is
+		if resp.StatusCode != 200 || calls.Load() != 2 {
+			t.Errorf("expected success after a retry, got %v after %v calls", resp.StatusCode, calls.Load())
+		}
+	})
+}
+
+func TestRetryBudget(t *testing.T) {
+	// GIVEN a budget of one retry per two calls
+	b := &retryBudget{ratio: 0.5}
+
+	// THEN retries must be earned
+	if b.withdraw() {
+		t.Error("expected no retry before any calls")
+	}
+	b.deposit()
+	if b.withdraw() {
+		t.Error("expected no retry after one call")
+	}
+	b.deposit()
+	if !b.withdraw() {
+		t.Error("expected a retry after two calls")
+	}
+
+	// AND can't be saved up without limit
+	for range 1000 {
+		b.deposit()
+	}
+	n := 0
+	for b.withdraw() {
+		n++
+	}
+	if n != maxRetryBalance {
+		t.Errorf("expected %v retries saved up, got %v", maxRetryBalance, n)
+	}
+}
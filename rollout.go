@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// rollout gradually moves requests to an upstream on a schedule, so a
+// migration doesn't need repeated manual weight changes. Until the first
+// step the upstream gets no requests, then the percent of the latest step
+// which has started. If it replaces another upstream, the requests it gets
+// no longer go to that one, splitting the traffic between the two.
+type rollout struct {
+	Replaces string        `json:"replaces,omitempty"`
+	Steps    []rolloutStep `json:"steps"`
+}
+
+type rolloutStep struct {
+	At      time.Time `json:"at"`
+	Percent float64   `json:"percent"`
+}
+
+func validateRollout(u upstream) error {
+	r := u.Rollout
+	if r == nil {
+		return nil
+	}
+	if r.Replaces == u.Name {
+		return errors.New("an upstream's rollout can't replace itself")
+	}
+	if len(r.Steps) == 0 {
+		return errors.New("a rollout needs steps")
+	}
+	for i, s := range r.Steps {
+		if s.Percent < 0 || s.Percent > 100 {
+			return fmt.Errorf("rollout percent %v must be between 0 and 100", s.Percent)
+		}
+		if i > 0 && !s.At.After(r.Steps[i-1].At) {
+			return errors.New("rollout steps must be in time order")
+		}
+	}
+	return nil
+}
+
+// percent is the share of requests the upstream gets at now.
+func (r *rollout) percent(now time.Time) float64 {
+	if r == nil {
+		return 100
+	}
+	pct := 0.0
+	for _, s := range r.Steps {
+		if now.Before(s.At) {
+			break
+		}
+		pct = s.Percent
+	}
+	return pct
+}
+
+// applyRollouts decides, for each upstream being rolled out, whether req
+// goes to it or to the upstream it replaces. With -rollout-key the same key
+// keeps going to the same side, and stays on the new upstream as its share
+// grows; otherwise each request is decided at random.
+func (p *RegProxy) applyRollouts(req *http.Request, upstreams map[string]upstream, now time.Time) {
+	var drop []string
+	for _, ups := range upstreams {
+		if ups.Rollout == nil {
+			continue
+		}
+		x := rand.Float64()
+		if p.rolloutKey != nil {
+			if key := p.rolloutKey(req); key != "" {
+				x = hashUnit(ups.Name, key)
+			}
+		}
+		if x*100 < ups.Rollout.percent(now) {
+			if ups.Rollout.Replaces != "" {
+				drop = append(drop, ups.Rollout.Replaces)
+			}
+		} else {
+			drop = append(drop, ups.Name)
+		}
+	}
+	for _, name := range drop {
+		delete(upstreams, name)
+	}
+}
+
+// rolloutGauge reports the share of requests each upstream being rolled out
+// gets now, by name.
+func (p *RegProxy) rolloutGauge() map[string]float64 {
+	upstreams, err := p.stored.all()
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	values := make(map[string]float64)
+	for _, ups := range upstreams {
+		if ups.Rollout != nil {
+			values[labelKey([]string{ups.Name})] = ups.Rollout.percent(now)
+		}
+	}
+	return values
+}
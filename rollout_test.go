@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRolloutPercent(t *testing.T) {
+	// GIVEN a 1% -> 10% -> 100% schedule
+	start := time.Date(2026, 11, 2, 9, 0, 0, 0, time.UTC)
+	r := &rollout{Steps: []rolloutStep{
+		{At: start, Percent: 1},
+		{At: start.Add(24 * time.Hour), Percent: 10},
+		{At: start.Add(72 * time.Hour), Percent: 100},
+	}}
+
+	// WHEN the share is read over time, THEN it follows the latest step to have started
+	for _, c := range []struct {
+		at       time.Time
+		expected float64
+	}{
+		{start.Add(-time.Minute), 0},
+		{start, 1},
+		{start.Add(30 * time.Hour), 10},
+		{start.Add(100 * time.Hour), 100},
+	} {
+		if got := r.percent(c.at); got != c.expected {
+			t.Errorf("at %v: expected %v%%, got %v%%", c.at, c.expected, got)
+		}
+	}
+}
+
+func TestRolloutSplitsByKey(t *testing.T) {
+	// GIVEN v2 replacing v1, keyed on a header
+	cfg := testConfig()
+	cfg.RolloutKey = "header:X-User-Id"
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	start := time.Now()
+	v2 := upstream{Name: "v2", Rollout: &rollout{Replaces: "v1", Steps: []rolloutStep{
+		{At: start, Percent: 10},
+		{At: start.Add(time.Hour), Percent: 50},
+	}}}
+	route := func(user int, now time.Time) string {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("X-User-Id", fmt.Sprint("user-", user))
+		upstreams := map[string]upstream{"v1": {Name: "v1"}, "v2": v2, "audit": {Name: "audit"}}
+		rp.applyRollouts(req, upstreams, now)
+		if _, ok := upstreams["audit"]; !ok || len(upstreams) != 2 {
+			t.Fatalf("expected one side of the rollout and audit, got %v", upstreams)
+		}
+		if _, ok := upstreams["v2"]; ok {
+			return "v2"
+		}
+		return "v1"
+	}
+
+	// WHEN many users' requests are routed at each step
+	early, later := 0, 0
+	for i := range 10000 {
+		side := route(i, start)
+		if side == "v2" {
+			early++
+			// THEN users moved to v2 stay there as its share grows
+			if route(i, start.Add(2*time.Hour)) != "v2" {
+				t.Fatalf("expected user %d to stay on v2", i)
+			}
+		}
+		if route(i, start.Add(2*time.Hour)) == "v2" {
+			later++
+		}
+	}
+
+	// AND each step gets about its share
+	if early < 800 || early > 1200 || later < 4500 || later > 5500 {
+		t.Errorf("expected about 10%% then 50%% on v2, got %d then %d", early, later)
+	}
+}
+
+func TestRolloutRouting(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN v2 fully rolled out in place of v1, and v3 not yet started
+		var mu sync.Mutex
+		var calls []string
+		now := time.Now()
+		for _, u := range []upstream{
+			{Name: "v1"},
+			{Name: "v2", Rollout: &rollout{Replaces: "v1", Steps: []rolloutStep{{At: now.Add(-time.Hour), Percent: 100}}}},
+			{Name: "v3", Rollout: &rollout{Steps: []rolloutStep{{At: now.Add(time.Hour), Percent: 100}}}},
+		} {
+			name := u.Name
+			srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls = append(calls, name)
+			}))
+			defer srv.Close()
+			u.Callback = srv.URL
+			register(url, u, t)
+		}
+
+		// WHEN a request arrives
+		resp, err := http.Post(url+"/orders", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN only v2 is called
+		mu.Lock()
+		defer mu.Unlock()
+		slices.Sort(calls)
+		if got := strings.Join(calls, ","); got != "v2" {
+			t.Errorf("expected only v2 to be called, got %s", got)
+		}
+	})
+}
+
+func TestRolloutValidation(t *testing.T) {
+	now := time.Now()
+	for _, r := range []*rollout{
+		{},
+		{Replaces: "v2", Steps: []rolloutStep{{At: now, Percent: 10}}},
+		{Steps: []rolloutStep{{At: now, Percent: 110}}},
+		{Steps: []rolloutStep{{At: now, Percent: 10}, {At: now, Percent: 50}}},
+	} {
+		if err := validateRollout(upstream{Name: "v2", Rollout: r}); err == nil {
+			t.Errorf("expected %+v to be rejected", r)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+)
+
+// registerRuntimeMetrics reports on the health of the Go runtime alongside
+// the proxy's own metrics. Every request fans out to goroutines of its own,
+// so their number, the memory they hold and the garbage collection it costs
+// are the first signs of trouble. They are read with runtime/metrics, which
+// unlike runtime.ReadMemStats doesn't stop the world.
+func registerRuntimeMetrics(r *registry) {
+	r.gaugeFunc("go_goroutines", "Goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	r.gaugeFunc("go_heap_objects_bytes", "Bytes of live and not yet collected heap objects.", runtimeMetric("/memory/classes/heap/objects:bytes"))
+	r.gaugeFunc("go_heap_goal_bytes", "Heap size the garbage collector aims to finish its cycle within.", runtimeMetric("/gc/heap/goal:bytes"))
+	r.gaugeFunc("go_memory_total_bytes", "Bytes of memory mapped by the Go runtime.", runtimeMetric("/memory/classes/total:bytes"))
+	r.counterFunc("go_gc_cycles_total", "Completed garbage collection cycles.", runtimeMetric("/gc/cycles/total:gc-cycles"))
+	r.counterFunc("go_gc_pauses_total", "Stop-the-world pauses for garbage collection.", func() float64 {
+		n, _ := gcPauses()
+		return n
+	})
+	r.counterFunc("go_gc_pause_seconds_total", "Approximate time stopped for garbage collection, from a histogram of pause lengths.", func() float64 {
+		_, total := gcPauses()
+		return total
+	})
+	// File descriptors can only be counted where there is a /proc
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		return
+	}
+	r.gaugeFunc("process_open_fds", "File descriptors the process has open, including connections.", func() float64 {
+		fds, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			return 0
+		}
+		// Less the one reading the directory
+		return float64(len(fds) - 1)
+	})
+	r.gaugeFunc("process_max_fds", "The most file descriptors the process may have open.", maxFDs)
+}
+
+// runtimeMetric returns a function reading a single-valued runtime metric.
+func runtimeMetric(name string) func() float64 {
+	return func() float64 {
+		s := []metrics.Sample{{Name: name}}
+		metrics.Read(s)
+		switch s[0].Value.Kind() {
+		case metrics.KindUint64:
+			return float64(s[0].Value.Uint64())
+		case metrics.KindFloat64:
+			return s[0].Value.Float64()
+		}
+		return 0
+	}
+}
+
+// gcPauses returns how many garbage collection pauses there have been, and
+// roughly how long they took in all, from the midpoints of the runtime's
+// histogram of them.
+func gcPauses() (count, seconds float64) {
+	s := []metrics.Sample{{Name: "/sched/pauses/total/gc:seconds"}}
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindFloat64Histogram {
+		return 0, 0
+	}
+	h := s[0].Value.Float64Histogram()
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		lo, hi := h.Buckets[i], h.Buckets[i+1]
+		mid := (lo + hi) / 2
+		switch {
+		case math.IsInf(lo, -1):
+			mid = hi
+		case math.IsInf(hi, 1):
+			mid = lo
+		}
+		count += float64(n)
+		seconds += float64(n) * mid
+	}
+	return count, seconds
+}
+
+// maxFDs reads the soft limit on open files from /proc/self/limits.
+func maxFDs() float64 {
+	f, err := os.Open("/proc/self/limits")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		if rest, ok := strings.CutPrefix(scan.Text(), "Max open files"); ok {
+			fields := strings.Fields(rest)
+			if len(fields) == 0 {
+				return 0
+			}
+			if fields[0] == "unlimited" {
+				return math.Inf(1)
+			}
+			n, _ := strconv.ParseFloat(fields[0], 64)
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestRuntimeMetrics(t *testing.T) {
+	// GIVEN a garbage collection has happened
+	r := newRegistry()
+	registerRuntimeMetrics(r)
+	runtime.GC()
+
+	// WHEN
+	var out bytes.Buffer
+	r.write(&out)
+
+	// THEN the runtime's health is reported, with GC totals as counters
+	for _, want := range []string{
+		`(?m)^# TYPE go_goroutines gauge$`,
+		`(?m)^# TYPE go_gc_cycles_total counter$`,
+		`(?m)^# TYPE go_gc_pause_seconds_total counter$`,
+	} {
+		if !regexp.MustCompile(want).Match(out.Bytes()) {
+			t.Errorf("expected %s in %s", want, out.String())
+		}
+	}
+	for _, name := range []string{"go_goroutines", "go_heap_objects_bytes", "go_gc_cycles_total", "go_gc_pauses_total"} {
+		m := regexp.MustCompile(`(?m)^` + name + ` (\S+)$`).FindSubmatch(out.Bytes())
+		if m == nil {
+			t.Errorf("expected %s to be reported", name)
+			continue
+		}
+		if v, err := strconv.ParseFloat(string(m[1]), 64); err != nil || v <= 0 {
+			t.Errorf("expected %s to be positive, got %s", name, m[1])
+		}
+	}
+}
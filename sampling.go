@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Trace sampling strategies
+const (
+	sampleAlways      = "always"
+	sampleRatio       = "ratio"
+	sampleParentBased = "parent-based"
+)
+
+var traceSamplers = []string{sampleAlways, sampleRatio, sampleParentBased}
+
+// traceSampleRoute overrides the sampling ratio for requests whose path
+// starts with prefix.
+type traceSampleRoute struct {
+	prefix string
+	ratio  float64
+}
+
+// parseTraceSampleRoute parses a prefix=ratio route override.
+func parseTraceSampleRoute(s string) (traceSampleRoute, error) {
+	prefix, r, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return traceSampleRoute{}, fmt.Errorf("invalid trace sample route %s, expected /path/prefix=ratio", s)
+	}
+	ratio, err := strconv.ParseFloat(r, 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return traceSampleRoute{}, fmt.Errorf("invalid trace sample route %s, the ratio must be between 0 and 1", s)
+	}
+	return traceSampleRoute{prefix: prefix, ratio: ratio}, nil
+}
+
+// sortTraceSampleRoutes puts the longest prefixes first, so they win.
+func sortTraceSampleRoutes(routes []traceSampleRoute) {
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+}
+
+// sampleTrace makes the sampling decision passed on to upstreams. Always
+// samples everything, ratio samples a share of traces by their ID whatever
+// the caller decided, and parent-based follows the caller's decision,
+// sampling a share of the traces it starts. A route override swaps in its
+// own ratio, even for always.
+func (p *RegProxy) sampleTrace(req *http.Request, tc traceContext) traceContext {
+	ratio, overridden := p.cfg.TraceSampleRatio, false
+	for _, r := range p.cfg.TraceSampleRoutes {
+		if strings.HasPrefix(req.URL.Path, r.prefix) {
+			ratio, overridden = r.ratio, true
+			break
+		}
+	}
+	switch {
+	case p.cfg.TraceSampler == sampleParentBased && !tc.deferred:
+	case p.cfg.TraceSampler == sampleAlways && !overridden, p.cfg.TraceSampler == "":
+		tc.sampled = true
+	default:
+		tc.sampled = traceIDRatio(tc.traceID, ratio)
+	}
+	tc.deferred = false
+	return tc
+}
+
+// traceIDRatio samples ratio of trace IDs, consistently so that every proxy
+// makes the same decision for a trace. Like OpenTelemetry's TraceIdRatioBased
+// sampler, it uses the trace ID's lower 8 bytes, which are random.
+func traceIDRatio(traceID string, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if len(traceID) < 16 {
+		return false
+	}
+	v, err := strconv.ParseUint(traceID[len(traceID)-16:], 16, 64)
+	if err != nil {
+		return false
+	}
+	return v>>1 < uint64(ratio*math.MaxInt64)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSampleTrace(t *testing.T) {
+	caller := traceContext{traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7"}
+	newTrace := traceContext{traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7", deferred: true}
+	routes := []traceSampleRoute{{prefix: "/webhooks/", ratio: 0}}
+	for name, tt := range map[string]struct {
+		sampler string
+		ratio   float64
+		path    string
+		tc      traceContext
+		want    bool
+	}{
+		"always overrides the caller":        {sampler: sampleAlways, path: "/orders", tc: caller, want: true},
+		"always with a route override":       {sampler: sampleAlways, path: "/webhooks/github", tc: caller, want: false},
+		"ratio ignores the caller":           {sampler: sampleRatio, ratio: 1, path: "/orders", tc: caller, want: true},
+		"ratio of zero":                      {sampler: sampleRatio, ratio: 0, path: "/orders", tc: newTrace, want: false},
+		"parent-based follows the caller":    {sampler: sampleParentBased, ratio: 1, path: "/orders", tc: caller, want: false},
+		"parent-based samples new traces":    {sampler: sampleParentBased, ratio: 1, path: "/orders", tc: newTrace, want: true},
+		"parent-based with a route override": {sampler: sampleParentBased, ratio: 1, path: "/webhooks/github", tc: newTrace, want: false},
+	} {
+		// GIVEN
+		cfg := testConfig()
+		cfg.TraceSampler, cfg.TraceSampleRatio, cfg.TraceSampleRoutes = tt.sampler, tt.ratio, routes
+		p := &RegProxy{cfg: cfg}
+
+		// WHEN
+		got := p.sampleTrace(httptest.NewRequest("POST", tt.path, nil), tt.tc)
+
+		// THEN
+		if got.sampled != tt.want || got.deferred {
+			t.Errorf("%s: expected sampled %v, got %+v", name, tt.want, got)
+		}
+	}
+}
+
+func TestTraceIDRatio(t *testing.T) {
+	sampled := 0
+	for range 10000 {
+		if traceIDRatio(randomHex(traceIDLength), 0.1) {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Errorf("expected about 1000 of 10000 traces sampled, got %d", sampled)
+	}
+	id := randomHex(traceIDLength)
+	if traceIDRatio(id, 0.5) != traceIDRatio(id, 0.5) {
+		t.Error("expected the same decision for the same trace")
+	}
+}
+
+func TestParseTraceSampleRoute(t *testing.T) {
+	routes := []traceSampleRoute{}
+	for _, s := range []string{"/=0.5", "/webhooks/=0.01"} {
+		r, err := parseTraceSampleRoute(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, r)
+	}
+	sortTraceSampleRoutes(routes)
+	if routes[0].prefix != "/webhooks/" || routes[0].ratio != 0.01 {
+		t.Errorf("expected the longest prefix first, got %v", routes)
+	}
+	for _, s := range []string{"webhooks=0.1", "/webhooks", "/webhooks=2"} {
+		if _, err := parseTraceSampleRoute(s); err == nil {
+			t.Errorf("expected %s to be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileRefPrefix marks a registration value which is a reference to a secret
+// in a file, as file:/path, e.g. a mounted Kubernetes secret.
+const fileRefPrefix = "file:"
+
+// parseFileRef returns the path of a file: reference, ok being false if s
+// isn't a reference at all.
+func parseFileRef(s string) (path string, ok bool, err error) {
+	path, ok = strings.CutPrefix(s, fileRefPrefix)
+	if ok && !filepath.IsAbs(path) {
+		return "", true, fmt.Errorf("invalid file reference [%s], expected %s/absolute/path", s, fileRefPrefix)
+	}
+	return path, ok, nil
+}
+
+// checkSecretFile refuses a file: reference to anything but a file under
+// dir, once symlinks are resolved, so a registrant can't have the proxy send
+// them arbitrary files from its disk. With no dir, file: references aren't
+// allowed at all.
+func checkSecretFile(dir, name string) error {
+	if dir == "" {
+		return fmt.Errorf("file reference [%s%s] isn't allowed, as -secret-file-dir isn't set", fileRefPrefix, name)
+	}
+	outside := fmt.Errorf("file reference [%s%s] isn't under -secret-file-dir", fileRefPrefix, name)
+	root, err := filepath.EvalSymlinks(filepath.Clean(dir))
+	if err != nil {
+		return outside
+	}
+	target, err := filepath.EvalSymlinks(filepath.Clean(name))
+	if err != nil {
+		return outside
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return outside
+	}
+	return nil
+}
+
+type secretFile struct {
+	value   string
+	version string
+}
+
+// secretFiles holds the secrets read from files, picking up changes to them
+// without a restart when they're rotated. As with certificates, files are
+// polled rather than watched, and if a changed file can't be read the
+// previous secret is kept. Files are read when first needed, then kept.
+type secretFiles struct {
+	mu    sync.Mutex
+	files map[string]secretFile
+}
+
+func newSecretFiles() *secretFiles {
+	return &secretFiles{files: make(map[string]secretFile)}
+}
+
+// lookup returns the secret in the named file, without surrounding space.
+func (s *secretFiles) lookup(name string) (string, error) {
+	s.mu.Lock()
+	f, ok := s.files[name]
+	s.mu.Unlock()
+	if ok {
+		return f.value, nil
+	}
+	if _, err := s.reload(name); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[name].value, nil
+}
+
+// Run checks the files read so far for changes every interval until ctx is
+// done.
+func (s *secretFiles) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			names := make([]string, 0, len(s.files))
+			for name := range s.files {
+				names = append(names, name)
+			}
+			s.mu.Unlock()
+			for _, name := range names {
+				if changed, err := s.reload(name); err != nil {
+					log.Printf("Failed to reload secret file %s, still using the previous secret: %v", name, err)
+				} else if changed {
+					log.Printf("Reloaded secret file %s", name)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload reads the named file if it has changed since it was last read.
+func (s *secretFiles) reload(name string) (bool, error) {
+	version, err := fileVersion(name)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	unchanged := s.files[name].version == version
+	s.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	value := strings.TrimSpace(string(b))
+	if value == "" {
+		// Most likely caught part way through being written
+		return false, fmt.Errorf("secret file %s is empty", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = secretFile{value: value, version: version}
+	return true, nil
+}
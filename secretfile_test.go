@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSecretFileReload(t *testing.T) {
+	// GIVEN a secret read from a file
+	name := filepath.Join(t.TempDir(), "api_key")
+	if err := os.WriteFile(name, []byte("old-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := newSecretFiles()
+	if v, err := s.lookup(name); err != nil || v != "old-key" {
+		t.Fatalf("expected old-key, got %q %v", v, err)
+	}
+
+	// WHEN the file is caught part way through being rewritten
+	if err := os.WriteFile(name, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN the old secret is still used
+	if _, err := s.reload(name); err == nil {
+		t.Error("expected an empty file not to load")
+	}
+	if v, _ := s.lookup(name); v != "old-key" {
+		t.Errorf("expected old-key, got %q", v)
+	}
+
+	// WHEN it's rotated
+	if err := os.WriteFile(name, []byte("rotated-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN the new secret is used
+	if changed, err := s.reload(name); !changed || err != nil {
+		t.Fatalf("expected the new secret to load, got %v %v", changed, err)
+	}
+	if v, _ := s.lookup(name); v != "rotated-key" {
+		t.Errorf("expected rotated-key, got %q", v)
+	}
+	if changed, _ := s.reload(name); changed {
+		t.Error("expected an unchanged file not to be reloaded")
+	}
+}
+
+func TestSecretFileReferences(t *testing.T) {
+	cfg := testConfig()
+	cfg.SecretFileDir = t.TempDir()
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN an upstream whose API key is in a file
+		name := filepath.Join(cfg.SecretFileDir, "api_key")
+		if err := os.WriteFile(name, []byte("k3y"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		var seen string
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			seen = req.URL.Query().Get("api_key")
+			mu.Unlock()
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "orders", Callback: srv.URL, Query: &queryRules{Set: map[string]string{"api_key": fileRefPrefix + name}}}, t)
+
+		// WHEN it's called
+		resp, err := http.Get(url + "/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it gets the secret
+		mu.Lock()
+		defer mu.Unlock()
+		if resp.StatusCode != 200 || seen != "k3y" {
+			t.Errorf("expected 200 with the API key, got %v %q", resp.StatusCode, seen)
+		}
+	})
+}
+
+func TestFileReferenceValidation(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	for _, name := range []string{"api_key", "link"} {
+		if err := os.WriteFile(filepath.Join(outside, name), []byte("TOPSECRET"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "api_key"), []byte("k3y"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "api_key"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		dir   string
+		ref   string
+		valid bool
+	}{
+		{dir, "file:" + filepath.Join(dir, "api_key"), true},
+		{dir, "file:api_key", false},
+		{"", "file:" + filepath.Join(dir, "api_key"), false},
+		{dir, "file:" + filepath.Join(outside, "api_key"), false},
+		{dir, "file:" + dir + "/../" + filepath.Base(outside) + "/api_key", false},
+		{dir, "file:" + filepath.Join(dir, "link"), false},
+		{dir, "file:" + filepath.Join(dir, "missing"), false},
+		{dir, "file:" + dir, false},
+	} {
+		u := upstream{Name: "orders", Callback: "http://orders", Query: &queryRules{Set: map[string]string{"api_key": test.ref}}}
+		err := validateSecretRefs(u, secretRefPolicy{fileDir: test.dir})
+		if (err == nil) != test.valid {
+			t.Errorf("%s in %q: expected valid %v, got %v", test.ref, test.dir, test.valid, err)
+		}
+	}
+}
+
+func TestFileReferenceOutsideDirIsNotRegistered(t *testing.T) {
+	cfg := testConfig()
+	cfg.SecretFileDir = t.TempDir()
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a file outside the secrets directory
+		name := filepath.Join(t.TempDir(), "leak")
+		if err := os.WriteFile(name, []byte("TOPSECRET"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		// WHEN an upstream is registered to have it sent to its callback
+		b, _ := json.Marshal(upstream{Name: "thief", Callback: "http://thief", Query: &queryRules{Set: map[string]string{"leak": fileRefPrefix + name}}})
+		resp, err := http.Post(url+"/register", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN it's refused
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", resp.StatusCode)
+		}
+	})
+}
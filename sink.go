@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink delivers requests to one kind of upstream, chosen by the scheme of
+// its callback, so the modes orchestrating calls to upstreams needn't know
+// how each is reached. Deliver is given the original request, its buffered
+// body and the parsed callback, and returns the upstream's response, or a
+// synthetic one for sinks which don't have their own.
+type Sink interface {
+	Deliver(req *http.Request, body *requestBody, ups upstream, callback *url.URL) (*http.Response, error)
+}
+
+// newSinks returns the sinks available to p, by callback scheme.
+func newSinks(p *RegProxy, cfg Config) map[string]Sink {
+	h := &httpSink{p: p}
+	amqp := newAMQPPublishers()
+	sinks := map[string]Sink{
+		"http":  h,
+		"https": h,
+		"kafka": newKafkaProducers(),
+		"amqp":  amqp,
+		"amqps": amqp,
+	}
+	if cfg.FileSinkDir != "" {
+		sinks["file"] = &fileSink{dir: cfg.FileSinkDir}
+	}
+	if len(cfg.ExecSinks) > 0 {
+		sinks["exec"] = &execSink{commands: cfg.ExecSinks}
+	}
+	return sinks
+}
+
+// accepted is the response of sinks which have no response of their own,
+// once they have taken a request.
+func accepted(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "202 Accepted",
+		StatusCode: http.StatusAccepted,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// credentialHeaders are left out of the messages published to brokers,
+// written to files or handed to commands, where anyone who can read them
+// could replay them
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
+
+// messageHeaders returns the request headers to publish with a message to a
+// broker, or pass to another sink, without credentials or anything only
+// meant for the proxy.
+func messageHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	h.Del(callbackHeader)
+	for _, k := range credentialHeaders {
+		h.Del(k)
+	}
+	removeHopByHopHeaders(h)
+	return h
+}
+
+// httpSink proxies requests to HTTP upstreams.
+type httpSink struct {
+	p *RegProxy
+}
+
+func (s *httpSink) Deliver(req *http.Request, body *requestBody, ups upstream, callback *url.URL) (*http.Response, error) {
+	p := s.p
+	// Note although there is an existing
+	// net/http/httputil.ReverseProxy implementation, it doesn't let us
+	// forward to _multiple_ upstreams and choose a response based on header
+	// so we can't use it here unfortunately
+	if p.isSelf(callback) {
+		log.Printf("Not forwarding request %s to upstream %s at %s, which is this proxy", req.URL.Path, ups.Name, callback)
+		return nil, errLoopDetected
+	}
+	req2 := req.Clone(p.conns.trace(withEgressProxy(req.Context(), ups.Proxy), ups.Name))
+	req2.RequestURI = "" // Isn't allowed to be set on client requests
+	req2.Header.Del(callbackHeader)
+	removeHopByHopHeaders(req2.Header)
+	if d := deliveryFrom(req.Context()); d != nil {
+		req2.Header.Set(requestIDHeader, d.requestID)
+		injectTrace(req2.Header, d.trace, p.cfg.TracePropagation)
+	}
+	p.addForwardingHeaders(req, req2)
+	req2.ContentLength = body.size
+	if body.size == 0 {
+		req2.Body = http.NoBody
+	} else {
+		req2.Body = body.reader()
+	}
+	targetURL(req2.URL, callback, ups, p.cfg.PathMode)
+	log.Printf("Forwarding request %s to upstream %s at %s", req2.URL.Path, ups.Name, callback)
+	resp2, err := p.client.Do(req2)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Printf("Cancelled request %s to upstream %s at %s", req2.URL.Path, ups.Name, callback)
+		} else {
+			log.Printf("Error forwarding request %s to upstream %s at %s: %v", req2.URL.Path, ups.Name, callback, err)
+		}
+		return nil, err
+	}
+	log.Printf("Success forwarding request %s to upstream %s at %s: %v", req2.URL.Path, ups.Name, callback, resp2.StatusCode)
+	return resp2, nil
+}
+
+// fileRecord is a request as appended to a file sink, one JSON object per
+// line.
+type fileRecord struct {
+	RequestID string      `json:"requestId"`
+	Received  time.Time   `json:"received"`
+	Method    string      `json:"method"`
+	Path      string      `json:"path"`
+	Header    http.Header `json:"header"`
+	// Body is base64 encoded, as it needn't be text
+	Body string `json:"body"`
+}
+
+// fileSink appends requests to files under dir, for upstreams registered as
+// file:///name.jsonl. Registrations can't reach outside dir.
+type fileSink struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (s *fileSink) Deliver(req *http.Request, body *requestBody, ups upstream, callback *url.URL) (*http.Response, error) {
+	name, err := fileSinkPath(s.dir, callback)
+	if err != nil {
+		return nil, err
+	}
+	r := body.reader()
+	data, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, err
+	}
+	rec := fileRecord{
+		Received: time.Now(),
+		Method:   req.Method,
+		Path:     req.URL.RequestURI(),
+		Header:   messageHeaders(req.Header),
+		Body:     base64.StdEncoding.EncodeToString(data),
+	}
+	if d := deliveryFrom(req.Context()); d != nil {
+		rec.RequestID = d.requestID
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("Error writing request %s for upstream %s to %s: %v", req.URL.Path, ups.Name, name, err)
+		return nil, err
+	}
+	log.Printf("Wrote request %s for upstream %s to %s", req.URL.Path, ups.Name, name)
+	return accepted(req), nil
+}
+
+// fileSinkPath resolves a file callback within dir.
+func fileSinkPath(dir string, callback *url.URL) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(callback.Path, "/")))
+	if callback.Host != "" || rel == "." || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("file callback [%s] must name a file in the sink directory, as file:///name.jsonl", callback)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// execSink runs a command configured on this proxy for each request, for
+// upstreams registered as exec://name. Registrations can only name
+// commands, never choose what is run. The body is the command's stdin, and
+// the request line, ID and headers are in its environment, which otherwise
+// only has the proxy's PATH. A command which exits successfully is a 200
+// response with its output as the body.
+type execSink struct {
+	commands map[string]string
+}
+
+func (s *execSink) Deliver(req *http.Request, body *requestBody, ups upstream, callback *url.URL) (*http.Response, error) {
+	command, ok := s.commands[callback.Host]
+	if !ok {
+		return nil, fmt.Errorf("no exec sink command named [%s]", callback.Host)
+	}
+	headers, err := json.Marshal(messageHeaders(req.Header))
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(req.Context(), command)
+	// Only PATH is passed on from the proxy's own environment, which may hold
+	// its secrets
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"REGPROXY_METHOD=" + req.Method,
+		"REGPROXY_PATH=" + req.URL.RequestURI(),
+		"REGPROXY_HEADERS=" + string(headers),
+	}
+	if d := deliveryFrom(req.Context()); d != nil {
+		cmd.Env = append(cmd.Env, "REGPROXY_REQUEST_ID="+d.requestID)
+	}
+	stdin := body.reader()
+	defer stdin.Close()
+	cmd.Stdin = stdin
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	log.Printf("Running %s for request %s to upstream %s", command, req.URL.Path, ups.Name)
+	if err := cmd.Run(); err != nil {
+		log.Printf("Error running %s for request %s to upstream %s: %v: %s", command, req.URL.Path, ups.Name, err, strings.TrimSpace(stderr.String()))
+		return nil, fmt.Errorf("exec sink %s: %w", callback.Host, err)
+	}
+	resp := accepted(req)
+	resp.Status, resp.StatusCode = "200 OK", http.StatusOK
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.ContentLength = int64(stdout.Len())
+	resp.Body = io.NopCloser(&stdout)
+	return resp, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	cfg := testConfig()
+	cfg.FileSinkDir = t.TempDir()
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN
+		register(url, upstream{Name: "archive", Callback: "file:///archive/hooks.jsonl"}, t)
+
+		// WHEN
+		for _, body := range []string{"one", "two"} {
+			req, _ := http.NewRequest(http.MethodPost, url+"/hook", strings.NewReader(body))
+			req.Header.Set("Content-Type", "text/plain")
+			req.Header.Set("Authorization", "Bearer s3cret")
+			req.Header.Set("Cookie", "session=s3cret")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				t.Errorf("expected 202, got %v", resp.StatusCode)
+			}
+		}
+
+		// THEN each request is a line of the file
+		f, err := os.Open(filepath.Join(cfg.FileSinkDir, "archive", "hooks.jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var bodies []string
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var rec fileRecord
+			if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+				t.Fatal(err)
+			}
+			b, _ := base64.StdEncoding.DecodeString(rec.Body)
+			bodies = append(bodies, string(b))
+			if rec.Method != "POST" || rec.Path != "/hook" || rec.Header.Get("Content-Type") != "text/plain" || rec.RequestID == "" {
+				t.Errorf("unexpected record %+v", rec)
+			}
+			if strings.Contains(s.Text(), "s3cret") {
+				t.Errorf("expected credentials to be left out, got %s", s.Text())
+			}
+		}
+		if strings.Join(bodies, ",") != "one,two" {
+			t.Errorf("unexpected bodies %v", bodies)
+		}
+	})
+}
+
+func TestFileCallbackStaysInSinkDir(t *testing.T) {
+	for _, callback := range []string{"file:///../escape.jsonl", "file://host/x.jsonl", "file:///"} {
+		if err := validateUpstream(upstream{Name: "a", Callback: callback}); err == nil {
+			t.Errorf("expected %s to be rejected", callback)
+		}
+	}
+}
+
+func TestExecSink(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "sink.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$REGPROXY_METHOD $REGPROXY_PATH $(cat)\"\nif env | grep -q s3cret; then echo leaked; fi\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REGPROXY_TEST_SECRET", "s3cret")
+	cfg := testConfig()
+	cfg.ExecSinks = map[string]string{"echo": script}
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN
+		register(url, upstream{Name: "script", Callback: "exec://echo"}, t)
+
+		// WHEN
+		req, _ := http.NewRequest(http.MethodPost, url+"/hook", strings.NewReader("payload"))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		req.Header.Set("X-Api-Key", "s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		// THEN the command ran, without the credentials or the proxy's environment
+		out, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(out) != "POST /hook payload\n" {
+			t.Errorf("unexpected response %v %q", resp.StatusCode, out)
+		}
+	})
+}
+
+func TestDisabledSink(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN exec sinks aren't enabled
+		register(url, upstream{Name: "script", Callback: "exec://echo"}, t)
+
+		// WHEN
+		status := getStatus(url, t)
+
+		// THEN
+		if status != http.StatusInternalServerError {
+			t.Errorf("expected 500, got %v", status)
+		}
+	})
+}
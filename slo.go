@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sloBucketWidth is the resolution SLO calls are counted at
+const sloBucketWidth = time.Minute
+
+// sloBuckets covers the longest of sloWindows
+const sloBuckets = 360
+
+// sloWindows are the windows error budget burn rates are measured over, in
+// pairs of a short and long window for alerting on fast and slow burns as
+// in the Google SRE workbook.
+var sloWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+// upstreamSLO is an objective for the calls to an upstream. A call is good
+// if it succeeds, and within LatencyMs if that's set.
+type upstreamSLO struct {
+	// Target is the share of calls which should be good, e.g. 0.999
+	Target float64 `json:"target"`
+	// LatencyMs optionally counts successful calls slower than this as bad
+	LatencyMs int64 `json:"latencyMs,omitempty"`
+}
+
+func validateSLO(slo *upstreamSLO) error {
+	if slo == nil {
+		return nil
+	}
+	if slo.Target <= 0 || slo.Target >= 1 {
+		return errors.New("slo target must be between 0 and 1, e.g. 0.999")
+	}
+	if slo.LatencyMs < 0 {
+		return errors.New("slo latencyMs can't be negative")
+	}
+	return nil
+}
+
+// good says whether a call counts towards the objective.
+func (slo *upstreamSLO) good(statuses statusRanges, resp *http.Response, err error, took time.Duration) bool {
+	if err != nil || !statuses.contains(resp.StatusCode) {
+		return false
+	}
+	return slo.LatencyMs == 0 || took <= time.Duration(slo.LatencyMs)*time.Millisecond
+}
+
+// sloTracker counts good and total calls to upstreams with an SLO, by
+// minute, over the longest window.
+type sloTracker struct {
+	mu        sync.Mutex
+	upstreams map[string]*[sloBuckets]sloBucket
+}
+
+type sloBucket struct {
+	minute      int64
+	good, total int64
+}
+
+func newSLOTracker() *sloTracker {
+	return &sloTracker{upstreams: make(map[string]*[sloBuckets]sloBucket)}
+}
+
+func (t *sloTracker) observe(name string, good bool, now time.Time) {
+	minute := now.Unix() / int64(sloBucketWidth/time.Second)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	buckets := t.upstreams[name]
+	if buckets == nil {
+		buckets = new([sloBuckets]sloBucket)
+		t.upstreams[name] = buckets
+	}
+	b := &buckets[minute%sloBuckets]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+// burnRate is how fast the upstream is spending its error budget over the
+// window: 1 spends it exactly over the SLO's period, 14.4 in a fiftieth of a
+// 30 day period. It's 0 without any calls.
+func (t *sloTracker) burnRate(name string, target float64, window time.Duration, now time.Time) float64 {
+	minute := now.Unix() / int64(sloBucketWidth/time.Second)
+	from := minute - int64(window/sloBucketWidth)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	buckets := t.upstreams[name]
+	if buckets == nil {
+		return 0
+	}
+	var good, total int64
+	for _, b := range buckets {
+		if b.minute > from && b.minute <= minute {
+			good += b.good
+			total += b.total
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(total-good) / float64(total) / (1 - target)
+}
+
+// retain forgets upstreams which are no longer tracked.
+func (t *sloTracker) retain(names map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name := range t.upstreams {
+		if !names[name] {
+			delete(t.upstreams, name)
+		}
+	}
+}
+
+// sloStatus is an upstream's SLO and its burn rates, by window.
+type sloStatus struct {
+	Upstream  string             `json:"upstream"`
+	Target    float64            `json:"target"`
+	BurnRates map[string]float64 `json:"burnRates"`
+}
+
+// sloStatuses reports on every registered upstream with an SLO, by name.
+func (p *RegProxy) sloStatuses() ([]sloStatus, error) {
+	upstreams, err := p.storage.All()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var statuses []sloStatus
+	names := make(map[string]bool)
+	for _, u := range upstreams {
+		if u.SLO == nil {
+			continue
+		}
+		names[u.Name] = true
+		s := sloStatus{Upstream: u.Name, Target: u.SLO.Target, BurnRates: make(map[string]float64, len(sloWindows))}
+		for _, w := range sloWindows {
+			s.BurnRates[w.name] = p.slos.burnRate(u.Name, u.SLO.Target, w.d, now)
+		}
+		statuses = append(statuses, s)
+	}
+	p.slos.retain(names)
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Upstream < statuses[j].Upstream })
+	return statuses, nil
+}
+
+// sloBurnRateGauge is the value of regproxy_slo_burn_rate.
+func (p *RegProxy) sloBurnRateGauge() map[string]float64 {
+	statuses, err := p.sloStatuses()
+	if err != nil {
+		return nil
+	}
+	values := make(map[string]float64)
+	for _, s := range statuses {
+		for window, rate := range s.BurnRates {
+			values[labelKey([]string{s.Upstream, window})] = rate
+		}
+	}
+	return values
+}
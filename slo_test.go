@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSLOBurnRate(t *testing.T) {
+	// GIVEN 100 calls in the last few minutes, 2 of them bad, and older bad calls
+	slos := newSLOTracker()
+	now := time.Now()
+	for i := range 100 {
+		slos.observe("foo", i >= 2, now.Add(-time.Duration(i)*time.Second))
+	}
+	for range 10 {
+		slos.observe("foo", false, now.Add(-2*time.Hour))
+	}
+
+	// WHEN
+	recent := slos.burnRate("foo", 0.99, 5*time.Minute, now)
+	longer := slos.burnRate("foo", 0.99, 6*time.Hour, now)
+
+	// THEN 2% bad against a budget of 1% burns it twice as fast
+	if math.Abs(recent-2) > 1e-9 {
+		t.Errorf("expected a 5m burn rate of 2, got %v", recent)
+	}
+	if math.Abs(longer-float64(12)/110/0.01) > 1e-9 {
+		t.Errorf("expected the older calls in the 6h burn rate, got %v", longer)
+	}
+	if got := slos.burnRate("bar", 0.99, time.Hour, now); got != 0 {
+		t.Errorf("expected no burn without calls, got %v", got)
+	}
+}
+
+func TestSLOGood(t *testing.T) {
+	slo := &upstreamSLO{Target: 0.99, LatencyMs: 100}
+	ok := &http.Response{StatusCode: 200}
+	for name, tt := range map[string]struct {
+		resp *http.Response
+		err  error
+		took time.Duration
+		want bool
+	}{
+		"fast success": {resp: ok, took: 50 * time.Millisecond, want: true},
+		"slow success": {resp: ok, took: 150 * time.Millisecond},
+		"failure":      {resp: &http.Response{StatusCode: 503}, took: time.Millisecond},
+		"error":        {err: errLoopDetected},
+	} {
+		if got := slo.good(defaultSuccessStatuses, tt.resp, tt.err, tt.took); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", name, tt.want, got)
+		}
+	}
+}
+
+func TestSLOMetrics(t *testing.T) {
+	storage := &RegStorageMemory{upstreams: make(map[string]upstream)}
+	rp := NewRegProxy(testConfig(), storage)
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN an upstream with an SLO which fails every call
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "foo", Callback: srv.URL, SLO: &upstreamSLO{Target: 0.9}}, t)
+
+		// WHEN
+		r, err := http.Post(url+"/orders", "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Body.Close()
+
+		// THEN the whole budget is burnt ten times over
+		if got := rp.sloBurnRateGauge()[labelKey([]string{"foo", "5m"})]; math.Abs(got-10) > 1e-9 {
+			t.Errorf("expected a burn rate of 10, got %v", got)
+		}
+		statuses, err := rp.sloStatuses()
+		if err != nil || len(statuses) != 1 || statuses[0].Upstream != "foo" || statuses[0].Target != 0.9 {
+			t.Errorf("unexpected statuses %+v, %v", statuses, err)
+		}
+		stats, err := rp.grpcStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.GetSlos()) != 1 || stats.GetSlos()[0].GetTarget() != 0.9 {
+			t.Errorf("expected the SLO in the stats, got %v", stats.GetSlos())
+		}
+	})
+}
+
+func TestValidateSLO(t *testing.T) {
+	for _, slo := range []*upstreamSLO{{Target: 0}, {Target: 1}, {Target: 0.99, LatencyMs: -1}} {
+		if err := validateSLO(slo); err == nil {
+			t.Errorf("expected %+v to be rejected", slo)
+		}
+	}
+	if err := validateSLO(&upstreamSLO{Target: 0.999, LatencyMs: 250}); err != nil {
+		t.Error(err)
+	}
+}
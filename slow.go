@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Slow upstream event states, as reported by regproxy_slow_upstream_events_total
+const (
+	slowStateSlow      = "slow"
+	slowStateRecovered = "recovered"
+)
+
+// latencySamples is how many recent calls are kept per upstream
+const latencySamples = 512
+
+// slowCheckInterval is how often upstream latencies are checked
+const slowCheckInterval = 10 * time.Second
+
+// slowEvent is logged, counted and POSTed to the webhook when an upstream
+// becomes slow or recovers.
+type slowEvent struct {
+	Upstream string    `json:"upstream"`
+	State    string    `json:"state"`
+	P95Ms    int64     `json:"p95Ms"`
+	SLOMs    int64     `json:"sloMs"`
+	Since    time.Time `json:"since"`
+}
+
+// slowDetector watches the rolling p95 latency of calls to each upstream.
+// An upstream whose p95 stays above the SLO for the sustain period is
+// reported as slow, and as recovered once it drops back below, so we hear
+// about a degrading upstream before its callers do.
+type slowDetector struct {
+	slo     time.Duration
+	window  time.Duration
+	sustain time.Duration
+	webhook string
+	client  *http.Client
+	events  *counterVec
+
+	mu        sync.Mutex
+	upstreams map[string]*upstreamLatency
+}
+
+type latencySample struct {
+	at   time.Time
+	took time.Duration
+}
+
+type upstreamLatency struct {
+	samples [latencySamples]latencySample
+	next    int
+	// breachedSince is when the p95 first went over the SLO, zero while
+	// it's within it
+	breachedSince time.Time
+	slow          bool
+}
+
+func (d *slowDetector) observe(name string, took time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u := d.upstreams[name]
+	if u == nil {
+		u = &upstreamLatency{}
+		d.upstreams[name] = u
+	}
+	u.samples[u.next] = latencySample{at: time.Now(), took: took}
+	u.next = (u.next + 1) % latencySamples
+}
+
+// Run checks latencies every slowCheckInterval until ctx is done.
+func (d *slowDetector) Run(ctx context.Context) {
+	t := time.NewTicker(slowCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			d.check(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check compares each upstream's p95 over the window with the SLO, raising
+// events for any which have changed state.
+func (d *slowDetector) check(now time.Time) []slowEvent {
+	d.mu.Lock()
+	var events []slowEvent
+	for name, u := range d.upstreams {
+		p95, ok := u.p95(now.Add(-d.window))
+		if !ok {
+			continue
+		}
+		breached := p95 > d.slo
+		switch {
+		case breached && u.breachedSince.IsZero():
+			u.breachedSince = now
+		case !breached:
+			u.breachedSince = time.Time{}
+		}
+		e := slowEvent{Upstream: name, P95Ms: p95.Milliseconds(), SLOMs: d.slo.Milliseconds()}
+		if breached && !u.slow && now.Sub(u.breachedSince) >= d.sustain {
+			u.slow = true
+			e.State, e.Since = slowStateSlow, u.breachedSince
+			events = append(events, e)
+		} else if !breached && u.slow {
+			u.slow = false
+			e.State, e.Since = slowStateRecovered, now
+			events = append(events, e)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, e := range events {
+		d.events.inc(e.Upstream, e.State)
+		log.Printf("Upstream %s is %s: p95 latency %dms against an SLO of %dms", e.Upstream, e.State, e.P95Ms, e.SLOMs)
+		if d.webhook != "" {
+			go d.notify(e)
+		}
+	}
+	return events
+}
+
+// p95 over the samples taken since from, if there are any.
+func (u *upstreamLatency) p95(from time.Time) (time.Duration, bool) {
+	took, n := u.quantile(from, 95)
+	return took, n > 0
+}
+
+// quantile returns the latency which percent of the samples taken since from
+// are within, and how many samples there were.
+func (u *upstreamLatency) quantile(from time.Time, percent int) (time.Duration, int) {
+	var recent []time.Duration
+	for _, s := range u.samples {
+		if !s.at.IsZero() && s.at.After(from) {
+			recent = append(recent, s.took)
+		}
+	}
+	if len(recent) == 0 {
+		return 0, 0
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	return recent[(len(recent)*percent+99)/100-1], len(recent)
+}
+
+func (d *slowDetector) notify(e slowEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	r, err := d.client.Post(d.webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Printf("Failed to send slow upstream event to %s: %v", d.webhook, err)
+		return
+	}
+	_ = r.Body.Close()
+	if !isSuccess(r) {
+		log.Printf("Slow upstream webhook %s returned %d", d.webhook, r.StatusCode)
+	}
+}
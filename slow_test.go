@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestSlowDetector(webhook string) *slowDetector {
+	return &slowDetector{
+		slo:       100 * time.Millisecond,
+		window:    time.Minute,
+		sustain:   30 * time.Second,
+		webhook:   webhook,
+		client:    http.DefaultClient,
+		events:    newProxyMetrics().slowEvents,
+		upstreams: make(map[string]*upstreamLatency),
+	}
+}
+
+func TestSlowUpstreamNeedsSustainedBreach(t *testing.T) {
+	// GIVEN an upstream whose p95 is over the SLO
+	d := newTestSlowDetector("")
+	for i := 0; i < 10; i++ {
+		d.observe("a", 200*time.Millisecond)
+	}
+	now := time.Now()
+
+	// WHEN it has only just breached
+	if events := d.check(now); len(events) != 0 {
+		t.Fatalf("expected no events yet, got %v", events)
+	}
+
+	// WHEN it has stayed over for the sustain period
+	d.observe("a", 200*time.Millisecond)
+	events := d.check(now.Add(30 * time.Second))
+
+	// THEN
+	if len(events) != 1 || events[0].State != slowStateSlow || events[0].P95Ms != 200 {
+		t.Fatalf("expected a slow event, got %v", events)
+	}
+	if n := d.events.value("a", slowStateSlow); n != 1 {
+		t.Errorf("expected the event counted, got %v", n)
+	}
+}
+
+func TestSlowUpstreamRecovers(t *testing.T) {
+	// GIVEN a slow upstream and a webhook
+	received := make(chan slowEvent, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e slowEvent
+		_ = json.NewDecoder(r.Body).Decode(&e)
+		received <- e
+	}))
+	defer hook.Close()
+	d := newTestSlowDetector(hook.URL)
+	d.sustain = 0
+	d.observe("a", time.Second)
+	d.check(time.Now())
+
+	// WHEN it speeds up enough to bring the p95 back under
+	for i := 0; i < 100; i++ {
+		d.observe("a", time.Millisecond)
+	}
+	events := d.check(time.Now())
+
+	// THEN
+	if len(events) != 1 || events[0].State != slowStateRecovered {
+		t.Fatalf("expected a recovered event, got %v", events)
+	}
+	for _, state := range []string{slowStateSlow, slowStateRecovered} {
+		select {
+		case e := <-received:
+			if e.Upstream != "a" {
+				t.Errorf("unexpected webhook event %v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected a %s webhook event", state)
+		}
+	}
+}
+
+func TestP95(t *testing.T) {
+	u := &upstreamLatency{}
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		u.samples[i] = latencySample{at: now, took: time.Duration(i) * time.Millisecond}
+	}
+	if p95, _ := u.p95(now.Add(-time.Second)); p95 != 95*time.Millisecond {
+		t.Errorf("expected 95ms, got %v", p95)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// snapshotVersion is bumped whenever the snapshot format changes
+// incompatibly, so that imports of newer snapshots are refused rather than
+// half understood.
+const snapshotVersion = 1
+
+// registrySnapshot is a complete copy of the registry, for backup, disaster
+// recovery and moving registrations between environments.
+type registrySnapshot struct {
+	Version   int        `json:"version"`
+	Exported  time.Time  `json:"exported"`
+	Instance  string     `json:"instance,omitempty"`
+	Upstreams []upstream `json:"upstreams"`
+}
+
+// exportRegistry handles GET /admin/registry/export.
+func (p *RegProxy) exportRegistry(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(resp, http.MethodGet)
+		return
+	}
+	list, err := p.sortedUpstreams()
+	if err != nil {
+		errResp(resp, err)
+		return
+	}
+	resp.Header().Set("Content-Disposition", `attachment; filename="regproxy-registry.json"`)
+	writeJSON(resp, http.StatusOK, registrySnapshot{
+		Version:   snapshotVersion,
+		Exported:  time.Now().UTC(),
+		Instance:  p.cfg.InstanceID,
+		Upstreams: list,
+	})
+}
+
+// importRegistry handles POST /admin/registry/import, restoring a snapshot
+// from exportRegistry. Like PUT /upstreams it replaces the registry unless
+// ?mode=merge is given, and applies all of the snapshot or none of it.
+func (p *RegProxy) importRegistry(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		methodNotAllowed(resp, http.MethodPost)
+		return
+	}
+	mode, err := bulkMode(req)
+	if err != nil {
+		badRequest(resp, err.Error())
+		return
+	}
+	var snap registrySnapshot
+	if err := json.NewDecoder(req.Body).Decode(&snap); err != nil {
+		badRequest(resp, err.Error())
+		return
+	}
+	if snap.Version != snapshotVersion {
+		badRequest(resp, fmt.Sprintf("Unsupported snapshot version [%d], expected %d", snap.Version, snapshotVersion))
+		return
+	}
+	incoming, err := p.validateUpstreams(snap.Upstreams)
+	if err != nil {
+		badRequest(resp, err.Error())
+		return
+	}
+	// An import restores the registrations as they were, whatever is there
+	if err := p.applyUpstreams(incoming, mode, true); err != nil {
+		errResp(resp, err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
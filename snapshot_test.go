@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRegistryExportImport(t *testing.T) {
+	labelled := upstream{Name: "a", Callback: "http://a", Priority: 1, Proxy: egressDirect, Labels: map[string]string{"team": "records"}}
+	var exported []byte
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN
+		register(url, labelled, t)
+
+		// WHEN
+		r, err := http.Get(url + "/admin/registry/export")
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN another instance with its own registrations
+		register(url, upstream{Name: "b", Callback: "http://b"}, t)
+
+		// WHEN the snapshot is imported
+		r := doJSON(t, "POST", url+"/admin/registry/import", string(exported), nil)
+
+		// THEN the registry matches the exported one, labels and options included
+		if r.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected 204, got %v", r.StatusCode)
+		}
+		g, err := http.Get(url + "/upstreams")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer g.Body.Close()
+		var list []upstream
+		if err := json.NewDecoder(g.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(list, []upstream{labelled}) {
+			t.Errorf("unexpected registry %v", list)
+		}
+	})
+}
+
+func TestRegistryImportRejectsUnknownVersion(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		r := doJSON(t, "POST", url+"/admin/registry/import", `{"version":99,"upstreams":[]}`, nil)
+		if r.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400, got %v", r.StatusCode)
+		}
+	})
+}
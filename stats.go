@@ -0,0 +1,56 @@
+package main
+
+import "net/http"
+
+// adminStats is the proxy's current load, as served at GET /admin/stats and
+// by the gRPC GetStats.
+type adminStats struct {
+	Upstreams             int         `json:"upstreams"`
+	RequestsInFlight      int64       `json:"requestsInFlight"`
+	UpstreamCallsInFlight int64       `json:"upstreamCallsInFlight"`
+	Leader                bool        `json:"leader"`
+	QueuedRequests        int         `json:"queuedRequests"`
+	SLOs                  []sloStatus `json:"slos,omitempty"`
+	// UpstreamBytes and TenantBytes are the body bytes this instance has
+	// sent and received since it started, by upstream and tenant
+	UpstreamBytes map[string]byteCounts `json:"upstreamBytes,omitempty"`
+	TenantBytes   map[string]byteCounts `json:"tenantBytes,omitempty"`
+	// Connections are the transport's connections to each upstream
+	Connections map[string]connCounts `json:"connections,omitempty"`
+}
+
+func (p *RegProxy) stats() (adminStats, error) {
+	upstreams, err := p.storage.All()
+	if err != nil {
+		return adminStats{}, err
+	}
+	slos, err := p.sloStatuses()
+	if err != nil {
+		return adminStats{}, err
+	}
+	return adminStats{
+		Upstreams:             len(upstreams),
+		RequestsInFlight:      p.admission.inFlight.Load(),
+		UpstreamCallsInFlight: p.calls.inFlight.Load(),
+		Leader:                p.leader.isLeader(),
+		QueuedRequests:        p.queues.length(),
+		SLOs:                  slos,
+		UpstreamBytes:         byteStats(p.metrics.upstreamBytes),
+		TenantBytes:           byteStats(p.metrics.tenantBytes),
+		Connections:           p.conns.counts(),
+	}, nil
+}
+
+// statsReport handles GET /admin/stats.
+func (p *RegProxy) statsReport(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		methodNotAllowed(resp, http.MethodGet, http.MethodHead)
+		return
+	}
+	stats, err := p.stats()
+	if err != nil {
+		errResp(resp, err)
+		return
+	}
+	writeJSON(resp, http.StatusOK, stats)
+}
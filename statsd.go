@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsD line formats
+const (
+	statsdPlain = "statsd"
+	statsdDog   = "dogstatsd"
+)
+
+// maxStatsDPacket keeps StatsD datagrams within a typical Ethernet MTU
+const maxStatsDPacket = 1432
+
+// statsdExporter pushes the metrics to a StatsD server every interval, for
+// monitoring stacks which don't scrape Prometheus. Counters are sent as the
+// increase since the last push and gauges as their value. With DogStatsD,
+// labels such as the upstream become tags; plain StatsD has no tags, so
+// their values are appended to the metric name instead.
+type statsdExporter struct {
+	reg    *registry
+	conn   net.Conn
+	prefix string
+	dog    bool
+	tags   []string
+
+	// last holds the counter values last pushed, by series
+	last map[string]float64
+}
+
+func newStatsDExporter(reg *registry, addr, prefix, format string, tags []string) (*statsdExporter, error) {
+	if format != statsdPlain && format != statsdDog {
+		return nil, fmt.Errorf("unknown statsd format %s, expected %s or %s", format, statsdPlain, statsdDog)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdExporter{reg: reg, conn: conn, prefix: prefix, dog: format == statsdDog, tags: tags, last: make(map[string]float64)}, nil
+}
+
+// Run pushes the metrics every interval until ctx is done.
+func (e *statsdExporter) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := e.push(); err != nil {
+				log.Printf("Failed to push metrics to statsd: %v", err)
+			}
+		}
+	}
+}
+
+// push sends every metric's current value, batching lines into datagrams.
+func (e *statsdExporter) push() error {
+	var packet bytes.Buffer
+	var err error
+	send := func() {
+		if packet.Len() > 0 {
+			if _, werr := e.conn.Write(packet.Bytes()); werr != nil && err == nil {
+				err = werr
+			}
+			packet.Reset()
+		}
+	}
+	e.reg.visit(func(name, _, kind string, labels, values []string, value float64) {
+		line := e.line(name, kind, labels, values, value)
+		if line == "" {
+			return
+		}
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsDPacket {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	})
+	send()
+	return err
+}
+
+// line formats one value, or returns "" if a counter hasn't changed.
+func (e *statsdExporter) line(name, kind string, labels, values []string, value float64) string {
+	stat := e.prefix + strings.TrimPrefix(name, "regproxy_")
+	tags := e.tags
+	if e.dog {
+		for i, l := range labels {
+			if i < len(values) {
+				tags = append(tags[:len(tags):len(tags)], l+":"+statsdSanitize(values[i]))
+			}
+		}
+	} else {
+		for _, v := range values {
+			stat += "." + statsdSanitize(v)
+		}
+	}
+	typ := "g"
+	if kind == "counter" {
+		series := stat + "|" + strings.Join(tags, ",")
+		delta := value - e.last[series]
+		e.last[series] = value
+		if delta == 0 {
+			return ""
+		}
+		typ, value = "c", delta
+	}
+	line := stat + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + typ
+	if e.dog && len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// statsdSanitize replaces the characters with a meaning in StatsD lines, or
+// metric names, in a label value.
+func statsdSanitize(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', ',', '#', '@', '.', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, v)
+}
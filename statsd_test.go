@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func statsdServer(t *testing.T) (*net.UDPConn, func() []string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn, func() []string {
+		buf := make([]byte, maxStatsDPacket)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		slices.Sort(lines)
+		return lines
+	}
+}
+
+func TestStatsDExport(t *testing.T) {
+	// GIVEN
+	conn, read := statsdServer(t)
+	reg := newRegistry()
+	retries := reg.counter("regproxy_retries_total", "", "upstream")
+	reg.gaugeFunc("regproxy_requests_in_flight", "", func() float64 { return 3 })
+	retries.add(2, "foo")
+	e, err := newStatsDExporter(reg, conn.LocalAddr().String(), "regproxy.", statsdDog, []string{"env:test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN
+	if err := e.push(); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN labels are tags
+	want := []string{"regproxy.requests_in_flight:3|g|#env:test", "regproxy.retries_total:2|c|#env:test,upstream:foo"}
+	if got := read(); !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// WHEN pushed again
+	retries.inc("foo")
+	if err := e.push(); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN counters are sent as their increase
+	want = []string{"regproxy.requests_in_flight:3|g|#env:test", "regproxy.retries_total:1|c|#env:test,upstream:foo"}
+	if got := read(); !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestStatsDPlainNames(t *testing.T) {
+	// GIVEN plain StatsD, without tags
+	conn, read := statsdServer(t)
+	reg := newRegistry()
+	reg.counter("regproxy_probe_results_total", "", "upstream", "result").inc("foo.bar", "success")
+	e, err := newStatsDExporter(reg, conn.LocalAddr().String(), "rp.", statsdPlain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN
+	if err := e.push(); err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN labels are part of the name
+	want := []string{"rp.probe_results_total.foo_bar.success:1|c"}
+	if got := read(); !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
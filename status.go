@@ -0,0 +1,114 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Which response wins when upstreams disagree
+const (
+	preferError   = "error"
+	preferSuccess = "success"
+)
+
+// Status policies, choosing the response returned when several upstreams
+// answer
+const (
+	// statusLatest returns the latest error or success, by -prefer
+	statusLatest = "latest"
+	// statusPrimary returns the primary upstream's response
+	statusPrimary = "primary"
+	// statusWorst and statusBest rank responses by rankResults
+	statusWorst = "worst"
+	statusBest  = "best"
+	// statusFixed returns -fixed-status with every upstream's outcome
+	statusFixed = "fixed"
+)
+
+var statusPolicies = []string{statusLatest, statusPrimary, statusWorst, statusBest, statusFixed}
+
+// rankResults returns the worst or best result, so the same outcomes always
+// give the same status whatever order they completed in. From best to worst
+// they are successes, failed responses, then errors, and within each lower
+// statuses are better. Ties go to the earlier upstream by priority and name.
+func (p *RegProxy) rankResults(results []result, worst bool) result {
+	severity := func(r result) int {
+		switch {
+		case r.err != nil:
+			return 1000
+		case p.ok(r):
+			return r.resp.StatusCode - 1000
+		}
+		return r.resp.StatusCode
+	}
+	return slices.MinFunc(results, func(a, b result) int {
+		c := cmp.Compare(severity(a), severity(b))
+		if worst {
+			c = -c
+		}
+		return cmp.Or(c, comparePriority(a.ups, b.ups))
+	})
+}
+
+type statusRange struct {
+	min, max int
+}
+
+// statusRanges is a set of HTTP status codes, written like 200-299,304.
+type statusRanges []statusRange
+
+// defaultSuccessStatuses is what counts as success unless configured otherwise
+var defaultSuccessStatuses = statusRanges{{200, 399}}
+
+func parseStatusRanges(s string) (statusRanges, error) {
+	var res statusRanges
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		if !isRange {
+			hi = lo
+		}
+		min, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status range [%s]: %w", part, err)
+		}
+		max, err := strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status range [%s]: %w", part, err)
+		}
+		if min < 100 || max > 599 || min > max {
+			return nil, fmt.Errorf("invalid status range [%s]", part)
+		}
+		res = append(res, statusRange{min, max})
+	}
+	return res, nil
+}
+
+// contains reports whether code is in the set. An empty set is treated as
+// the default success statuses.
+func (s statusRanges) contains(code int) bool {
+	if len(s) == 0 {
+		s = defaultSuccessStatuses
+	}
+	for _, r := range s {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func (s statusRanges) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		if r.min == r.max {
+			parts[i] = strconv.Itoa(r.min)
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", r.min, r.max)
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseStatusRanges(t *testing.T) {
+	r, err := parseStatusRanges("200-299, 304")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for code, expected := range map[int]bool{200: true, 299: true, 304: true, 302: false, 404: false} {
+		if r.contains(code) != expected {
+			t.Errorf("contains(%d) expected %v", code, expected)
+		}
+	}
+	if r.String() != "200-299,304" {
+		t.Errorf("unexpected string %s", r)
+	}
+	for _, invalid := range []string{"", "abc", "300-200", "200-999"} {
+		if _, err := parseStatusRanges(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func withStatusUpstreams(url string, t *testing.T, statuses ...int) func() {
+	var servers []*httptest.Server
+	for i, status := range statuses {
+		status := status
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			rr.WriteHeader(status)
+		}))
+		servers = append(servers, srv)
+		register(url, upstream{Name: string(rune('a' + i)), Callback: srv.URL}, t)
+	}
+	return func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+}
+
+func getStatus(url string, t *testing.T) int {
+	// Don't follow the redirects the test upstreams hand out
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	r, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Body.Close()
+	return r.StatusCode
+}
+
+func TestSuccessStatuses(t *testing.T) {
+	cfg := testConfig()
+	cfg.SuccessStatuses = statusRanges{{200, 299}}
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN a redirect no longer counts as success
+		defer withStatusUpstreams(url, t, 200, 302)()
+
+		// THEN the redirect is treated as the failure
+		if status := getStatus(url, t); status != 302 {
+			t.Errorf("expected 302, got %v", status)
+		}
+	})
+}
+
+func TestPreferSuccess(t *testing.T) {
+	cfg := testConfig()
+	cfg.Prefer = preferSuccess
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN one healthy upstream and one failing
+		defer withStatusUpstreams(url, t, 200, 500)()
+
+		// THEN the success is returned
+		if status := getStatus(url, t); status != 200 {
+			t.Errorf("expected 200, got %v", status)
+		}
+	})
+}
+
+func TestPreferSuccessAllFailing(t *testing.T) {
+	cfg := testConfig()
+	cfg.Prefer = preferSuccess
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		defer withStatusUpstreams(url, t, 503, 503)()
+		if status := getStatus(url, t); status != 503 {
+			t.Errorf("expected 503, got %v", status)
+		}
+	})
+}
+
+func TestStatusPolicies(t *testing.T) {
+	for _, c := range []struct {
+		policy   string
+		statuses []int
+		expected int
+	}{
+		{statusPrimary, []int{200, 503}, 200},
+		{statusPrimary, []int{404, 200}, 404},
+		{statusWorst, []int{404, 503, 200}, 503},
+		{statusWorst, []int{200, 204}, 204},
+		{statusBest, []int{404, 503, 204}, 204},
+		{statusBest, []int{503, 404}, 404},
+	} {
+		cfg := testConfig()
+		cfg.StatusPolicy = c.policy
+		withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+			// GIVEN upstreams answering with different statuses
+			defer withStatusUpstreams(url, t, c.statuses...)()
+
+			// THEN the policy picks the same status whichever answers last
+			for range 3 {
+				if status := getStatus(url, t); status != c.expected {
+					t.Errorf("%s of %v: expected %v, got %v", c.policy, c.statuses, c.expected, status)
+				}
+			}
+		})
+	}
+}
+
+func TestFixedStatusPolicy(t *testing.T) {
+	cfg := testConfig()
+	cfg.StatusPolicy = statusFixed
+	cfg.FixedStatus = http.StatusMultiStatus
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN one healthy upstream and one failing
+		defer withStatusUpstreams(url, t, 200, 500)()
+
+		// WHEN
+		r, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+
+		// THEN the fixed status is returned, with each upstream's outcome
+		var report deliveryReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != http.StatusMultiStatus || report.Status != http.StatusMultiStatus || len(report.Upstreams) != 2 {
+			t.Errorf("expected 207 with both outcomes, got %v %+v", r.StatusCode, report)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"sync"
+	"time"
+)
+
+// storageMinBackoff is how soon storage is checked again after it fails
+const storageMinBackoff = time.Second
+
+// storageHealth checks the storage backend periodically, keeping the last
+// registry read from it. While the backend is down the proxy is degraded:
+// requests are routed with that snapshot rather than failing, or waiting on
+// a backend which isn't answering, and it's checked again with exponential
+// backoff until it recovers. Backends dial afresh after a failure, so that's
+// all reconnecting takes.
+//
+// For remote backends the snapshot is also a read-through cache: requests
+// are always routed with it, refreshed every interval and after each change
+// made through this instance, so a slow backend never holds them up.
+type storageHealth struct {
+	storage    RegStorage
+	interval   time.Duration
+	maxBackoff time.Duration
+	cache      bool
+
+	mu       sync.Mutex
+	snapshot map[string]upstream
+	// downSince is when the backend started failing, zero while it's healthy
+	downSince time.Time
+}
+
+func newStorageHealth(storage RegStorage, cfg Config) *storageHealth {
+	h := &storageHealth{storage: storage, interval: cfg.StorageHealthInterval, maxBackoff: cfg.StorageMaxBackoff}
+	if cfg.StorageCacheRefresh > 0 && isRemoteStorage(storage) {
+		h.cache, h.interval = true, cfg.StorageCacheRefresh
+	}
+	return h
+}
+
+// isRemoteStorage says whether every read of storage goes over the network.
+func isRemoteStorage(storage RegStorage) bool {
+	switch storage.(type) {
+	case *RegStorageRedis, *RegStorageDynamo:
+		return true
+	}
+	return false
+}
+
+// all returns the registry to route a request with: the cached one, or the
+// backend's while it's healthy, otherwise the last one read from it if there
+// is one.
+func (h *storageHealth) all() (map[string]upstream, error) {
+	h.mu.Lock()
+	if h.snapshot != nil && (h.cache || !h.downSince.IsZero()) {
+		// Callers may change the map
+		snapshot := maps.Clone(h.snapshot)
+		h.mu.Unlock()
+		return snapshot, nil
+	}
+	h.mu.Unlock()
+	upstreams, err := h.storage.All()
+	h.observe(upstreams, err)
+	if err != nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.snapshot != nil {
+			return maps.Clone(h.snapshot), nil
+		}
+		return nil, err
+	}
+	return upstreams, nil
+}
+
+// observe records the outcome of reading the registry from the backend.
+func (h *storageHealth) observe(upstreams map[string]upstream, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case err != nil && h.downSince.IsZero():
+		h.downSince = time.Now()
+		if h.snapshot != nil {
+			log.Printf("Storage is down, routing with the last known registry of %d upstreams: %v", len(h.snapshot), err)
+		} else {
+			log.Printf("Storage is down, with no registry to fall back on: %v", err)
+		}
+	case err == nil:
+		if !h.downSince.IsZero() {
+			log.Printf("Storage has recovered after %v", time.Since(h.downSince).Round(time.Second))
+			h.downSince = time.Time{}
+		}
+		h.snapshot = maps.Clone(upstreams)
+	}
+}
+
+// changed refreshes the cache after this instance has changed the registry.
+func (h *storageHealth) changed() {
+	if h.cache {
+		h.check()
+	}
+}
+
+// healthy says whether the backend answered when last asked.
+func (h *storageHealth) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.downSince.IsZero()
+}
+
+// check reads the registry from the backend, returning whether it worked.
+func (h *storageHealth) check() bool {
+	upstreams, err := h.storage.All()
+	h.observe(upstreams, err)
+	return err == nil
+}
+
+// Run checks the backend every interval until ctx is done, backing off from
+// storageMinBackoff to maxBackoff while it's down.
+func (h *storageHealth) Run(ctx context.Context) {
+	var backoff time.Duration
+	wait := h.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if h.check() {
+			backoff, wait = 0, h.interval
+		} else {
+			backoff = min(max(backoff*2, storageMinBackoff), h.maxBackoff)
+			wait = backoff
+		}
+	}
+}
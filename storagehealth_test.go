@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// flakyStorage is in-memory storage which can be made to fail, counting
+// reads.
+type flakyStorage struct {
+	RegStorageMemory
+	down  atomic.Bool
+	reads atomic.Int32
+}
+
+func (s *flakyStorage) All() (map[string]upstream, error) {
+	s.reads.Add(1)
+	if s.down.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return s.RegStorageMemory.All()
+}
+
+func TestStorageDegradedMode(t *testing.T) {
+	storage := &flakyStorage{RegStorageMemory: RegStorageMemory{upstreams: make(map[string]upstream)}}
+	rp := NewRegProxy(testConfig(), storage)
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN an upstream registered while storage was up
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "foo", Callback: srv.URL}, t)
+		if r, err := http.Get(url + "/orders"); err != nil {
+			t.Fatal(err)
+		} else {
+			_ = r.Body.Close()
+		}
+
+		// WHEN storage goes down
+		storage.down.Store(true)
+		r, err := http.Get(url + "/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Body.Close()
+
+		// THEN requests are still routed with the last known registry
+		if r.StatusCode != http.StatusOK || calls.Load() != 2 {
+			t.Errorf("expected the request to be proxied, got %d after %d calls", r.StatusCode, calls.Load())
+		}
+		if health := getHealth(url, t); !strings.Contains(health, "warn") {
+			t.Errorf("expected a warning from the health check, got %s", health)
+		}
+
+		// WHEN it recovers THEN the proxy notices at its next check
+		storage.down.Store(false)
+		if !rp.stored.check() || !strings.Contains(getHealth(url, t), "pass") {
+			t.Error("expected storage to have recovered")
+		}
+	})
+}
+
+func TestStorageDownWithoutSnapshot(t *testing.T) {
+	// GIVEN storage which has never answered
+	storage := &flakyStorage{RegStorageMemory: RegStorageMemory{upstreams: make(map[string]upstream)}}
+	storage.down.Store(true)
+	h := newStorageHealth(storage, testConfig())
+
+	// WHEN THEN there's nothing to fall back on
+	if _, err := h.all(); err == nil {
+		t.Error("expected an error")
+	}
+	if h.healthy() {
+		t.Error("expected storage to be unhealthy")
+	}
+}
+
+func TestStorageCache(t *testing.T) {
+	// GIVEN a cache over storage
+	storage := &flakyStorage{RegStorageMemory: RegStorageMemory{upstreams: make(map[string]upstream)}}
+	_ = storage.Put(upstream{Name: "foo", Callback: "http://foo"})
+	h := &storageHealth{storage: storage, cache: true}
+
+	// WHEN routing several requests
+	for range 3 {
+		if upstreams, err := h.all(); err != nil || len(upstreams) != 1 {
+			t.Fatalf("unexpected %v, %v", upstreams, err)
+		}
+	}
+
+	// THEN storage is only read the first time
+	if n := storage.reads.Load(); n != 1 {
+		t.Errorf("expected one read, got %d", n)
+	}
+
+	// WHEN the registry is changed through this instance
+	_ = storage.Put(upstream{Name: "bar", Callback: "http://bar"})
+	h.changed()
+
+	// THEN the change is seen straight away
+	if upstreams, _ := h.all(); len(upstreams) != 2 {
+		t.Errorf("expected the cache to be refreshed, got %v", upstreams)
+	}
+}
+
+func getHealth(url string, t *testing.T) string {
+	r, err := http.Get(url + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	b, _ := io.ReadAll(r.Body)
+	return string(b)
+}
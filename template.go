@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// callbackVar matches the variables of a templated callback:
+// {{.Header.Name}}, {{.Query.name}}, {{.Method}} and {{.PathSuffix}}.
+var callbackVar = regexp.MustCompile(`\{\{\s*\.(\w+)(?:\.([\w-]+))?\s*\}\}`)
+
+// templateSentinel stands in for variables when checking where they are
+const templateSentinel = "regproxy-template-var"
+
+func isCallbackTemplate(callback string) bool {
+	return strings.Contains(callback, "{{")
+}
+
+// validateCallbackTemplate checks that a templated callback only uses known
+// variables, and only after its host, so that requests can't choose where
+// they are sent.
+func validateCallbackTemplate(callback string) error {
+	var err error
+	filled := callbackVar.ReplaceAllStringFunc(callback, func(v string) string {
+		m := callbackVar.FindStringSubmatch(v)
+		switch {
+		case (m[1] == "Header" || m[1] == "Query") && m[2] != "":
+		case (m[1] == "Method" || m[1] == "PathSuffix") && m[2] == "":
+		default:
+			err = fmt.Errorf("unknown callback template variable %s", v)
+		}
+		return templateSentinel
+	})
+	if err != nil {
+		return err
+	}
+	if strings.Contains(filled, "{{") || strings.Contains(filled, "}}") {
+		return fmt.Errorf("invalid callback template [%s]", callback)
+	}
+	u, err := url.Parse(filled)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(u.Scheme, templateSentinel) || strings.Contains(u.Host, templateSentinel) || strings.Contains(u.User.String(), templateSentinel) {
+		return fmt.Errorf("callback template [%s] may only use variables after the host", callback)
+	}
+	return nil
+}
+
+// expandCallback fills in a templated callback's variables from req. Values
+// are escaped, except PathSuffix, the request's path without its leading
+// slash, which may span several segments.
+func expandCallback(callback string, req *http.Request) (string, error) {
+	var err error
+	expanded := callbackVar.ReplaceAllStringFunc(callback, func(v string) string {
+		m := callbackVar.FindStringSubmatch(v)
+		var value string
+		switch m[1] {
+		case "Header":
+			value = req.Header.Get(m[2])
+		case "Query":
+			value = req.URL.Query().Get(m[2])
+		case "Method":
+			value = req.Method
+		case "PathSuffix":
+			return strings.TrimPrefix(req.URL.EscapedPath(), "/")
+		}
+		if value == "" || value == "." || value == ".." {
+			err = fmt.Errorf("no usable value for %s in callback template", v)
+		}
+		return url.PathEscape(value)
+	})
+	return expanded, err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTemplatedCallback(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN
+		var gotPath string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotPath = r.URL.EscapedPath()
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "tenant", Callback: srv.URL + "/hooks/{{.Header.X-Tenant}}/{{ .PathSuffix }}"}, t)
+
+		// WHEN
+		req, _ := http.NewRequest("POST", url+"/orders/1", nil)
+		req.Header.Set("X-Tenant", "acme/eu")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN the tenant is one escaped segment
+		if resp.StatusCode != 200 || gotPath != "/hooks/acme%2Feu/orders/1" {
+			t.Errorf("unexpected %v to path %s", resp.StatusCode, gotPath)
+		}
+
+		// WHEN the header is missing
+		if status := getStatus(url, t); status != http.StatusInternalServerError {
+			t.Errorf("expected 500 without a tenant, got %v", status)
+		}
+	})
+}
+
+func TestCallbackTemplateValidation(t *testing.T) {
+	for callback, valid := range map[string]bool{
+		"http://host/{{.Header.X-Tenant}}/{{.PathSuffix}}?m={{.Method}}": true,
+		"http://host/{{.Query.region}}":                                  true,
+		"http://{{.Header.Host}}/hook":                                   false,
+		"http://host/{{.Body}}":                                          false,
+		"http://host/{{.Header}}":                                        false,
+		"http://host/{{.Header.X-Tenant":                                 false,
+	} {
+		if err := validateUpstream(upstream{Name: "a", Callback: callback}); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", callback, valid, err)
+		}
+	}
+}
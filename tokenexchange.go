@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExchangeGrant is the RFC 8693 grant type
+const tokenExchangeGrant = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+// maxExchangedTokens bounds the cache of exchanged tokens
+const maxExchangedTokens = 10000
+
+// tokenExchange swaps the bearer token of requests to an upstream for one
+// it accepts, for upstreams in a different auth realm to the clients. It
+// either exchanges the token at an RFC 8693 Endpoint, or looks it up in
+// Static, a fixed mapping from inbound tokens to the upstream's, where
+// "*" maps any other token. Requests without a token, or whose token can't
+// be exchanged, aren't sent to the upstream at all.
+type tokenExchange struct {
+	Endpoint     string            `json:"endpoint,omitempty"`
+	ClientID     string            `json:"clientId,omitempty"`
+	ClientSecret string            `json:"clientSecret,omitempty"`
+	Audience     string            `json:"audience,omitempty"`
+	Scope        string            `json:"scope,omitempty"`
+	Static       map[string]string `json:"static,omitempty"`
+}
+
+func validateTokenExchange(x *tokenExchange) error {
+	if x == nil {
+		return nil
+	}
+	if (x.Endpoint == "") == (len(x.Static) == 0) {
+		return errors.New("tokenExchange needs either an endpoint or a static mapping")
+	}
+	if x.Endpoint != "" {
+		u, err := url.Parse(x.Endpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid tokenExchange endpoint [%s]", x.Endpoint)
+		}
+	}
+	return nil
+}
+
+type exchangedToken struct {
+	token   string
+	expires time.Time
+}
+
+// tokenExchanger exchanges tokens, caching them until shortly before they
+// expire.
+type tokenExchanger struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]exchangedToken
+}
+
+func newTokenExchanger(client *http.Client) *tokenExchanger {
+	return &tokenExchanger{client: client, tokens: make(map[string]exchangedToken)}
+}
+
+// exchange returns req with its bearer token replaced by the one for ups,
+// if it has a token exchange.
+func (e *tokenExchanger) exchange(req *http.Request, ups upstream) (*http.Request, error) {
+	x := ups.TokenExchange
+	if x == nil {
+		return req, nil
+	}
+	inbound, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || inbound == "" {
+		return nil, fmt.Errorf("no bearer token to exchange for upstream %s", ups.Name)
+	}
+	var token string
+	if len(x.Static) > 0 {
+		if token, ok = x.Static[inbound]; !ok {
+			token, ok = x.Static["*"]
+		}
+		if !ok {
+			return nil, fmt.Errorf("no token mapped for upstream %s", ups.Name)
+		}
+	} else {
+		var err error
+		if token, err = e.fetch(req, ups.Name, x, inbound); err != nil {
+			log.Printf("Failed to exchange token for upstream %s: %v", ups.Name, err)
+			return nil, err
+		}
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
+
+func (e *tokenExchanger) fetch(req *http.Request, name string, x *tokenExchange, inbound string) (string, error) {
+	sum := sha256.Sum256([]byte(x.Endpoint + "\x00" + x.ClientID + "\x00" + x.Audience + "\x00" + x.Scope + "\x00" + inbound))
+	key := name + ":" + hex.EncodeToString(sum[:])
+	now := time.Now()
+	e.mu.Lock()
+	cached, ok := e.tokens[key]
+	e.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":         {tokenExchangeGrant},
+		"subject_token":      {inbound},
+		"subject_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+	}
+	if x.Audience != "" {
+		form.Set("audience", x.Audience)
+	}
+	if x.Scope != "" {
+		form.Set("scope", x.Scope)
+	}
+	treq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, x.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	treq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if x.ClientID != "" {
+		treq.SetBasicAuth(url.QueryEscape(x.ClientID), url.QueryEscape(x.ClientSecret))
+	}
+	resp, err := e.client.Do(treq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	_ = json.Unmarshal(body, &result)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, result.Error, result.Description)
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access_token")
+	}
+	if result.ExpiresIn > 0 {
+		// Leave a margin so tokens don't expire on their way to the upstream
+		expires := now.Add(time.Duration(result.ExpiresIn)*time.Second - min(30*time.Second, time.Duration(result.ExpiresIn)*time.Second/2))
+		e.mu.Lock()
+		if len(e.tokens) >= maxExchangedTokens {
+			for k, t := range e.tokens {
+				if now.After(t.expires) {
+					delete(e.tokens, k)
+				}
+			}
+			if len(e.tokens) >= maxExchangedTokens {
+				clear(e.tokens)
+			}
+		}
+		e.tokens[key] = exchangedToken{token: result.AccessToken, expires: expires}
+		e.mu.Unlock()
+	}
+	return result.AccessToken, nil
+}
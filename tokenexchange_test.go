@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestTokenExchange(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN a token endpoint, and upstreams seeing different tokens
+		var mu sync.Mutex
+		exchanges := 0
+		sts := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			_ = req.ParseForm()
+			id, secret, _ := req.BasicAuth()
+			if req.Form.Get("grant_type") != tokenExchangeGrant || req.Form.Get("audience") != "shadow" || id != "regproxy" || secret != "s3cret" {
+				writeJSON(rr, 400, map[string]string{"error": "invalid_request"})
+				return
+			}
+			mu.Lock()
+			exchanges++
+			mu.Unlock()
+			writeJSON(rr, 200, map[string]any{"access_token": "shadow-" + req.Form.Get("subject_token"), "expires_in": 300})
+		}))
+		defer sts.Close()
+		seen := make(map[string]string)
+		for _, ups := range []upstream{
+			{Name: "primary"},
+			{Name: "shadow", TokenExchange: &tokenExchange{Endpoint: sts.URL, ClientID: "regproxy", ClientSecret: "s3cret", Audience: "shadow"}},
+			{Name: "legacy", TokenExchange: &tokenExchange{Static: map[string]string{"client-token": "legacy-token"}}},
+		} {
+			srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				seen[ups.Name] = req.Header.Get("Authorization")
+				mu.Unlock()
+			}))
+			defer srv.Close()
+			ups.Callback = srv.URL
+			register(url, ups, t)
+		}
+
+		// WHEN
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", url, nil)
+			req.Header.Set("Authorization", "Bearer client-token")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("expected 200, got %v", resp.StatusCode)
+			}
+		}
+
+		// THEN each upstream gets its own token, exchanged once
+		mu.Lock()
+		defer mu.Unlock()
+		for name, want := range map[string]string{"primary": "Bearer client-token", "shadow": "Bearer shadow-client-token", "legacy": "Bearer legacy-token"} {
+			if seen[name] != want {
+				t.Errorf("expected %s to see %q, got %q", name, want, seen[name])
+			}
+		}
+		if exchanges != 1 {
+			t.Errorf("expected the exchanged token to be cached, got %d exchanges", exchanges)
+		}
+	})
+}
+
+func TestTokenExchangeUnmapped(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN an upstream with no mapping for the client's token
+		called := false
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			called = true
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "legacy", Callback: srv.URL, TokenExchange: &tokenExchange{Static: map[string]string{"other": "x"}}}, t)
+
+		// WHEN
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer client-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN the client's token isn't passed on
+		if called || resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("expected the upstream not to be called, got %v, called %v", resp.StatusCode, called)
+		}
+	})
+}
+
+func TestValidateTokenExchange(t *testing.T) {
+	for _, x := range []*tokenExchange{
+		{},
+		{Endpoint: "https://sts.test/token", Static: map[string]string{"*": "x"}},
+		{Endpoint: "ftp://sts.test"},
+	} {
+		if validateTokenExchange(x) == nil {
+			t.Errorf("expected %+v to be rejected", x)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Trace context propagation formats
+const (
+	traceW3C     = "w3c"
+	traceB3      = "b3"
+	traceB3Multi = "b3multi"
+)
+
+// Trace context headers
+const (
+	traceparentHeader    = "Traceparent"
+	b3Header             = "B3"
+	b3TraceIDHeader      = "X-B3-Traceid"
+	b3SpanIDHeader       = "X-B3-Spanid"
+	b3ParentSpanHeader   = "X-B3-Parentspanid"
+	b3SampledHeader      = "X-B3-Sampled"
+	b3FlagsHeader        = "X-B3-Flags"
+	traceIDLength        = 32
+	spanIDLength         = 16
+	b3ShortTraceIDLength = 16
+)
+
+// parseTracePropagation parses a comma separated list of formats.
+func parseTracePropagation(s string) ([]string, error) {
+	var formats []string
+	for _, f := range strings.Split(s, ",") {
+		switch f = strings.TrimSpace(f); f {
+		case traceW3C, traceB3, traceB3Multi:
+			formats = append(formats, f)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown trace propagation format %s, expected %s, %s or %s", f, traceW3C, traceB3, traceB3Multi)
+		}
+	}
+	return formats, nil
+}
+
+// traceContext identifies the caller's span, which the proxy doesn't record
+// spans of its own so passes on to upstreams as their parent.
+type traceContext struct {
+	traceID      string
+	spanID       string
+	parentSpanID string
+	sampled      bool
+	// deferred is set when the caller left the sampling decision to us
+	deferred bool
+}
+
+// extractTrace reads the caller's trace context from W3C or B3 headers,
+// starting a new trace if there is none.
+func extractTrace(h http.Header) traceContext {
+	if tc, ok := parseTraceparent(h.Get(traceparentHeader)); ok {
+		return tc
+	}
+	var tc traceContext
+	var ok bool
+	if b3 := h.Get(b3Header); b3 != "" {
+		tc, ok = parseB3(b3)
+	} else {
+		tc, ok = parseB3Multi(h)
+	}
+	if !ok {
+		// Start a new trace, keeping any sampling decision the caller made
+		tc = traceContext{traceID: randomHex(traceIDLength), spanID: randomHex(spanIDLength), sampled: tc.sampled, deferred: tc.deferred}
+	}
+	return tc
+}
+
+// parseTraceparent parses a W3C traceparent, accepting later versions as
+// the spec asks by only reading the fields of version 00.
+func parseTraceparent(v string) (traceContext, bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) || len(parts[3]) != 2 {
+		return traceContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || !validTraceID(parts[1], traceIDLength) || !validTraceID(parts[2], spanIDLength) {
+		return traceContext{}, false
+	}
+	return traceContext{traceID: parts[1], spanID: parts[2], sampled: flags[0]&1 == 1}, true
+}
+
+// parseB3 parses a single b3 header, which may hold just a sampling decision.
+// The decision is returned even when there are no IDs.
+func parseB3(v string) (traceContext, bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) == 1 {
+		sampled, ok := parseB3Sampled(parts[0])
+		return traceContext{sampled: sampled, deferred: !ok}, false
+	}
+	if len(parts) > 4 {
+		return traceContext{deferred: true}, false
+	}
+	tc := traceContext{traceID: b3TraceID(parts[0]), spanID: parts[1], deferred: true}
+	if len(parts) > 2 {
+		var ok bool
+		if tc.sampled, ok = parseB3Sampled(parts[2]); !ok {
+			return traceContext{deferred: true}, false
+		}
+		tc.deferred = false
+	}
+	if len(parts) > 3 {
+		tc.parentSpanID = parts[3]
+		if !validTraceID(tc.parentSpanID, spanIDLength) {
+			return traceContext{deferred: true}, false
+		}
+	}
+	if !validTraceID(tc.traceID, traceIDLength) || !validTraceID(tc.spanID, spanIDLength) {
+		return traceContext{deferred: true}, false
+	}
+	return tc, true
+}
+
+// parseB3Multi parses the X-B3-* headers.
+func parseB3Multi(h http.Header) (traceContext, bool) {
+	tc := traceContext{deferred: true}
+	if h.Get(b3FlagsHeader) == "1" {
+		tc.sampled, tc.deferred = true, false
+	} else if s := h.Get(b3SampledHeader); s != "" {
+		sampled, ok := parseB3Sampled(s)
+		tc.sampled, tc.deferred = sampled, !ok
+	}
+	tc.traceID, tc.spanID = b3TraceID(h.Get(b3TraceIDHeader)), h.Get(b3SpanIDHeader)
+	if !validTraceID(tc.traceID, traceIDLength) || !validTraceID(tc.spanID, spanIDLength) {
+		return traceContext{sampled: tc.sampled, deferred: tc.deferred}, false
+	}
+	if p := h.Get(b3ParentSpanHeader); validTraceID(p, spanIDLength) {
+		tc.parentSpanID = p
+	}
+	return tc, true
+}
+
+func parseB3Sampled(s string) (sampled, ok bool) {
+	switch s {
+	case "1", "d", "true":
+		return true, true
+	case "0", "false":
+		return false, true
+	}
+	return false, false
+}
+
+// b3TraceID widens a 64 bit B3 trace ID to the 128 bits W3C needs.
+func b3TraceID(id string) string {
+	if len(id) == b3ShortTraceIDLength {
+		return strings.Repeat("0", traceIDLength-b3ShortTraceIDLength) + id
+	}
+	return id
+}
+
+// validTraceID checks id is n lowercase hex digits, not all zero.
+func validTraceID(id string, n int) bool {
+	if len(id) != n || strings.Trim(id, "0") == "" {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n/2)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// injectTrace writes tc to h in each of the formats, leaving the headers of
+// other formats as the caller sent them.
+func injectTrace(h http.Header, tc traceContext, formats []string) {
+	if tc.traceID == "" {
+		return
+	}
+	sampled := "0"
+	if tc.sampled {
+		sampled = "1"
+	}
+	for _, f := range formats {
+		switch f {
+		case traceW3C:
+			h.Set(traceparentHeader, "00-"+tc.traceID+"-"+tc.spanID+"-0"+sampled)
+		case traceB3:
+			v := tc.traceID + "-" + tc.spanID
+			if !tc.deferred {
+				v += "-" + sampled
+				if tc.parentSpanID != "" {
+					v += "-" + tc.parentSpanID
+				}
+			}
+			h.Set(b3Header, v)
+		case traceB3Multi:
+			for _, k := range []string{b3TraceIDHeader, b3SpanIDHeader, b3ParentSpanHeader, b3SampledHeader, b3FlagsHeader} {
+				h.Del(k)
+			}
+			h.Set(b3TraceIDHeader, tc.traceID)
+			h.Set(b3SpanIDHeader, tc.spanID)
+			if tc.parentSpanID != "" {
+				h.Set(b3ParentSpanHeader, tc.parentSpanID)
+			}
+			if !tc.deferred {
+				h.Set(b3SampledHeader, sampled)
+			}
+		}
+	}
+}
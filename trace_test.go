@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtractTrace(t *testing.T) {
+	const traceID, spanID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", "05e3ac9a4f6e3b90"
+	for name, tt := range map[string]struct {
+		header http.Header
+		want   traceContext
+	}{
+		"traceparent": {
+			header: http.Header{traceparentHeader: {"00-" + traceID + "-" + spanID + "-01"}},
+			want:   traceContext{traceID: traceID, spanID: spanID, sampled: true},
+		},
+		"b3 single": {
+			header: http.Header{b3Header: {traceID + "-" + spanID + "-0-" + parentID}},
+			want:   traceContext{traceID: traceID, spanID: spanID, parentSpanID: parentID},
+		},
+		"b3 single, deferred": {
+			header: http.Header{b3Header: {traceID + "-" + spanID}},
+			want:   traceContext{traceID: traceID, spanID: spanID, deferred: true},
+		},
+		"b3 multi, 64 bit trace ID": {
+			header: http.Header{b3TraceIDHeader: {"a3ce929d0e0e4736"}, b3SpanIDHeader: {spanID}, b3SampledHeader: {"1"}},
+			want:   traceContext{traceID: "0000000000000000a3ce929d0e0e4736", spanID: spanID, sampled: true},
+		},
+		"b3 multi, debug": {
+			header: http.Header{b3TraceIDHeader: {traceID}, b3SpanIDHeader: {spanID}, b3FlagsHeader: {"1"}},
+			want:   traceContext{traceID: traceID, spanID: spanID, sampled: true},
+		},
+	} {
+		if got := extractTrace(tt.header); got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", name, tt.want, got)
+		}
+	}
+}
+
+func TestExtractTraceStartsNewTrace(t *testing.T) {
+	for name, tt := range map[string]struct {
+		header   http.Header
+		sampled  bool
+		deferred bool
+	}{
+		"none":              {header: http.Header{}, deferred: true},
+		"invalid":           {header: http.Header{traceparentHeader: {"00-00000000000000000000000000000000-00f067aa0ba902b7-01"}}, deferred: true},
+		"b3 sampling only":  {header: http.Header{b3Header: {"0"}}},
+		"X-B3-Sampled only": {header: http.Header{b3SampledHeader: {"0"}}},
+	} {
+		tc := extractTrace(tt.header)
+		if !validTraceID(tc.traceID, traceIDLength) || !validTraceID(tc.spanID, spanIDLength) || tc.parentSpanID != "" {
+			t.Errorf("%s: expected a new trace, got %+v", name, tc)
+		}
+		if tc.sampled != tt.sampled || tc.deferred != tt.deferred {
+			t.Errorf("%s: expected sampled %v deferred %v, got %+v", name, tt.sampled, tt.deferred, tc)
+		}
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	cfg := testConfig()
+	cfg.TracePropagation = []string{traceW3C, traceB3, traceB3Multi}
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// GIVEN an upstream recording what it receives
+		var received http.Header
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			received = req.Header.Clone()
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "foo", Callback: srv.URL}, t)
+
+		// WHEN a request arrives with a W3C trace context
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Body.Close()
+
+		// THEN it is passed on in every format
+		for h, want := range map[string]string{
+			traceparentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			b3Header:          "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+			b3TraceIDHeader:   "4bf92f3577b34da6a3ce929d0e0e4736",
+			b3SpanIDHeader:    "00f067aa0ba902b7",
+			b3SampledHeader:   "1",
+		} {
+			if got := received.Get(h); got != want {
+				t.Errorf("expected %s %q, got %q", h, want, got)
+			}
+		}
+	})
+}
+
+func TestParseTracePropagation(t *testing.T) {
+	if got, err := parseTracePropagation("w3c, b3multi"); err != nil || len(got) != 2 || got[1] != traceB3Multi {
+		t.Errorf("unexpected %v, %v", got, err)
+	}
+	if _, err := parseTracePropagation("jaeger"); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// Byte directions, from the proxy's side, as reported by
+// regproxy_upstream_bytes_total and regproxy_tenant_bytes_total
+const (
+	bytesSent     = "sent"
+	bytesReceived = "received"
+)
+
+// byteCounts are the body bytes sent to and received from an upstream or
+// a tenant, for capacity planning and cross-charging.
+type byteCounts struct {
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+// byteStats totals a bytes counter by its first label, upstream or tenant.
+func byteStats(c *counterVec) map[string]byteCounts {
+	stats := make(map[string]byteCounts)
+	c.visit(func(_, _, _ string, _, values []string, value float64) {
+		s := stats[values[0]]
+		switch values[1] {
+		case bytesSent:
+			s.Sent += int64(value)
+		case bytesReceived:
+			s.Received += int64(value)
+		}
+		stats[values[0]] = s
+	})
+	return stats
+}
+
+// countedBody counts the bytes read from a response body, handing the total
+// to done when it's closed.
+type countedBody struct {
+	io.ReadCloser
+	n    int64
+	done func(n int64)
+}
+
+func (b *countedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countedBody) Close() error {
+	if b.done != nil {
+		b.done(b.n)
+		b.done = nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// countingWriter counts the body bytes written to a client.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// countResponse counts the bytes of an upstream's response body as it's
+// read.
+func (p *RegProxy) countResponse(ups upstream, resp *http.Response) *http.Response {
+	resp.Body = &countedBody{ReadCloser: resp.Body, done: func(n int64) {
+		p.metrics.upstreamBytes.add(float64(n), ups.Name, bytesReceived)
+	}}
+	return resp
+}
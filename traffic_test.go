@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestByteCounts(t *testing.T) {
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		// GIVEN an upstream answering with 11 bytes
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			_, _ = rr.Write([]byte(`{"ok":true}`))
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "billing", Callback: srv.URL}, t)
+
+		// WHEN a tenant sends 17 bytes
+		req, _ := http.NewRequest("POST", url+"/invoices", strings.NewReader(`{"amount": 1234}`+"\n"))
+		req.Header.Set("X-Tenant-Id", "north")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN the bytes are counted both ways, for the upstream and the tenant
+		for _, c := range []struct {
+			counter  *counterVec
+			labels   []string
+			expected float64
+		}{
+			{rp.metrics.upstreamBytes, []string{"billing", bytesSent}, 17},
+			{rp.metrics.upstreamBytes, []string{"billing", bytesReceived}, 11},
+			{rp.metrics.tenantBytes, []string{"north", bytesReceived}, 17},
+			{rp.metrics.tenantBytes, []string{"north", bytesSent}, 11},
+		} {
+			if n := c.counter.value(c.labels...); n != c.expected {
+				t.Errorf("%v: expected %v bytes, got %v", c.labels, c.expected, n)
+			}
+		}
+
+		// AND they're in the stats
+		if resp, err = http.Get(url + "/admin/stats"); err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var stats adminStats
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats.UpstreamBytes["billing"] != (byteCounts{Sent: 17, Received: 11}) || stats.TenantBytes["north"] != (byteCounts{Sent: 11, Received: 17}) {
+			t.Errorf("unexpected byte counts %+v %+v", stats.UpstreamBytes, stats.TenantBytes)
+		}
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Translation outcomes, as reported by regproxy_translations_total
+const (
+	translationApplied = "applied"
+	translationSkipped = "skipped"
+	translationFailed  = "failed"
+)
+
+// translator converts a decoded JSON payload from one version to another,
+// so that consumers still on an old webhook schema can sit alongside new
+// ones behind the same endpoint. It reports false, leaving the payload as
+// it was, if the payload isn't at the version it converts from.
+type translator interface {
+	translate(payload any) (any, bool, error)
+}
+
+// mapping is a translator configured by a JSON document, which renames,
+// removes and sets fields, in that order. Field paths are dot-separated,
+// and in rename and remove a * segment matches any key or array index, a
+// renamed field's * segments being filled in from those it matched.
+type mapping struct {
+	// VersionField is the path to the payload's version, if it has one.
+	// Only payloads at version From are translated, and their version is
+	// then set to To.
+	VersionField string            `json:"versionField,omitempty"`
+	From         string            `json:"from,omitempty"`
+	To           string            `json:"to,omitempty"`
+	Rename       map[string]string `json:"rename,omitempty"`
+	Remove       []string          `json:"remove,omitempty"`
+	// Set values are decoded afresh for each payload, so that payloads
+	// never share them
+	Set map[string]json.RawMessage `json:"set,omitempty"`
+}
+
+// validateTranslations checks every translation an upstream names is one
+// this proxy has loaded.
+func validateTranslations(u upstream, translations map[string]translator) error {
+	for _, t := range u.Translations {
+		if _, ok := translations[t]; !ok {
+			return fmt.Errorf("translation [%s] needs -translation %s=<mapping file>", t, t)
+		}
+	}
+	return nil
+}
+
+// parseTranslation parses name=file, loading the mapping in file.
+func parseTranslation(s string) (string, translator, error) {
+	name, file, ok := strings.Cut(s, "=")
+	if !ok || name == "" || file == "" {
+		return "", nil, fmt.Errorf("expected name=file, got [%s]", s)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	var m mapping
+	if err := dec.Decode(&m); err != nil {
+		return "", nil, fmt.Errorf("invalid mapping %s: %w", file, err)
+	}
+	if err := m.validate(); err != nil {
+		return "", nil, fmt.Errorf("invalid mapping %s: %w", file, err)
+	}
+	return name, &m, nil
+}
+
+func (m *mapping) validate() error {
+	if m.VersionField != "" && (m.From == "" || m.To == "") {
+		return errors.New("a versionField needs the versions to translate from and to")
+	}
+	for from, to := range m.Rename {
+		if from == "" || to == "" {
+			return errors.New("fields can't be renamed from or to an empty path")
+		}
+		if strings.Count(from, "*") != strings.Count(to, "*") {
+			return fmt.Errorf("renaming %s to %s needs the same number of * segments in each", from, to)
+		}
+	}
+	if m.VersionField != "" && strings.Contains(m.VersionField, "*") {
+		return errors.New("the versionField can't have * segments")
+	}
+	for path := range m.Set {
+		if path == "" || strings.Contains(path, "*") {
+			return fmt.Errorf("can't set [%s], fields to set need a path without * segments", path)
+		}
+	}
+	return nil
+}
+
+func (m *mapping) translate(payload any) (any, bool, error) {
+	var version any
+	if m.VersionField != "" {
+		v, ok := fieldAt(payload, strings.Split(m.VersionField, "."))
+		if !ok || fmt.Sprint(v) != m.From {
+			return payload, false, nil
+		}
+		version = v
+	}
+	// In a stable order, so a mapping behaves the same every time
+	renames := make([]string, 0, len(m.Rename))
+	for from := range m.Rename {
+		renames = append(renames, from)
+	}
+	sort.Strings(renames)
+	for _, from := range renames {
+		to := m.Rename[from]
+		for _, match := range matchFields(payload, strings.Split(from, "."), nil) {
+			v, _ := fieldAt(payload, match.path)
+			removeField(payload, match.path)
+			if err := setField(&payload, fillWildcards(strings.Split(to, "."), match.wildcards), v); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	for _, path := range m.Remove {
+		for _, match := range matchFields(payload, strings.Split(path, "."), nil) {
+			removeField(payload, match.path)
+		}
+	}
+	for path, raw := range m.Set {
+		v, err := decodeJSONNumbers(bytes.NewReader(raw))
+		if err != nil {
+			return nil, false, err
+		}
+		if err := setField(&payload, strings.Split(path, "."), v); err != nil {
+			return nil, false, err
+		}
+	}
+	if m.VersionField != "" {
+		// Keep the version a number if it was one
+		var to any = m.To
+		if _, ok := version.(json.Number); ok {
+			if _, err := strconv.ParseFloat(m.To, 64); err == nil {
+				to = json.Number(m.To)
+			}
+		}
+		if err := setField(&payload, strings.Split(m.VersionField, "."), to); err != nil {
+			return nil, false, err
+		}
+	}
+	return payload, true, nil
+}
+
+// fieldMatch is a concrete field path matched by a path with * segments,
+// and the segments the *s matched, in order.
+type fieldMatch struct {
+	path      []string
+	wildcards []string
+}
+
+// matchFields returns the fields in v matching pattern, below prefix.
+func matchFields(v any, pattern []string, prefix *fieldMatch) []fieldMatch {
+	if prefix == nil {
+		prefix = &fieldMatch{}
+	}
+	if len(pattern) == 0 {
+		return []fieldMatch{*prefix}
+	}
+	var keys []string
+	switch vt := v.(type) {
+	case map[string]any:
+		if pattern[0] != "*" {
+			keys = []string{pattern[0]}
+		} else {
+			for k := range vt {
+				keys = append(keys, k)
+			}
+		}
+	case []any:
+		if pattern[0] != "*" {
+			keys = []string{pattern[0]}
+		} else {
+			for i := range vt {
+				keys = append(keys, strconv.Itoa(i))
+			}
+		}
+	}
+	var matches []fieldMatch
+	for _, k := range keys {
+		child, ok := fieldAt(v, []string{k})
+		if !ok {
+			continue
+		}
+		next := &fieldMatch{path: append(slices.Clone(prefix.path), k), wildcards: prefix.wildcards}
+		if pattern[0] == "*" {
+			next.wildcards = append(slices.Clone(prefix.wildcards), k)
+		}
+		matches = append(matches, matchFields(child, pattern[1:], next)...)
+	}
+	return matches
+}
+
+// fillWildcards replaces the * segments of path with those matched.
+func fillWildcards(path, wildcards []string) []string {
+	filled := make([]string, len(path))
+	for i, segment := range path {
+		if segment == "*" {
+			segment, wildcards = wildcards[0], wildcards[1:]
+		}
+		filled[i] = segment
+	}
+	return filled
+}
+
+// fieldAt returns the value at path in v, an object key or array index for
+// each segment.
+func fieldAt(v any, path []string) (any, bool) {
+	for _, segment := range path {
+		switch vt := v.(type) {
+		case map[string]any:
+			child, ok := vt[segment]
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []any:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(vt) {
+				return nil, false
+			}
+			v = vt[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// removeField deletes the object key at path. Array elements are left in
+// place, removing one would shift the indexes of the rest.
+func removeField(v any, path []string) {
+	parent, ok := fieldAt(v, path[:len(path)-1])
+	if obj, isObj := parent.(map[string]any); ok && isObj {
+		delete(obj, path[len(path)-1])
+	}
+}
+
+// setField sets the value at path in *v, creating objects along the way.
+func setField(v *any, path []string, value any) error {
+	if len(path) == 0 {
+		*v = value
+		return nil
+	}
+	switch vt := (*v).(type) {
+	case nil:
+		child := any(nil)
+		if err := setField(&child, path[1:], value); err != nil {
+			return err
+		}
+		*v = map[string]any{path[0]: child}
+	case map[string]any:
+		child := vt[path[0]]
+		if err := setField(&child, path[1:], value); err != nil {
+			return err
+		}
+		vt[path[0]] = child
+	case []any:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(vt) {
+			return fmt.Errorf("can't set index [%s] of an array of %d", path[0], len(vt))
+		}
+		return setField(&vt[i], path[1:], value)
+	default:
+		return fmt.Errorf("can't set field [%s] of a %T", path[0], vt)
+	}
+	return nil
+}
+
+// translate applies ups's translations to body in order, returning the
+// translated body, which the caller must close, or body itself if none
+// applied.
+func (p *RegProxy) translate(ups upstream, body *requestBody) (*requestBody, error) {
+	if len(ups.Translations) == 0 {
+		return body, nil
+	}
+	r := body.reader()
+	payload, err := decodeJSONNumbers(r)
+	_ = r.Close()
+	if err != nil {
+		p.metrics.translations.inc(ups.Translations[0], translationFailed)
+		return nil, fmt.Errorf("can't translate a body which isn't JSON: %w", err)
+	}
+	applied := false
+	for _, name := range ups.Translations {
+		t, ok := p.cfg.Translations[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown translation [%s]", name)
+		}
+		var translated bool
+		if payload, translated, err = t.translate(payload); err != nil {
+			p.metrics.translations.inc(name, translationFailed)
+			return nil, fmt.Errorf("translation %s failed: %w", name, err)
+		}
+		if translated {
+			p.metrics.translations.inc(name, translationApplied)
+			applied = true
+		} else {
+			p.metrics.translations.inc(name, translationSkipped)
+		}
+	}
+	if !applied {
+		return body, nil
+	}
+	buf := getBuffer()
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(payload); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	// Without the encoder's trailing newline
+	buf.Truncate(buf.Len() - 1)
+	return newRequestBody(buf, nil, int64(buf.Len())), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const v1ToV2 = `{
+	"versionField": "version",
+	"from": "1",
+	"to": "2",
+	"rename": {"patientId": "subject.id", "results.*.code": "results.*.loinc"},
+	"remove": ["legacy"],
+	"set": {"subject.type": "Patient"}
+}`
+
+func writeMapping(t *testing.T, name, mapping string) string {
+	file := filepath.Join(t.TempDir(), name+".json")
+	if err := os.WriteFile(file, []byte(mapping), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name + "=" + file
+}
+
+func TestMappingTranslate(t *testing.T) {
+	_, m, err := parseTranslation(writeMapping(t, "v1-to-v2", v1ToV2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		payload, expected string
+		translated        bool
+	}{
+		{
+			`{"version":1,"patientId":"p1","legacy":true,"results":[{"code":"718-7"},{"code":"4548-4"}]}`,
+			`{"results":[{"loinc":"718-7"},{"loinc":"4548-4"}],"subject":{"id":"p1","type":"Patient"},"version":2}`,
+			true,
+		},
+		// Already on v2, or unversioned
+		{`{"version":2,"patientId":"p1"}`, `{"patientId":"p1","version":2}`, false},
+		{`{"patientId":"p1"}`, `{"patientId":"p1"}`, false},
+	} {
+		payload, _ := decodeJSONNumbers(strings.NewReader(c.payload))
+		got, translated, err := m.translate(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(got)
+		if string(b) != c.expected || translated != c.translated {
+			t.Errorf("%s: expected %s (translated %t), got %s (%t)", c.payload, c.expected, c.translated, b, translated)
+		}
+	}
+}
+
+func TestParseTranslationRejectsMistakes(t *testing.T) {
+	for _, mapping := range []string{
+		`{"versionField": "version"}`,
+		`{"rename": {"items.*.code": "code"}}`,
+		`{"set": {"items.*.code": "x"}}`,
+		`{"renames": {}}`,
+	} {
+		if _, _, err := parseTranslation(writeMapping(t, "bad", mapping)); err == nil {
+			t.Errorf("expected %s to be rejected", mapping)
+		}
+	}
+	if _, _, err := parseTranslation("v1-to-v2"); err == nil {
+		t.Error("expected a translation without a file to be rejected")
+	}
+}
+
+func TestUpstreamTranslations(t *testing.T) {
+	// GIVEN an old consumer of v1 payloads and a new one of v2
+	name, m, err := parseTranslation(writeMapping(t, "v2-to-v1", `{"versionField": "version", "from": "2", "to": "1", "rename": {"subject.id": "patientId"}, "remove": ["subject"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.Translations = map[string]translator{name: m}
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+		received := make(chan string, 2)
+		for _, u := range []upstream{{Name: "old", Translations: []string{"v2-to-v1"}}, {Name: "new"}} {
+			name := u.Name
+			srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+				b, _ := io.ReadAll(req.Body)
+				received <- name + " " + string(b)
+			}))
+			defer srv.Close()
+			u.Callback = srv.URL
+			register(url, u, t)
+		}
+
+		// WHEN a v2 payload is sent
+		resp, err := http.Post(url+"/results", "application/json", strings.NewReader(`{"version":2,"subject":{"id":"p1"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		// THEN the old consumer gets it as v1, and the new one as it was sent
+		got := map[string]bool{<-received: true, <-received: true}
+		for _, expected := range []string{`old {"patientId":"p1","version":1}`, `new {"version":2,"subject":{"id":"p1"}}`} {
+			if !got[expected] {
+				t.Errorf("expected %s, got %v", expected, got)
+			}
+		}
+		if n := rp.metrics.translations.value("v2-to-v1", translationApplied); n != 1 {
+			t.Errorf("expected 1 translation, got %v", n)
+		}
+	})
+}
+
+func TestUnknownTranslationIsRefused(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// WHEN an upstream names a translation this proxy hasn't loaded
+		r := doJSON(t, "PUT", url+"/upstreams/old", `{"callback":"http://old","translations":["v2-to-v1"]}`, nil)
+
+		// THEN it's refused, rather than failing every request
+		if r.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400, got %v", r.StatusCode)
+		}
+	})
+}
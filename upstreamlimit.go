@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// upstreamLimitQueue waits for room under the upstream's rate, up to
+	// -upstream-rate-limit-max-wait
+	upstreamLimitQueue = "queue"
+	// upstreamLimitShed fails calls over the upstream's rate straight away
+	upstreamLimitShed = "shed"
+)
+
+var upstreamLimitPolicies = []string{upstreamLimitQueue, upstreamLimitShed}
+
+var errUpstreamRateLimited = errors.New("upstream rate limit exceeded")
+
+// upstreamRateLimit is the capacity an upstream declares when it registers,
+// which calls to it are smoothed to.
+type upstreamRateLimit struct {
+	// PerSecond is the sustained rate of calls
+	PerSecond float64 `json:"perSecond"`
+	// Burst is how many calls may be made at once after a quiet spell,
+	// defaulting to a second's worth
+	Burst int `json:"burst,omitempty"`
+	// Policy says whether calls over the rate wait, the default, or fail
+	Policy string `json:"policy,omitempty"`
+}
+
+func validateUpstreamRateLimit(l *upstreamRateLimit) error {
+	if l == nil {
+		return nil
+	}
+	if !(l.PerSecond > 0) {
+		return errors.New("rateLimit perSecond must be positive")
+	}
+	if l.Burst < 0 {
+		return errors.New("rateLimit burst can't be negative")
+	}
+	switch l.Policy {
+	case "", upstreamLimitQueue, upstreamLimitShed:
+	default:
+		return fmt.Errorf("unknown rateLimit policy [%s], expected one of %s", l.Policy, strings.Join(upstreamLimitPolicies, ", "))
+	}
+	return nil
+}
+
+func (l upstreamRateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return max(1, math.Ceil(l.PerSecond))
+}
+
+// tokenBucket holds up to burst tokens, refilled at the limit's rate, one
+// being taken for each call.
+type tokenBucket struct {
+	limit upstreamRateLimit
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token, returning how long until it may be used. If that's
+// longer than maxWait no token is taken, and it returns false.
+func (b *tokenBucket) reserve(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.limit.burst(), b.tokens+now.Sub(b.last).Seconds()*b.limit.PerSecond)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0, true
+	}
+	wait := time.Duration(-b.tokens / b.limit.PerSecond * float64(time.Second))
+	if wait > maxWait {
+		b.tokens++
+		return wait, false
+	}
+	return wait, true
+}
+
+// upstreamLimiters keeps a token bucket for each upstream registered with a
+// rate limit. The buckets are this instance's own, so with several
+// instances each allows the upstream's rate.
+type upstreamLimiters struct {
+	maxWait time.Duration
+	limited *counterVec
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newUpstreamLimiters(cfg Config, limited *counterVec) *upstreamLimiters {
+	return &upstreamLimiters{maxWait: cfg.UpstreamRateLimitMaxWait, limited: limited, buckets: make(map[string]*tokenBucket)}
+}
+
+// bucket returns ups's bucket, starting it afresh, full, if it's new or its
+// limit has changed.
+func (u *upstreamLimiters) bucket(ups upstream, now time.Time) *tokenBucket {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	b, ok := u.buckets[ups.Name]
+	if !ok || b.limit != *ups.RateLimit {
+		b = &tokenBucket{limit: *ups.RateLimit, tokens: ups.RateLimit.burst(), last: now}
+		u.buckets[ups.Name] = b
+	}
+	return b
+}
+
+// wait holds a call to ups until it's within the upstream's rate limit, or
+// fails it if it would have to wait too long, or not at all under the shed
+// policy.
+func (u *upstreamLimiters) wait(ctx context.Context, ups upstream) error {
+	if ups.RateLimit == nil {
+		return nil
+	}
+	maxWait := u.maxWait
+	if ups.RateLimit.Policy == upstreamLimitShed {
+		maxWait = 0
+	}
+	now := time.Now()
+	wait, ok := u.bucket(ups, now).reserve(now, maxWait)
+	if !ok {
+		u.limited.inc(ups.Name, "shed")
+		return errUpstreamRateLimited
+	}
+	if wait <= 0 {
+		return nil
+	}
+	u.limited.inc(ups.Name, "delayed")
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
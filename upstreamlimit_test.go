@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	// GIVEN 10 calls a second, 2 at once
+	now := time.Now()
+	b := &tokenBucket{limit: upstreamRateLimit{PerSecond: 10, Burst: 2}, tokens: 2, last: now}
+
+	// WHEN calls burst, THEN the burst goes straight away
+	for range 2 {
+		if wait, ok := b.reserve(now, 0); !ok || wait != 0 {
+			t.Fatalf("expected the burst to be allowed, got %v %t", wait, ok)
+		}
+	}
+	// AND the next must wait for a token, failing if it can't
+	if _, ok := b.reserve(now, 0); ok {
+		t.Error("expected a call over the rate to be shed")
+	}
+	if wait, ok := b.reserve(now, time.Second); !ok || wait != 100*time.Millisecond {
+		t.Errorf("expected to wait 100ms, got %v %t", wait, ok)
+	}
+	// AND tokens are refilled over time
+	if wait, ok := b.reserve(now.Add(300*time.Millisecond), 0); !ok || wait != 0 {
+		t.Errorf("expected a token after 300ms, got %v %t", wait, ok)
+	}
+}
+
+func TestUpstreamRateLimit(t *testing.T) {
+	for _, policy := range []string{upstreamLimitQueue, upstreamLimitShed} {
+		t.Run(policy, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.UpstreamRateLimitMaxWait = time.Second
+			rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+			withRegProxyInstance(t, rp, func(url string, t *testing.T) {
+				// GIVEN an upstream which takes 20 calls a second, one at once
+				var calls atomic.Int32
+				srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+					calls.Add(1)
+				}))
+				defer srv.Close()
+				register(url, upstream{Name: "legacy", Callback: srv.URL, RateLimit: &upstreamRateLimit{PerSecond: 20, Burst: 1, Policy: policy}}, t)
+
+				// WHEN a burst of requests arrives
+				start := time.Now()
+				var wg sync.WaitGroup
+				for range 3 {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						resp, err := http.Post(url+"/orders", "application/json", strings.NewReader("{}"))
+						if err == nil {
+							_ = resp.Body.Close()
+						}
+					}()
+				}
+				wg.Wait()
+
+				// THEN the queue policy spreads the calls out, and shed drops the excess
+				switch policy {
+				case upstreamLimitQueue:
+					if calls.Load() != 3 || time.Since(start) < 90*time.Millisecond {
+						t.Errorf("expected 3 calls over 100ms, got %d in %v", calls.Load(), time.Since(start))
+					}
+					if n := rp.metrics.upstreamLimited.value("legacy", "delayed"); n != 2 {
+						t.Errorf("expected 2 delayed calls, got %v", n)
+					}
+				case upstreamLimitShed:
+					if calls.Load() != 1 {
+						t.Errorf("expected 1 call, got %d", calls.Load())
+					}
+					if n := rp.metrics.upstreamLimited.value("legacy", "shed"); n != 2 {
+						t.Errorf("expected 2 shed calls, got %v", n)
+					}
+				}
+			})
+		})
+	}
+}
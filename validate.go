@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+)
+
+// configErrors collects everything wrong with the configuration, so that it
+// can all be reported at once rather than one problem per attempt to start.
+type configErrors []error
+
+func (e *configErrors) add(err error) {
+	*e = append(*e, err)
+}
+
+func (e *configErrors) addf(format string, args ...any) {
+	e.add(fmt.Errorf(format, args...))
+}
+
+// report prints the outcome of regproxy validate, returning the exit status.
+func (e configErrors) report(out, errOut io.Writer) int {
+	if len(e) == 0 {
+		fmt.Fprintln(out, "Configuration is valid")
+		return 0
+	}
+	for _, err := range e {
+		fmt.Fprintf(errOut, "invalid: %v\n", err)
+	}
+	return 1
+}
+
+// validateDeployment checks what the flags alone can't show: that the
+// registry can be read from storage, that every registration in it is valid
+// and can be delivered to with these flags, and that listeners' certificates
+// haven't expired. Nothing is written to storage.
+func validateDeployment(cfg Config, location string, ttl time.Duration, listeners []listenerConfig) configErrors {
+	var invalid configErrors
+	for _, lc := range listeners {
+		if lc.Cert == "" {
+			continue
+		}
+		if err := checkCertExpiry(lc.Cert, lc.Key, time.Now()); err != nil {
+			invalid.addf("listener %s: %v", lc.Addr, err)
+		}
+	}
+	upstreams, err := readRegistry(location, ttl)
+	if err != nil {
+		invalid.addf("reading the registry from %s: %v", location, err)
+		return invalid
+	}
+	sinks := newSinks(nil, cfg)
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := checkRegistration(upstreams[name], sinks, cfg); err != nil {
+			invalid.addf("upstream %s: %v", name, err)
+		}
+	}
+	return invalid
+}
+
+// readRegistry reads the registrations from the storage at location, as
+// main would use it, but without writing to it or starting anything.
+func readRegistry(location string, ttl time.Duration) (map[string]upstream, error) {
+	if objects, ok, err := newObjectStore(location); ok || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		st, err := NewRegStorageObject(context.Background(), objects, nil)
+		if err != nil {
+			return nil, err
+		}
+		return st.All()
+	}
+	if dynamo, ok, err := newDynamoStorage(location, ttl); ok || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return dynamo.All()
+	}
+	if redis, ok, err := newRedisStorage(location); ok || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return redis.All()
+	}
+	if location == "memory" {
+		return nil, nil
+	}
+	aead, err := storageCipher(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	upstreams, _, err := (&RegStorageFile{fileName: location, aead: aead}).read()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return upstreams, err
+}
+
+// checkRegistration checks an upstream as registering it would, and that
+// this proxy has a sink to deliver to its callback.
+func checkRegistration(u upstream, sinks map[string]Sink, cfg Config) error {
+	if err := validateUpstream(u); err != nil {
+		return err
+	}
+	if err := validateDelay(u, cfg.Mode); err != nil {
+		return err
+	}
+	if err := validateSecretRefs(u, newSecretRefPolicy(cfg)); err != nil {
+		return err
+	}
+	callback, err := url.Parse(u.Callback)
+	if err != nil {
+		return err
+	}
+	for _, b := range u.Buckets {
+		if !slices.ContainsFunc(cfg.ExperimentBuckets, func(eb experimentBucket) bool { return eb.name == b }) {
+			return fmt.Errorf("bucket [%s] isn't one of -experiment-buckets, so it gets no requests", b)
+		}
+	}
+	if err := validateTranslations(u, cfg.Translations); err != nil {
+		return err
+	}
+	if _, ok := sinks[callback.Scheme]; !ok {
+		switch callback.Scheme {
+		case "file":
+			return fmt.Errorf("callback %s needs -file-sink-dir", u.Callback)
+		case "exec":
+			return fmt.Errorf("callback %s needs -exec-sink for command %s", u.Callback, callback.Host)
+		}
+		return fmt.Errorf("unsupported callback scheme [%s]", callback.Scheme)
+	}
+	switch callback.Scheme {
+	case "http", "https":
+		if callback.Host == "" && !isCallbackTemplate(u.Callback) {
+			return fmt.Errorf("callback %s has no host", u.Callback)
+		}
+	case "exec":
+		if _, ok := cfg.ExecSinks[callback.Host]; !ok {
+			return fmt.Errorf("callback %s needs -exec-sink for command %s", u.Callback, callback.Host)
+		}
+	}
+	return nil
+}
+
+// checkCertExpiry checks that a listener's certificate is valid at now.
+func checkCertExpiry(certFile, keyFile string, now time.Time) error {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	switch {
+	case now.After(leaf.NotAfter):
+		return fmt.Errorf("certificate %s expired at %v", certFile, leaf.NotAfter)
+	case now.Before(leaf.NotBefore):
+		return fmt.Errorf("certificate %s isn't valid until %v", certFile, leaf.NotBefore)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateDeployment(t *testing.T) {
+	// GIVEN a registry with registrations this proxy can't deliver to
+	dir := t.TempDir()
+	location := filepath.Join(dir, "registry.json")
+	st, err := NewRegStorageFile(location, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []upstream{
+		{Name: "orders", Callback: "http://orders"},
+		{Name: "archive", Callback: "file:///archive.jsonl"},
+		{Name: "legacy", Callback: "ftp://legacy"},
+	} {
+		if err := st.Put(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// WHEN
+	invalid := validateDeployment(testConfig(), location, 0, nil)
+
+	// THEN each is reported, by name
+	var got []string
+	for _, err := range invalid {
+		got = append(got, err.Error())
+	}
+	expected := []string{
+		"upstream archive: callback file:///archive.jsonl needs -file-sink-dir",
+		"upstream legacy: unsupported callback scheme [ftp]",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestValidateCertExpiry(t *testing.T) {
+	// GIVEN a certificate valid for the next hour
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeSelfSigned(t, cert, key, "proxy.example")
+
+	// THEN it is valid now, but not in two hours
+	if err := checkCertExpiry(cert, key, time.Now()); err != nil {
+		t.Errorf("expected the certificate to be valid, got %v", err)
+	}
+	if err := checkCertExpiry(cert, key, time.Now().Add(2*time.Hour)); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expected the certificate to have expired, got %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultRefPrefix marks a registration value which is a reference to a
+// secret in HashiCorp Vault, as vault:path#field, e.g.
+// vault:secret/data/orders#api_key. It's resolved each time the upstream is
+// called, so the secret itself is never kept in the registry.
+const vaultRefPrefix = "vault:"
+
+// Environment variables read as the Vault CLI does
+const (
+	vaultTokenEnv     = "VAULT_TOKEN"
+	vaultNamespaceEnv = "VAULT_NAMESPACE"
+)
+
+// parseVaultRef splits a vault: reference into its path and field, ok being
+// false if s isn't a reference at all.
+func parseVaultRef(s string) (path, field string, ok bool, err error) {
+	ref, ok := strings.CutPrefix(s, vaultRefPrefix)
+	if !ok {
+		return "", "", false, nil
+	}
+	path, field, _ = strings.Cut(ref, "#")
+	path = strings.Trim(path, "/")
+	if path == "" || field == "" {
+		return "", "", true, fmt.Errorf("invalid vault reference [%s], expected %spath#field", s, vaultRefPrefix)
+	}
+	return path, field, true, nil
+}
+
+// secretRefPolicy is what the operator allows registrations to refer to.
+type secretRefPolicy struct {
+	// fileDir holds the files which file: references may name, none being
+	// allowed if it's empty
+	fileDir string
+	// vaultPrefixes are the Vault paths under which vault: references may
+	// read secrets, none being allowed if it's empty
+	vaultPrefixes []string
+}
+
+func newSecretRefPolicy(cfg Config) secretRefPolicy {
+	return secretRefPolicy{fileDir: cfg.SecretFileDir, vaultPrefixes: cfg.VaultPathPrefixes}
+}
+
+// checkVaultPath refuses a vault: reference to anything outside prefixes,
+// so a registrant can't have the proxy send them any secret its token can
+// read. Prefixes match whole path segments.
+func checkVaultPath(prefixes []string, path string) error {
+	if len(prefixes) == 0 {
+		return fmt.Errorf("vault reference [%s%s] isn't allowed, as -vault-path-prefixes isn't set", vaultRefPrefix, path)
+	}
+	if slices.ContainsFunc(strings.Split(path, "/"), func(segment string) bool {
+		return segment == "" || segment == "." || segment == ".."
+	}) {
+		return fmt.Errorf("invalid vault reference [%s%s], expected a path without empty, . or .. segments", vaultRefPrefix, path)
+	}
+	for _, prefix := range prefixes {
+		prefix = strings.Trim(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("vault reference [%s%s] isn't under -vault-path-prefixes", vaultRefPrefix, path)
+}
+
+// validateSecretRefs checks any vault: or file: references in the values
+// which may hold secrets, and that they only refer to what refs allows.
+func validateSecretRefs(u upstream, refs secretRefPolicy) error {
+	var errs []error
+	_ = forEachSecret(&u, func(v *string) error {
+		if path, _, ok, err := parseVaultRef(*v); err != nil {
+			errs = append(errs, err)
+		} else if ok {
+			if err := checkVaultPath(refs.vaultPrefixes, path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if name, ok, err := parseFileRef(*v); err != nil {
+			errs = append(errs, err)
+		} else if ok {
+			if err := checkSecretFile(refs.fileDir, name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return nil
+	})
+	return errors.Join(errs...)
+}
+
+// forEachSecret calls f with each value of u which may be a secret, so may
+// be a vault: or file: reference. Maps are copied before f sees their values, so f
+// may change them without changing the upstream u was copied from.
+func forEachSecret(u *upstream, f func(v *string) error) error {
+	if u.Query != nil && len(u.Query.Set) > 0 {
+		q := *u.Query
+		q.Set = maps.Clone(q.Set)
+		u.Query = &q
+		for name, v := range q.Set {
+			if err := f(&v); err != nil {
+				return err
+			}
+			q.Set[name] = v
+		}
+	}
+	if u.TokenExchange != nil {
+		x := *u.TokenExchange
+		u.TokenExchange = &x
+		if err := f(&x.ClientSecret); err != nil {
+			return err
+		}
+		static := make(map[string]string, len(x.Static))
+		for inbound, token := range x.Static {
+			if err := f(&inbound); err != nil {
+				return err
+			}
+			if err := f(&token); err != nil {
+				return err
+			}
+			static[inbound] = token
+		}
+		if x.Static != nil {
+			x.Static = static
+		}
+	}
+	return nil
+}
+
+type vaultSecret struct {
+	data    map[string]any
+	expires time.Time
+}
+
+// vaultClient reads secrets from Vault's KV engine, version 1 or 2, caching
+// them for their lease or cacheTTL. If Vault can't be reached once a secret
+// has expired, the stale secret is used until it can.
+type vaultClient struct {
+	addr      string
+	namespace string
+	token     func() (string, error)
+	cacheTTL  time.Duration
+	client    *http.Client
+
+	mu      sync.Mutex
+	secrets map[string]vaultSecret
+}
+
+// newVaultClient returns nil if no Vault address is configured. The token
+// is read from the token file, reloaded from files when it's rotated, or
+// otherwise from VAULT_TOKEN.
+func newVaultClient(cfg Config, getenv func(string) string, files *secretFiles) *vaultClient {
+	if cfg.VaultAddr == "" {
+		return nil
+	}
+	v := &vaultClient{
+		addr:      strings.TrimSuffix(cfg.VaultAddr, "/"),
+		namespace: getenv(vaultNamespaceEnv),
+		cacheTTL:  cfg.VaultCacheTTL,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		secrets:   make(map[string]vaultSecret),
+	}
+	if cfg.VaultTokenFile != "" {
+		v.token = func() (string, error) { return files.lookup(cfg.VaultTokenFile) }
+	} else {
+		token := getenv(vaultTokenEnv)
+		v.token = func() (string, error) { return token, nil }
+	}
+	return v
+}
+
+// resolveSecrets returns a copy of ups with any vault: or file: references
+// replaced by the secrets they refer to. References are checked again here,
+// as registrations may have been stored, or gossiped, before the policy
+// changed, and a symlink may since point elsewhere.
+func (p *RegProxy) resolveSecrets(ctx context.Context, ups upstream) (upstream, error) {
+	err := forEachSecret(&ups, func(v *string) error {
+		if name, ok, err := parseFileRef(*v); ok || err != nil {
+			if err == nil {
+				err = checkSecretFile(p.secretRefs.fileDir, name)
+			}
+			if err == nil {
+				*v, err = p.secrets.lookup(name)
+			}
+			return err
+		}
+		path, field, ok, err := parseVaultRef(*v)
+		if !ok || err != nil {
+			return err
+		}
+		if p.vault == nil {
+			return fmt.Errorf("upstream %s refers to a secret in vault, but -vault-addr isn't set", ups.Name)
+		}
+		if err := checkVaultPath(p.secretRefs.vaultPrefixes, path); err != nil {
+			return err
+		}
+		*v, err = p.vault.lookup(ctx, path, field)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to resolve secrets for upstream %s: %v", ups.Name, err)
+	}
+	return ups, err
+}
+
+// lookup returns a field of the secret at path.
+func (v *vaultClient) lookup(ctx context.Context, path, field string) (string, error) {
+	now := time.Now()
+	v.mu.Lock()
+	cached, ok := v.secrets[path]
+	v.mu.Unlock()
+	if !ok || !now.Before(cached.expires) {
+		data, lease, err := v.read(ctx, path)
+		switch {
+		case err == nil:
+			cached = vaultSecret{data: data, expires: now.Add(lease)}
+		case ok && cached.data != nil:
+			log.Printf("Failed to read %s from vault, using the secret read before: %v", path, err)
+			// Don't ask again for every request while Vault is down
+			cached.expires = now.Add(min(v.cacheTTL, time.Minute))
+		default:
+			return "", fmt.Errorf("reading %s from vault: %w", path, err)
+		}
+		v.mu.Lock()
+		v.secrets[path] = cached
+		v.mu.Unlock()
+	}
+	value, ok := cached.data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret at %s in vault has no string field %s", path, field)
+	}
+	return value, nil
+}
+
+// read fetches the secret at path, and how long it may be cached for.
+func (v *vaultClient) read(ctx context.Context, path string) (map[string]any, time.Duration, error) {
+	token, err := v.token()
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading the vault token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+(&url.URL{Path: path}).EscapedPath(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, 0, fmt.Errorf("vault returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		LeaseDuration int64          `json:"lease_duration"`
+		Data          map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return nil, 0, err
+	}
+	data := out.Data
+	// KV version 2 nests the secret, alongside its metadata
+	if nested, ok := data["data"].(map[string]any); ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = nested
+		}
+	}
+	ttl := v.cacheTTL
+	if out.LeaseDuration > 0 {
+		ttl = min(ttl, time.Duration(out.LeaseDuration)*time.Second)
+	}
+	return data, ttl, nil
+}
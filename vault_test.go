@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeVault serves a KV version 2 secret at secret/data/orders to
+// root-token, counting reads.
+func fakeVault(t *testing.T, reads *atomic.Int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "root-token" {
+			writeJSON(rr, http.StatusForbidden, map[string]any{"errors": []string{"permission denied"}})
+			return
+		}
+		if req.URL.Path != "/v1/secret/data/orders" {
+			writeJSON(rr, http.StatusNotFound, map[string]any{"errors": []string{}})
+			return
+		}
+		reads.Add(1)
+		writeJSON(rr, http.StatusOK, map[string]any{
+			"lease_duration": 0,
+			"data": map[string]any{
+				"data":     map[string]any{"api_key": "k3y", "client_secret": "s3cret"},
+				"metadata": map[string]any{"version": 3},
+			},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestVaultSecretsResolvedWhenCalling(t *testing.T) {
+	// GIVEN Vault, with a token in a file
+	var reads atomic.Int32
+	vault := fakeVault(t, &reads)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("root-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.VaultAddr = vault.URL
+	cfg.VaultPathPrefixes = []string{"secret/data/orders"}
+	cfg.VaultTokenFile = tokenFile
+	cfg.VaultCacheTTL = time.Minute
+	withRegProxyConfig(t, cfg, func(url string, t *testing.T) {
+		// AND an upstream whose API key is in Vault
+		var mu sync.Mutex
+		var seen []string
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			seen = append(seen, req.URL.Query().Get("api_key"))
+			mu.Unlock()
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "orders", Callback: srv.URL, Query: &queryRules{Set: map[string]string{"api_key": "vault:secret/data/orders#api_key"}}}, t)
+
+		// WHEN it's called twice
+		for range 2 {
+			resp, err := http.Get(url + "/orders")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatalf("expected 200, got %v", resp.StatusCode)
+			}
+		}
+
+		// THEN it gets the secret, read from Vault once
+		mu.Lock()
+		defer mu.Unlock()
+		if len(seen) != 2 || seen[0] != "k3y" || seen[1] != "k3y" {
+			t.Errorf("expected the upstream to see the API key, got %q", seen)
+		}
+		if n := reads.Load(); n != 1 {
+			t.Errorf("expected the secret to be cached, got %d reads", n)
+		}
+		// AND only the reference is registered
+		resp, err := http.Get(url + "/upstreams/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var u upstream
+		if err := json.NewDecoder(resp.Body).Decode(&u); err != nil {
+			t.Fatal(err)
+		}
+		if u.Query.Set["api_key"] != "vault:secret/data/orders#api_key" {
+			t.Errorf("expected the registry to keep the reference, got %q", u.Query.Set["api_key"])
+		}
+	})
+}
+
+func TestVaultUnreachableUsesStaleSecret(t *testing.T) {
+	// GIVEN a secret read from Vault and cached
+	var reads atomic.Int32
+	vault := fakeVault(t, &reads)
+	cfg := testConfig()
+	cfg.VaultAddr = vault.URL
+	cfg.VaultPathPrefixes = []string{"secret/data/orders"}
+	cfg.VaultCacheTTL = time.Millisecond
+	v := newVaultClient(cfg, fakeEnv(map[string]string{vaultTokenEnv: "root-token"}), newSecretFiles())
+	if _, err := v.lookup(context.Background(), "secret/data/orders", "api_key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN it has expired and Vault is down
+	time.Sleep(5 * time.Millisecond)
+	vault.Close()
+	secret, err := v.lookup(context.Background(), "secret/data/orders", "api_key")
+
+	// THEN the stale secret is used
+	if err != nil || secret != "k3y" {
+		t.Errorf("expected the stale secret, got %q, %v", secret, err)
+	}
+	// AND secrets never read fail
+	if _, err := v.lookup(context.Background(), "secret/data/billing", "api_key"); err == nil {
+		t.Error("expected an error for a secret never read")
+	}
+}
+
+func TestVaultResolvesTokenExchangeWithoutChangingRegistration(t *testing.T) {
+	// GIVEN an upstream whose token exchange secrets are in Vault
+	var reads atomic.Int32
+	vault := fakeVault(t, &reads)
+	cfg := testConfig()
+	cfg.VaultAddr = vault.URL
+	cfg.VaultPathPrefixes = []string{"secret/data/orders"}
+	cfg.VaultCacheTTL = time.Minute
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	rp.vault = newVaultClient(cfg, fakeEnv(map[string]string{vaultTokenEnv: "root-token"}), newSecretFiles())
+	ups := upstream{Name: "shadow", TokenExchange: &tokenExchange{Endpoint: "https://sts.example", ClientSecret: "vault:secret/data/orders#client_secret",
+		Static: map[string]string{"*": "vault:secret/data/orders#api_key"}}}
+
+	// WHEN
+	resolved, err := rp.resolveSecrets(context.Background(), ups)
+
+	// THEN
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.TokenExchange.ClientSecret != "s3cret" || resolved.TokenExchange.Static["*"] != "k3y" {
+		t.Errorf("expected the secrets to be resolved, got %+v", resolved.TokenExchange)
+	}
+	if !strings.HasPrefix(ups.TokenExchange.ClientSecret, vaultRefPrefix) || !strings.HasPrefix(ups.TokenExchange.Static["*"], vaultRefPrefix) {
+		t.Errorf("expected the registration to be unchanged, got %+v", ups.TokenExchange)
+	}
+}
+
+func TestVaultReferenceValidation(t *testing.T) {
+	for _, test := range []struct {
+		prefixes []string
+		ref      string
+		valid    bool
+	}{
+		{[]string{"secret/data/orders"}, "vault:secret/data/orders#api_key", true},
+		{[]string{"secret/data/billing", "/secret/data/orders/"}, "vault:secret/data/orders/eu#api_key", true},
+		{[]string{"secret/data/orders"}, "plain-value", true},
+		{nil, "plain-value", true},
+		{[]string{"secret/data/orders"}, "vault:secret/data/orders", false},
+		{[]string{"secret/data/orders"}, "vault:#api_key", false},
+		{nil, "vault:secret/data/orders#api_key", false},
+		{[]string{"secret/data/orders"}, "vault:secret/data/payroll#api_key", false},
+		{[]string{"secret/data/orders"}, "vault:secret/data/orders-admin#api_key", false},
+		{[]string{"secret/data/orders"}, "vault:secret/data/orders/../payroll#api_key", false},
+		{[]string{"secret/data/orders"}, "vault:secret/data/orders//x#api_key", false},
+	} {
+		u := upstream{Name: "orders", Callback: "http://orders", Query: &queryRules{Set: map[string]string{"api_key": test.ref}}}
+		err := validateSecretRefs(u, secretRefPolicy{vaultPrefixes: test.prefixes})
+		if (err == nil) != test.valid {
+			t.Errorf("%s under %q: expected valid %v, got %v", test.ref, test.prefixes, test.valid, err)
+		}
+	}
+}
+
+func TestVaultReferenceOutsidePrefixIsNotResolved(t *testing.T) {
+	// GIVEN a registration made before its vault path was disallowed
+	var reads atomic.Int32
+	vault := fakeVault(t, &reads)
+	cfg := testConfig()
+	cfg.VaultAddr = vault.URL
+	cfg.VaultPathPrefixes = []string{"secret/data/billing"}
+	rp := NewRegProxy(cfg, &RegStorageMemory{upstreams: make(map[string]upstream)})
+	rp.vault = newVaultClient(cfg, fakeEnv(map[string]string{vaultTokenEnv: "root-token"}), newSecretFiles())
+	ups := upstream{Name: "orders", Query: &queryRules{Set: map[string]string{"api_key": "vault:secret/data/orders#api_key"}}}
+
+	// WHEN it's called
+	_, err := rp.resolveSecrets(context.Background(), ups)
+
+	// THEN the secret isn't read
+	if err == nil || reads.Load() != 0 {
+		t.Errorf("expected the reference to be refused without reading vault, got %v after %d reads", err, reads.Load())
+	}
+}
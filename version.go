@@ -0,0 +1,55 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// The build, set with -ldflags "-X main.version=6 -X main.commit=... -X
+// main.buildDate=...", as the Dockerfile does.
+var (
+	version   = "dev"
+	commit    string
+	buildDate string
+)
+
+// buildInfo says which build is running, as served at GET /admin/version.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// currentBuild returns the build info, falling back to the VCS details Go
+// stamps on builds from a checkout for what wasn't set with -ldflags.
+func currentBuild() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.BuildDate == "":
+				b.BuildDate = s.Value
+			}
+		}
+	}
+	return b
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("regproxy %s (commit %s, built %s, %s)", b.Version, cmp.Or(b.Commit, "unknown"), cmp.Or(b.BuildDate, "unknown"), b.GoVersion)
+}
+
+// versionReport handles GET /admin/version.
+func (p *RegProxy) versionReport(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		methodNotAllowed(resp, http.MethodGet, http.MethodHead)
+		return
+	}
+	writeJSON(resp, http.StatusOK, currentBuild())
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+func TestVersionEndpoint(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// WHEN
+		resp, err := http.Get(url + "/admin/version")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		// THEN the build is described
+		var b buildInfo
+		if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || b.Version != version || b.GoVersion != runtime.Version() {
+			t.Errorf("expected the build info, got %v %+v", resp.StatusCode, b)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// forwardedByHeader identifies each proxy instance a request has passed
+// through, as Via does but with an instance rather than product name.
+const forwardedByHeader = "X-Forwarded-By"
+
+// addForwardingHeaders marks an outbound request as having passed through
+// this proxy, appending to anything earlier proxies added.
+func (p *RegProxy) addForwardingHeaders(in *http.Request, out *http.Request) {
+	appendHeader(out.Header, "Via", fmt.Sprintf("%d.%d %s", in.ProtoMajor, in.ProtoMinor, p.cfg.ViaName))
+	appendHeader(out.Header, forwardedByHeader, p.cfg.InstanceID)
+}
+
+// appendHeader adds value to a comma separated header, keeping it on one line.
+func appendHeader(h http.Header, name, value string) {
+	if prior := h.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(name, value)
+}
+
+// hopByHopHeaders only apply to a single connection, so aren't passed on by
+// proxies (RFC 7230 section 6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the standard hop-by-hop headers from h, and
+// any others its Connection header names.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
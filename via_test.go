@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardingHeaders(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN an upstream recording what it receives
+		var via, forwardedBy string
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			via = req.Header.Get("Via")
+			forwardedBy = req.Header.Get(forwardedByHeader)
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "foo", Callback: srv.URL}, t)
+
+		// WHEN a request which has already been through another proxy arrives
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Via", "1.0 fred")
+		req.Header.Set(forwardedByHeader, "other-instance")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Body.Close()
+
+		// THEN we are added to the chain
+		if via != "1.0 fred, 1.1 regproxy" {
+			t.Errorf("unexpected Via %q", via)
+		}
+		if forwardedBy != "other-instance, test-instance" {
+			t.Errorf("unexpected %s %q", forwardedByHeader, forwardedBy)
+		}
+	})
+}
+
+func TestHopByHopHeadersRemoved(t *testing.T) {
+	withRegProxy(t, func(url string, t *testing.T) {
+		// GIVEN an upstream recording what it receives, and sending its own
+		var received http.Header
+		srv := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+			received = req.Header.Clone()
+			rr.Header().Set("Connection", "X-Upstream-Hop")
+			rr.Header().Set("X-Upstream-Hop", "1")
+			rr.Header().Set("Keep-Alive", "timeout=5")
+			rr.Header().Set("X-Kept", "1")
+		}))
+		defer srv.Close()
+		register(url, upstream{Name: "foo", Callback: srv.URL}, t)
+
+		// WHEN
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Connection", "X-Client-Hop")
+		req.Header.Set("X-Client-Hop", "1")
+		req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+		req.Header.Set("TE", "trailers")
+		req.Header.Set("X-Kept", "1")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Body.Close()
+
+		// THEN
+		for _, h := range []string{"X-Client-Hop", "Proxy-Authorization", "Te"} {
+			if received.Get(h) != "" {
+				t.Errorf("expected %s not to be forwarded", h)
+			}
+		}
+		if received.Get("X-Kept") == "" {
+			t.Error("expected X-Kept to be forwarded")
+		}
+		if r.Header.Get("X-Upstream-Hop") != "" || r.Header.Get("Keep-Alive") != "" || r.Header.Get("X-Kept") == "" {
+			t.Errorf("unexpected response headers %v", r.Header)
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// xfccHeader carries the verified client certificate of mTLS listeners to
+// upstreams, in the format Envoy uses.
+const xfccHeader = "X-Forwarded-Client-Cert"
+
+// Client certificate policies for mTLS listeners
+const (
+	clientAuthRequire  = "require"
+	clientAuthOptional = "optional"
+)
+
+// setClientCert replaces any X-Forwarded-Client-Cert header a client sent,
+// which can't be trusted, with the details of the certificate it verified
+// with, if any: its SHA-256 hash, subject, and URI and DNS SANs, e.g.
+// Hash=ab12..;Subject="CN=billing,O=Example";URI=spiffe://example/billing
+func setClientCert(req *http.Request) {
+	req.Header.Del(xfccHeader)
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+	parts := []string{"Hash=" + hex.EncodeToString(sum[:]), "Subject=" + xfccQuote(cert.Subject.String())}
+	for _, u := range cert.URIs {
+		parts = append(parts, "URI="+xfccQuote(u.String()))
+	}
+	for _, d := range cert.DNSNames {
+		parts = append(parts, "DNS="+xfccQuote(d))
+	}
+	req.Header.Set(xfccHeader, strings.Join(parts, ";"))
+}
+
+// xfccQuote quotes values containing the header's separators.
+func xfccQuote(v string) string {
+	if !strings.ContainsAny(v, `,;="`) {
+		return v
+	}
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newClientCert returns a CA and a client certificate it issued.
+func newClientCert(t *testing.T) (*x509.CertPool, tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	spiffe, _ := url.Parse("spiffe://example.test/billing")
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "billing", Organization: []string{"Example, Inc"}},
+		URIs:         []*url.URL{spiffe},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertForwarded(t *testing.T) {
+	// GIVEN an mTLS listener, and an upstream recording what it receives
+	pool, clientCert := newClientCert(t)
+	rp := NewRegProxy(testConfig(), &RegStorageMemory{upstreams: make(map[string]upstream)})
+	srv := httptest.NewUnstartedServer(rp.handler)
+	srv.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	defer srv.Close()
+	var xfcc string
+	ups := httptest.NewServer(http.HandlerFunc(func(rr http.ResponseWriter, req *http.Request) {
+		xfcc = req.Header.Get(xfccHeader)
+	}))
+	defer ups.Close()
+	client := srv.Client()
+	if err := rp.storage.Put(upstream{Name: "foo", Callback: ups.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		cert bool
+		want func(string) bool
+	}{
+		{"without a certificate", false, func(v string) bool { return v == "" }},
+		{"with a certificate", true, func(v string) bool {
+			return strings.HasPrefix(v, "Hash=") &&
+				strings.Contains(v, `;Subject="CN=billing,O=Example\, Inc";URI=spiffe://example.test/billing`)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			xfcc = "unset"
+			client.Transport.(*http.Transport).TLSClientConfig.Certificates = nil
+			if tc.cert {
+				client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+			}
+			client.CloseIdleConnections()
+
+			// WHEN a client tries to spoof the header
+			req, _ := http.NewRequest("GET", srv.URL, nil)
+			req.Header.Set(xfccHeader, "Hash=forged;Subject=\"CN=admin\"")
+			r, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = r.Body.Close()
+
+			// THEN only the verified certificate is passed on
+			if !tc.want(xfcc) {
+				t.Errorf("unexpected %s %q", xfccHeader, xfcc)
+			}
+		})
+	}
+}